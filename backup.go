@@ -1,41 +1,170 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/cipher"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
 	"math"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/mitranim/gg"
 	"github.com/rjeczalik/notify"
 )
 
-var FLAGS = Flags{Config: `backup.json`}
+var FLAGS = Flags{Config: `backup.json`, ConfigRetry: time.Second, ShutdownGrace: time.Second * 30}
 
 type Flags struct {
 	Config  string `json:"config"`
 	Help    bool   `json:"help"`
 	Verbose bool   `json:"verbose"`
+	DryRun  bool   `json:"dryRun"`
+
+	// Log only errors. Exclusive with verbose mode. See `LogWriter.Quiet`.
+	Quiet bool `json:"quiet"`
+
+	// Log why each trigger did or didn't result in a backup, even without
+	// verbose mode. See `logDecision`.
+	Decisions bool `json:"decisions"`
+
+	// Delay before re-reading a config that failed to decode. Zero disables.
+	ConfigRetry time.Duration `json:"configRetry"`
+
+	// Minimum time between restarts on config changes. Zero disables.
+	RestartGuard time.Duration `json:"restartGuard"`
+
+	// Maximum time to wait for running entries on shutdown. See `awaitShutdown`.
+	ShutdownGrace time.Duration `json:"shutdownGrace"`
+
+	// Skip the up-to-date check of startup backups. See `RunState.Initial`.
+	ForceInitial bool `json:"forceInitial"`
+
+	// Print warnings about the config and exit. See `RunState.Warnings`.
+	Check bool `json:"check"`
+
+	// Address of the HTTP server of Prometheus metrics. See `Metrics`.
+	MetricsAddr string `json:"metricsAddr"`
+
+	// Also append logs as JSON records to this file. See `LogWriter`.
+	JsonLogsTo string `json:"jsonLogsTo"`
+
+	// Format of logs written to stderr. See `LOG_FORMAT_TEXT`.
+	LogFormat string `json:"logFormat"`
+
+	// Exit on programming bugs instead of logging them. See `isBug`.
+	CrashOnBug bool `json:"crashOnBug"`
+
+	// Library used for watching files. See `WATCH_BACKEND_NOTIFY`.
+	WatchBackend string `json:"watchBackend"`
+
+	// Print the formats supported by this build and exit. See `FORMATS`.
+	ListFormats bool `json:"listFormats"`
+
+	// Back up every entry once and exit, without watching. See `cmdOnce`.
+	Once bool `json:"once"`
+
+	// Patterns restricting which entries run. See `Entry.Match`.
+	Entries StringsFlag `json:"entries"`
+
+	// Lowest-priority defaults of config settings. See `RunState.GetDebounce`.
+	Defaults CommonConfig `json:"defaults"`
 }
 
 type Config struct {
 	CommonConfig
 	Entries []Entry `json:"entries"`
+
+	// OTLP/HTTP collector address such as "http://localhost:4318".
+	// When set, backups are traced. See `Tracer`.
+	OtelEndpoint string `json:"otelEndpoint"`
+
+	// Maximum bytes of copy buffers and compressors in flight across all
+	// entries. Zero means unlimited. See `MEMORY`.
+	MaxCopyMemory uint64 `json:"maxCopyMemory"`
+
+	// Path of a tamper-evident log of all backups. See `AuditRecord`.
+	AuditLog string `json:"auditLog"`
+
+	// Quiet period after config file changes before reloading. Zero reloads
+	// on every change. See `runReloading`.
+	ConfigDebounce gg.Opt[Duration] `json:"configDebounce"`
+
+	// More config files whose entries are added. See `includeConfigs`.
+	Include []string `json:"include"`
+
+	// Paths of the config file and the included files, for watching.
+	Files []string `json:"-"`
+}
+
+func (self Config) GetConfigDebounce() Duration {
+	if self.ConfigDebounce.IsNull() {
+		return DEFAULT_CONFIG_DEBOUNCE
+	}
+	return self.ConfigDebounce.Val
 }
 
 type Entry struct {
 	CommonConfig
+	Name   string `json:"name"`
 	Input  string `json:"input"`
 	Output string `json:"output"`
+
+	// Several inputs backed up together, instead of `Input`. See
+	// `RunState.MultiInput`.
+	Inputs []string `json:"inputs"`
+
+	// Skips the entry without removing it from the config. Takes effect on
+	// the next config reload, like any other change.
+	Disabled bool `json:"disabled"`
+
+	// Additional output directories, each receiving every backup, optionally
+	// in its own format. See `Entry.GetOutputs` and `Output`.
+	Outputs []Output `json:"outputs"`
+
+	// Directory against which the output variable "{relpath}" is resolved.
+	// See `RELPATH_VAR`.
+	Root string `json:"root"`
+
+	// Maps glob patterns of paths relative to the input to additional output
+	// directories. See `Route`.
+	Routes map[string]string `json:"routes"`
+
+	// Either "copy" (default) or "move", which removes the backed-up files
+	// from the input. See `MODE_MOVE`.
+	Mode string `json:"mode"`
+
+	// Days and hours when backups are allowed. See `Window`.
+	Window Window `json:"window"`
+
+	// Glob patterns of backup names exempt from retention.
+	// See `RunState.Pinned`.
+	Keep []string `json:"keep"`
+
+	// Gitignore-style patterns of input paths to skip.
+	// See `RunState.Excludes`.
+	Exclude []string `json:"exclude"`
+
+	// Private key and known hosts file for remote outputs. The latter
+	// defaults to "~/.ssh/known_hosts". See `SFTP_SCHEME`.
+	SshKey        string `json:"sshKey"`
+	SshKnownHosts string `json:"sshKnownHosts"`
 }
 
 type CommonConfig struct {
@@ -43,18 +172,296 @@ type CommonConfig struct {
 	Deadline gg.Opt[Duration] `json:"deadline"`
 	Throttle gg.Opt[Duration] `json:"throttle"`
 	Limit    gg.Opt[uint64]   `json:"limit"`
+
+	// Keep backups newer than this regardless of "limit". See `expiredBackups`.
+	MaxAge gg.Opt[Duration] `json:"maxAge"`
+
+	// Delete the oldest backups while their total size exceeds this.
+	// Zero means unlimited. See `overBudget`.
+	MaxBytes gg.Opt[ByteSize] `json:"maxBytes"`
+
+	// Radix of backup indices in file names, between 2 and 36. Default 10.
+	IndexRadix gg.Opt[uint64] `json:"indexRadix"`
+
+	// Minimum number of digits of backup indices in file names, padded with
+	// zeros. Default 6. Zero means the width of the largest possible index.
+	// See `IndexFormat.GetWidth`.
+	IndexWidth gg.Opt[uint64] `json:"indexWidth"`
+
+	// Separator between the name of the input and the index, such as "_"
+	// (default) in "app_000003.log", or ".v" in "app.v000003.log".
+	IndexSep string `json:"indexSep"`
+
+	// Either "index" (default) or "timestamp", with the layout
+	// `TimestampLayout`. See `NAMING_TIMESTAMP`.
+	Naming          string `json:"naming"`
+	TimestampLayout string `json:"timestampLayout"`
+
+	// FS event types that trigger backups. Default: all of them.
+	WatchEvents []WatchEvent `json:"watchEvents"`
+
+	// Write a checksum manifest next to each new backup. See `Manifest`.
+	Manifest gg.Opt[bool] `json:"manifest"`
+
+	// On startup, verify the latest backup against its manifest, if any.
+	VerifyOnStart gg.Opt[bool] `json:"verifyOnStart"`
+
+	// File overwritten with the current timestamp after each successful
+	// backup, for external liveness monitoring.
+	HealthFile string `json:"healthFile"`
+
+	// Keep a history of backup attempts next to the backups. See `History`.
+	History      gg.Opt[bool]   `json:"history"`
+	HistoryLimit gg.Opt[uint64] `json:"historyLimit"`
+
+	// External command used instead of the built-in copy. See `Command`.
+	CopyCommand Command `json:"copyCommand"`
+
+	// External command run after each successful backup. See `runPostHook`.
+	PostHook Command `json:"postHook"`
+
+	// When non-empty, directory backups include only files whose detected
+	// MIME type matches any of these patterns. See `matchContentType`.
+	ContentTypes []string `json:"contentTypes"`
+
+	// Mode of directories created for backups, such as "0755", applied
+	// regardless of the process umask. By default, directories are created
+	// with mode 0777 restricted by the umask. See `RunState.MkdirAll`.
+	DirMode gg.Opt[FileMode] `json:"dirMode"`
+
+	// Keep all backups of an entry in one zip file. See `ZIP_EXT`.
+	Zip gg.Opt[bool] `json:"zip"`
+
+	// Prepare each backup set separately and atomically swap it into place.
+	// See `STAGING_EXT`.
+	Staging gg.Opt[bool] `json:"staging"`
+
+	// When the input is a symlink, re-resolve it when it's retargeted.
+	// See `InputWatcher`.
+	WatchInputLink gg.Opt[bool] `json:"watchInputLink"`
+
+	// Exclude the most recently modified file of a directory input when it
+	// was modified within this time, assuming it's still being written.
+	// See `activeFile`.
+	SkipActive gg.Opt[Duration] `json:"skipActive"`
+
+	// Deduplicate files across backups in a content-addressed store.
+	// See `STORE_DIR`.
+	Store gg.Opt[bool] `json:"store"`
+
+	// Copy ACLs of files and directories along with their contents, where
+	// supported. See `copyAcl`.
+	PreserveAcls gg.Opt[bool] `json:"preserveAcls"`
+
+	// Make each backup a tar archive of the files changed since the previous
+	// one, with a full backup every `FullEvery` backups. See `TAR_EXT`.
+	Incremental gg.Opt[bool]   `json:"incremental"`
+	FullEvery   gg.Opt[uint64] `json:"fullEvery"`
+
+	// Index of the first backup, for continuing the numbering of another
+	// tool. Default 1. See `RunState.NextIndex`.
+	StartIndex gg.Opt[Index] `json:"startIndex"`
+
+	// Abort copying a file after this time. See `withTimeout`.
+	FileTimeout gg.Opt[Duration] `json:"fileTimeout"`
+
+	// Skip files which fail to copy instead of failing the backup.
+	// See `copyFileOrSkip`.
+	ContinueOnError gg.Opt[bool] `json:"continueOnError"`
+
+	// Record the size of each new backup next to it. See `SIZE_EXT`.
+	RecordSize gg.Opt[bool] `json:"recordSize"`
+
+	// Copy modification times of files and directories. Enabled by default.
+	// See `copyTimes`.
+	PreserveTimes gg.Opt[bool] `json:"preserveTimes"`
+
+	// How the first backup treats existing backups in the output directory.
+	// See `FIRST_RUN_ADOPT`.
+	FirstRun string `json:"firstRun"`
+
+	// Either "none" (default) or "gzip". See `COMPRESS_GZIP`.
+	Compress string `json:"compress"`
+
+	// Level of gzip compression, from 1 to 9. See `RunState.GzipLevel`.
+	CompressLevel gg.Opt[uint64] `json:"compressLevel"`
+
+	// Either "none" (default), "tar" or "tar.gz". See `ARCHIVE_TAR`.
+	Archive string `json:"archive"`
+
+	// Encrypt copied files with a key. See `Encryption`.
+	Encrypt gg.Opt[Encryption] `json:"encrypt"`
+
+	// Either "auto" (default) or "never". See `REFLINK_AUTO`.
+	Reflink string `json:"reflink"`
+
+	// Hardlink files unchanged since the previous backup instead of copying
+	// them. See `RunState.Hardlinked`.
+	Hardlink gg.Opt[bool] `json:"hardlink"`
+
+	// Flush copied files and the output directory to storage before a backup
+	// counts as complete. Enabled by default. See `syncDir`.
+	Fsync gg.Opt[bool] `json:"fsync"`
+
+	// Skip backups when the content of the input is the same as at the
+	// previous backup. See `contentHash`.
+	SkipUnchanged gg.Opt[bool] `json:"skipUnchanged"`
+
+	// Compare the checksum of each copied file with its source.
+	// See `verifyCopy`.
+	Verify gg.Opt[bool] `json:"verify"`
+
+	// Skip files and directories whose names start with a dot.
+	// See `RunState.Excludes`.
+	IgnoreHidden gg.Opt[bool] `json:"ignoreHidden"`
+
+	// Either "copy" (default), "follow" or "skip". See `SYMLINKS_COPY`.
+	Symlinks string `json:"symlinks"`
+
+	// Max number of files copied at once by the built-in copying. Defaults
+	// to `GOMAXPROCS`. See `copyTree`.
+	Concurrency gg.Opt[uint64] `json:"concurrency"`
+
+	// Max throughput of the copies of each entry. See `RateLimiter`.
+	RateLimit gg.Opt[ByteRate] `json:"rateLimit"`
+
+	// Size of the buffer of each file copy. Zero means `COPY_BUFFER_SIZE`.
+	// At most `COPY_BUFFER_MAX`. See `copyBudgeted`.
+	CopyBufferSize gg.Opt[ByteSize] `json:"copyBufferSize"`
+
+	// In verbose mode, log the progress of copying files of at least this
+	// size at this interval. See `Progress`.
+	ProgressThreshold gg.Opt[ByteSize] `json:"progressThreshold"`
+	ProgressInterval  gg.Opt[Duration] `json:"progressInterval"`
+
+	// Check for free space on the output before copying, and the margin to
+	// require on top of the input size. See `checkSpace`.
+	CheckSpace  gg.Opt[bool]     `json:"checkSpace"`
+	SpaceMargin gg.Opt[ByteSize] `json:"spaceMargin"`
+
+	// Skip files smaller or larger than these. Zero means unlimited.
+	// See `RunState.IncludesSize`.
+	MinSize gg.Opt[ByteSize] `json:"minSize"`
+	MaxSize gg.Opt[ByteSize] `json:"maxSize"`
 }
 
 type RunState struct {
+	Ctx    context.Context
 	Config Config
 	Entry  Entry
 	Latest time.Time
+	Tracer *Tracer
+	Route  *Route
+
+	// Cumulative since the entry started. See `Counters`.
+	Counters Counters
+
+	// Defaults to the real clock. See `RunState.GetClock`.
+	Clock Clock
+
+	// Options of the entry, resolved once by `newRunState`. See
+	// `RunState.Options`.
+	Resolved *CommonConfig
+
+	// Defaults to `diskFree`. See `checkSpace`.
+	DiskFree func(string) (uint64, error)
+
+	// Set while the watch of the input is broken, which makes the entry
+	// unhealthy. See `runEvents`.
+	WatchErr error
+
+	// All outputs of an entry with several of them, including this one, and
+	// the highest index among their backups before the current round of
+	// backups. See `reservePeerIndex`.
+	Peers   []string
+	PeerMax Index
+
+	// Content hash of the input at the previous backup made by this run of
+	// the entry, with `skipUnchanged`. See `contentHash`.
+	LastHash string
+
+	// Reset by every `backup` call.
+	Started  time.Time
+	Span     *Span
+	Stats    CopyStats
+	Target   string
+	Active   string
+	Index    Index
+	Result   string
+	Manifest *Manifest
+
+	// Previous backup, whose files unchanged since then are hardlinked
+	// rather than copied. See `linkFile`.
+	LinkDest string
+
+	// Real paths of the directories being copied, in the symlink mode
+	// "follow". See `followSymlink`.
+	Ancestors []string
+
+	// Set while copying files in parallel. See `copyTree`.
+	Pool *CopyPool
+
+	// Shared by the targets of the entry. Nil when unlimited.
+	// See `RateLimiter`.
+	Limiter *RateLimiter
+
+	// Nil unless encrypting. See `Encryption`.
+	Cipher cipher.AEAD
+
+	// Errors of retention, which don't fail the backup. See `finalize`.
+	Retention error
+}
+
+// Outcomes of `backup`, used in traces and history.
+const (
+	RESULT_OK         = `ok`
+	RESULT_ERROR      = `error`
+	RESULT_UP_TO_DATE = `up_to_date`
+	RESULT_DRY_RUN    = `dry_run`
+)
+
+type CopyStats struct {
+	Files   uint64
+	Bytes   uint64
+	Skipped uint64
+	Linked  uint64
+}
+
+func (self *CopyStats) Add(val CopyStats) {
+	self.Files += val.Files
+	self.Bytes += val.Bytes
+	self.Skipped += val.Skipped
+	self.Linked += val.Linked
+}
+
+/*
+Counts of the decisions that didn't result in a backup, for tuning throttle and
+debounce. Counted per backup target, since the start of the entry. Shown with
+`-decisions` and in trace spans after each backup.
+*/
+type Counters struct {
+	Throttled uint64 // FS events ignored due to throttling.
+	Coalesced uint64 // FS events merged into a pending backup by debounce.
+	Filtered  uint64 // FS events outside of the route pattern.
+	UpToDate  uint64 // Backups skipped because the latest one is up to date.
+}
+
+func (self Counters) String() string {
+	return fmt.Sprintf(
+		`throttled: %v, coalesced: %v, filtered: %v, up to date: %v`,
+		self.Throttled, self.Coalesced, self.Filtered, self.UpToDate,
+	)
 }
 
 const DEFAULT_DEBOUNCE = Duration(time.Second)
 const DEFAULT_DEADLINE = Duration(time.Second * 10)
 const DEFAULT_THROTTLE = Duration(time.Minute * 10)
 const DEFAULT_LIMIT = 128
+const DEFAULT_HISTORY_LIMIT = 1024
+const CONFIG_RETRY_MAX = 3
+const DEFAULT_CONFIG_DEBOUNCE = Duration(time.Millisecond * 500)
+const REMOVE_RETRY_MAX = 2
+const REMOVE_RETRY_DELAY = time.Millisecond * 500
 
 func main() {
 	log.SetOutput(os.Stderr)
@@ -62,7 +469,27 @@ func main() {
 	flag.Usage = usage
 	flag.BoolVar(&FLAGS.Help, `h`, FLAGS.Help, `print help and exit`)
 	flag.BoolVar(&FLAGS.Verbose, `v`, FLAGS.Verbose, `verbose logging`)
-	flag.StringVar(&FLAGS.Config, `c`, FLAGS.Config, `config file`)
+	flag.BoolVar(&FLAGS.Quiet, `q`, FLAGS.Quiet, `quiet logging: only errors`)
+	flag.BoolVar(&FLAGS.DryRun, `n`, FLAGS.DryRun, `dry run: print what would change, without writing or deleting`)
+	flag.BoolVar(&FLAGS.Decisions, `decisions`, FLAGS.Decisions, `log why each trigger did or didn't result in a backup`)
+	flag.StringVar(&FLAGS.Config, `c`, FLAGS.Config, `config file, "http://" or "https://" URL, or "-" for stdin`)
+	flag.BoolVar(&FLAGS.ForceInitial, `force-initial`, FLAGS.ForceInitial, `always make a new backup on startup, even if the latest one seems up to date`)
+	flag.DurationVar(&FLAGS.ConfigRetry, `config-retry`, FLAGS.ConfigRetry, `delay before re-reading a config that failed to decode; 0 disables retries`)
+	flag.DurationVar(&FLAGS.RestartGuard, `restart-guard`, FLAGS.RestartGuard, `minimum time between restarts on config changes; later changes are applied when it elapses`)
+	flag.DurationVar(&FLAGS.ShutdownGrace, `shutdown-grace`, FLAGS.ShutdownGrace, `on SIGINT or SIGTERM, how long to wait for running backups to stop before exiting`)
+	flag.Var(&FLAGS.Entries, `entry`, `run only entries whose name or input matches this glob pattern; may be repeated`)
+	flag.Var(OptFlag[Duration]{&FLAGS.Defaults.Debounce}, `debounce`, gg.Str(`default debounce (default `, DEFAULT_DEBOUNCE, `)`))
+	flag.Var(OptFlag[Duration]{&FLAGS.Defaults.Deadline}, `deadline`, gg.Str(`default deadline (default `, DEFAULT_DEADLINE, `)`))
+	flag.Var(OptFlag[Duration]{&FLAGS.Defaults.Throttle}, `throttle`, gg.Str(`default throttle (default `, DEFAULT_THROTTLE, `)`))
+	flag.Var(OptFlag[uint64]{&FLAGS.Defaults.Limit}, `limit`, gg.Str(`default limit (default `, DEFAULT_LIMIT, `)`))
+	flag.BoolVar(&FLAGS.Check, `check`, FLAGS.Check, `print warnings about the config and exit`)
+	flag.StringVar(&FLAGS.MetricsAddr, `metrics-addr`, FLAGS.MetricsAddr, `serve Prometheus metrics at this address, such as ":9100"`)
+	flag.StringVar(&FLAGS.JsonLogsTo, `json-logs-to`, FLAGS.JsonLogsTo, `also append logs to this file as JSON lines`)
+	flag.StringVar(&FLAGS.LogFormat, `log-format`, LOG_FORMAT_TEXT, `format of logs written to stderr: "text" or "json"`)
+	flag.BoolVar(&FLAGS.CrashOnBug, `crash-on-bug`, FLAGS.CrashOnBug, `exit on internal errors caused by bugs, instead of logging them and continuing`)
+	flag.StringVar(&FLAGS.WatchBackend, `watch-backend`, WATCH_BACKEND_NOTIFY, `library for watching files: "notify" or "fsnotify"`)
+	flag.BoolVar(&FLAGS.ListFormats, `list-formats`, FLAGS.ListFormats, `print supported formats and exit`)
+	flag.BoolVar(&FLAGS.Once, `once`, FLAGS.Once, `back up every entry once and exit, without watching; exits with code 1 if any backup failed`)
 	flag.Parse()
 
 	if FLAGS.Help {
@@ -71,18 +498,32 @@ func main() {
 		return
 	}
 
+	if FLAGS.ListFormats {
+		listFormats()
+		os.Exit(0)
+		return
+	}
+
+	if err := gg.Catch(initLogs); err != nil {
+		logErr(err)
+		os.Exit(1)
+		return
+	}
+
 	args := flag.Args()
-	if len(args) > 0 {
-		if args[0] == `help` {
-			usage()
-			os.Exit(0)
-			return
-		}
+	if len(args) > 0 && args[0] == `help` {
+		usage()
+		os.Exit(0)
+		return
+	}
 
-		fmt.Fprintf(os.Stderr, "unexpected arguments: %q\n", args)
+	env, err := gg.Catch11(readEnv, os.Getenv)
+	if err != nil {
+		logErr(err)
 		os.Exit(1)
 		return
 	}
+	ENV = env
 
 	if FLAGS.Config == `` {
 		fmt.Fprintln(os.Stderr, `missing path to config file`)
@@ -90,28 +531,90 @@ func main() {
 		return
 	}
 
-	if !gg.FileExists(FLAGS.Config) {
+	if !isConfigStream(FLAGS.Config) && !gg.FileExists(FLAGS.Config) {
 		fmt.Fprintf(os.Stderr, "missing config file %q\n", FLAGS.Config)
 		os.Exit(1)
 		return
 	}
 
-	events := make(chan notify.EventInfo, 1)
-	watchConfig(FLAGS.Config, events)
-	defer notify.Stop(events)
+	if FLAGS.Check {
+		runCommand(cmdCheck, args)
+		return
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go run(ctx)
+	if FLAGS.Once {
+		runCommand(cmdOnce, args)
+		return
+	}
 
-	for range events {
-		if FLAGS.Verbose {
-			log.Println(`restarting on config change`)
+	if len(args) > 0 {
+		cmd := COMMANDS[args[0]]
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "unexpected arguments: %q\n", args)
+			os.Exit(1)
+			return
+		}
+		runCommand(cmd, args[1:])
+		return
+	}
+
+	// An invalid config fails the startup, whereas on reloads it only keeps
+	// the previous config. A config which fails to decode is retried instead,
+	// since it may be caught mid-write. See `runReloading`.
+	if conf, err := gg.Catch01(readConfig); err == nil {
+		if err := validateConfig(conf); err != nil {
+			logErr(gg.Wrapf(err, `invalid config file %v`, fmtPath(FLAGS.Config)))
+			os.Exit(1)
+			return
 		}
+	}
+
+	ctx := watchShutdown()
+	if err := gg.Catch(func() { serveMetrics(ctx, FLAGS.MetricsAddr) }); err != nil {
+		logErr(err)
+		os.Exit(1)
+		return
+	}
+	watchPause()
+	watchTrigger()
+
+	events := make(chan notify.EventInfo, 1)
+	if isConfigStream(FLAGS.Config) {
+		log.Printf(`reading config from %v; reloading on changes is unavailable`, fmtPath(FLAGS.Config))
+	} else {
+		CONFIG_WATCHER = &ConfigWatcher{Events: events}
+		CONFIG_WATCHER.Update([]string{FLAGS.Config})
+		defer CONFIG_WATCHER.Close()
+	}
+
+	runReloading(ctx, events)
+	awaitShutdown()
+}
 
-		cancel()
-		ctx, cancel = context.WithCancel(context.Background())
-		go run(ctx)
+func runCommand(cmd func([]string), args []string) {
+	err := gg.Catch10(cmd, args)
+	if err != nil {
+		logErr(err)
+		os.Exit(1)
+		return
 	}
+	os.Exit(0)
+}
+
+/*
+Subcommands, invoked as "backup <command> <args>". Each reads the config file
+and exits when done. Panics are reported as errors with exit code 1.
+*/
+var COMMANDS = map[string]func([]string){
+	`history`:      cmdHistory,
+	`extract`:      cmdExtract,
+	`pin`:          cmdPin,
+	`repair`:       cmdRepair,
+	`audit-verify`: cmdAuditVerify,
+	`doctor`:       cmdDoctor,
+	`list`:         cmdList,
+	`restore`:      cmdRestore,
+	`prune`:        cmdPrune,
 }
 
 const HELP = `CLI tool for automatic file backups.
@@ -121,7 +624,8 @@ and copies files to the specified output paths.
 Input and output paths are specified via a JSON
 configuration file. By default it's "backup.json"
 in the current directory. You may specify another
-path.
+path, an "http://" or "https://" URL, or "-" for
+stdin.
 
 Example "backup.json":
 
@@ -135,232 +639,2297 @@ Example "backup.json":
     ]
   }
 
+Commands:
+
+  backup                   watch inputs and make backups
+  backup help              print help and exit
+  backup history [entry]   print the history of matching entries
+  backup pin <entry> <index>
+                           exempt a backup from retention
+  backup repair <entry>    fix malformed and duplicate backup names;
+                           use -n to only print the fixes
+  backup extract <backup> <dir>
+                           reconstruct a stored or incremental backup
+                           into a directory
+  backup audit-verify [file]
+                           check the hash chain of the audit log
+  backup doctor [entry]    diagnose common setup problems
+  backup list [-json] [entry]
+                           print existing backups with times and sizes
+  backup restore [-force] <entry> [index]
+                           copy a backup back to the input path
+  backup prune [entry]     delete old backups by the retention settings
+  backup -once             back up every entry once and exit,
+                           for cron and CI
+
 The tool also watches its configuration file and
-restarts on any changes to it.
+restarts on any changes to it. If the changed file
+fails to decode, the previous config keeps running.
+
+On Unix, SIGUSR1 pauses backups and SIGUSR2 resumes
+them, without restarting the process. SIGHUP backs up
+all entries immediately, ignoring throttle, debounce
+and backup windows.
+
+SIGINT and SIGTERM stop the tool gracefully: running
+backups are interrupted between files and removed,
+waiting up to "-shutdown-grace". A second signal
+exits immediately.
 
 Flags:
 
 `
 
+/*
+Formats and platform-specific capabilities supported by this build, grouped by
+kind, printed by `-list-formats`. Names of config values are taken from the
+constants which validate them. Capabilities of the current platform are added
+by `platformFormats`, `aclFormats` and `reflinkFormats`.
+*/
+var FORMATS = []Format{
+	{`config`, `json`, `config file`},
+	{`archive`, `zip`, `versioned zip mode, see "zip"`},
+	{`archive`, ARCHIVE_TAR, `single-file and incremental backups, see "archive" and "incremental"`},
+	{`archive`, ARCHIVE_TAR_GZ, `single-file backups, see "archive"`},
+	{`compress`, COMPRESS_GZIP, `per-file compression, see "compress"`},
+	{`encrypt`, ENCRYPT_AES_256_GCM, `per-file encryption, see "encrypt"`},
+	{`storage`, `sha256`, `content-addressed store, see "store"`},
+	{`checksum`, `sha256`, `backup manifests, see "manifest"`},
+	{`watch`, `notify`, `default watch backend, see "-watch-backend"`},
+	{`watch`, `fsnotify`, `alternative watch backend, see "-watch-backend"`},
+	{`output`, `sftp`, `remote outputs, see "sshKey"`},
+}
+
+type Format struct {
+	Kind string
+	Name string
+	Desc string
+}
+
+// All formats supported by this build, including those of the current platform.
+func allFormats() []Format {
+	return gg.Concat(FORMATS, platformFormats(), aclFormats(), reflinkFormats())
+}
+
+func listFormats() {
+	for _, val := range allFormats() {
+		fmt.Printf("%-10v %-16v %v\n", val.Kind, val.Name, val.Desc)
+	}
+}
+
 func usage() {
 	fmt.Fprint(os.Stderr, HELP)
 	flag.PrintDefaults()
 }
 
 /*
-Watching a single file doesn't seem to work on Windows at the moment.
-We report the error and proceed anyway, as this is non-critical.
-Github issue: https://github.com/rjeczalik/notify/issues/225.
+Watches the directories of the config files rather than the files themselves,
+because watching a single file doesn't work on Windows with the default watch
+backend (Github issue: https://github.com/rjeczalik/notify/issues/225), and
+because editors often save by renaming a new file over the old one, which ends
+watches of the old file. Events of other files in the directories are ignored
+by `runReloading` (see `isConfigEvent`). Failing to watch is reported, but
+non-critical.
 */
-func watchConfig(path string, events chan notify.EventInfo) {
-	err := notify.Watch(path, events, notify.All)
+func watchConfig(paths []string, events chan notify.EventInfo) Watcher {
+	watcher := newWatcher(events, nil)
+	seen := gg.Set[string]{}
+
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if seen.Has(dir) {
+			continue
+		}
+		seen.Add(dir)
 
-	if err != nil {
-		if FLAGS.Verbose {
-			log.Printf(`unable to watch config file: %+v`, err)
-		} else {
-			log.Printf(`unable to watch config file: %v`, err)
+		err := watcher.Add(dir, false, notify.All)
+		if err != nil {
+			if FLAGS.Verbose {
+				logErrorf(`unable to watch config file %v: %+v`, fmtPath(path), err)
+			} else {
+				logErrorf(`unable to watch config file %v: %v`, fmtPath(path), err)
+			}
 		}
-		return
 	}
 
 	if FLAGS.Verbose {
-		log.Printf(`watching config file %v`, fmtPath(path))
+		log.Printf(`watching config files %q`, paths)
 	}
+	return watcher
+}
+
+// Nil events are accepted, for tests. See `watchConfig`.
+func isConfigEvent(eve notify.EventInfo) bool {
+	return eve == nil || samePath(eve.Path(), FLAGS.Config) || CONFIG_WATCHER.Has(eve.Path())
 }
 
 func readConfig() (out Config) {
 	path := FLAGS.Config
 	defer gg.Detailf(`unable to decode config file %v`, fmtPath(path))
-	gg.JsonDecodeFile(path, &out)
-	return
-}
-
-func run(ctx context.Context) {
-	defer gg.RecWith(logErr)
-	conf := readConfig()
+	gg.JsonDecode(readConfigSource(path), &out)
+	out.CommonConfig = resolveConfig(ENV, out.CommonConfig)
 
-	for _, entry := range conf.Entries {
-		go runEntry(ctx, conf, entry)
+	// Includes of a config from a URL or stdin are relative to the current
+	// directory.
+	if isConfigStream(path) {
+		includeConfigs(&out, `.`, out.Include, nil)
+	} else {
+		out.Files = []string{path}
+		includeConfigs(&out, filepath.Dir(path), out.Include, []string{gg.Try1(filepath.Abs(path))})
 	}
+
+	out.Entries = expandEntries(out.Entries)
+	return
 }
 
-func runEntry(ctx context.Context, conf Config, entry Entry) {
-	defer gg.RecWith(logErr)
+// Source of time for `runReloading`. Replaced in tests.
+var CONFIG_CLOCK Clock = RealClock{}
+
+/*
+Runs the entries of the config file, restarting them whenever the config file
+changes. The new config is decoded before stopping the running entries. If it
+fails to decode, for example because it was saved mid-edit, the entries of the
+previous config keep running, and the tool retries reading the config a few
+times (see `Flags.ConfigRetry`), in case the file was caught mid-write. The
+retries also apply when the initial config fails to decode.
+
+To avoid restart storms when another program rewrites the config repeatedly,
+restarts are at least `Flags.RestartGuard` apart. Changes within the guard
+window are coalesced into one reload when the window ends, which reads the
+latest version of the file.
+
+Editors often write the config several times per save, for example via a
+temporary file, a rename, and a mode change. Changes are debounced by the
+`configDebounce` of the running config: the reload happens once no changes
+arrive for that long. This happens before the restart guard.
+
+Returns when the given context is cancelled, after stopping the entries. See
+`watchShutdown`.
+*/
+func runReloading(ctx context.Context, events chan notify.EventInfo) {
+	var cancel context.CancelFunc
+	var retry <-chan time.Time
+	var retries int
+	var restarted time.Time
+	var queued <-chan time.Time
+	var settled <-chan time.Time
+	debounce := DEFAULT_CONFIG_DEBOUNCE
+
+	reload := func() {
+		retry = nil
+		queued = nil
+
+		conf, err := gg.Catch01(readValidConfig)
+		if err != nil {
+			logErr(err)
+			if cancel != nil {
+				log.Println(`keeping the previous config`)
+			}
+			if FLAGS.ConfigRetry > 0 && retries < CONFIG_RETRY_MAX {
+				retries++
+				retry = CONFIG_CLOCK.After(FLAGS.ConfigRetry)
+			}
+			return
+		}
 
-	events := make(chan notify.EventInfo, 2)
-	gg.Try(notify.Watch(filepath.Join(entry.Input, `...`), events, notify.All))
-	defer notify.Stop(events)
+		retries = 0
+		debounce = conf.GetConfigDebounce()
+		CONFIG_WATCHER.Update(conf.Files)
+		if cancel != nil {
+			cancel()
+		}
 
-	if FLAGS.Verbose {
-		log.Printf(`watching %v`, fmtPath(entry.Input))
+		var sub context.Context
+		sub, cancel = context.WithCancel(ctx)
+		restarted = CONFIG_CLOCK.Now()
+		run(sub, conf)
 	}
 
-	var run RunState
-	run.Config = conf
-	run.Entry = entry
+	changed := func() {
+		guard := FLAGS.RestartGuard
+		elapsed := CONFIG_CLOCK.Since(restarted)
+		if guard > 0 && elapsed < guard {
+			if queued == nil {
+				if FLAGS.Verbose {
+					log.Printf(`config changed %v after the last restart, delaying reload until the restart guard %v elapses`, elapsed, guard)
+				}
+				queued = CONFIG_CLOCK.After(guard - elapsed)
+			}
+			return
+		}
 
-	backup(&run)
-	debounce := run.GetDebounce().Duration()
-	deadline := run.GetDeadline().Duration()
-	throttle := run.GetThrottle().Duration()
+		if FLAGS.Verbose {
+			log.Println(`reloading on config change`)
+		}
+		reload()
+	}
+
+	reload()
 
-outer:
 	for {
 		select {
 		case <-ctx.Done():
+			if cancel != nil {
+				cancel()
+			}
 			return
 
 		case eve := <-events:
-			latest := run.Latest
-			if throttle > 0 && !latest.IsZero() {
-				elapsed := time.Since(latest)
-				if elapsed < throttle {
-					if FLAGS.Verbose {
-						log.Printf(`ignoring FS event: elapsed time %v < throttle time %v`, elapsed, throttle)
-					}
-					continue outer
-				}
+			if !isConfigEvent(eve) {
+				continue
 			}
+			retries = 0
 
-			logEvent(eve)
-
-			if debounce == 0 {
-				backup(&run)
-				continue outer
+			// Every change restarts the quiet period.
+			if debounce > 0 {
+				settled = CONFIG_CLOCK.After(debounce.Duration())
+				continue
 			}
+			changed()
 
-			var dead <-chan time.Time
-			if deadline != 0 {
-				dead = time.After(deadline)
+		case <-settled:
+			settled = nil
+			changed()
+
+		case <-queued:
+			if FLAGS.Verbose {
+				log.Println(`reloading on config change after restart guard`)
 			}
+			reload()
 
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case eve := <-events:
-					logEvent(eve)
-				case <-time.After(debounce):
-					backup(&run)
-					continue outer
-				case <-dead:
-					backup(&run)
-					continue outer
-				}
+		case <-retry:
+			if FLAGS.Verbose {
+				log.Printf(`retrying to read config (attempt %v of %v)`, retries, CONFIG_RETRY_MAX)
 			}
+			reload()
 		}
 	}
 }
 
-func backup(run *RunState) {
+func run(ctx context.Context, conf Config) {
 	defer gg.RecWith(logErr)
-	defer gg.Detailf(`failed to backup %v`, fmtPath(run.Entry.Input))
-
-	inp := gg.ParseTo[IndexedName](run.Entry.Input)
-	outs := gg.Sorted(relatedNames(run.Entry.Output, inp))
-	prev := gg.Last(outs)
-
-	defer gg.Ok(func() { finalize(run, outs) })
+	tracer := newTracer(ctx, conf)
+	MEMORY.SetLimit(conf.MaxCopyMemory)
 
-	if run.Initial() && gg.IsNotZero(prev) {
-		name := prev.String()
-		path := filepath.Join(run.Entry.Output, name)
-		nextTime := maxModTime(run.Entry.Input)
-		prevTime := maxModTime(path)
-		if prevTime.After(nextTime) {
+	for _, entry := range conf.Entries {
+		if entry.Disabled {
 			if FLAGS.Verbose {
-				log.Printf(`backup %v is already up to date`, fmtPath(path))
+				log.Printf(`skipping entry %v: disabled`, fmtPath(entry.GetName()))
 			}
-			return
+			continue
+		}
+		if !entry.Match(FLAGS.Entries) {
+			if FLAGS.Verbose {
+				log.Printf(`skipping entry %v: doesn't match %q`, fmtPath(entry.GetName()), FLAGS.Entries)
+			}
+			continue
 		}
-	}
 
-	next := gg.Or(prev, inp)
-	next.Index = gg.Inc(next.Index) // Panics in case of overflow.
+		name := entry.GetName()
+		RUNNING.Add(name)
+		go func(entry Entry) {
+			defer RUNNING.Done(name)
+			runEntry(ctx, conf, entry, tracer)
+		}(entry)
+	}
+}
 
-	path := filepath.Join(run.Entry.Output, next.String())
-	copyRecursive(run.Entry.Input, path, run.Entry.Output)
+/*
+Implementation of `-once`, for running from cron or CI: backs up every entry
+matching the `-entry` patterns, if any, once, without watching, and exits.
+Like on startup, backups are skipped when up to date, unless `-force-initial`
+is set. The backup window of each entry is ignored. Failed backups are logged
+and don't prevent the others; if any backup failed, the command fails.
+*/
+func cmdOnce(args []string) {
+	if len(args) > 0 {
+		panic(gg.Errf(`unexpected arguments: %q`, args))
+	}
 
-	// For `finalize`.
-	outs = append(outs, next)
+	conf := readValidConfig()
+	ctx, cancel := context.WithCancel(context.Background())
+	tracer := newTracer(ctx, conf)
+	MEMORY.SetLimit(conf.MaxCopyMemory)
 
-	if FLAGS.Verbose {
-		log.Printf(`backed up %v`, fmtPath(path))
-	}
-}
+	var count, failed int
+	for _, entry := range conf.Entries {
+		if entry.Disabled || !entry.Match(FLAGS.Entries) {
+			continue
+		}
 
-func finalize(run *RunState, outs []IndexedName) {
-	run.Latest = time.Now()
+		run := newRunState(ctx, conf, entry, tracer)
+		targets := run.Targets()
+		gg.Each(targets, removeTemps)
+		backupTargets(targets, `backing up once`)
 
-	limit := gg.NumConv[int](run.GetLimit())
-	if limit <= 0 {
-		return
+		for _, tar := range targets {
+			count++
+			if tar.Result == RESULT_ERROR {
+				failed++
+			}
+		}
 	}
 
-	for _, out := range gg.Take(outs, len(outs)-limit) {
-		path := filepath.Join(run.Entry.Output, out.String())
-		_ = os.RemoveAll(path)
+	cancel()
+	tracer.Wait()
 
-		if FLAGS.Verbose {
-			log.Printf(`deleted %v`, fmtPath(path))
-		}
+	if failed > 0 {
+		panic(gg.Errf(`%v of %v backups failed`, failed, count))
+	}
+	if FLAGS.Verbose {
+		log.Printf(`finished %v backups`, count)
 	}
 }
 
+// Returns the state of a starting entry, with its options resolved.
+func newRunState(ctx context.Context, conf Config, entry Entry, tracer *Tracer) *RunState {
+	var run RunState
+	run.Ctx = ctx
+	run.Config = conf
+	run.Entry = entry
+	run.Tracer = tracer
+	run.StoreResolved()
+	run.Limiter = newRateLimiter(&run)
+	logWarnings(run)
+	return &run
+}
+
+func runEntry(ctx context.Context, conf Config, entry Entry, tracer *Tracer) {
+	defer gg.RecWith(logErr)
+
+	run := newRunState(ctx, conf, entry, tracer)
+
+	watchers := newInputWatchers(run)
+	defer watchers.Close()
+
+	// A missing input is awaited by `runEvents`.
+	err := gg.Catch(watchers.Watch)
+	if err != nil {
+		if run.Entry.MissingInput() == `` {
+			panic(err)
+		}
+		watchers[0].Fail(err)
+	}
+
+	targets := run.Targets()
+	gg.Each(targets, removeTemps)
+
+	if run.GetVerifyOnStart() {
+		gg.Each(targets, verifyLatest)
+	}
+
+	runEvents(ctx, run, targets, watchers[0].Events, watchers.Filter, watchers[0].Errors, watchers.Rewatch)
+}
+
+// Delay between attempts to re-establish a broken watch. See `runEvents`.
+const WATCH_RETRY_DELAY = time.Second * 10
+
+/*
+State machine of debounce, deadline, and throttle: makes the startup backups,
+then backs up the targets affected by the FS events until the context is
+cancelled. Backups are gated by the backup window of the entry, if any (see
+`Schedule`). Uses the clock of the entry (see `Clock`), which allows to test it
+deterministically.
+
+Watch errors mean that changes may go unnoticed. They're logged, the entry is
+marked unhealthy (see `touchHealthFile`), and the watch is re-established every
+`WATCH_RETRY_DELAY` until it succeeds. Then the targets are backed up, in case
+changes were missed.
+
+When the input is missing, such as on startup or after being removed, this is
+logged once, and backups are deferred (see `Schedule.Missing`). The input is
+checked every `WATCH_RETRY_DELAY`, and on every event of its watch, which for a
+single-file input notices its recreation. When it reappears, the watch is
+re-established and the targets are backed up.
+*/
+func runEvents(
+	ctx context.Context,
+	run *RunState,
+	targets []*RunState,
+	events <-chan notify.EventInfo,
+	filter func(notify.EventInfo) (notify.EventInfo, bool),
+	errs <-chan error,
+	rewatch func() error,
+) {
+	clock := run.GetClock()
+	debounce := run.GetDebounce().Duration()
+	deadline := run.GetDeadline().Duration()
+	sched := Schedule{Run: run}
+	trigger := TRIGGERS.Add()
+	defer TRIGGERS.Remove(trigger)
+
+	var retry <-chan time.Time
+	setWatchErr := func(err error) {
+		for _, tar := range targets {
+			tar.WatchErr = err
+		}
+	}
+
+	// Returns true if the input is missing, logging this only once.
+	checkMissing := func() bool {
+		path := run.Entry.MissingInput()
+		if path == `` {
+			return false
+		}
+		if !sched.Missing {
+			sched.Missing = true
+			log.Printf(`input %v is missing; deferring backups until it reappears`, fmtPath(path))
+		}
+		if retry == nil {
+			retry = clock.After(WATCH_RETRY_DELAY)
+		}
+		return true
+	}
+
+	reestablish := func() {
+		err := rewatch()
+		if err != nil {
+			logErr(gg.Wrapf(err, `unable to re-establish watch of %v`, run.Entry.FmtInput()))
+			retry = clock.After(WATCH_RETRY_DELAY)
+			return
+		}
+
+		retry = nil
+		setWatchErr(nil)
+
+		if sched.Missing {
+			sched.Missing = false
+			log.Printf(`input %v reappeared; resuming backups`, run.Entry.FmtInput())
+			sched.Backup(targets, `backing up: the input reappeared`)
+			return
+		}
+
+		log.Printf(`re-established watch of %v`, run.Entry.FmtInput())
+		sched.Backup(targets, `backing up: the watch was re-established`)
+	}
+
+	checkMissing()
+	sched.Backup(targets, `backing up on startup`)
+
+outer:
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-sched.Wake:
+			sched.Backup(nil, `backing up: the backup window opened`)
+
+		case <-trigger:
+			sched.Force(targets, `backing up: triggered by a signal`)
+
+		case err := <-errs:
+			setWatchErr(err)
+			if checkMissing() {
+				continue outer
+			}
+			logErr(gg.Wrapf(err, `watch of %v is broken`, run.Entry.FmtInput()))
+			if retry == nil {
+				retry = clock.After(WATCH_RETRY_DELAY)
+			}
+
+		case <-retry:
+			retry = nil
+			if checkMissing() {
+				continue outer
+			}
+			reestablish()
+
+		case eve := <-events:
+			eve, ok := filter(eve)
+			if !ok || checkMissing() {
+				continue outer
+			}
+			if sched.Missing {
+				reestablish()
+				continue outer
+			}
+
+			dirty := pendingTargets(targets, eve, nil)
+			if len(dirty) <= 0 {
+				continue outer
+			}
+
+			logEvent(eve)
+
+			if debounce == 0 {
+				sched.Backup(dirty, `backing up: debounce is disabled`)
+				continue outer
+			}
+
+			var dead <-chan time.Time
+			if deadline != 0 {
+				dead = clock.After(deadline)
+			}
+
+			count := 1
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case eve := <-events:
+					eve, ok := filter(eve)
+					if ok && checkMissing() {
+						continue outer
+					}
+					if ok {
+						logEvent(eve)
+						count++
+						dirty = pendingTargets(targets, eve, dirty)
+					}
+				case <-clock.After(debounce):
+					sched.Backup(dirty, `backing up: no FS events for debounce time %v after %v events`, debounce, count)
+					continue outer
+				case <-dead:
+					sched.Backup(dirty, `backing up: reached deadline %v after %v events`, deadline, count)
+					continue outer
+				case <-trigger:
+					sched.Force(targets, `backing up: triggered by a signal after %v events`, count)
+					continue outer
+				}
+			}
+		}
+	}
+}
+
+/*
+Watches the input of an entry. When the input is a symlink, the link is resolved
+when the entry starts, which happens on startup and on every config reload, and
+its target is watched. Backups still copy via the link and are named after it,
+so when the link is retargeted, backups of the new target continue the same
+sequence of indexed names.
+
+With the setting `watchInputLink`, the directory containing the link is also
+watched, and when the link is retargeted, the watch is moved to the new target,
+and all targets of the entry are backed up as if their input had changed.
+*/
+type InputWatcher struct {
+	Run     *RunState
+	Input   string // One of the inputs of the entry. See `Entry.GetInputs`.
+	Events  chan notify.EventInfo
+	Errors  chan error
+	Watcher Watcher
+	Link    string // Absolute path of the input symlink, when tracked.
+	Target  string // Resolved input.
+	File    string // Absolute path of a single-file input.
+}
+
+/*
+A single-file input is watched via its directory, filtering the events of other
+files (see `InputWatcher.Filter`), since watching a single file doesn't work on
+Windows with the default watch backend (see `watchConfig`). This also keeps the
+watch when the file is replaced by renaming.
+*/
+func (self *InputWatcher) Watch() {
+	run := self.Run
+	inp := self.Input
+	self.Target = resolveInput(inp)
+	self.Watcher = newWatcher(self.Events, self.Errors)
+	self.File = ``
+
+	if gg.FileExists(self.Target) {
+		self.File = gg.Try1(filepath.Abs(self.Target))
+		gg.Try(self.Watcher.Add(filepath.Dir(self.File), false, run.GetWatchEvents()))
+	} else {
+		gg.Try(self.Watcher.Add(self.Target, true, run.GetWatchEvents()))
+	}
+
+	if FLAGS.Verbose {
+		if self.Target != inp {
+			log.Printf(`watching %v via link %v`, fmtPath(self.Target), fmtPath(inp))
+		} else {
+			log.Printf(`watching %v`, fmtPath(inp))
+		}
+	}
+
+	if self.Target != inp && run.GetWatchInputLink() {
+		self.Link = gg.Try1(filepath.Abs(inp))
+		gg.Try(self.Watcher.Add(filepath.Dir(self.Link), false, notify.All))
+	}
+}
+
+func (self *InputWatcher) Close() {
+	if self.Watcher != nil {
+		_ = self.Watcher.Close()
+	}
+}
+
+func (self *InputWatcher) Rewatch() error {
+	self.Close()
+	return gg.Catch(self.Watch)
+}
+
+/*
+Reports a watch error without blocking. The channel is buffered, and one pending
+error is enough to trigger re-watching.
+*/
+func (self *InputWatcher) Fail(err error) {
+	select {
+	case self.Errors <- err:
+	default:
+	}
+}
+
+/*
+Returns false for FS events that must be ignored. The directory of a single-file
+input is watched non-recursively, and events for other files in it are ignored.
+When the input link is tracked, its directory is watched non-recursively, and
+events for other paths in that directory are ignored. Events for the link itself
+are ignored unless the link was retargeted, in which case the watch is moved,
+and the returned event is nil, which is accepted by all targets (see
+`RunState.Accepts`).
+*/
+func (self *InputWatcher) Filter(eve notify.EventInfo) (notify.EventInfo, bool) {
+	if eve == nil {
+		return eve, true
+	}
+
+	path := eve.Path()
+	if self.File != `` && path != self.File && path != self.Link {
+		return eve, false
+	}
+
+	// Watches don't survive the removal or renaming of the watched path. The
+	// watch of the directory of a single-file input does. Either way, the
+	// event lets `runEvents` notice the missing input.
+	if self.File == `` && eve.Event()&(notify.Remove|notify.Rename) != 0 && path == gg.Try1(filepath.Abs(self.Target)) {
+		self.Fail(gg.Errf(`%v was removed or renamed`, fmtPath(self.Target)))
+	}
+
+	if self.Link == `` {
+		return eve, true
+	}
+
+	if path != self.Link {
+		return eve, inputRel(self.Target, path) != ``
+	}
+
+	prev := self.Target
+	if resolveInput(self.Input) == prev {
+		return nil, false
+	}
+
+	self.Close()
+	self.Watch()
+	log.Printf(`input link %v retargeted from %v to %v`, fmtPath(self.Input), fmtPath(prev), fmtPath(self.Target))
+	return nil, true
+}
+
+// True if the path belongs to the input of this watcher. See `InputWatchers`.
+func (self *InputWatcher) Owns(path string) bool {
+	if path == self.Link || path == self.File {
+		return true
+	}
+	return self.File == `` && inputRel(self.Target, path) != ``
+}
+
+/*
+True if the input doesn't exist, including a symlink to a missing target. Other
+errors, such as denied permissions, are left to the backup to report.
+*/
+func inputMissing(path string) bool {
+	_, err := os.Stat(path)
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// If the input is a symlink, returns its target, otherwise the input itself.
+func resolveInput(path string) string {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return path
+	}
+
+	out, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return out
+}
+
+// Backs up each target unless backups are paused. See `PAUSED`.
+func backupTargets(targets []*RunState, pat string, args ...any) {
+	reservePeerIndex(targets)
+
+	for _, tar := range targets {
+		if PAUSED.Load() {
+			logDecision(tar, `skipping backup: backups are paused`)
+			continue
+		}
+		logDecision(tar, pat, args...)
+		backup(tar)
+	}
+}
+
+func backup(run *RunState) {
+	defer gg.RecWith(logErr)
+	defer gg.Finally(run.Start())
+	defer gg.Detailf(`failed to backup %v`, run.Entry.FmtInput())
+
+	format := run.GetIndexFormat()
+	format.Validate()
+	multi := run.MultiInput()
+	compress := run.CompressExt()
+	encrypt := run.EncryptExt()
+
+	if !multi && run.FiltersSize() {
+		info, err := os.Stat(run.Entry.Input)
+		if err == nil && info.Mode().IsRegular() && !run.SizeInBounds(ByteSize(info.Size())) {
+			logDecision(run, `skipping backup: the size of %v, %v bytes, is outside of "minSize" and "maxSize"`, fmtPath(run.Entry.Input), info.Size())
+			run.Result = RESULT_UP_TO_DATE
+			run.Counters.UpToDate++
+			return
+		}
+	}
+
+	if remote, ok := parseRemote(run.Entry.Output); ok {
+		remoteBackup(run, remote)
+		return
+	}
+
+	if run.Initial() {
+		firstRun(run)
+	}
+
+	if run.GetStaging() && !FLAGS.DryRun {
+		defer gg.Finally(newStage(run).Done)
+	}
+
+	run.Active = activeFile(run)
+
+	if run.GetZip() {
+		zipBackup(run)
+		return
+	}
+
+	if run.GetIncremental() {
+		incrementalBackup(run)
+		return
+	}
+
+	move := run.GetMove()
+	if move {
+		validateMove(run)
+		if !hasFiles(run) {
+			logDecision(run, `skipping backup: no files to move`)
+			run.Result = RESULT_UP_TO_DATE
+			run.Counters.UpToDate++
+			return
+		}
+	}
+
+	archived := run.Archived()
+	inp := run.BackupName()
+	outs := gg.Sorted(relatedNames(run.Entry.Output, inp))
+	prev := gg.Last(outs)
+
+	defer gg.Ok(func() { finalize(run, outs) })
+
+	// In move mode, any files in the input are new.
+	if run.CheckUpToDate() && !move && gg.IsNotZero(prev) {
+		name := prev.String()
+		path := filepath.Join(run.Entry.Output, name)
+		if isUpToDate(run, path) {
+			logDecision(run, `skipping backup: %v is already up to date`, fmtPath(path))
+			run.Result = RESULT_UP_TO_DATE
+			run.Counters.UpToDate++
+			return
+		}
+	}
+
+	// Move mode removes the input files, so the same content is new again.
+	var hash string
+	if run.GetSkipUnchanged() && !move {
+		hash = inputHash(run)
+		if hash == run.LastHash && gg.IsNotZero(prev) {
+			logDecision(run, `skipping backup: the content of %v is unchanged since the previous backup`, run.Entry.FmtInput())
+			run.Result = RESULT_UP_TO_DATE
+			run.Counters.UpToDate++
+			return
+		}
+	}
+
+	// Not derived from the previous name, which may be padded differently.
+	next := inp
+	next.Index = run.NextIndex(gg.MaxPrim2(prev.Index, run.PeerMax))
+	if !multi && !gg.DirExists(run.Entry.Input) {
+		next.Compress = compress
+		next.Encrypt = encrypt
+	}
+
+	path := filepath.Join(run.Entry.Output, next.String())
+
+	if FLAGS.DryRun {
+		prevPath := ``
+		if gg.IsNotZero(prev) {
+			prevPath = filepath.Join(run.Entry.Output, prev.String())
+		}
+		if archived {
+			log.Printf(`%v would archive %v to %v`, DRY_RUN_PREFIX, fmtPath(run.Entry.Input), fmtPath(path))
+		} else if multi {
+			logInputsDiff(run, prevPath, path)
+		} else {
+			logDiff(run, prevPath, path)
+		}
+		if cmd := run.GetCopyCommand(); len(cmd) > 0 {
+			log.Printf(`%v would run %q`, DRY_RUN_PREFIX, cmd.Args(run.Entry.Input, path))
+		} else if FLAGS.Verbose && multi {
+			copyInputs(run, path)
+		} else if FLAGS.Verbose && !run.GetStore() && !archived {
+			// Logs every copy without writing. See `copyRecursive`.
+			copyRecursive(run, run.Entry.Input, path, run.Entry.Output)
+		}
+		if move {
+			log.Printf(`%v would remove the backed-up files from %v`, DRY_RUN_PREFIX, fmtPath(run.Entry.Input))
+		}
+		outs = append(outs, next)
+		run.Result = RESULT_DRY_RUN
+		return
+	}
+
+	outs = checkSpace(run, outs, next)
+
+	run.Span.Set(`backup.output`, path)
+	run.Span.Set(`backup.index`, uint64(next.Index))
+
+	run.Target = path
+	run.Index = next.Index
+	if run.GetManifest() && !run.GetStore() && !archived {
+		run.Manifest = newManifest()
+	}
+
+	// Retention runs only after the new backup is fully written and verified.
+	// A failed backup is removed rather than left taking up an index, so that
+	// retention never counts an incomplete backup towards the limit.
+	defer gg.Fail(func(error) { removeIncomplete(path) })
+
+	// The backup is written under a temporary name and renamed into place
+	// when complete, so that a crash never leaves a partial backup under an
+	// indexed name. See `removeTemps`.
+	temp := tempPath(path)
+	defer gg.Fail(func(error) { removeIncomplete(temp) })
+	run.Target = temp
+	if run.Hardlinked() && gg.IsNotZero(prev) {
+		run.LinkDest = filepath.Join(run.Entry.Output, prev.String())
+	}
+
+	if run.GetStore() {
+		storeBackup(run, temp)
+	} else if cmd := run.GetCopyCommand(); len(cmd) > 0 {
+		copyWithCommand(run, cmd, run.Entry.Input, temp)
+	} else if archived {
+		writeArchive(run, temp)
+	} else if multi {
+		copyInputs(run, temp)
+	} else {
+		copyTree(run, run.Entry.Input, temp, run.Entry.Output)
+	}
+
+	gg.Try(os.Rename(temp, path))
+	if run.GetFsync() {
+		gg.Try(syncDir(run.Entry.Output))
+	}
+	run.Target = path
+	run.Manifest.Write(path)
+	verifyNew(run, path)
+	writeSize(run, path)
+
+	if move {
+		moveInput(run, path)
+	}
+	run.LastHash = hash
+
+	// For `finalize`.
+	outs = append(outs, next)
+
+	if FLAGS.Verbose || FLAGS.Decisions {
+		logRecord(LogRecord{Msg: `backed up ` + fmtPath(path), Entry: run.Entry.GetName(), Path: path})
+	}
+}
+
+func finalize(run *RunState, outs []IndexedName) {
+	run.Latest = run.GetClock().Now()
+	touchHealthFile(run)
+	deleted := prune(run, outs)
+	if !FLAGS.DryRun {
+		METRICS.SetRetained(run, len(outs)-len(deleted))
+	}
+	runPostHook(run)
+}
+
+/*
+Applies retention to the given backups of the entry, sorted by index: deletes
+the ones expired by `limit` and `maxAge` (see `expiredBackups`), then the
+oldest ones over `maxBytes` (see `overBudget`), and collects unreferenced store
+objects. Called after every backup, and by `backup prune`. Returns the backups
+selected for deletion; failures to delete them are in `RunState.Retention`.
+*/
+func prune(run *RunState, outs []IndexedName) []IndexedName {
+	// Pinned backups are exempt from retention. See `RunState.Pinned`.
+	rotated := gg.Reject(outs, run.Pinned)
+
+	deleted := expiredBackups(run, rotated, gg.Last(outs))
+	deleted = append(deleted, overBudget(run, outs, deleted)...)
+
+	if run.GetStore() && !FLAGS.DryRun {
+		defer collectStore(run, gg.Reject(outs, func(val IndexedName) bool {
+			return gg.Has(deleted, val)
+		}))
+	}
+
+	deleteBackups(run, deleted)
+	return deleted
+}
+
+/*
+Returns the backups to be deleted by retention, oldest first. Without the
+setting `maxAge`, these are the oldest backups over `limit`. With `maxAge`, a
+backup is deleted only when it's both over the limit and older than `maxAge`,
+where limit 0 means that only the age counts. The age of a backup is the time
+since its most recently modified file was modified, which, with preserved times,
+is when its input last changed before the backup (see `copyTimes`). The latest
+backup is never deleted by age.
+*/
+func expiredBackups(run *RunState, rotated []IndexedName, latest IndexedName) (out []IndexedName) {
+	limit := gg.NumConv[int](run.GetLimit())
+	maxAge := run.GetMaxAge().Duration()
+	over := rotated
+	if limit > 0 {
+		over = gg.Take(rotated, len(rotated)-limit)
+	} else if maxAge <= 0 {
+		return nil
+	}
+
+	for _, val := range over {
+		path := filepath.Join(run.Entry.Output, val.String())
+
+		if maxAge <= 0 {
+			if FLAGS.Verbose {
+				log.Printf(`expired %v: over limit %v`, fmtPath(path), limit)
+			}
+			out = append(out, val)
+			continue
+		}
+
+		if val == latest {
+			continue
+		}
+
+		age := run.GetClock().Since(maxModTime(path, nil))
+		if age <= maxAge {
+			continue
+		}
+
+		if FLAGS.Verbose {
+			if limit > 0 {
+				log.Printf(`expired %v: over limit %v and older than max age %v (age %v)`, fmtPath(path), limit, maxAge, age)
+			} else {
+				log.Printf(`expired %v: older than max age %v (age %v)`, fmtPath(path), maxAge, age)
+			}
+		}
+		out = append(out, val)
+	}
+	return
+}
+
+/*
+Deletes the given old backups of the entry. In dry run mode, only logs what
+would be deleted.
+*/
+func deleteBackups(run *RunState, names []IndexedName) {
+	for _, out := range names {
+		path := filepath.Join(run.Entry.Output, out.String())
+
+		if FLAGS.DryRun {
+			log.Printf(`%v would delete %v`, DRY_RUN_PREFIX, fmtPath(path))
+			continue
+		}
+
+		// Failed deletions are retried by the next backup, which again finds
+		// the old backup over the limit. They don't fail the new backup, but
+		// are reported in its trace span and history.
+		err := removeBackupRetry(path)
+		if err != nil {
+			err = gg.Wrapf(err, `unable to delete old backup %v`, fmtPath(path))
+			logErr(err)
+			run.Retention = errors.Join(run.Retention, err)
+			continue
+		}
+
+		if FLAGS.Verbose {
+			logRecord(LogRecord{Msg: `deleted ` + fmtPath(path), Entry: run.Entry.GetName(), Path: path})
+		}
+	}
+}
+
+/*
+Writes the time of the latest successful backup to the health file, if one is
+configured. Monitoring tools can alert when the file goes stale. Failures are
+logged, but don't fail the backup.
+*/
+func touchHealthFile(run *RunState) {
+	path := run.GetHealthFile()
+	if path == `` || FLAGS.DryRun {
+		return
+	}
+
+	// Goes stale while the entry may be missing changes.
+	if run.WatchErr != nil {
+		logDecision(run, `not updating health file %v: the watch is broken`, fmtPath(path))
+		return
+	}
+
+	defer gg.RecWith(logErr)
+	defer gg.Detailf(`unable to write health file %v`, fmtPath(path))
+
+	gg.MkdirAll(filepath.Dir(path))
+	gg.WriteFile(path, run.Latest.Format(time.RFC3339)+"\n")
+}
+
+/*
+Suffixes of the files kept next to each backup. They're deleted, renamed, and
+moved along with their backups.
+*/
+var SIDECAR_EXTS = []string{MANIFEST_EXT, PIN_EXT, SIZE_EXT}
+
+/*
+Removes a backup along with its sidecar files. Backups of read-only directories
+have read-only directories too (see `copyMode`), whose entries can't be
+removed, so on failure, makes them writable and tries again.
+*/
+func removeBackup(path string) error {
+	err := os.RemoveAll(path)
+	if err != nil && errors.Is(err, fs.ErrPermission) {
+		makeDirsWritable(path)
+		err = os.RemoveAll(path)
+	}
+
+	errs := []error{err}
+	for _, ext := range SIDECAR_EXTS {
+		errs = append(errs, removeFile(path+ext))
+	}
+	return errors.Join(errs...)
+}
+
+// Adds the owner write permission to every directory in the tree. Best effort.
+func makeDirsWritable(root string) {
+	_ = filepath.WalkDir(root, func(path string, src fs.DirEntry, err error) error {
+		if err == nil && src.IsDir() {
+			if info, err := src.Info(); err == nil {
+				_ = os.Chmod(path, info.Mode().Perm()|0o200)
+			}
+		}
+		return nil
+	})
+}
+
+// Flushes the file to storage. See `CommonConfig.Fsync`.
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Like `os.Remove`, but ignores missing files.
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if isErrFileNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+/*
+Like `removeBackup`, but retries a few times after a short delay. Deletion may
+fail temporarily, for example on Windows, when another program has a file open.
+*/
+func removeBackupRetry(path string) (err error) {
+	for ind := range gg.Iter(REMOVE_RETRY_MAX + 1) {
+		if ind > 0 {
+			time.Sleep(REMOVE_RETRY_DELAY)
+		}
+		err = removeBackup(path)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func removeIncomplete(path string) {
+	if _, err := os.Lstat(path); isErrFileNotFound(err) {
+		return
+	}
+
+	err := removeBackup(path)
+	if err != nil {
+		logErr(gg.Wrapf(err, `unable to remove incomplete backup %v`, fmtPath(path)))
+		return
+	}
+	if FLAGS.Verbose {
+		log.Printf(`removed incomplete backup %v`, fmtPath(path))
+	}
+}
+
+/*
+Infix of the temporary names of backups being written, such as
+".app_<index>.log.tmp-<pid>". The leading dot hides them, and prevents them
+from decoding as related names of the backup.
+*/
+const TEMP_INFIX = `.tmp-`
+
+func tempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), `.`+filepath.Base(path)+TEMP_INFIX+strconv.Itoa(os.Getpid()))
+}
+
+/*
+Removes the temporary backups of the entry left in its output directory by a
+crashed or killed process. Called when the entry starts, before its first
+backup. In dry run mode, only logs what would be removed.
+*/
+func removeTemps(run *RunState) {
+	defer gg.RecWith(logErr)
+
+	inp := run.BackupName()
+	for _, name := range readDir(run.Entry.Output) {
+		base, ok := cutTempName(name)
+		if !ok || !inp.Related(inp.IndexFormat.Parse(base)) {
+			continue
+		}
+
+		path := filepath.Join(run.Entry.Output, name)
+		if FLAGS.DryRun {
+			log.Printf(`%v would remove incomplete backup %v`, DRY_RUN_PREFIX, fmtPath(path))
+			continue
+		}
+		removeIncomplete(path)
+	}
+}
+
+// Returns the backup name from a temporary name produced by `tempPath`.
+func cutTempName(name string) (string, bool) {
+	if !strings.HasPrefix(name, `.`) {
+		return ``, false
+	}
+	ind := strings.LastIndex(name, TEMP_INFIX)
+	if ind < 0 {
+		return ``, false
+	}
+	return name[1:ind], true
+}
+
+/*
+When manifests are enabled, re-reads the new backup from disk and compares it
+against the checksums computed while copying.
+*/
+func verifyNew(run *RunState, path string) {
+	if run.Manifest == nil {
+		return
+	}
+
+	problems := run.Manifest.Verify(path)
+	if len(problems) > 0 {
+		panic(gg.Errf(`verification of new backup %v failed: %v`, fmtPath(path), strings.Join(problems, `; `)))
+	}
+}
+
+/*
+Decision log: records why a trigger did or didn't result in a backup. Shown in
+verbose mode, or with `-decisions` for auditing without the rest of verbose
+output.
+*/
+func logDecision(run *RunState, pat string, arg ...any) {
+	if !(FLAGS.Verbose || FLAGS.Decisions) {
+		return
+	}
+
+	name := fmtPath(run.Entry.GetName())
+	if run.Route != nil {
+		name += ` route ` + fmtPath(run.Route.Pattern)
+	}
+	log.Printf(`%v: `+pat, append([]any{name}, arg...)...)
+}
+
 func logErr(err error) {
 	if err == nil {
 		return
 	}
-	if FLAGS.Verbose {
-		log.Printf(`%+v`, err)
+	if isBug(err) {
+		logRecord(LogRecord{
+			Level:  LOG_LEVEL_ERROR,
+			Msg:    fmt.Sprintf(`internal error, please report it as a bug: %+v`, err),
+			Errors: errChain(err),
+		})
+		if FLAGS.CrashOnBug {
+			os.Exit(1)
+		}
+		return
+	}
+	rec := LogRecord{Level: LOG_LEVEL_ERROR, Msg: err.Error(), Errors: errChain(err)}
+	if FLAGS.Verbose {
+		rec.Msg = fmt.Sprintf(`%+v`, err)
+	}
+	logRecord(rec)
+}
+
+/*
+True if the error comes from a programming bug, such as a nil dereference or an
+out-of-range index, or a panic with a non-error value, rather than from a failed
+operation, which is always reported with a `gg.Err`. The recoveries which keep
+backups running despite failures, such as `gg.RecWith(logErr)`, also catch bugs,
+which are then logged with a stack trace (see `logErr`), and, with the flag
+`-crash-on-bug`, exit the process.
+*/
+func isBug(err error) bool {
+	var runtimeErr runtime.Error
+	var anyErr gg.ErrAny
+	return errors.As(err, &runtimeErr) || errors.As(err, &anyErr)
+}
+
+// Returns the entry name, falling back on the input path.
+func (self Entry) GetName() string { return gg.Or(self.Name, self.Input) }
+
+/*
+Name of the files kept next to the backups of the entry, such as the history
+file. See `historyPath`.
+*/
+func (self Entry) BaseName() string {
+	if len(self.Inputs) > 0 {
+		return self.Name
+	}
+	return filepath.Base(self.Input)
+}
+
+/*
+Returns the output directories of the entry: "output" followed by "outputs",
+without empty and duplicate paths. Each output receives every backup, and is
+retained separately. See `RunState.Targets`.
+*/
+func (self Entry) GetOutputs() (out []string) {
+	for _, val := range gg.Concat([]string{self.Output}, gg.Map(self.Outputs, Output.GetPath)) {
+		if val != `` && !gg.Has(out, val) {
+			out = append(out, val)
+		}
+	}
+	return
+}
+
+/*
+Returns the settings of the given output from `Entry.Outputs`, if any. The
+main output, "output", has no settings of its own.
+*/
+func (self Entry) OutputOf(path string) Output {
+	if path == self.Output {
+		return Output{Path: path}
+	}
+	return gg.Find(self.Outputs, func(val Output) bool { return val.Path == path })
+}
+
+/*
+One of `Entry.Outputs`. In JSON, either a path, or an object with the path and
+the format of the backups in this output, which overrides the settings of the
+entry, such as `{"path": "archives", "archive": "tar.gz"}`. This allows one
+entry to keep plain copies for quick access in one output, and compressed
+archives for long-term storage in another.
+*/
+type Output struct {
+	Path          string         `json:"path"`
+	Compress      string         `json:"compress"`
+	CompressLevel gg.Opt[uint64] `json:"compressLevel"`
+	Archive       string         `json:"archive"`
+}
+
+func (self Output) GetPath() string { return self.Path }
+
+// True if the output has any settings of its own.
+func (self Output) HasFormat() bool {
+	return self.Compress != `` || self.CompressLevel.Ok || self.Archive != ``
+}
+
+func (self *Output) UnmarshalJSON(src []byte) error {
+	if json.Unmarshal(src, &self.Path) == nil {
+		return nil
+	}
+	type Plain Output
+	return json.Unmarshal(src, (*Plain)(self))
+}
+
+// Returns the config of an entry with the settings of this output on top.
+func (self Output) Apply(conf CommonConfig) CommonConfig {
+	return resolveConfig(CommonConfig{
+		Compress:      self.Compress,
+		CompressLevel: self.CompressLevel,
+		Archive:       self.Archive,
+	}, conf)
+}
+
+/*
+True if there are no patterns, or if any pattern matches the entry's name or
+any of its input paths. Patterns use the syntax of `filepath.Match`; a pattern
+also matches if it's equal to the name or an input path.
+*/
+func (self Entry) Match(patterns []string) bool {
+	if len(patterns) <= 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if globMatch(pattern, self.Name) || globMatch(pattern, self.Input) {
+			return true
+		}
+		for _, val := range self.Inputs {
+			if globMatch(pattern, val) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func globMatch(pattern, src string) bool {
+	if src == `` {
+		return false
+	}
+	if pattern == src {
+		return true
+	}
+	ok, _ := filepath.Match(pattern, src)
+	return ok
+}
+
+// Repeatable string flag.
+type StringsFlag []string
+
+func (self StringsFlag) String() string { return strings.Join(self, `,`) }
+
+func (self *StringsFlag) Set(src string) error {
+	*self = append(*self, src)
+	return nil
+}
+
+// Adapter for using `gg.Opt` with the "flag" package.
+type OptFlag[A any] struct{ *gg.Opt[A] }
+
+func (self OptFlag[A]) String() string {
+	if self.Opt == nil {
+		return ``
+	}
+	return self.Opt.String()
+}
+
+func (self OptFlag[A]) Set(src string) error { return self.Opt.Parse(src) }
+
+// Workaround for the lack of a text decoding method in `time.Duration`.
+type Duration time.Duration
+
+func (self Duration) Duration() time.Duration { return time.Duration(self) }
+
+func (self Duration) String() string { return self.Duration().String() }
+
+/*
+The JSON decoder doesn't report which field failed to decode, so the error
+includes the value and the expected format.
+*/
+func (self *Duration) UnmarshalText(src []byte) error {
+	val, err := time.ParseDuration(gg.ToString(src))
+	if err != nil {
+		return gg.Errf(`invalid duration %q: expected a number with a unit, such as "500ms", "10s" or "1h"`, src)
+	}
+	*self = Duration(val)
+	return nil
+}
+
+// File permission bits in octal notation, such as "0755".
+type FileMode fs.FileMode
+
+func (self FileMode) String() string { return `0` + strconv.FormatUint(uint64(self), 8) }
+
+func (self *FileMode) UnmarshalText(src []byte) error {
+	val, err := strconv.ParseUint(gg.ToString(src), 8, 32)
+	if err == nil && fs.FileMode(val)&^fs.ModePerm != 0 {
+		err = gg.Errf(`file mode %q has bits other than permissions`, src)
+	}
+	if err == nil {
+		*self = FileMode(val)
+	}
+	return err
+}
+
+/*
+Number of bytes, such as a size limit. In JSON, either a number or a string
+with an optional unit, such as "512", "100MB" or "1.5GiB". The units "KB",
+"MB", "GB" and "TB" are powers of 1000, and "KiB", "MiB", "GiB" and "TiB" are
+powers of 1024. Units are case-insensitive.
+*/
+type ByteSize uint64
+
+func (self ByteSize) String() string { return strconv.FormatUint(uint64(self), 10) }
+
+func (self *ByteSize) UnmarshalJSON(src []byte) error {
+	var str string
+	if json.Unmarshal(src, &str) == nil {
+		return self.UnmarshalText([]byte(str))
+	}
+	return json.Unmarshal(src, (*uint64)(self))
+}
+
+func (self *ByteSize) UnmarshalText(src []byte) error {
+	val, err := parseByteSize(gg.ToString(src))
+	if err == nil {
+		*self = val
+	}
+	return err
+}
+
+var BYTE_UNITS = map[string]float64{
+	``:    1,
+	`B`:   1,
+	`KB`:  1e3,
+	`MB`:  1e6,
+	`GB`:  1e9,
+	`TB`:  1e12,
+	`KIB`: 1 << 10,
+	`MIB`: 1 << 20,
+	`GIB`: 1 << 30,
+	`TIB`: 1 << 40,
+}
+
+func parseByteSize(src string) (ByteSize, error) {
+	text := strings.TrimSpace(src)
+	num := strings.TrimRightFunc(text, unicode.IsLetter)
+	unit := strings.ToUpper(text[len(num):])
+
+	mul, ok := BYTE_UNITS[unit]
+	if !ok {
+		return 0, gg.Errf(`unknown unit in byte size %q`, src)
+	}
+
+	val, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || !(val >= 0) || val*mul >= math.MaxUint64 {
+		return 0, gg.Errf(`invalid byte size %q`, src)
+	}
+	return ByteSize(val * mul), nil
+}
+
+/*
+Like `os.MkdirAll`. When the setting `dirMode` is provided, each created
+directory gets exactly that mode, regardless of the process umask. Existing
+directories are left unchanged.
+*/
+func (self RunState) MkdirAll(path string) {
+	mode := self.GetDirMode()
+	if !mode.Ok {
+		gg.Try(os.MkdirAll(path, os.ModePerm))
+		return
+	}
+	mkdirAllMode(path, fs.FileMode(mode.Val))
+}
+
+func mkdirAllMode(path string, mode fs.FileMode) {
+	if gg.DirExists(path) {
+		return
+	}
+
+	parent := filepath.Dir(path)
+	if parent != path {
+		mkdirAllMode(parent, mode)
+	}
+
+	err := os.Mkdir(path, mode)
+	if errors.Is(err, fs.ErrExist) {
+		return
+	}
+	gg.Try(err)
+
+	// The mode given to `os.Mkdir` is restricted by the umask.
+	gg.Try(os.Chmod(path, mode))
+}
+
+/*
+Source of time for the timing logic of entries, such as debounce, deadline, and
+throttle. Replaced in tests.
+*/
+type Clock interface {
+	Now() time.Time
+	Since(time.Time) time.Duration
+	After(time.Duration) <-chan time.Time
+}
+
+type RealClock struct{}
+
+func (self RealClock) Now() time.Time                           { return time.Now() }
+func (self RealClock) Since(val time.Time) time.Duration        { return time.Since(val) }
+func (self RealClock) After(val time.Duration) <-chan time.Time { return time.After(val) }
+
+func (self RunState) GetClock() Clock {
+	if self.Clock == nil {
+		return RealClock{}
+	}
+	return self.Clock
+}
+
+func (self RunState) GetDiskFree(path string) (uint64, error) {
+	if self.DiskFree == nil {
+		return diskFree(path)
+	}
+	return self.DiskFree(path)
+}
+
+func (self RunState) Initial() bool { return self.Latest.IsZero() }
+
+/*
+Panics when the entry has been stopped, such as on shutdown or config reload,
+to interrupt a running backup between files. The incomplete backup is then
+removed like after any other failure.
+*/
+func (self RunState) CheckStopped() {
+	if self.Ctx != nil {
+		gg.Try(self.Ctx.Err())
+	}
+}
+
+/*
+True if the backup may be skipped when the latest existing backup is newer than
+the input. Only startup backups are checked, unless disabled by `-force-initial`.
+*/
+func (self RunState) CheckUpToDate() bool { return self.Initial() && !FLAGS.ForceInitial }
+
+/*
+Filters input paths for the current backup. See `PathFilter`. The input itself
+is always included.
+*/
+func (self *RunState) Includes(path string, src fs.DirEntry) bool {
+	rel := inputRel(self.Entry.Input, path)
+	if rel == `.` {
+		return true
+	}
+	return path != self.Active &&
+		!self.Excludes(rel, src.IsDir()) &&
+		self.Route.Includes(rel, src) &&
+		self.IncludesContentType(path, src) &&
+		self.IncludesSize(src)
+}
+
+// True if `Includes` may exclude files by criteria other than their directory.
+func (self *RunState) FiltersFiles() bool {
+	return self.Route != nil || len(self.GetContentTypes()) > 0 || self.Active != `` || self.FiltersSize()
+}
+
+/*
+Returns the most recently modified file of a directory input if it was modified
+within the window of the setting `skipActive`, assuming that it's still being
+written, such as the current file of a log directory. Returns an empty string
+otherwise. The file is excluded from the current backup (see `Includes`).
+*/
+func activeFile(run *RunState) string {
+	window := run.GetSkipActive().Duration()
+	if window <= 0 || !gg.DirExists(run.Entry.Input) {
+		return ``
+	}
+
+	var out string
+	var modTime time.Time
+
+	gg.Try(filepath.WalkDir(run.Entry.Input, func(path string, src fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !run.Includes(path, src) {
+			return skipEntry(src)
+		}
+		if src.IsDir() {
+			return nil
+		}
+
+		info := gg.Try1(src.Info())
+		if info.ModTime().After(modTime) {
+			out, modTime = path, info.ModTime()
+		}
+		return nil
+	}))
+
+	elapsed := run.GetClock().Since(modTime)
+	if out == `` || elapsed >= window {
+		return ``
+	}
+
+	logDecision(run, `skipping active file %v: modified %v ago, within %v`, fmtPath(out), elapsed, window)
+	return out
+}
+
+func (self *RunState) IncludesContentType(path string, src fs.DirEntry) bool {
+	patterns := self.GetContentTypes()
+	if len(patterns) <= 0 || src.IsDir() {
+		return true
+	}
+	return matchContentType(patterns, detectContentType(path))
+}
+
+/*
+Filters regular files by the settings `minSize` and `maxSize`, for skipping
+files such as core dumps or empty lock files. A single-file input is filtered
+by `backup` instead, since `Includes` always includes the input itself.
+*/
+func (self *RunState) IncludesSize(src fs.DirEntry) bool {
+	if !self.FiltersSize() || !src.Type().IsRegular() {
+		return true
+	}
+	info, err := src.Info()
+	if err != nil {
+		return true
+	}
+	return self.SizeInBounds(ByteSize(info.Size()))
+}
+
+func (self RunState) FiltersSize() bool { return self.GetMinSize() > 0 || self.GetMaxSize() > 0 }
+
+func (self RunState) SizeInBounds(size ByteSize) bool {
+	max := self.GetMaxSize()
+	return size >= self.GetMinSize() && (max <= 0 || size <= max)
+}
+
+/*
+Returns the states that receive backups from this entry: one for each of the
+entry's own outputs, if any, which receive full backups on every change, and
+one per route. See `Route`. The first output reuses this state. Outputs with
+their own settings get them on top of the settings of the entry (see `Output`).
+*/
+func (self *RunState) Targets() (out []*RunState) {
+	entry := self.Entry
+	outputs := entry.GetOutputs()
+	for ind, output := range outputs {
+		tar := self
+		if ind > 0 {
+			val := *self
+			tar = &val
+		}
+		tar.Entry.Output = output
+		tar.Entry.CommonConfig = entry.OutputOf(output).Apply(entry.CommonConfig)
+		if self.Resolved != nil {
+			tar.StoreResolved()
+		}
+		if len(outputs) > 1 {
+			tar.Peers = outputs
+		}
+		out = append(out, tar)
+	}
+
+	for _, pattern := range gg.SortedPrim(gg.MapKeys(self.Entry.Routes)) {
+		tar := *self
+		tar.Entry.CommonConfig = entry.CommonConfig
+		if self.Resolved != nil {
+			tar.StoreResolved()
+		}
+		tar.Peers = nil
+		tar.Route = &Route{Pattern: pattern, Output: self.Entry.Routes[pattern]}
+		tar.Entry.Output = tar.Route.Output
+		out = append(out, &tar)
+	}
+	return
+}
+
+/*
+True if an FS event should cause a backup of this target, unless ignored due
+to throttling. Events of types not in `watchEvents` are ignored, since some
+watches, such as that of the input link, use all types. Events for excluded
+paths are ignored (see `RunState.Excludes`). Routed targets accept only events
+for matching paths.
+*/
+func (self *RunState) Accepts(eve notify.EventInfo) bool {
+	if eve == nil {
+		return true
+	}
+	if eve.Event()&self.GetWatchEvents() == 0 {
+		return false
+	}
+	if self.ExcludesEvent(eve.Path()) {
+		return false
+	}
+	if self.Route == nil {
+		return true
+	}
+	return matchGlob(self.Route.Pattern, inputRel(resolveInput(self.Entry.Input), eve.Path()))
+}
+
+func (self *RunState) Throttled() bool {
+	throttle := self.GetThrottle().Duration()
+	if throttle <= 0 || self.Latest.IsZero() {
+		return false
+	}
+
+	elapsed := self.GetClock().Since(self.Latest)
+	if elapsed < throttle {
+		logDecision(self, `ignoring FS event: elapsed time %v < throttle time %v`, elapsed, throttle)
+		self.Counters.Throttled++
+		return true
+	}
+	return false
+}
+
+/*
+Set by `SIGUSR1` and cleared by `SIGUSR2`; see `watchPause`. While paused, FS
+events are drained without triggering backups, and pending backups are skipped.
+Throttle state is preserved, and changes made while paused are backed up on the
+next FS event after resuming.
+*/
+var PAUSED gg.Atom[bool]
+
+func (self *RunState) Paused() bool {
+	if PAUSED.Load() {
+		logDecision(self, `ignoring FS event: backups are paused`)
+		return true
+	}
+	return false
+}
+
+func setPaused(val bool) {
+	if PAUSED.Swap(val) == val {
+		return
+	}
+	if val {
+		log.Println(`pausing backups`)
 	} else {
-		log.Println(err)
+		log.Println(`resuming backups`)
 	}
 }
 
-// Workaround for the lack of a text decoding method in `time.Duration`.
-type Duration time.Duration
+/*
+Adds the targets that should be backed up due to the given event to the set of
+pending targets, preserving order and avoiding duplicates.
+*/
+func pendingTargets(targets []*RunState, eve notify.EventInfo, pending []*RunState) []*RunState {
+	for _, tar := range targets {
+		if !tar.Accepts(eve) {
+			tar.Counters.Filtered++
+		} else if gg.Has(pending, tar) {
+			tar.Counters.Coalesced++
+		} else if !tar.Paused() && !tar.Throttled() {
+			pending = append(pending, tar)
+		}
+	}
+	return pending
+}
 
-func (self Duration) Duration() time.Duration { return time.Duration(self) }
+/*
+Routes changes under the entry's input to an additional output directory. A
+routed backup includes only the input files whose path relative to the input
+matches the pattern, and happens only when a matching path changes. Patterns
+are slash-separated, each segment using `filepath.Match` syntax; the segment "**"
+matches any number of segments. Different routes should use different output
+directories, since routed backups are indexed by the same input name.
+*/
+type Route struct {
+	Pattern string
+	Output  string
+}
 
-func (self Duration) String() string { return self.Duration().String() }
+func (self *Route) Includes(rel string, src fs.DirEntry) bool {
+	if self == nil || src.IsDir() {
+		return true
+	}
+	return matchGlob(self.Pattern, rel)
+}
 
-func (self *Duration) UnmarshalText(src []byte) error {
-	val, err := time.ParseDuration(gg.ToString(src))
-	if err == nil {
-		*self = Duration(val)
+/*
+Returns the slash-separated path relative to the input. Both paths are made
+absolute first, since FS events use absolute paths. Returns an empty string when
+the path is outside of the input.
+*/
+func inputRel(inp, path string) string {
+	inp = gg.Try1(filepath.Abs(inp))
+	path = gg.Try1(filepath.Abs(path))
+
+	rel, err := filepath.Rel(inp, path)
+	if err != nil || rel == `..` || strings.HasPrefix(rel, `..`+string(filepath.Separator)) {
+		return ``
 	}
-	return err
+	return filepath.ToSlash(rel)
 }
 
-func (self RunState) Initial() bool { return self.Latest.IsZero() }
+/*
+Detects the MIME type of a file from its first bytes, via
+`http.DetectContentType`. Returns an empty string for unreadable files, which
+excludes them from content-type-filtered backups.
+*/
+func detectContentType(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ``
+	}
+	defer file.Close()
+
+	var buf [CONTENT_SNIFF_LEN]byte
+	size, _ := io.ReadFull(file, buf[:])
+	return http.DetectContentType(buf[:size])
+}
+
+// Max number of bytes considered by `http.DetectContentType`.
+const CONTENT_SNIFF_LEN = 512
+
+/*
+Matches a MIME type such as "text/plain; charset=utf-8" against glob patterns
+such as "text/*" or "image/png". Parameters are ignored.
+*/
+func matchContentType(patterns []string, typ string) bool {
+	typ, _, _ = strings.Cut(typ, `;`)
+	typ = strings.TrimSpace(typ)
+	if typ == `` {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		ok, _ := filepath.Match(pattern, typ)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches a slash-separated path against a glob pattern. See `Route`.
+func matchGlob(pattern, path string) bool {
+	return matchGlobSegments(strings.Split(pattern, `/`), strings.Split(path, `/`))
+}
+
+func matchGlobSegments(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == `**` {
+			pattern = pattern[1:]
+			for ind := range gg.Iter(len(path) + 1) {
+				if matchGlobSegments(pattern, path[ind:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(path) <= 0 {
+			return false
+		}
+		ok, _ := filepath.Match(pattern[0], path[0])
+		if !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) <= 0
+}
+
+/*
+Resets per-backup state and starts a trace span for the backup, if tracing is
+enabled. Must be deferred via `gg.Finally(run.Start())`, so that the returned
+`Finish` records the outcome.
+*/
+func (self *RunState) Start() func(error) {
+	self.Started = time.Now()
+	self.Stats = CopyStats{}
+	self.Target = ``
+	self.Active = ``
+	self.Index = 0
+	self.Result = ``
+	self.Manifest = nil
+	self.Ancestors = nil
+	self.LinkDest = ``
+	self.Retention = nil
+	self.Span = self.Tracer.Start(`backup`)
+	self.Span.Set(`backup.entry`, self.Entry.JoinInputs())
+	return self.Finish
+}
+
+/*
+Records the outcome of a backup: ends its trace span and appends a record to
+its history. `Result` is set by `backup` for backups that were skipped, and
+left empty for successful ones.
+*/
+func (self *RunState) Finish(err error) {
+	if err != nil {
+		self.Result = RESULT_ERROR
+	} else if self.Result == `` {
+		self.Result = RESULT_OK
+	}
+
+	span := self.Span
+	self.Span = nil
+	span.Set(`backup.files`, self.Stats.Files)
+	span.Set(`backup.bytes`, self.Stats.Bytes)
+	span.Set(`backup.skipped`, self.Stats.Skipped)
+	span.Set(`backup.linked`, self.Stats.Linked)
+	span.Set(`backup.result`, self.Result)
+	if self.Retention != nil {
+		span.Set(`retention.error`, self.Retention.Error())
+	}
+	span.Set(`events.throttled`, self.Counters.Throttled)
+	span.Set(`events.coalesced`, self.Counters.Coalesced)
+	span.Set(`events.filtered`, self.Counters.Filtered)
+	span.Set(`backups.up_to_date`, self.Counters.UpToDate)
+	span.End(err)
+
+	logDecision(self, `counters: %v`, self.Counters)
+
+	METRICS.Finish(self)
+	appendHistory(self, err)
+	appendAudit(self, err)
+}
+
+/*
+Built-in defaults of the common config, the last source consulted by
+`RunState.Resolve`. Every optional field is set, except `DirMode`, where
+unset means the process umask.
+*/
+var DEFAULTS = CommonConfig{
+	Debounce:          gg.OptVal(DEFAULT_DEBOUNCE),
+	Deadline:          gg.OptVal(DEFAULT_DEADLINE),
+	Throttle:          gg.OptVal(DEFAULT_THROTTLE),
+	Limit:             gg.OptVal(uint64(DEFAULT_LIMIT)),
+	MaxAge:            gg.OptVal(Duration(0)),
+	MaxBytes:          gg.OptVal(ByteSize(0)),
+	IndexRadix:        gg.OptVal(uint64(INDEX_RADIX)),
+	IndexWidth:        gg.OptVal(uint64(DEFAULT_INDEX_WIDTH)),
+	IndexSep:          INDEX_SEP,
+	Naming:            NAMING_INDEX,
+	TimestampLayout:   TIMESTAMP_LAYOUT,
+	Manifest:          gg.OptVal(false),
+	VerifyOnStart:     gg.OptVal(false),
+	History:           gg.OptVal(false),
+	HistoryLimit:      gg.OptVal(uint64(DEFAULT_HISTORY_LIMIT)),
+	Zip:               gg.OptVal(false),
+	Staging:           gg.OptVal(false),
+	WatchInputLink:    gg.OptVal(false),
+	SkipActive:        gg.OptVal(Duration(0)),
+	Store:             gg.OptVal(false),
+	PreserveAcls:      gg.OptVal(false),
+	Incremental:       gg.OptVal(false),
+	FullEvery:         gg.OptVal(uint64(DEFAULT_FULL_EVERY)),
+	StartIndex:        gg.OptVal(Index(1)),
+	FileTimeout:       gg.OptVal(Duration(0)),
+	ContinueOnError:   gg.OptVal(false),
+	RecordSize:        gg.OptVal(false),
+	PreserveTimes:     gg.OptVal(true),
+	FirstRun:          FIRST_RUN_ADOPT,
+	Compress:          COMPRESS_NONE,
+	CompressLevel:     gg.OptVal(uint64(GZIP_LEVEL_DEFAULT)),
+	Archive:           ARCHIVE_NONE,
+	Encrypt:           gg.OptVal(Encryption{}),
+	Reflink:           REFLINK_AUTO,
+	Hardlink:          gg.OptVal(false),
+	Fsync:             gg.OptVal(true),
+	SkipUnchanged:     gg.OptVal(false),
+	Verify:            gg.OptVal(false),
+	IgnoreHidden:      gg.OptVal(false),
+	Symlinks:          SYMLINKS_COPY,
+	Concurrency:       gg.OptVal(uint64(runtime.GOMAXPROCS(0))),
+	RateLimit:         gg.OptVal(ByteRate(0)),
+	CopyBufferSize:    gg.OptVal(ByteSize(0)),
+	ProgressThreshold: gg.OptVal(DEFAULT_PROGRESS_THRESHOLD),
+	ProgressInterval:  gg.OptVal(DEFAULT_PROGRESS_INTERVAL),
+	CheckSpace:        gg.OptVal(true),
+	SpaceMargin:       gg.OptVal(DEFAULT_SPACE_MARGIN),
+	MinSize:           gg.OptVal(ByteSize(0)),
+	MaxSize:           gg.OptVal(ByteSize(0)),
+}
+
+/*
+Returns the common config of the entry with every option resolved. Each option
+is taken from the first source that sets it: the entry, the top level of the
+config file with the environment applied over it (see `readEnv`), the CLI flags
+(see `Flags.Defaults`), and finally `DEFAULTS`. `newRunState` stores the result
+(see `RunState.StoreResolved`), so that the options of a running entry are
+resolved once per config load.
+*/
+func (self RunState) Resolve() CommonConfig {
+	return resolveConfig(self.Entry.CommonConfig, self.Config.CommonConfig, FLAGS.Defaults, DEFAULTS)
+}
+
+// Resolves the options of the entry and stores them for `RunState.Options`.
+func (self *RunState) StoreResolved() {
+	val := self.Resolve()
+	self.Entry.CommonConfig = val
+	self.Resolved = &val
+}
+
+/*
+Returns the resolved options used by the getters below: the stored ones, if
+any, otherwise resolved on the spot, which is the case for states not made by
+`newRunState`, such as in one-off commands.
+*/
+func (self RunState) Options() *CommonConfig {
+	if self.Resolved != nil {
+		return self.Resolved
+	}
+	val := self.Resolve()
+	return &val
+}
+
+/*
+Merges the given configs, in order of precedence. For each field, uses the
+first non-zero value. For `gg.Opt` fields, any set value is non-zero, even when
+the underlying value is zero, such as `false`.
+*/
+func resolveConfig(src ...CommonConfig) (out CommonConfig) {
+	tar := reflect.ValueOf(&out).Elem()
+
+	for ind := 0; ind < tar.NumField(); ind++ {
+		for _, conf := range src {
+			val := reflect.ValueOf(conf).Field(ind)
+			if !val.IsZero() {
+				tar.Field(ind).Set(val)
+				break
+			}
+		}
+	}
+	return
+}
+
+func (self RunState) GetDebounce() Duration { return self.Options().Debounce.Val }
+
+func (self RunState) GetDeadline() Duration { return self.Options().Deadline.Val }
+
+func (self RunState) GetThrottle() Duration { return self.Options().Throttle.Val }
+
+func (self RunState) GetLimit() uint64 { return self.Options().Limit.Val }
+
+func (self RunState) GetMaxAge() Duration { return self.Options().MaxAge.Val }
+
+func (self RunState) GetMaxBytes() ByteSize { return self.Options().MaxBytes.Val }
+
+func (self RunState) GetWatchEvents() notify.Event {
+	src := self.Options().WatchEvents
+	if len(src) <= 0 {
+		return notify.All
+	}
+
+	var out notify.Event
+	for _, val := range src {
+		out |= notify.Event(val)
+	}
+	return out
+}
+
+func (self RunState) GetManifest() bool { return self.Options().Manifest.Val }
+
+func (self RunState) GetVerifyOnStart() bool { return self.Options().VerifyOnStart.Val }
+
+func (self RunState) GetHealthFile() string { return self.Options().HealthFile }
+
+func (self RunState) GetCopyCommand() Command { return self.Options().CopyCommand }
+
+func (self RunState) GetPostHook() Command { return self.Options().PostHook }
+
+func (self RunState) GetContentTypes() []string { return self.Options().ContentTypes }
+
+func (self RunState) GetDirMode() gg.Opt[FileMode] { return self.Options().DirMode }
+
+func (self RunState) GetZip() bool { return self.Options().Zip.Val }
+
+func (self RunState) GetStaging() bool { return self.Options().Staging.Val }
+
+func (self RunState) GetWatchInputLink() bool { return self.Options().WatchInputLink.Val }
+
+func (self RunState) GetSkipActive() Duration { return self.Options().SkipActive.Val }
+
+func (self RunState) GetStore() bool { return self.Options().Store.Val }
+
+func (self RunState) GetPreserveAcls() bool { return self.Options().PreserveAcls.Val }
+
+func (self RunState) GetIncremental() bool { return self.Options().Incremental.Val }
+
+func (self RunState) GetFullEvery() uint64 { return self.Options().FullEvery.Val }
+
+func (self RunState) GetStartIndex() Index { return self.Options().StartIndex.Val }
+
+func (self RunState) GetFileTimeout() Duration { return self.Options().FileTimeout.Val }
+
+func (self RunState) GetContinueOnError() bool { return self.Options().ContinueOnError.Val }
+
+func (self RunState) GetRecordSize() bool { return self.Options().RecordSize.Val }
+
+func (self RunState) GetPreserveTimes() bool { return self.Options().PreserveTimes.Val }
+
+func (self RunState) GetFirstRun() string { return self.Options().FirstRun }
+
+func (self RunState) GetCompress() string { return self.Options().Compress }
+
+func (self RunState) GetCompressLevel() uint64 { return self.Options().CompressLevel.Val }
+
+func (self RunState) GetArchive() string { return self.Options().Archive }
+
+func (self RunState) GetEncrypt() Encryption { return self.Options().Encrypt.Val }
 
-func (self RunState) GetDebounce() Duration {
-	return optGet(optCoalesce(self.Entry.Debounce, self.Config.Debounce), DEFAULT_DEBOUNCE)
+func (self RunState) GetReflink() string { return self.Options().Reflink }
+
+func (self RunState) GetHardlink() bool { return self.Options().Hardlink.Val }
+
+func (self RunState) GetFsync() bool { return self.Options().Fsync.Val }
+
+func (self RunState) GetSkipUnchanged() bool { return self.Options().SkipUnchanged.Val }
+
+func (self RunState) GetVerify() bool { return self.Options().Verify.Val }
+
+func (self RunState) GetIgnoreHidden() bool { return self.Options().IgnoreHidden.Val }
+
+func (self RunState) GetSymlinks() string { return self.Options().Symlinks }
+
+func (self RunState) GetConcurrency() uint64 { return self.Options().Concurrency.Val }
+
+func (self RunState) GetRateLimit() ByteRate { return self.Options().RateLimit.Val }
+
+func (self RunState) GetCopyBufferSize() ByteSize { return self.Options().CopyBufferSize.Val }
+
+func (self RunState) GetProgressThreshold() ByteSize {
+	return self.Options().ProgressThreshold.Val
+}
+
+func (self RunState) GetProgressInterval() Duration {
+	return self.Options().ProgressInterval.Val
+}
+
+func (self RunState) GetCheckSpace() bool { return self.Options().CheckSpace.Val }
+
+func (self RunState) GetSpaceMargin() ByteSize { return self.Options().SpaceMargin.Val }
+
+func (self RunState) GetMinSize() ByteSize { return self.Options().MinSize.Val }
+
+func (self RunState) GetMaxSize() ByteSize { return self.Options().MaxSize.Val }
+
+func (self RunState) GetHistory() bool { return self.Options().History.Val }
+
+func (self RunState) GetHistoryLimit() uint64 { return self.Options().HistoryLimit.Val }
+
+func (self RunState) GetIndexRadix() uint64 { return self.Options().IndexRadix.Val }
+
+func (self RunState) GetNaming() string { return self.Options().Naming }
+
+func (self RunState) GetTimestampLayout() string { return self.Options().TimestampLayout }
+
+func (self RunState) GetIndexWidth() uint64 { return self.Options().IndexWidth.Val }
+
+func (self RunState) GetIndexSep() string { return self.Options().IndexSep }
+
+func (self RunState) GetIndexFormat() IndexFormat {
+	return IndexFormat{
+		Radix:  int(gg.MinPrim2(self.GetIndexRadix(), INDEX_RADIX_MAX+1)),
+		Width:  int(gg.MinPrim2(self.GetIndexWidth(), uint64(INDEX_WIDTH_MAX+1))),
+		Sep:    self.GetIndexSep(),
+		Naming: self.GetNaming(),
+		Layout: self.GetTimestampLayout(),
+	}
+}
+
+/*
+Returns warnings about combinations of options which are valid, but silently
+degrade behavior. Logged whenever an entry starts, and printed by `-check`.
+*/
+func (self RunState) Warnings() (out []string) {
+	debounce := self.GetDebounce()
+	deadline := self.GetDeadline()
+	throttle := self.GetThrottle()
+
+	if debounce > 0 && throttle > 0 && throttle < debounce {
+		out = append(out, gg.Str(
+			`throttle `, throttle, ` is shorter than debounce `, debounce,
+			`, so it has no effect: backups are already at least the debounce time apart`,
+		))
+	}
+
+	if debounce > 0 && deadline > 0 && deadline < debounce {
+		out = append(out, gg.Str(
+			`deadline `, deadline, ` is shorter than debounce `, debounce,
+			`, so debounce has no effect: every backup waits for the deadline`,
+		))
+	}
+
+	if self.GetLimit() == 1 && (self.GetManifest() || self.GetVerifyOnStart()) {
+		out = append(out, `limit 1 with "manifest" or "verifyOnStart" leaves no fallback: `+
+			`when the only backup fails verification, there's no older one to restore`)
+	}
+
+	if self.GetMaxAge() > 0 && (self.GetZip() || self.GetIncremental()) {
+		out = append(out, `"maxAge" has no effect with "zip" or "incremental", which are retained only by "limit"`)
+	}
+	return
+}
+
+func logWarnings(run RunState) {
+	for _, val := range run.Warnings() {
+		log.Printf(`warning: entry %v: %v`, fmtPath(run.Entry.GetName()), val)
+	}
 }
 
-func (self RunState) GetDeadline() Duration {
-	return optGet(optCoalesce(self.Entry.Deadline, self.Config.Deadline), DEFAULT_DEADLINE)
+/*
+Implementation of `-check`. Prints warnings for the entries matching the
+`-entry` patterns, if any, or for all entries.
+*/
+func cmdCheck(args []string) {
+	if len(args) > 0 {
+		panic(gg.Errf(`unexpected arguments: %q`, args))
+	}
+
+	conf := readValidConfig()
+	var count int
+
+	for _, entry := range conf.Entries {
+		if !entry.Match(FLAGS.Entries) {
+			continue
+		}
+		run := RunState{Config: conf, Entry: entry}
+		logWarnings(run)
+		count += len(run.Warnings())
+	}
+
+	if count <= 0 {
+		log.Printf(`no warnings in %v`, fmtPath(FLAGS.Config))
+	}
 }
 
-func (self RunState) GetThrottle() Duration {
-	return optGet(optCoalesce(self.Entry.Throttle, self.Config.Throttle), DEFAULT_THROTTLE)
+// Config overrides from environment variables. See `readEnv`.
+var ENV CommonConfig
+
+/*
+Reads config overrides from the environment variables `BACKUP_DEBOUNCE`,
+`BACKUP_DEADLINE`, `BACKUP_THROTTLE` and `BACKUP_LIMIT`, for deployments where
+the config file is baked into an image. `readConfig` applies them over the top
+level of the config file, but not over the settings of entries. Empty variables
+are ignored.
+*/
+func readEnv(get func(string) string) (out CommonConfig) {
+	envOpt(get, `BACKUP_DEBOUNCE`, &out.Debounce)
+	envOpt(get, `BACKUP_DEADLINE`, &out.Deadline)
+	envOpt(get, `BACKUP_THROTTLE`, &out.Throttle)
+	envOpt(get, `BACKUP_LIMIT`, &out.Limit)
+	return
 }
 
-func (self RunState) GetLimit() uint64 {
-	return optGet(optCoalesce(self.Entry.Limit, self.Config.Limit), DEFAULT_LIMIT)
+func envOpt[A any](get func(string) string, key string, tar *gg.Opt[A]) {
+	src := get(key)
+	if src == `` {
+		return
+	}
+	defer gg.Detailf(`unable to decode environment variable %v=%q`, key, src)
+	gg.Try(tar.Parse(src))
 }
 
-func optCoalesce[A any](src ...gg.Opt[A]) gg.Opt[A] {
-	return gg.Find(src, gg.Opt[A].IsNotNull)
+// Name of a `notify` event type, used in config. See `WATCH_EVENTS`.
+type WatchEvent notify.Event
+
+var WATCH_EVENTS = map[string]notify.Event{
+	`create`: notify.Create,
+	`write`:  notify.Write,
+	`remove`: notify.Remove,
+	`rename`: notify.Rename,
 }
 
-func optGet[A any](src gg.Opt[A], def A) A {
-	if src.Ok {
-		return src.Val
+func (self *WatchEvent) UnmarshalText(src []byte) error {
+	val, ok := WATCH_EVENTS[gg.ToString(src)]
+	if !ok {
+		return gg.Errf(
+			`unknown watch event %q, expected one of: %q`,
+			src, gg.SortedPrim(gg.MapKeys(WATCH_EVENTS)),
+		)
 	}
-	return def
+	*self = WatchEvent(val)
+	return nil
 }
 
 /*
@@ -376,63 +2945,266 @@ func fileNameSplit(src string) (string, string) {
 	if base == `` {
 		return ext, ``
 	}
-	return base, ext
+	return base, ext
+}
+
+// Difference from `os.ReadDir`: returns `[]string`, not `[]os.FileInfo`.
+func readDir(path string) []string {
+	defer gg.SkipOnly(isErrFileNotFound)
+	file := gg.Try1(os.OpenFile(path, os.O_RDONLY, os.ModePerm))
+	defer file.Close()
+	return gg.Try1(file.Readdirnames(-1))
+}
+
+func isErrFileNotFound(err error) bool { return errors.Is(err, os.ErrNotExist) }
+
+const INDEX_SEP = `_`
+
+const INDEX_RADIX = 10
+
+const INDEX_RADIX_MIN = 2
+
+const INDEX_RADIX_MAX = 36
+
+const INDEX_MAX = Index(math.MaxUint64)
+
+var INDEX_WIDTH = INDEX_MAX.Width()
+
+// Width of the largest index in the smallest radix.
+var INDEX_WIDTH_MAX = Index(math.MaxUint64).WidthIn(INDEX_RADIX_MIN)
+
+const DEFAULT_INDEX_WIDTH = 6
+
+type Index uint64
+
+/*
+Returns the index of the backup following the given one, or `startIndex` when
+there's no previous backup, for any backup mode. Zero is not a valid index, so
+the start index is at least 1. Later backups continue from the previous index,
+so retention works as usual, and width and padding depend only on the radix.
+With timestamp naming, returns the current time instead. See `NAMING_TIMESTAMP`.
+
+When the previous index is the largest possible one, such as after a manual
+rename or a huge `startIndex`, there's no next index, and the backup fails with
+an error explaining how to fix the output directory, rather than wrapping
+around and overwriting the oldest backups.
+*/
+func (self RunState) NextIndex(prev Index) Index {
+	if format := self.GetIndexFormat(); format.IsTimestamp() {
+		return format.NextTimestamp(prev, self.GetClock().Now())
+	}
+	if prev == 0 {
+		return gg.MaxPrim2(self.GetStartIndex(), 1)
+	}
+	if prev >= INDEX_MAX {
+		panic(errIndexOverflow(self.Entry.Output, prev))
+	}
+	return prev + 1
+}
+
+func errIndexOverflow(dir string, prev Index) error {
+	return gg.Errf(
+		`unable to index the next backup in %v: the latest backup has the largest possible index %v; move the existing backups elsewhere, or rename them with smaller indices`,
+		fmtPath(dir), uint64(prev),
+	)
+}
+
+/*
+For entries with several outputs (see `Entry.Outputs`): before a round of
+backups, finds the highest index among the backups in all outputs, which the
+new backups continue from. Every output then gets the same index for the same
+backup, even when some of them missed earlier backups, for example because they
+were unmounted. Outputs which can't be read are ignored: their own backups
+report the problem. The backups in each output are found by its own name, which
+depends on its format (see `Output`).
+*/
+func reservePeerIndex(targets []*RunState) {
+	for _, tar := range targets {
+		tar.PeerMax = 0
+
+		for _, dir := range tar.Peers {
+			_ = gg.Catch(func() {
+				// Listing remote outputs requires connecting to them.
+				if _, ok := parseRemote(dir); ok {
+					return
+				}
+
+				peer := gg.Find(targets, func(val *RunState) bool {
+					return val.Route == nil && val.Entry.Output == dir
+				})
+				inp := gg.Or(peer, tar).BackupName()
+
+				for _, val := range relatedNames(dir, inp) {
+					tar.PeerMax = gg.MaxPrim2(tar.PeerMax, val.Index)
+				}
+			})
+		}
+	}
+}
+
+func (self Index) String() string { return self.Encode(INDEX_RADIX) }
+
+/*
+Encodes the index in the given radix, zero-padded to the width of the largest
+possible index in that radix, so that lexicographic order of encoded indices
+matches their numeric order.
+*/
+func (self Index) Encode(radix int) string { return self.Pad(radix, indexWidth(radix)) }
+
+/*
+Encodes the index in the given radix, zero-padded to the given width. Indices
+wider than that are not truncated.
+*/
+func (self Index) Pad(radix, width int) string {
+	missing := width - self.WidthIn(radix)
+	if missing <= 0 {
+		return strconv.FormatUint(uint64(self), radix)
+	}
+
+	buf := make(gg.Buf, width)
+	for ind := range gg.Iter(missing) {
+		buf[ind] = '0'
+	}
+	strconv.AppendUint(buf[missing:missing], uint64(self), radix)
+	return buf.String()
+}
+
+func (self Index) Width() int { return self.WidthIn(INDEX_RADIX) }
+
+func (self Index) WidthIn(radix int) (out int) {
+	if self == 0 {
+		return 1
+	}
+	for self > 0 {
+		out++
+		self /= Index(radix)
+	}
+	return
 }
 
-// Difference from `os.ReadDir`: returns `[]string`, not `[]os.FileInfo`.
-func readDir(path string) []string {
-	defer gg.SkipOnly(isErrFileNotFound)
-	file := gg.Try1(os.OpenFile(path, os.O_RDONLY, os.ModePerm))
-	defer file.Close()
-	return gg.Try1(file.Readdirnames(-1))
+func indexWidth(radix int) int {
+	if radix == INDEX_RADIX {
+		return INDEX_WIDTH
+	}
+	return Index(math.MaxUint64).WidthIn(radix)
 }
 
-func isErrFileNotFound(err error) bool { return errors.Is(err, os.ErrNotExist) }
+/*
+Settings that determine how indices are encoded into and decoded from file
+names. Zero values mean defaults, except for `Width`, where zero means the
+width of the largest possible index. `Sep`, `Naming` and `Layout` are the
+config options `indexSep`, `naming` and `timestampLayout`.
+*/
+type IndexFormat struct {
+	Radix  int
+	Width  int
+	Sep    string
+	Naming string
+	Layout string
+}
 
-const INDEX_SEP = `_`
+func (self IndexFormat) GetRadix() int { return gg.Or(self.Radix, INDEX_RADIX) }
 
-const INDEX_RADIX = 10
+// Returns the separator between the name of the input and the index.
+func (self IndexFormat) GetSep() string { return gg.Or(self.Sep, INDEX_SEP) }
+
+/*
+Returns the width to which indices are padded. Indices which outgrow it, such as
+the index 1000000 with the width 6, are wider, and sort after narrower ones by
+`Index`, but not lexicographically. Decoding accepts any padding, so backups
+made with another width continue one sequence.
+*/
+func (self IndexFormat) GetWidth() int { return gg.Or(self.Width, indexWidth(self.GetRadix())) }
 
-var INDEX_WIDTH = Index(math.MaxUint64).Width()
+func (self IndexFormat) Validate() {
+	radix := self.GetRadix()
+	if radix < INDEX_RADIX_MIN || radix > INDEX_RADIX_MAX {
+		panic(gg.Errf(`invalid index radix %v: must be between %v and %v`, radix, INDEX_RADIX_MIN, INDEX_RADIX_MAX))
+	}
 
-type Index uint64
+	sep := self.GetSep()
+	if strings.ContainsAny(sep, `/\`) || strings.Trim(sep, `.`) == `` {
+		panic(gg.Errf(`invalid index separator %q: must not contain slashes or consist of dots`, sep))
+	}
 
-func (self Index) String() string {
-	missing := INDEX_WIDTH - self.Width()
-	if missing <= 0 {
-		return strconv.FormatUint(uint64(self), INDEX_RADIX)
+	width := self.GetWidth()
+	if width > indexWidth(radix) {
+		panic(gg.Errf(`invalid index width %v: must be at most %v, the width of the largest index in radix %v`, width, indexWidth(radix), radix))
 	}
+	self.validateNaming()
+}
 
-	buf := make(gg.Buf, INDEX_WIDTH)
-	for ind := range gg.Iter(missing) {
-		buf[ind] = '0'
+func (self IndexFormat) EncodeIndex(val Index) string {
+	if self.IsTimestamp() {
+		return self.encodeTimestamp(val)
 	}
-	strconv.AppendUint(buf[missing:missing], uint64(self), INDEX_RADIX)
-	return buf.String()
+	return val.Pad(self.GetRadix(), self.GetWidth())
 }
 
-func (self Index) Width() (out int) {
-	if self == 0 {
-		return 1
+/*
+Returns the smallest index after the given one which encodes differently. Used
+for renumbering backups.
+*/
+func (self IndexFormat) Successor(prev Index) Index {
+	if self.IsTimestamp() {
+		return self.NextTimestamp(prev, time.Time{})
 	}
-	for self > 0 {
-		out++
-		self /= INDEX_RADIX
+	if prev >= INDEX_MAX {
+		panic(gg.Errf(`index %v is the largest possible, and has no successor`, uint64(prev)))
 	}
+	return prev + 1
+}
+
+func (self IndexFormat) Parse(src string) (out IndexedName) {
+	out.IndexFormat = self
+	out.Decode(src)
 	return
 }
 
+/*
+Decodes an encoded index. In radixes above 10, index digits include letters,
+which makes ordinary words look like indices. To avoid misinterpreting names
+like "notes_draft.txt", such indices are accepted only when they're at least as
+wide as the padding.
+*/
+func (self IndexFormat) DecodeIndex(src string) (Index, bool) {
+	if self.IsTimestamp() {
+		return self.decodeTimestamp(src)
+	}
+
+	radix := self.GetRadix()
+	if radix > INDEX_RADIX && len(src) < self.GetWidth() {
+		return 0, false
+	}
+
+	val, err := strconv.ParseUint(src, radix, 64)
+	if err != nil {
+		return 0, false
+	}
+	return Index(val), true
+}
+
+/*
+Name of a backup, such as "app_<index>.log". `Compress` is the suffix of
+compressed single-file backups, such as ".gz", which follows the extension.
+`Encrypt` is the suffix of encrypted single-file backups, which follows the
+compression suffix. Neither affects relatedness, so compressed, encrypted and
+plain backups form one sequence. See `COMPRESS_GZIP` and `Encryption`.
+*/
 type IndexedName struct {
-	Name  string
-	Index Index
-	Ext   string
+	IndexFormat
+	Name     string
+	Index    Index
+	Ext      string
+	Compress string
+	Encrypt  string
 }
 
 func (self IndexedName) String() string {
 	if self.Index == 0 {
-		return self.Name + self.Ext
+		return self.Name + self.Ext + self.Compress + self.Encrypt
 	}
-	return self.Name + INDEX_SEP + self.Index.String() + self.Ext
+	return self.Name + self.GetSep() + self.EncodeIndex(self.Index) + self.Ext + self.Compress + self.Encrypt
 }
 
 func (self *IndexedName) UnmarshalText(src []byte) error {
@@ -441,33 +3213,56 @@ func (self *IndexedName) UnmarshalText(src []byte) error {
 }
 
 func (self *IndexedName) Decode(src string) {
+	self.Encrypt = ``
+	if strings.HasSuffix(src, ENC_EXT) && len(src) > len(ENC_EXT) {
+		self.Encrypt = ENC_EXT
+		src = strings.TrimSuffix(src, ENC_EXT)
+	}
+
+	self.Compress = ``
+	if strings.HasSuffix(src, GZIP_EXT) && len(src) > len(GZIP_EXT) {
+		self.Compress = GZIP_EXT
+		src = strings.TrimSuffix(src, GZIP_EXT)
+	}
+
 	name, ext := fileNameSplit(gg.ToString(src))
-	if name == `` {
-		self.Name = name
-		self.Index = 0
-		self.Ext = ext
-		return
+	sep := self.GetSep()
+
+	if name != `` {
+		// With a separator containing a dot, such as ".v", the index of a name
+		// without an extension, such as "notes.v000003", looks like one.
+		if strings.HasPrefix(ext, sep) && self.decodeIndexed(name, ext[len(sep):], ``) {
+			return
+		}
+
+		// The last separator, so that the base may contain separators.
+		ind := strings.LastIndex(name, sep)
+		if ind >= 0 && self.decodeIndexed(name[:ind], name[ind+len(sep):], ext) {
+			return
+		}
 	}
 
-	ind := strings.LastIndex(name, INDEX_SEP)
-	if ind < 0 {
-		self.Name = name
-		self.Index = 0
-		self.Ext = ext
-		return
+	self.Name = name
+	self.Index = 0
+	self.Ext = ext
+}
+
+func (self *IndexedName) decodeIndexed(name, digits, ext string) bool {
+	val, ok := self.DecodeIndex(digits)
+	if !ok {
+		return false
 	}
 
-	val, err := strconv.ParseUint(name[ind+len(INDEX_SEP):], INDEX_RADIX, 64)
-	if err != nil {
-		self.Name = name
-		self.Index = 0
-		self.Ext = ext
-		return
+	// Preserves other padding, such as from before a change of "indexWidth",
+	// so that the name encodes back to the same file.
+	if !self.IsTimestamp() && len(digits) != self.GetWidth() {
+		self.Width = len(digits)
 	}
 
-	self.Name = name[:ind]
-	self.Index = Index(val)
+	self.Name = name
+	self.Index = val
 	self.Ext = ext
+	return true
 }
 
 func (self IndexedName) Related(tar IndexedName) bool {
@@ -478,17 +3273,37 @@ func (self IndexedName) Less(tar IndexedName) bool {
 	return self.Index < tar.Index
 }
 
+/*
+True if the given backup is newer than the input, or, when times are preserved
+(see `copyTimes`), equally new.
+*/
+func isUpToDate(run *RunState, path string) bool {
+	return isUpToDateAt(run, maxModTime(path, nil), 0)
+}
+
+/*
+Like `isUpToDate`, for a backup with the given modification time, whose times
+may be truncated to the given precision, such as over SFTP.
+*/
+func isUpToDateAt(run *RunState, prevTime time.Time, prec time.Duration) bool {
+	nextTime := inputModTime(run)
+	return prevTime.After(nextTime) || (run.GetPreserveTimes() && prevTime.Equal(nextTime.Truncate(prec)))
+}
+
 /*
 Note: despite its name, `filepath.WalkDir` also supports walking a single file.
 This function should work for both directory backups and single file backups.
 */
-func maxModTime(src string) (out time.Time) {
+func maxModTime(src string, filter PathFilter) (out time.Time) {
 	gg.Try(filepath.WalkDir(
 		src,
-		func(_ string, src fs.DirEntry, _ error) error {
+		func(path string, src fs.DirEntry, _ error) error {
 			if src == nil {
 				return nil
 			}
+			if !filter.Includes(path, src) {
+				return skipEntry(src)
+			}
 
 			info, _ := src.Info()
 			if info == nil {
@@ -505,44 +3320,543 @@ func maxModTime(src string) (out time.Time) {
 	return
 }
 
+/*
+Decides which input paths a backup includes. Excluding a directory excludes its
+whole subtree. A nil filter includes everything.
+*/
+type PathFilter func(path string, src fs.DirEntry) bool
+
+func (self PathFilter) Includes(path string, src fs.DirEntry) bool {
+	return self == nil || self(path, src)
+}
+
+// For `filepath.WalkDir` callbacks: skips an excluded entry.
+func skipEntry(src fs.DirEntry) error {
+	if src.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// Returns the name of the backups of the entry, without an index.
+func (self RunState) BackupName() IndexedName {
+	if self.GetIncremental() {
+		return self.IncrementalName()
+	}
+	if self.Archived() {
+		return self.ArchiveName()
+	}
+	if self.MultiInput() {
+		return self.GetIndexFormat().Parse(self.Entry.Name)
+	}
+	return self.GetIndexFormat().Parse(self.Entry.Input)
+}
+
 func relatedNames(dir string, inp IndexedName) (out []IndexedName) {
-	out = gg.Map(readDir(dir), gg.ParseTo[IndexedName, string])
+	out = gg.Map(readDir(dir), inp.IndexFormat.Parse)
 	out = gg.Filter(out, inp.Related)
 	return
 }
 
-func copyRecursive(src, tar, dir string) {
-	if gg.Try1(os.Stat(src)).IsDir() {
-		copyDirRecursive(src, tar)
+const DRY_RUN_PREFIX = `[dry run]`
+
+type FileStat struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+type FileDiff struct {
+	Added    []string
+	Modified []string
+	Removed  []string
+}
+
+func (self FileDiff) IsEmpty() bool {
+	return len(self.Added) <= 0 && len(self.Modified) <= 0 && len(self.Removed) <= 0
+}
+
+/*
+Compares the input tree against a previous backup by relative path, size, and
+modification time. A file counts as modified when its size differs, or when
+the input is newer than the backup. This mirrors the up-to-date check in
+`backup`, and works regardless of whether the backup preserved source
+timestamps. An empty `prev` means there's no previous backup, and every input
+file counts as added.
+*/
+func diffFiles(inp, prev string, filter PathFilter) (out FileDiff) {
+	inpStats := fileStats(inp, filter)
+	prevStats := map[string]FileStat{}
+	if prev != `` {
+		prevStats = backupStats(prev)
+	}
+
+	for _, key := range gg.SortedPrim(gg.MapKeys(inpStats)) {
+		inpStat := inpStats[key]
+		prevStat, ok := prevStats[key]
+		if !ok {
+			out.Added = append(out.Added, key)
+		} else if inpStat.Size != prevStat.Size || inpStat.ModTime.After(prevStat.ModTime) {
+			out.Modified = append(out.Modified, key)
+		}
+	}
+
+	for _, key := range gg.SortedPrim(gg.MapKeys(prevStats)) {
+		if _, ok := inpStats[key]; !ok {
+			out.Removed = append(out.Removed, key)
+		}
+	}
+	return
+}
+
+/*
+Maps relative file paths to their sizes and modification times. For a single
+file, the only key is ".". Directories are not included.
+*/
+func fileStats(root string, filter PathFilter) map[string]FileStat {
+	defer gg.SkipOnly(isErrFileNotFound)
+	out := map[string]FileStat{}
+
+	gg.Try(filepath.WalkDir(root, func(path string, src fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !filter.Includes(path, src) {
+			return skipEntry(src)
+		}
+		if src.IsDir() {
+			return nil
+		}
+
+		info := gg.Try1(src.Info())
+		out[filepath.ToSlash(gg.Try1(filepath.Rel(root, path)))] = FileStat{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		return nil
+	}))
+	return out
+}
+
+/*
+Like `fileStats` for a backup. For a stored backup, reads its manifest, using
+the backup creation time as the modification time of every file.
+*/
+func backupStats(path string) map[string]FileStat {
+	manifest := readStored(path)
+	if manifest == nil {
+		return fileStats(path, nil)
+	}
+
+	out := map[string]FileStat{}
+	for key, val := range manifest.Files {
+		out[key] = FileStat{Size: gg.NumConv[int64](val.Size), ModTime: manifest.Created}
+	}
+	return out
+}
+
+func logDiff(run *RunState, prev, next string) {
+	inp := run.Entry.Input
+	diff := diffFiles(inp, prev, run.Includes)
+
+	if prev == `` {
+		log.Printf(`%v would back up %v to %v (no previous backup)`, DRY_RUN_PREFIX, fmtPath(inp), fmtPath(next))
 	} else {
-		gg.Try(os.MkdirAll(dir, os.ModePerm))
-		copyFile(src, tar)
+		log.Printf(`%v would back up %v to %v, changes since %v:`, DRY_RUN_PREFIX, fmtPath(inp), fmtPath(next), fmtPath(prev))
+	}
+
+	if diff.IsEmpty() {
+		log.Printf(`%v   no changes`, DRY_RUN_PREFIX)
+		return
+	}
+
+	for _, path := range diff.Added {
+		log.Printf(`%v   added    %v`, DRY_RUN_PREFIX, fmtPath(path))
+	}
+	for _, path := range diff.Modified {
+		log.Printf(`%v   modified %v`, DRY_RUN_PREFIX, fmtPath(path))
+	}
+	for _, path := range diff.Removed {
+		log.Printf(`%v   removed  %v`, DRY_RUN_PREFIX, fmtPath(path))
+	}
+}
+
+/*
+Copies a file or directory input into the backup. In dry run mode, only logs
+the copies. See `Flags.DryRun`.
+*/
+func copyRecursive(run *RunState, src, tar, dir string) {
+	run.CheckStopped()
+	info := gg.Try1(os.Lstat(src))
+	if isSymlink(info) && (src == run.Entry.Input || run.GetSymlinks() == SYMLINKS_FOLLOW) {
+		info = followSymlink(run, src)
+		if info == nil {
+			return
+		}
+	}
+	if !run.Includes(src, fs.FileInfoToDirEntry(info)) {
+		return
+	}
+
+	if isSymlink(info) {
+		copySymlink(run, src, tar, dir)
+		return
+	}
+
+	if info.IsDir() {
+		copyDirRecursive(run, src, tar)
+		return
+	}
+
+	// The name of a single-file backup already has the suffixes.
+	if src != run.Entry.Input {
+		tar += run.CompressExt() + run.EncryptExt()
+	}
+
+	if FLAGS.DryRun {
+		log.Printf(`%v would copy %v to %v`, DRY_RUN_PREFIX, fmtPath(src), fmtPath(tar))
+		run.AddStats(CopyStats{Files: 1, Bytes: uint64(info.Size())})
+		return
+	}
+
+	run.MkdirAll(dir)
+
+	// Workers use a copy of the run state, since the walk keeps modifying it,
+	// such as `RunState.Ancestors`. See `RunState.AddStats`.
+	job := run
+	if run.Pool != nil {
+		job = gg.Ptr(*run)
 	}
+	run.Pool.Go(func() { copyFileOrSkip(job, src, tar) })
 }
 
-func copyDirRecursive(srcDir, tarDir string) {
+/*
+Creates the target directory before copying its contents, so that empty
+directories, including an empty input, are preserved. An empty input still
+produces a new indexed backup, which keeps indexing consistent. When files are
+filtered (see `RunState.FiltersFiles`), nested directories are created lazily,
+only for included files, avoiding empty directories for filtered-out subtrees.
+*/
+func copyDirRecursive(run *RunState, srcDir, tarDir string) {
+	if !FLAGS.DryRun && (!run.FiltersFiles() || srcDir == run.Entry.Input) {
+		run.MkdirAll(tarDir)
+	}
+
+	if run.GetSymlinks() == SYMLINKS_FOLLOW {
+		run.Ancestors = append(run.Ancestors, gg.Try1(filepath.EvalSymlinks(srcDir)))
+		defer func() { run.Ancestors = run.Ancestors[:len(run.Ancestors)-1] }()
+	}
+
 	for _, name := range readDir(srcDir) {
 		copyRecursive(
+			run,
 			filepath.Join(srcDir, name),
 			filepath.Join(tarDir, name),
 			tarDir,
 		)
 	}
+
+	// With a copy pool, the contents are still being written, so this waits
+	// until they're done. See `CopyPool`.
+	run.Pool.Defer(func() {
+		// Applied last, so that restrictive permissions or ACLs can't prevent
+		// copying the contents.
+		if !run.GetDirMode().Ok && gg.DirExists(tarDir) {
+			copyMode(srcDir, tarDir)
+		}
+		if run.GetPreserveAcls() && gg.DirExists(tarDir) {
+			copyAcl(srcDir, tarDir)
+		}
+
+		// Writing the contents changes the time of the directory, so it's
+		// copied after them. Since subdirectories are copied first, times are
+		// applied bottom-up.
+		if run.GetPreserveTimes() && gg.DirExists(tarDir) {
+			copyTimes(srcDir, tarDir)
+		}
+	})
+}
+
+/*
+Sets the access and modification times of the target to the modification time
+of the source. Used with the config option `preserveTimes`. Preserved times
+make the backup exactly as new as its input, which the up-to-date check treats
+as up to date (see `isUpToDate`).
+*/
+func copyTimes(src, tar string) {
+	mod := gg.Try1(os.Stat(src)).ModTime()
+	gg.Try(os.Chtimes(tar, mod, mod))
+}
+
+/*
+Sets the permission bits of the target to those of the source, such as the
+executable bit, which `os.Create` and `os.MkdirAll` don't preserve. For
+directories, the setting `dirMode` takes priority. On Windows, only the
+read-only attribute is affected.
+*/
+func copyMode(src, tar string) {
+	gg.Try(os.Chmod(tar, gg.Try1(os.Stat(src)).Mode().Perm()))
+}
+
+/*
+With `continueOnError`, a file which fails to copy, for example due to
+`fileTimeout`, is skipped rather than failing the whole backup. The error is
+logged, and the file is counted in `CopyStats.Skipped`.
+*/
+func copyFileOrSkip(run *RunState, srcPath, tarPath string) {
+	if !run.GetContinueOnError() {
+		copyFile(run, srcPath, tarPath)
+		return
+	}
+
+	err := gg.Catch(func() { copyFile(run, srcPath, tarPath) })
+	if err != nil {
+		logErr(gg.Wrapf(err, `skipping %v`, fmtPath(srcPath)))
+		_ = removeFile(tarPath)
+		run.AddStats(CopyStats{Skipped: 1})
+	}
+}
+
+func copyFile(run *RunState, srcPath, tarPath string) {
+	var span *Span
+	if FLAGS.Verbose {
+		span = run.Span.Child(`copy`)
+		span.Set(`copy.source`, srcPath)
+		span.Set(`copy.target`, tarPath)
+		defer gg.Finally(span.End)
+	}
+
+	if linkFile(run, srcPath, tarPath) {
+		return
+	}
+
+	hash := run.Manifest.Hash()
+	progress, stop := startProgress(run, srcPath)
+	defer stop()
+
+	var level int
+	if run.CompressExt() != `` {
+		level = run.GzipLevel()
+	}
+
+	size, ok := reflinkFile(run, srcPath, tarPath)
+	if !ok {
+		var err error
+		size, err = withTimeout(run.Ctx, run.GetFileTimeout().Duration(), func(ctx context.Context) (int64, error) {
+			return copyFileData(ctx, srcPath, tarPath, hash, level, run.GetFsync(), run.Cipher, run.Limiter, progress, run.GetCopyBufferSize())
+		})
+		if errors.Is(err, context.DeadlineExceeded) {
+			_ = removeFile(tarPath)
+			err = gg.Wrapf(err, `timed out copying %v after %v`, fmtPath(srcPath), run.GetFileTimeout())
+		}
+		gg.Try(err)
+	}
+
+	span.Set(`copy.bytes`, size)
+
+	if run.GetVerify() {
+		verifyCopy(srcPath, tarPath, run.CompressExt() != ``, run.Cipher)
+	}
+
+	copyMode(srcPath, tarPath)
+	if run.GetPreserveAcls() {
+		copyAcl(srcPath, tarPath)
+	}
+	if run.GetPreserveTimes() {
+		copyTimes(srcPath, tarPath)
+	}
+
+	run.Pool.Locked(func() { run.Manifest.Add(run.Target, tarPath, uint64(size), hash) })
+	run.AddStats(CopyStats{Files: 1, Bytes: uint64(size)})
 }
 
-func copyFile(srcPath, tarPath string) {
-	src := gg.Try1(os.OpenFile(srcPath, os.O_RDONLY, os.ModePerm))
-	defer src.Close() // Ignore error.
+/*
+Must not touch the run state, since it may keep running after a timeout. See
+`withTimeout`. When opening the source hangs past the timeout, the output must
+not be created afterwards.
+*/
+func copyFileData(
+	ctx context.Context,
+	srcPath, tarPath string,
+	hash hash.Hash,
+	level int,
+	fsync bool,
+	aead cipher.AEAD,
+	limit *RateLimiter,
+	progress *Progress,
+	bufSize ByteSize,
+) (_ int64, err error) {
+	defer gg.Rec(&err)
+
+	file := gg.Try1(os.OpenFile(srcPath, os.O_RDONLY, os.ModePerm))
+	defer file.Close() // Ignore error.
+	gg.Try(ctx.Err())
+
+	// Limits and counts reading the input, before compression.
+	src := progress.Reader(limit.Reader(ctx, file))
 
 	out := gg.Try1(os.Create(tarPath))
 	defer gg.Close(out) // Do not ignore error.
 
-	gg.Try1(io.Copy(out, src))
+	var tar io.Writer = out
+	if hash != nil {
+		tar = io.MultiWriter(out, hash)
+	}
+
+	// Returns the size of the output, which, when compressed or encrypted,
+	// is what manifests verify.
+	count := &CountWriter{Writer: tar}
+
+	var enc *EncryptWriter
+	var dst io.Writer = count
+	if aead != nil {
+		enc = newEncryptWriter(count, aead)
+		dst = enc
+	}
+
+	if level > 0 {
+		gz := gg.Try1(gzip.NewWriterLevel(dst, level))
+		gg.Try1(copyBudgeted(ctx, gz, src, bufSize, DEFLATE_MEMORY))
+		gg.Try(gz.Close())
+	} else {
+		gg.Try1(copyBudgeted(ctx, dst, src, bufSize, 0))
+	}
+
+	if enc != nil {
+		gg.Try(enc.Close())
+	}
+
+	// Unlike closing, which is deferred, syncing fails the copy.
+	if fsync {
+		gg.Try(out.Sync())
+	}
+	return count.Count, nil
+}
+
+/*
+Runs the function with a timeout, for operations which can hang indefinitely,
+such as reading from a flaky network mount, but don't support cancellation.
+Zero timeout disables. On timeout or cancellation of the context, returns the
+context error while the function keeps running in the background until it
+returns on its own. The function may check the context to stop early.
+*/
+func withTimeout[A any](ctx context.Context, timeout time.Duration, fun func(context.Context) (A, error)) (A, error) {
+	ctx = gg.Or(ctx, context.Background())
+	if timeout <= 0 {
+		return fun(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type Result struct {
+		Val A
+		Err error
+	}
+	done := make(chan Result, 1)
+	go func() {
+		val, err := fun(ctx)
+		done <- Result{val, err}
+	}()
+
+	select {
+	case val := <-done:
+		return val.Val, val.Err
+	case <-ctx.Done():
+		var zero A
+		return zero, ctx.Err()
+	}
+}
+
+/*
+Command line of an external program, such as "rsync -a {src}/ {dst}/". In JSON,
+either a string, which is split on whitespace, or an array of arguments, which
+allows arguments with spaces. The placeholders "{src}" and "{dst}" are replaced
+with the input path and the path of the new backup. Splitting happens before
+substitution, so paths may contain spaces.
+*/
+type Command []string
+
+func (self *Command) UnmarshalJSON(src []byte) error {
+	var str string
+	if json.Unmarshal(src, &str) == nil {
+		*self = strings.Fields(str)
+		return nil
+	}
+	return json.Unmarshal(src, (*[]string)(self))
+}
+
+func (self Command) Args(src, dst string) []string {
+	return gg.Map(self, func(val string) string {
+		return strings.NewReplacer(`{src}`, src, `{dst}`, dst).Replace(val)
+	})
+}
+
+/*
+Runs the configured copy command instead of `copyRecursive`. The tool still
+handles watching, debouncing, indexing, and retention. Because the copying is
+done by another program, manifests and copy stats are computed afterwards by
+reading the resulting backup.
+*/
+func copyWithCommand(run *RunState, cmd Command, src, tar string) {
+	args := cmd.Args(src, tar)
+	defer gg.Detailf(`copy command %q failed`, args)
+
+	run.MkdirAll(run.Entry.Output)
+
+	proc := exec.CommandContext(gg.Or(run.Ctx, context.Background()), args[0], args[1:]...)
+	var buf gg.Buf
+	if FLAGS.Verbose {
+		log.Printf(`running %q`, args)
+		proc.Stdout = os.Stderr
+		proc.Stderr = os.Stderr
+	} else {
+		proc.Stdout = &buf
+		proc.Stderr = &buf
+	}
+
+	err := proc.Run()
+	if err != nil {
+		if len(buf) > 0 {
+			panic(gg.Wrapf(err, `output: %s`, bytes.TrimSpace(buf)))
+		}
+		panic(err)
+	}
+
+	statBackup(run, tar)
+}
+
+// Fills copy stats and the manifest, if any, by reading an existing backup.
+func statBackup(run *RunState, root string) {
+	gg.Try(filepath.WalkDir(root, func(path string, src fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if src.IsDir() {
+			return nil
+		}
+
+		hash := run.Manifest.Hash()
+		size := uint64(gg.Try1(src.Info()).Size())
+		if hash != nil {
+			file := gg.Try1(os.Open(path))
+			defer file.Close()
+			size = uint64(gg.Try1(io.Copy(hash, file)))
+		}
+
+		run.Stats.Files++
+		run.Stats.Bytes += size
+		run.Manifest.Add(root, path, size, hash)
+		return nil
+	}))
 }
 
 func logEvent(src notify.EventInfo) {
 	if src != nil && FLAGS.Verbose {
-		log.Println(`FS event:`, fmtEvent(src))
+		logRecord(LogRecord{
+			Msg:   `FS event: ` + fmtEvent(src),
+			Path:  src.Path(),
+			Event: src.Event().String(),
+		})
 	}
 }
 
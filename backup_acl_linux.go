@@ -0,0 +1,51 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Extended attributes storing POSIX ACLs: the access ACL of files and
+directories, and the default ACL which directories pass on to new children.
+*/
+var ACL_XATTRS = []string{`system.posix_acl_access`, `system.posix_acl_default`}
+
+/*
+Copies POSIX ACLs from the source to the target, for the option `preserveAcls`.
+Paths without ACLs, and filesystems without ACL support, are silently skipped.
+*/
+func copyAcl(src, tar string) {
+	defer gg.Detailf(`unable to copy ACLs from %v to %v`, fmtPath(src), fmtPath(tar))
+
+	for _, name := range ACL_XATTRS {
+		val, ok := getXattr(src, name)
+		if ok {
+			gg.Try(syscall.Setxattr(tar, name, val, 0))
+		}
+	}
+}
+
+func getXattr(path, name string) ([]byte, bool) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if isErrNoXattr(err) {
+		return nil, false
+	}
+	gg.Try(err)
+
+	buf := make([]byte, size)
+	size = gg.Try1(syscall.Getxattr(path, name, buf))
+	return buf[:size], true
+}
+
+func isErrNoXattr(err error) bool {
+	return errors.Is(err, syscall.ENODATA) || errors.Is(err, syscall.ENOTSUP)
+}
+
+func aclFormats() []Format {
+	return []Format{{`acl`, `POSIX ACL`, `see "preserveAcls"`}}
+}
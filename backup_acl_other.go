@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package main
+
+// ACLs are not supported on this platform. The option `preserveAcls` is a nop.
+func copyAcl(string, string) {}
+
+func aclFormats() []Format { return nil }
@@ -0,0 +1,64 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/mitranim/gg"
+)
+
+var (
+	ADVAPI32                = syscall.NewLazyDLL(`advapi32.dll`)
+	PROC_GET_NAMED_SECURITY = ADVAPI32.NewProc(`GetNamedSecurityInfoW`)
+	PROC_SET_NAMED_SECURITY = ADVAPI32.NewProc(`SetNamedSecurityInfoW`)
+)
+
+const (
+	SE_FILE_OBJECT            = 1
+	DACL_SECURITY_INFORMATION = 4
+)
+
+/*
+Copies the discretionary ACL, which controls access, from the source to the
+target, for the option `preserveAcls`. Owners and audit ACLs are not copied,
+since changing them requires special privileges.
+*/
+func copyAcl(src, tar string) {
+	defer gg.Detailf(`unable to copy ACLs from %v to %v`, fmtPath(src), fmtPath(tar))
+
+	var dacl, desc uintptr
+
+	code, _, _ := PROC_GET_NAMED_SECURITY.Call(
+		uintptr(unsafe.Pointer(gg.Try1(syscall.UTF16PtrFromString(src)))),
+		SE_FILE_OBJECT,
+		DACL_SECURITY_INFORMATION,
+		0,
+		0,
+		uintptr(unsafe.Pointer(&dacl)),
+		0,
+		uintptr(unsafe.Pointer(&desc)),
+	)
+	if code != 0 {
+		panic(syscall.Errno(code))
+	}
+	defer syscall.LocalFree(syscall.Handle(desc))
+
+	code, _, _ = PROC_SET_NAMED_SECURITY.Call(
+		uintptr(unsafe.Pointer(gg.Try1(syscall.UTF16PtrFromString(tar)))),
+		SE_FILE_OBJECT,
+		DACL_SECURITY_INFORMATION,
+		0,
+		0,
+		dacl,
+		0,
+	)
+	if code != 0 {
+		panic(syscall.Errno(code))
+	}
+}
+
+func aclFormats() []Format {
+	return []Format{{`acl`, `DACL`, `see "preserveAcls"`}}
+}
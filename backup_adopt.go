@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Values of the config option `firstRun`, which decides how the first backup of
+an entry reconciles an output directory already populated with backups, for
+example by another tool or by a previous installation:
+
+  - "adopt" (default): the existing backups continue the sequence. The next
+    index follows the latest one, the up-to-date check on startup compares the
+    input with the latest one, and retention counts and deletes them like any
+    other backups.
+
+  - "fresh": the existing backups are moved into a new subdirectory of
+    `PREVIOUS_DIR`, untouched by retention, and the sequence starts anew.
+
+  - "validate": the whole existing sequence is checked: names, as by
+    `backup repair`, and every backup against its manifest, if any. Any
+    problem fails the backup, until fixed.
+
+With "fresh" and "validate", a note named like the input plus `FIRST_RUN_EXT`
+is written to the output directory when done, and later runs, including after
+restarts, skip the reconciliation.
+*/
+const (
+	FIRST_RUN_ADOPT    = `adopt`
+	FIRST_RUN_FRESH    = `fresh`
+	FIRST_RUN_VALIDATE = `validate`
+)
+
+const FIRST_RUN_EXT = `.first-run.json`
+
+// Directory, inside the output directory, for backups moved aside by "fresh".
+const PREVIOUS_DIR = `.previous`
+
+type FirstRunNote struct {
+	Time    time.Time `json:"time"`
+	Mode    string    `json:"mode"`
+	Backups int       `json:"backups"`
+}
+
+func firstRunPath(run *RunState) string {
+	return filepath.Join(run.Entry.Output, run.Entry.BaseName()+FIRST_RUN_EXT)
+}
+
+// Called by `backup` on the first backup after the entry starts.
+func firstRun(run *RunState) {
+	mode := run.GetFirstRun()
+	if run.GetZip() {
+		return
+	}
+
+	names := gg.Filter(gg.Sorted(relatedNames(run.Entry.Output, run.BackupName())), func(val IndexedName) bool {
+		return val.Index != 0
+	})
+
+	switch mode {
+	case FIRST_RUN_ADOPT:
+		if len(names) > 0 {
+			logDecision(run, `adopting %v existing backups in %v`, len(names), fmtPath(run.Entry.Output))
+		}
+		return
+	case FIRST_RUN_FRESH, FIRST_RUN_VALIDATE:
+	default:
+		panic(gg.Errf(`unrecognized "firstRun" %q, expected %q, %q or %q`, mode, FIRST_RUN_ADOPT, FIRST_RUN_FRESH, FIRST_RUN_VALIDATE))
+	}
+
+	note := firstRunPath(run)
+	if gg.FileExists(note) {
+		return
+	}
+
+	defer gg.Detailf(`unable to reconcile existing backups in %v`, fmtPath(run.Entry.Output))
+
+	if mode == FIRST_RUN_FRESH {
+		moveAside(run, names)
+	} else {
+		validateSequence(run, names)
+	}
+
+	if FLAGS.DryRun {
+		return
+	}
+	gg.MkdirAll(run.Entry.Output)
+	writeFileAtomic(note, gg.JsonBytes(FirstRunNote{
+		Time:    run.GetClock().Now(),
+		Mode:    mode,
+		Backups: len(names),
+	}))
+}
+
+func moveAside(run *RunState, names []IndexedName) {
+	if len(names) <= 0 {
+		return
+	}
+	if run.GetStore() {
+		panic(gg.Errf(`"firstRun": %q can't be used with "store", whose objects are shared by all backups`, FIRST_RUN_FRESH))
+	}
+
+	dir := filepath.Join(run.Entry.Output, PREVIOUS_DIR, run.GetClock().Now().Format(`20060102T150405`))
+
+	if FLAGS.DryRun {
+		log.Printf(`%v would move %v existing backups to %v`, DRY_RUN_PREFIX, len(names), fmtPath(dir))
+		return
+	}
+
+	gg.MkdirAll(dir)
+	for _, name := range names {
+		str := name.String()
+		for _, ext := range gg.Concat([]string{``}, SIDECAR_EXTS) {
+			from := filepath.Join(run.Entry.Output, str+ext)
+			if ext == `` || gg.FileExists(from) {
+				gg.Try(os.Rename(from, filepath.Join(dir, str+ext)))
+			}
+		}
+	}
+	log.Printf(`moved %v existing backups to %v`, len(names), fmtPath(dir))
+}
+
+func validateSequence(run *RunState, names []IndexedName) {
+	var problems []string
+
+	for _, val := range repairPlan(run) {
+		problems = append(problems, gg.Str(fmtPath(filepath.Join(run.Entry.Output, val.From)), `: `, val.Reason))
+	}
+
+	for _, name := range names {
+		path := filepath.Join(run.Entry.Output, name.String())
+		manifest := readManifest(path)
+		if manifest != nil {
+			problems = append(problems, manifest.Verify(path)...)
+		}
+	}
+
+	if len(problems) <= 0 {
+		if FLAGS.Verbose {
+			log.Printf(`validated %v existing backups in %v`, len(names), fmtPath(run.Entry.Output))
+		}
+		return
+	}
+
+	for _, val := range problems {
+		logErrorf(`  %v`, val)
+	}
+	panic(gg.Errf(`found %v problems in the existing backups; fix names with "backup repair", or set "firstRun" to %q to accept them`, len(problems), FIRST_RUN_ADOPT))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Values of the config option `archive`. With "tar" or "tar.gz", each backup of a
+directory input is one tar archive, optionally gzipped, named like
+"docs_<index>.tar" or "docs_<index>.tar.gz", instead of a copied directory.
+Archives keep the relative paths, modes and modification times of the files and
+directories of the input, and symlinks as links. Archives with and without
+gzip belong to one sequence, like compressed single-file backups (see
+`IndexedName.Compress`). Single-file inputs and remote outputs are unaffected.
+*/
+const (
+	ARCHIVE_NONE   = `none`
+	ARCHIVE_TAR    = `tar`
+	ARCHIVE_TAR_GZ = `tar.gz`
+)
+
+/*
+True if the backups of the entry are archives. A missing input counts as a
+directory, so that the archives of a deleted directory are still listed and
+pruned. Panics on unrecognized values and unsupported combinations.
+*/
+func (self RunState) Archived() bool {
+	switch val := self.GetArchive(); val {
+	case ``, ARCHIVE_NONE:
+		return false
+	case ARCHIVE_TAR, ARCHIVE_TAR_GZ:
+		if gg.FileExists(self.Entry.Input) {
+			return false
+		}
+		if self.GetZip() || self.GetIncremental() || self.GetStore() || len(self.GetCopyCommand()) > 0 || self.GetMove() {
+			panic(gg.Errf(`"archive" can't be used with "zip", "incremental", "store", "copyCommand" or "mode": "move"`))
+		}
+		if self.GetCompress() == COMPRESS_GZIP {
+			panic(gg.Errf(`"archive" can't be used with "compress"; use "archive": %q instead`, ARCHIVE_TAR_GZ))
+		}
+		if self.GetSymlinks() == SYMLINKS_FOLLOW {
+			panic(gg.Errf(`"archive" can't be used with "symlinks": %q`, SYMLINKS_FOLLOW))
+		}
+		return true
+	default:
+		panic(gg.Errf(`unrecognized "archive" %q, expected %q, %q or %q`, val, ARCHIVE_NONE, ARCHIVE_TAR, ARCHIVE_TAR_GZ))
+	}
+}
+
+func (self RunState) ArchiveName() IndexedName {
+	out := IndexedName{
+		IndexFormat: self.GetIndexFormat(),
+		Name:        filepath.Base(self.Entry.Input),
+		Ext:         TAR_EXT,
+	}
+	if self.GetArchive() == ARCHIVE_TAR_GZ {
+		out.Compress = GZIP_EXT
+	}
+	return out
+}
+
+/*
+Called by `backup` instead of copying the input. Writes the archive to the
+given path, which is a temporary path renamed into place by the caller.
+*/
+func writeArchive(run *RunState, path string) {
+	defer gg.Detailf(`unable to write %v`, fmtPath(path))
+
+	run.MkdirAll(run.Entry.Output)
+
+	file := gg.Try1(os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666))
+	defer file.Close() // Nop after the explicit close.
+
+	var dst io.Writer = file
+	var zip *gzip.Writer
+	var extra uint64
+	if run.GetArchive() == ARCHIVE_TAR_GZ {
+		zip = gg.Try1(gzip.NewWriterLevel(file, run.GzipLevel()))
+		dst = zip
+		extra = DEFLATE_MEMORY
+	}
+
+	out := tar.NewWriter(dst)
+	inp := run.Entry.Input
+
+	gg.Try(filepath.WalkDir(inp, func(src string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		run.CheckStopped()
+		if src == inp {
+			return nil
+		}
+		if !run.Includes(src, entry) {
+			return skipEntry(entry)
+		}
+
+		key := filepath.ToSlash(gg.Try1(filepath.Rel(inp, src)))
+		if entry.Type().IsRegular() {
+			tarFile(run, out, key, extra)
+			return nil
+		}
+
+		info := gg.Try1(entry.Info())
+		var link string
+		if isSymlink(info) {
+			if run.GetSymlinks() == SYMLINKS_SKIP {
+				return nil
+			}
+			link = gg.Try1(os.Readlink(src))
+		}
+
+		head := gg.Try1(tar.FileInfoHeader(info, link))
+		head.Name = key
+		if entry.IsDir() {
+			head.Name += `/`
+		}
+		gg.Try(out.WriteHeader(head))
+		return nil
+	}))
+
+	gg.Try(out.Close())
+	if zip != nil {
+		gg.Try(zip.Close())
+	}
+	gg.Try(file.Sync())
+	gg.Try(file.Close())
+}
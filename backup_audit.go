@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Record of a tamper-evident audit log, enabled by the top-level config option
+`auditLog`, which is a path of a JSON lines file shared by all entries. Unlike
+the history (see `HISTORY_EXT`), records form a hash chain: each includes the
+hash of the previous one, and its own hash covers all its fields. Modifying,
+inserting, or removing a record breaks the chain, which is detected by the
+subcommand "audit-verify". Removing the latest records can't be detected from
+the log alone; compare the latest hash printed by "audit-verify" with a copy
+kept elsewhere.
+*/
+type AuditRecord struct {
+	Time           time.Time `json:"time"`
+	Host           string    `json:"host"`
+	User           string    `json:"user"`
+	Entry          string    `json:"entry"`
+	Input          string    `json:"input"`
+	Inputs         []string  `json:"inputs,omitempty"`
+	Result         string    `json:"result"`
+	Index          Index     `json:"index,omitempty"`
+	Path           string    `json:"path,omitempty"`
+	Files          uint64    `json:"files"`
+	Bytes          uint64    `json:"bytes"`
+	Error          string    `json:"error,omitempty"`
+	RetentionError string    `json:"retentionError,omitempty"`
+	Prev           string    `json:"prev"`
+	Hash           string    `json:"hash"`
+}
+
+// SHA-256 of the JSON encoding of the record without its own hash.
+func (self AuditRecord) Sum() string {
+	self.Hash = ``
+	sum := sha256.Sum256(gg.JsonBytes(self))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Appends records to audit logs. The hash of the latest record is read from the
+file once, then kept in memory. Safe for concurrent use by entries.
+*/
+type Audit struct {
+	sync.Mutex
+	Path string
+	Last string
+}
+
+var AUDIT Audit
+
+func (self *Audit) Append(path string, rec AuditRecord) {
+	self.Lock()
+	defer self.Unlock()
+
+	if self.Path != path {
+		self.Last = lastAuditHash(path)
+		self.Path = path
+	}
+
+	rec.Prev = self.Last
+	rec.Hash = rec.Sum()
+
+	file := gg.Try1(os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666))
+	defer gg.Close(file)
+	gg.Try1(file.Write(append(gg.JsonBytes(rec), '\n')))
+	gg.Try(file.Sync())
+
+	self.Last = rec.Hash
+}
+
+func lastAuditHash(path string) string {
+	line := gg.Last(readHistoryLines(path))
+	if line == nil {
+		return ``
+	}
+	var rec AuditRecord
+	gg.JsonDecode(line, &rec)
+	return rec.Hash
+}
+
+// Called by `RunState.Finish`. Failures are logged, but don't fail the backup.
+func appendAudit(run *RunState, err error) {
+	path := run.Config.AuditLog
+	if path == `` || FLAGS.DryRun {
+		return
+	}
+
+	defer gg.RecWith(logErr)
+	defer gg.Detailf(`unable to write audit log %v`, fmtPath(path))
+
+	rec := AuditRecord{
+		Time:   run.GetClock().Now(),
+		Host:   gg.Try1(os.Hostname()),
+		User:   currentUser(),
+		Entry:  run.Entry.GetName(),
+		Input:  run.Entry.Input,
+		Inputs: run.Entry.Inputs,
+		Result: run.Result,
+		Index:  run.Index,
+		Path:   run.Target,
+		Files:  run.Stats.Files,
+		Bytes:  run.Stats.Bytes,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if run.Retention != nil {
+		rec.RetentionError = run.Retention.Error()
+	}
+
+	AUDIT.Append(path, rec)
+}
+
+func currentUser() string {
+	val, err := user.Current()
+	if err != nil {
+		return ``
+	}
+	return val.Username
+}
+
+/*
+Checks the hash chain of the audit log. Returns the number of records, the hash
+of the latest one, and a description of each problem.
+*/
+func verifyAudit(path string) (count int, last string, problems []string) {
+	defer gg.Detailf(`unable to verify audit log %v`, fmtPath(path))
+
+	for ind, line := range readHistoryLines(path) {
+		count++
+		var rec AuditRecord
+		err := gg.Catch(func() { gg.JsonDecode(line, &rec) })
+		if err != nil {
+			problems = append(problems, fmt.Sprintf(`record %v: %v`, ind+1, err))
+			last = ``
+			continue
+		}
+
+		if rec.Prev != last {
+			problems = append(problems, fmt.Sprintf(`record %v: doesn't follow the previous record; records were removed, inserted, or modified`, ind+1))
+		}
+		if rec.Sum() != rec.Hash {
+			problems = append(problems, fmt.Sprintf(`record %v: hash mismatch; the record was modified`, ind+1))
+		}
+		last = rec.Hash
+	}
+	return
+}
+
+/*
+Subcommand "audit-verify [file]": verifies the audit log at the given path,
+defaulting to the `auditLog` of the config.
+*/
+func cmdAuditVerify(args []string) {
+	if len(args) > 1 {
+		panic(gg.Errf(`expected at most one audit log path, got %q`, args))
+	}
+
+	path := gg.Head(args)
+	if path == `` {
+		path = readConfig().AuditLog
+	}
+	if path == `` {
+		panic(gg.Errf(`missing audit log path: pass it as an argument or set "auditLog" in the config`))
+	}
+	if !gg.FileExists(path) {
+		panic(gg.Errf(`missing audit log %v`, fmtPath(path)))
+	}
+
+	count, last, problems := verifyAudit(path)
+	for _, val := range problems {
+		fmt.Println(val)
+	}
+	if len(problems) > 0 {
+		panic(gg.Errf(`audit log %v is corrupted or was tampered with: %v problems in %v records`, fmtPath(path), len(problems), count))
+	}
+	fmt.Printf("verified %v records in %v; latest hash: %v\n", count, fmtPath(path), last)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Values of the config option `compress`. With "gzip", every file copied by the
+built-in copying is compressed, and its name gets the suffix `GZIP_EXT`. For a
+single-file input, that's the backup itself, named like "app_<index>.log.gz";
+the suffix follows the index (see `IndexedName.Compress`). For a directory
+input, that's every file in the backup directory. Backups made with and
+without compression belong to one sequence, so the option can be changed at
+any time. Compressed files can be restored with any gzip tool.
+*/
+const (
+	COMPRESS_NONE = `none`
+	COMPRESS_GZIP = `gzip`
+)
+
+const GZIP_EXT = `.gz`
+
+// Default of the config option `compressLevel`, the same as in gzip tools.
+const GZIP_LEVEL_DEFAULT = 6
+
+/*
+Returns the level of gzip compression, for `compress` and "archive": "tar.gz",
+from `gzip.BestSpeed` to `gzip.BestCompression`. Higher levels make smaller
+files, but take more CPU. Panics when out of range.
+*/
+func (self RunState) GzipLevel() int {
+	val := self.GetCompressLevel()
+	if val < gzip.BestSpeed || val > gzip.BestCompression {
+		panic(gg.Errf(`"compressLevel" must be between %v and %v for gzip, got %v`, gzip.BestSpeed, gzip.BestCompression, val))
+	}
+	return int(val)
+}
+
+/*
+Returns the suffix of compressed files, or an empty string when compression is
+disabled. Panics on unrecognized values and unsupported combinations.
+*/
+func (self RunState) CompressExt() string {
+	switch val := self.GetCompress(); val {
+	case ``, COMPRESS_NONE:
+		return ``
+	case COMPRESS_GZIP:
+		if self.GetZip() || self.GetIncremental() || self.GetStore() || len(self.GetCopyCommand()) > 0 || self.GetMove() {
+			panic(gg.Errf(`"compress" can't be used with "zip", "incremental", "store", "copyCommand" or "mode": "move"`))
+		}
+		return GZIP_EXT
+	default:
+		panic(gg.Errf(`unrecognized "compress" %q, expected %q or %q`, val, COMPRESS_NONE, COMPRESS_GZIP))
+	}
+}
+
+// Counts the bytes written to the underlying writer.
+type CountWriter struct {
+	Writer io.Writer
+	Count  int64
+}
+
+func (self *CountWriter) Write(src []byte) (int, error) {
+	size, err := self.Writer.Write(src)
+	self.Count += int64(size)
+	return size, err
+}
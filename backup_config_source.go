@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Value of `-c` which reads the config from stdin. Stdin is read once, and reused
+on reloads. See `readConfigSource`.
+*/
+const CONFIG_STDIN = `-`
+
+// Timeout of fetching the config from a URL. See `fetchConfig`.
+const CONFIG_FETCH_TIMEOUT = time.Second * 30
+
+/*
+True if the config is fetched from an "http://" or "https://" URL or read from
+stdin, rather than from a file. Such a config can't be watched, so reloading on
+changes is unavailable.
+*/
+func isConfigStream(path string) bool {
+	return path == CONFIG_STDIN || isConfigUrl(path)
+}
+
+func isConfigUrl(path string) bool {
+	return strings.HasPrefix(path, `http://`) || strings.HasPrefix(path, `https://`)
+}
+
+// Returns the content of the config file, URL or stdin, for `readConfig`.
+func readConfigSource(path string) []byte {
+	if path == CONFIG_STDIN {
+		return readStdinConfig()
+	}
+	if isConfigUrl(path) {
+		return fetchConfig(path)
+	}
+	return gg.ReadFile[[]byte](path)
+}
+
+var STDIN_CONFIG struct {
+	sync.Once
+	Body []byte
+	Err  error
+}
+
+func readStdinConfig() []byte {
+	STDIN_CONFIG.Do(func() {
+		STDIN_CONFIG.Body, STDIN_CONFIG.Err = io.ReadAll(os.Stdin)
+	})
+	gg.Try(STDIN_CONFIG.Err)
+	return STDIN_CONFIG.Body
+}
+
+func fetchConfig(url string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), CONFIG_FETCH_TIMEOUT)
+	defer cancel()
+
+	req := gg.Try1(http.NewRequestWithContext(ctx, http.MethodGet, url, nil))
+	res := gg.Try1(http.DefaultClient.Do(req))
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		panic(gg.Errf(`unexpected response status %v`, res.Status))
+	}
+	return gg.Try1(io.ReadAll(res.Body))
+}
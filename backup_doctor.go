@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+// Linux limit of inotify watches per user, checked by `backup doctor`.
+const INOTIFY_MAX_WATCHES = `/proc/sys/fs/inotify/max_user_watches`
+
+/*
+Findings of `backup doctor`. Fatal findings are problems which prevent backups
+from working, and make the command exit with code 1. Other findings are
+warnings about likely mistakes.
+*/
+type Doctor struct {
+	Fatal    []string
+	Warnings []string
+}
+
+func (self *Doctor) Fail(pat string, args ...any) {
+	self.Fatal = append(self.Fatal, fmt.Sprintf(pat, args...))
+}
+
+func (self *Doctor) Warn(pat string, args ...any) {
+	self.Warnings = append(self.Warnings, fmt.Sprintf(pat, args...))
+}
+
+/*
+Subcommand "doctor [entry]": diagnoses common setup problems of the matching
+entries: config warnings (see `RunState.Warnings`), unreadable inputs,
+unwritable outputs, insufficient free space, the inotify limit on Linux,
+overlapping entries, and missing permissions for `preserveAcls`.
+*/
+func cmdDoctor(args []string) {
+	if len(args) > 1 {
+		panic(gg.Errf(`expected at most one entry pattern, got %q`, args))
+	}
+
+	var doc Doctor
+	doc.Run(args)
+
+	for _, val := range doc.Fatal {
+		fmt.Println(`FATAL:`, val)
+	}
+	for _, val := range doc.Warnings {
+		fmt.Println(`warning:`, val)
+	}
+
+	if len(doc.Fatal) > 0 {
+		panic(gg.Errf(`found %v fatal problems and %v warnings`, len(doc.Fatal), len(doc.Warnings)))
+	}
+	if len(doc.Warnings) <= 0 {
+		fmt.Println(`no problems found`)
+	}
+}
+
+func (self *Doctor) Run(args []string) {
+	conf, err := gg.Catch01(readConfig)
+	if err != nil {
+		self.Fail(`%v`, err)
+		return
+	}
+
+	var targets []*RunState
+	for _, entry := range conf.Entries {
+		if !entry.Match(args) {
+			continue
+		}
+
+		run := RunState{Config: conf, Entry: entry}
+		run.StoreResolved()
+		name := fmtPath(entry.GetName())
+
+		for _, val := range run.Warnings() {
+			self.Warn(`entry %v: %v`, name, val)
+		}
+
+		if _, err := gg.Catch01(run.MultiInput); err != nil {
+			self.Fail(`entry %v: %v`, name, err)
+			continue
+		}
+		if !gg.Every(entry.GetInputs(), func(path string) bool { return self.CheckInput(name, path) }) {
+			continue
+		}
+
+		for _, tar := range run.Targets() {
+			self.CheckOutput(tar)
+			targets = append(targets, tar)
+		}
+	}
+
+	if len(targets) <= 0 {
+		self.Warn(`no entries to check`)
+		return
+	}
+
+	self.CheckOverlaps(targets)
+	self.CheckWatches(targets)
+}
+
+func (self *Doctor) CheckInput(name, path string) bool {
+	if path == `` {
+		self.Fail(`entry %v: missing "input"`, name)
+		return false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		self.Fail(`entry %v: unreadable input: %v`, name, err)
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err == nil && info.IsDir() {
+		_, err = file.Readdirnames(1)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		self.Fail(`entry %v: unreadable input: %v`, name, err)
+		return false
+	}
+	return true
+}
+
+/*
+Checks the nearest existing directory of the output, which is where backups
+are created, possibly along with the missing parents of the output.
+*/
+func (self *Doctor) CheckOutput(run *RunState) {
+	name := fmtPath(run.Entry.GetName())
+	out := run.Entry.Output
+	if out == `` {
+		self.Fail(`entry %v: missing "output"`, name)
+		return
+	}
+
+	if remote, ok := parseRemote(out); ok {
+		self.CheckRemote(run, remote)
+		return
+	}
+
+	dir := out
+	for !gg.DirExists(dir) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+	}
+
+	tmp, err := os.CreateTemp(dir, `.backup-doctor-*`)
+	if err != nil {
+		self.Fail(`entry %v: output %v is not writable: %v`, name, fmtPath(out), err)
+		return
+	}
+	path := tmp.Name()
+	_ = tmp.Close()
+	defer os.Remove(path)
+
+	if run.GetPreserveAcls() {
+		err := gg.Catch(func() { copyAcl(run.Entry.GetInputs()[0], path) })
+		if err != nil {
+			self.Fail(`entry %v: unable to copy ACLs for "preserveAcls": %v`, name, err)
+		}
+	}
+
+	free, err := diskFree(dir)
+	if err != nil {
+		self.Warn(`entry %v: unable to determine free space of %v: %v`, name, fmtPath(dir), err)
+		return
+	}
+
+	size, err := gg.Catch01(func() BackupSize { return inputSize(run) })
+	if err != nil {
+		self.Warn(`entry %v: unable to determine the size of the input: %v`, name, err)
+		return
+	}
+	if size.Bytes > free {
+		self.Fail(`entry %v: the input takes %v bytes, but only %v bytes are free in %v`, name, size.Bytes, free, fmtPath(dir))
+	}
+}
+
+/*
+Two targets writing backups of the same name to the same directory would share
+one sequence, and delete each other's backups. Outputs inside inputs cause each
+backup to trigger another.
+*/
+func (self *Doctor) CheckOverlaps(targets []*RunState) {
+	for ind, one := range targets {
+		oneName := fmtPath(one.Entry.GetName())
+
+		for _, two := range targets {
+			if gg.Some(two.Entry.GetInputs(), func(path string) bool { return inputRel(path, one.Entry.Output) != `` }) {
+				self.Warn(`entry %v: output %v is inside the input of entry %v, so backups trigger more backups`, oneName, fmtPath(one.Entry.Output), fmtPath(two.Entry.GetName()))
+				break
+			}
+		}
+
+		for _, two := range targets[ind+1:] {
+			if samePath(one.Entry.Output, two.Entry.Output) && one.BackupName().Related(two.BackupName()) {
+				self.Fail(`entries %v and %v make backups of the same name in %v, which would delete each other`, oneName, fmtPath(two.Entry.GetName()), fmtPath(one.Entry.Output))
+			}
+		}
+	}
+}
+
+// Connects to a remote output and lists it. See `SFTP_SCHEME`.
+func (self *Doctor) CheckRemote(run *RunState, remote RemoteOutput) {
+	name := fmtPath(run.Entry.GetName())
+
+	err := gg.Catch(func() { validateRemote(run) })
+	if err != nil {
+		self.Fail(`entry %v: %v`, name, err)
+	}
+
+	err = gg.Catch(func() {
+		store := remote.Dial(run.Entry)
+		defer store.Close()
+		gg.Try1(store.ReadDir(remote.Path))
+	})
+	if err != nil {
+		self.Fail(`entry %v: remote output %v is not accessible: %v`, name, remote, err)
+	}
+}
+
+func samePath(one, two string) bool {
+	return gg.Try1(filepath.Abs(one)) == gg.Try1(filepath.Abs(two))
+}
+
+/*
+On Linux, recursive watches take one inotify watch per directory, and watching
+fails when the per-user limit is exceeded. The count is an estimate: other
+programs of the same user also take watches.
+*/
+func (self *Doctor) CheckWatches(targets []*RunState) {
+	if runtime.GOOS != `linux` {
+		return
+	}
+
+	body, err := os.ReadFile(INOTIFY_MAX_WATCHES)
+	if err != nil {
+		return
+	}
+	limit, err := strconv.ParseUint(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		return
+	}
+
+	var count uint64
+	seen := gg.Set[string]{}
+	for _, run := range targets {
+		for _, path := range run.Entry.GetInputs() {
+			if seen.Has(path) {
+				continue
+			}
+			seen.Add(path)
+			count += countDirs(path)
+		}
+	}
+
+	if count > limit {
+		self.Fail(`watching the inputs takes about %v inotify watches, over the limit %v; raise it in %v`, count, limit, INOTIFY_MAX_WATCHES)
+	} else if count > limit/10*9 {
+		self.Warn(`watching the inputs takes about %v inotify watches, close to the limit %v; consider raising it in %v`, count, limit, INOTIFY_MAX_WATCHES)
+	}
+}
+
+func countDirs(path string) (out uint64) {
+	_ = filepath.WalkDir(path, func(_ string, src fs.DirEntry, err error) error {
+		if err == nil && src.IsDir() {
+			out++
+		}
+		return nil
+	})
+	return gg.MaxPrim2(out, 1)
+}
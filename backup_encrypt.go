@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Config option `encrypt`, for backups stored off-site. When a key source is
+set, every file copied by the built-in copying is encrypted with AES-256-GCM,
+and its name gets the suffix `ENC_EXT`, which follows the compression suffix,
+if any, like "app_<index>.log.gz.enc". The key is 32 bytes, read from the file
+`keyFile` or the environment variable `keyEnv`, encoded in hex or base64; a key
+file may also contain the raw bytes. `backup restore` decrypts with the same
+key. See `EncryptWriter` for the format.
+*/
+type Encryption struct {
+	Algorithm string `json:"algorithm"`
+	KeyFile   string `json:"keyFile"`
+	KeyEnv    string `json:"keyEnv"`
+}
+
+const ENCRYPT_AES_256_GCM = `aes-256-gcm`
+
+const ENC_EXT = `.enc`
+
+// First bytes of every encrypted file, followed by the nonce.
+const ENC_MAGIC = "BACKUP\x00\x01"
+
+// Size of the plaintext of each sealed chunk of an encrypted file.
+const ENC_CHUNK = 64 << 10
+
+func (self Encryption) Enabled() bool { return self.KeyFile != `` || self.KeyEnv != `` }
+
+/*
+Returns the cipher for encrypting and decrypting backups, or nil when
+encryption is disabled. Panics when the key is missing or invalid, which is
+reported at startup by `validateEntry`.
+*/
+func (self Encryption) Cipher() cipher.AEAD {
+	if !self.Enabled() {
+		return nil
+	}
+
+	switch self.Algorithm {
+	case ``, ENCRYPT_AES_256_GCM:
+	default:
+		panic(gg.Errf(`unrecognized "algorithm" %q, expected %q`, self.Algorithm, ENCRYPT_AES_256_GCM))
+	}
+
+	block := gg.Try1(aes.NewCipher(self.Key()))
+	return gg.Try1(cipher.NewGCM(block))
+}
+
+func (self Encryption) Key() []byte {
+	var src []byte
+	if self.KeyFile != `` {
+		defer gg.Detailf(`unable to read encryption key from %v`, fmtPath(self.KeyFile))
+		src = gg.Try1(os.ReadFile(self.KeyFile))
+		if len(src) == 32 {
+			return src
+		}
+	} else {
+		defer gg.Detailf(`unable to read encryption key from environment variable %v`, self.KeyEnv)
+		src = []byte(os.Getenv(self.KeyEnv))
+		if len(src) <= 0 {
+			panic(gg.Errf(`the variable is empty or unset`))
+		}
+	}
+
+	text := strings.TrimSpace(string(src))
+	if out, err := hex.DecodeString(text); err == nil && len(out) == 32 {
+		return out
+	}
+	if out, err := base64.StdEncoding.DecodeString(text); err == nil && len(out) == 32 {
+		return out
+	}
+	panic(gg.Errf(`expected a key of 32 bytes, encoded in hex or base64`))
+}
+
+/*
+Returns the suffix of encrypted files, or an empty string when encryption is
+disabled. Panics on unsupported combinations.
+*/
+func (self RunState) EncryptExt() string {
+	if !self.GetEncrypt().Enabled() {
+		return ``
+	}
+	if self.GetZip() || self.GetIncremental() || self.GetStore() || self.Archived() || len(self.GetCopyCommand()) > 0 {
+		panic(gg.Errf(`"encrypt" can't be used with "zip", "incremental", "store", "archive" or "copyCommand"`))
+	}
+	return ENC_EXT
+}
+
+/*
+Encrypts the written data. The output starts with `ENC_MAGIC` and a random
+nonce, followed by chunks of `ENC_CHUNK` bytes of plaintext, each sealed
+separately, so that files of any size are encrypted in constant memory. Each
+chunk has its own nonce, the base nonce xored with the chunk number, and the
+last chunk is marked as such in its additional data, so that reordered,
+dropped or truncated chunks fail decryption. Must be closed to write the last
+chunk.
+*/
+type EncryptWriter struct {
+	Writer io.Writer
+	Cipher cipher.AEAD
+	Nonce  []byte
+	Count  uint64
+	Buf    []byte
+}
+
+func newEncryptWriter(out io.Writer, aead cipher.AEAD) *EncryptWriter {
+	nonce := make([]byte, aead.NonceSize())
+	gg.Try1(rand.Read(nonce))
+	gg.Try1(io.WriteString(out, ENC_MAGIC))
+	gg.Try1(out.Write(nonce))
+
+	return &EncryptWriter{
+		Writer: out,
+		Cipher: aead,
+		Nonce:  nonce,
+		Buf:    make([]byte, 0, ENC_CHUNK+aead.Overhead()),
+	}
+}
+
+func (self *EncryptWriter) Write(src []byte) (size int, err error) {
+	for len(src) > 0 {
+		// The last chunk is written by `.Close`, so a full buffer is flushed
+		// only when more data follows.
+		if len(self.Buf) == ENC_CHUNK {
+			err = self.flush(false)
+			if err != nil {
+				return
+			}
+		}
+
+		chunk := gg.MinPrim2(len(src), ENC_CHUNK-len(self.Buf))
+		self.Buf = append(self.Buf, src[:chunk]...)
+		src = src[chunk:]
+		size += chunk
+	}
+	return
+}
+
+func (self *EncryptWriter) Close() error { return self.flush(true) }
+
+func (self *EncryptWriter) flush(last bool) error {
+	out := self.Cipher.Seal(self.Buf[:0], encNonce(self.Nonce, self.Count), self.Buf, encChunkData(last))
+	self.Count++
+	self.Buf = self.Buf[:0]
+	_, err := self.Writer.Write(out)
+	return err
+}
+
+func encNonce(base []byte, count uint64) []byte {
+	out := bytes.Clone(base)
+	tail := out[len(out)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^count)
+	return out
+}
+
+func encChunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Decrypts the output of `EncryptWriter`.
+type DecryptReader struct {
+	Reader *bufio.Reader
+	Cipher cipher.AEAD
+	Nonce  []byte
+	Count  uint64
+	Buf    []byte
+	Done   bool
+}
+
+func newDecryptReader(src io.Reader, aead cipher.AEAD) *DecryptReader {
+	head := make([]byte, len(ENC_MAGIC)+aead.NonceSize())
+	_, err := io.ReadFull(src, head)
+	if err != nil || string(head[:len(ENC_MAGIC)]) != ENC_MAGIC {
+		panic(gg.Errf(`not an encrypted backup file`))
+	}
+
+	return &DecryptReader{
+		Reader: bufio.NewReaderSize(src, ENC_CHUNK+aead.Overhead()),
+		Cipher: aead,
+		Nonce:  head[len(ENC_MAGIC):],
+	}
+}
+
+func (self *DecryptReader) Read(out []byte) (int, error) {
+	for len(self.Buf) <= 0 {
+		if self.Done {
+			return 0, io.EOF
+		}
+		err := self.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	size := copy(out, self.Buf)
+	self.Buf = self.Buf[size:]
+	return size, nil
+}
+
+func (self *DecryptReader) next() error {
+	buf := make([]byte, ENC_CHUNK+self.Cipher.Overhead())
+	size, err := io.ReadFull(self.Reader, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return gg.Errf(`truncated encrypted file`)
+		}
+		return err
+	}
+
+	// A chunk is the last one when nothing follows it.
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		_, err := self.Reader.Peek(1)
+		last = err == io.EOF
+	}
+
+	self.Buf, err = self.Cipher.Open(buf[:0], encNonce(self.Nonce, self.Count), buf[:size], encChunkData(last))
+	if err != nil {
+		return gg.Errf(`unable to decrypt: wrong key or corrupted file`)
+	}
+	self.Count++
+	self.Done = last
+	return nil
+}
+
+/*
+Decrypts the files of an encrypted backup copied by `backup restore`, in place.
+A single-file backup is decrypted as a whole. In a directory backup, only the
+files with the suffix `ENC_EXT` are decrypted, and lose the suffix.
+*/
+func decryptTree(aead cipher.AEAD, path string, single bool) {
+	if single {
+		tmp := path + `.dec`
+		decryptFile(aead, path, tmp)
+		gg.Try(os.Rename(tmp, path))
+		return
+	}
+
+	gg.Try(filepath.WalkDir(path, func(src string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() && strings.HasSuffix(src, ENC_EXT) {
+			decryptFile(aead, src, strings.TrimSuffix(src, ENC_EXT))
+		}
+		return nil
+	}))
+}
+
+// Replaces the encrypted file with the decrypted one, keeping mode and times.
+func decryptFile(aead cipher.AEAD, srcPath, tarPath string) {
+	defer gg.Detailf(`unable to decrypt %v`, fmtPath(srcPath))
+
+	src := gg.Try1(os.Open(srcPath))
+	defer src.Close()
+
+	out := gg.Try1(os.OpenFile(tarPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600))
+	defer gg.Fail(func(error) { _ = os.Remove(tarPath) })
+	defer out.Close() // Nop after the explicit close.
+
+	gg.Try1(io.Copy(out, newDecryptReader(src, aead)))
+	gg.Try(out.Close())
+	copyMode(srcPath, tarPath)
+	copyTimes(srcPath, tarPath)
+	gg.Try(src.Close())
+	gg.Try(os.Remove(srcPath))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// True if the given path, slash-separated and relative to the input, matches
+// any pattern of `Entry.Exclude`, or is inside a directory which does. Patterns
+// are similar to gitignore:
+//
+//   - A pattern without a slash, such as "*.log" or "node_modules", matches the
+//     base name at any depth.
+//
+//   - A pattern with a slash, such as "build/*.o" or "**/node_modules", matches
+//     the whole relative path, with the syntax of `Route` patterns.
+//
+//   - A trailing slash, such as "tmp/", matches only directories.
+//
+// Excluding a directory excludes its whole subtree: backups don't descend into
+// it, and changes inside it don't trigger backups.
+//
+// With `ignoreHidden`, paths with any segment starting with a dot, such as
+// ".DS_Store" or ".git/config", are also excluded, regardless of how
+// `fileNameSplit` treats such names. The input itself is never excluded, even
+// when its own name starts with a dot.
+func (self *RunState) Excludes(rel string, isDir bool) bool {
+	if rel == `` || rel == `.` {
+		return false
+	}
+	if self.GetIgnoreHidden() && isHiddenRel(rel) {
+		return true
+	}
+
+	patterns := self.Entry.Exclude
+	if len(patterns) <= 0 {
+		return false
+	}
+
+	segments := strings.Split(rel, `/`)
+	for ind := range segments {
+		prefix := strings.Join(segments[:ind+1], `/`)
+		dir := ind < len(segments)-1 || isDir
+
+		for _, pattern := range patterns {
+			if matchExclude(pattern, prefix, dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchExclude(pattern, rel string, isDir bool) bool {
+	pattern, dirOnly := strings.CutSuffix(pattern, `/`)
+	if dirOnly && !isDir {
+		return false
+	}
+
+	pattern = strings.TrimPrefix(pattern, `/`)
+	if !strings.Contains(pattern, `/`) {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchGlob(pattern, rel)
+}
+
+func isHiddenRel(rel string) bool {
+	for _, val := range strings.Split(rel, `/`) {
+		if strings.HasPrefix(val, `.`) && val != `.` && val != `..` {
+			return true
+		}
+	}
+	return false
+}
+
+// Like `RunState.Excludes`, for the absolute paths of FS events.
+func (self *RunState) ExcludesEvent(path string) bool {
+	if len(self.Entry.Exclude) <= 0 && !self.GetIgnoreHidden() {
+		return false
+	}
+	info, err := os.Stat(path)
+	return self.Excludes(inputRel(resolveInput(self.Entry.InputOf(path)), path), err == nil && info.IsDir())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Template variable of outputs, replaced with the directory of the input relative
+to the root of the entry (see `Entry.Root`). Together with glob inputs, this
+preserves the hierarchy of the sources in the backup store. For example, with
+the input "src/?/*.txt" and the output "backups/{relpath}", the source
+"src/a/one.txt" is backed up to "backups/a/one_<index>.txt".
+*/
+const RELPATH_VAR = `{relpath}`
+
+/*
+Called by `readConfig`. Replaces each entry whose input is a glob pattern, in
+the syntax of `filepath.Glob`, with one entry per matching path, and resolves
+the template variables of outputs (see `RELPATH_VAR`). Patterns are expanded
+once per config load: paths which start matching later are picked up by the
+next reload.
+*/
+func expandEntries(src []Entry) (out []Entry) {
+	for _, entry := range src {
+		out = append(out, entry.Expand()...)
+	}
+	return
+}
+
+func (self Entry) Expand() []Entry {
+	// Patterns are rejected by `RunState.MultiInput`.
+	if len(self.Inputs) > 0 {
+		return []Entry{self}
+	}
+	if !hasGlobMeta(self.Input) {
+		return []Entry{self.WithRelpath(self.Input)}
+	}
+
+	defer gg.Detailf(`unable to expand input pattern %q`, self.Input)
+
+	paths := gg.Try1(filepath.Glob(self.Input))
+	if len(paths) <= 0 && FLAGS.Verbose {
+		log.Printf(`input pattern %q matches nothing`, self.Input)
+	}
+
+	return gg.Map(paths, self.WithRelpath)
+}
+
+// Returns a copy of the entry with the given input and resolved outputs.
+func (self Entry) WithRelpath(path string) Entry {
+	root := self.GetRoot()
+	self.Input = path
+
+	if !hasRelpath(self.Output) && !gg.Some(gg.Map(self.Outputs, Output.GetPath), hasRelpath) && !gg.Some(gg.MapVals(self.Routes), hasRelpath) {
+		return self
+	}
+
+	rel := gg.Try1(filepath.Rel(root, filepath.Dir(path)))
+	if rel == `..` || strings.HasPrefix(rel, `..`+string(filepath.Separator)) {
+		panic(gg.Errf(`input %v is outside of the root %v`, fmtPath(path), fmtPath(root)))
+	}
+
+	self.Output = strings.ReplaceAll(self.Output, RELPATH_VAR, rel)
+	self.Outputs = gg.Map(self.Outputs, func(val Output) Output {
+		val.Path = strings.ReplaceAll(val.Path, RELPATH_VAR, rel)
+		return val
+	})
+
+	if self.Routes != nil {
+		routes := make(map[string]string, len(self.Routes))
+		for key, val := range self.Routes {
+			routes[key] = strings.ReplaceAll(val, RELPATH_VAR, rel)
+		}
+		self.Routes = routes
+	}
+	return self
+}
+
+/*
+Returns the directory against which `RELPATH_VAR` is resolved: `Entry.Root`
+if set, otherwise the longest leading directory of the input without glob
+characters, or the directory of the input when it's not a pattern.
+*/
+func (self Entry) GetRoot() string {
+	if self.Root != `` {
+		return self.Root
+	}
+
+	dir := filepath.Dir(self.Input)
+	for hasGlobMeta(dir) {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+func hasRelpath(src string) bool { return strings.Contains(src, RELPATH_VAR) }
+
+func hasGlobMeta(src string) bool { return strings.ContainsAny(src, `*?[`) }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+True if the entry has the config option `hardlink`. Each file of a new backup
+which is unchanged since the previous backup is then hardlinked to its copy in
+the previous backup, like "rsync --link-dest", so that unchanged files take no
+extra space. A file counts as unchanged when the previous copy has the same
+size and permissions, and isn't older than the input file, which mirrors
+`diffFiles`. Changed files, and files which can't be linked, for example when
+the output is on another filesystem, are copied as usual. Panics on
+unsupported combinations.
+*/
+func (self RunState) Hardlinked() bool {
+	if !self.GetHardlink() {
+		return false
+	}
+	if self.GetZip() || self.GetIncremental() || self.GetStore() || self.Archived() || len(self.GetCopyCommand()) > 0 {
+		panic(gg.Errf(`"hardlink" can't be used with "zip", "incremental", "store", "archive" or "copyCommand"`))
+	}
+	if self.GetCompress() == COMPRESS_GZIP || self.EncryptExt() != `` {
+		panic(gg.Errf(`"hardlink" can't be used with "compress" or "encrypt"`))
+	}
+	return true
+}
+
+/*
+Called by `copyFile`. Hardlinks the target to the copy of the same file in the
+previous backup, if any, when the file is unchanged since then, returning true
+on success. The link shares its permissions and times with the previous copy,
+which already match the input, so they're not copied again.
+*/
+func linkFile(run *RunState, srcPath, tarPath string) bool {
+	if run.LinkDest == `` {
+		return false
+	}
+
+	prevPath := filepath.Join(run.LinkDest, gg.Try1(filepath.Rel(run.Target, tarPath)))
+	src, err := os.Stat(srcPath)
+	if err != nil {
+		return false
+	}
+	prev, err := os.Lstat(prevPath)
+	if err != nil ||
+		!prev.Mode().IsRegular() ||
+		prev.Size() != src.Size() ||
+		prev.Mode().Perm() != src.Mode().Perm() ||
+		src.ModTime().After(prev.ModTime()) {
+		return false
+	}
+
+	if os.Link(prevPath, tarPath) != nil {
+		return false
+	}
+
+	hash := run.Manifest.Hash()
+	if hash != nil {
+		file := gg.Try1(os.Open(tarPath))
+		defer file.Close()
+		gg.Try1(io.Copy(hash, file))
+	}
+
+	run.Pool.Locked(func() { run.Manifest.Add(run.Target, tarPath, uint64(prev.Size()), hash) })
+	run.AddStats(CopyStats{Files: 1, Bytes: uint64(prev.Size()), Linked: 1})
+	return true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Returns the SHA-256 of the content of a file or directory, used by the config
+option `skipUnchanged` to skip backups when nothing actually changed, for
+example when a file was saved without changes. For a directory, combines the
+sorted relative paths of the included files and directories with the contents
+of the files, so the order of traversal doesn't matter, while additions,
+removals, and renames do. Modification times are ignored.
+*/
+func contentHash(root string, filter PathFilter) string {
+	defer gg.Detailf(`unable to hash %v`, fmtPath(root))
+
+	type Item struct {
+		Rel  string
+		Path string
+		Dir  bool
+	}
+	var items []Item
+
+	gg.Try(filepath.WalkDir(root, func(path string, src fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !filter.Includes(path, src) {
+			return skipEntry(src)
+		}
+		rel := filepath.ToSlash(gg.Try1(filepath.Rel(root, path)))
+		items = append(items, Item{rel, path, src.IsDir()})
+		return nil
+	}))
+
+	sort.Slice(items, func(one, two int) bool { return items[one].Rel < items[two].Rel })
+
+	out := sha256.New()
+	for _, item := range items {
+		gg.Try1(io.WriteString(out, item.Rel))
+		if item.Dir {
+			gg.Try1(out.Write([]byte{'/', 0}))
+			continue
+		}
+		gg.Try1(out.Write([]byte{0}))
+		gg.Try1(out.Write(fileHash(item.Path)))
+	}
+	return hex.EncodeToString(out.Sum(nil))
+}
+
+func fileHash(path string) []byte {
+	file := gg.Try1(os.Open(path))
+	defer file.Close()
+	return readerHash(file)
+}
+
+func readerHash(src io.Reader) []byte {
+	out := sha256.New()
+	gg.Try1(io.Copy(out, src))
+	return out.Sum(nil)
+}
+
+/*
+Used by the config option `verify`: re-reads the source and its copy from disk
+and compares their SHA-256. A compressed copy is decompressed first. On
+mismatch, removes the copy and panics, which fails the backup, or, with
+`continueOnError`, skips the file. A source modified between the copy and the
+verification also counts as a mismatch.
+*/
+func verifyCopy(srcPath, tarPath string, compressed bool, aead cipher.AEAD) {
+	defer gg.Detailf(`unable to verify the copy of %v`, fmtPath(srcPath))
+
+	if bytes.Equal(fileHash(srcPath), copyHash(tarPath, compressed, aead)) {
+		return
+	}
+	_ = removeFile(tarPath)
+	panic(gg.Errf(`the copy %v differs from its source`, fmtPath(tarPath)))
+}
+
+func copyHash(path string, compressed bool, aead cipher.AEAD) []byte {
+	file := gg.Try1(os.Open(path))
+	defer file.Close()
+
+	var inp io.Reader = file
+	if aead != nil {
+		inp = newDecryptReader(file, aead)
+	}
+	if !compressed {
+		return readerHash(inp)
+	}
+
+	src := gg.Try1(gzip.NewReader(inp))
+	defer src.Close()
+	return readerHash(src)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Suffix of history files. When the config option `history` is enabled, each
+output directory gets a history file for the entry's input, named like the
+input's base name plus this suffix. This suffix never decodes as a related name
+of the backups (see `IndexedName.Decode`).
+
+Unlike manifests, which describe one backup each, a history file is a
+chronological record of every backup attempt, including failures and skips.
+It's capped at `historyLimit` records, dropping the oldest.
+*/
+const HISTORY_EXT = `.history.jsonl`
+
+type HistoryRecord struct {
+	Time   time.Time `json:"time"`
+	Result string    `json:"result"`
+	Index  Index     `json:"index,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Files  uint64    `json:"files"`
+	Bytes  uint64    `json:"bytes"`
+	Error  string    `json:"error,omitempty"`
+
+	// Failures of deleting old backups, which don't fail the backup.
+	RetentionError string `json:"retentionError,omitempty"`
+}
+
+func historyPath(run *RunState) string {
+	return filepath.Join(run.Entry.Output, run.Entry.BaseName()+HISTORY_EXT)
+}
+
+// Called by `RunState.Finish`. Failures are logged, but don't fail the backup.
+func appendHistory(run *RunState, err error) {
+	if !run.GetHistory() || FLAGS.DryRun {
+		return
+	}
+
+	path := historyPath(run)
+	defer gg.RecWith(logErr)
+	defer gg.Detailf(`unable to write history %v`, fmtPath(path))
+
+	rec := HistoryRecord{
+		Time:   run.GetClock().Now(),
+		Result: run.Result,
+		Index:  run.Index,
+		Path:   run.Target,
+		Files:  run.Stats.Files,
+		Bytes:  run.Stats.Bytes,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if run.Retention != nil {
+		rec.RetentionError = run.Retention.Error()
+	}
+
+	lines := readHistoryLines(path)
+	lines = append(lines, gg.JsonBytes(rec))
+	lines = gg.Drop(lines, len(lines)-gg.NumConv[int](run.GetHistoryLimit()))
+
+	gg.MkdirAll(filepath.Dir(path))
+	writeFileAtomic(path, append(bytes.Join(lines, []byte("\n")), '\n'))
+}
+
+func readHistoryLines(path string) (out [][]byte) {
+	body, err := os.ReadFile(path)
+	if isErrFileNotFound(err) {
+		return nil
+	}
+	gg.Try(err)
+
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			out = append(out, line)
+		}
+	}
+	return
+}
+
+func readHistory(path string) []HistoryRecord {
+	return gg.Map(readHistoryLines(path), gg.JsonDecodeTo[HistoryRecord, []byte])
+}
+
+// Writes to a temporary sibling file, then renames it over the target.
+func writeFileAtomic(path string, body []byte) {
+	tmp := path + `.tmp`
+	gg.Try(os.WriteFile(tmp, body, 0o666))
+	gg.Try(os.Rename(tmp, path))
+}
+
+// Subcommand "history [entry]": prints the history of matching entries.
+func cmdHistory(args []string) {
+	if len(args) > 1 {
+		panic(gg.Errf(`expected at most one entry pattern, got %q`, args))
+	}
+
+	conf := readConfig()
+	for _, entry := range conf.Entries {
+		if !entry.Match(args) {
+			continue
+		}
+
+		run := RunState{Config: conf, Entry: entry}
+		for _, tar := range run.Targets() {
+			printHistory(tar)
+		}
+	}
+}
+
+func printHistory(run *RunState) {
+	path := historyPath(run)
+	fmt.Printf("%v -> %v:\n", fmtPath(run.Entry.GetName()), fmtPath(run.Entry.Output))
+
+	recs := readHistory(path)
+	if len(recs) <= 0 {
+		fmt.Println(`  no history`)
+		return
+	}
+
+	for _, rec := range recs {
+		fmt.Printf(`  %v  %-10v`, rec.Time.Format(time.RFC3339), rec.Result)
+		if rec.Path != `` {
+			fmt.Printf(`  %v  %v files  %v bytes`, fmtPath(rec.Path), rec.Files, rec.Bytes)
+		}
+		if rec.Error != `` {
+			fmt.Printf(`  %v`, rec.Error)
+		}
+		if rec.RetentionError != `` {
+			fmt.Printf(`  retention: %v`, rec.RetentionError)
+		}
+		fmt.Println()
+	}
+}
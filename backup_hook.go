@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Runs the configured post-hook after a successful backup, such as for copying it
+to cold storage. The command runs with the environment of the tool, plus these
+variables describing the backup:
+
+	BACKUP_NAME         name of the entry
+	BACKUP_INPUT        input path of the entry
+	BACKUP_OUTPUT_PATH  path of the new backup (for versioned zip backups, the archive)
+	BACKUP_INDEX        encoded index of the new backup, as in its name
+
+Doesn't run in dry runs, or when the backup was skipped as up to date. The hook
+is stopped along with the entry. Failures are logged, but don't fail or remove
+the backup, which is already complete when the hook runs.
+*/
+func runPostHook(run *RunState) {
+	cmd := run.GetPostHook()
+	if len(cmd) <= 0 || run.Target == `` || FLAGS.DryRun {
+		return
+	}
+
+	defer gg.RecWith(logErr)
+	defer gg.Detailf(`post-hook %q failed for %v`, []string(cmd), fmtPath(run.Target))
+
+	proc := exec.CommandContext(gg.Or(run.Ctx, context.Background()), cmd[0], cmd[1:]...)
+	proc.Env = append(
+		os.Environ(),
+		`BACKUP_NAME=`+run.Entry.GetName(),
+		`BACKUP_INPUT=`+run.Entry.JoinInputs(),
+		`BACKUP_OUTPUT_PATH=`+run.Target,
+		`BACKUP_INDEX=`+run.GetIndexFormat().EncodeIndex(run.Index),
+	)
+
+	var buf gg.Buf
+	if FLAGS.Verbose {
+		log.Printf(`running post-hook %q`, []string(cmd))
+		proc.Stdout = os.Stderr
+		proc.Stderr = os.Stderr
+	} else {
+		proc.Stdout = &buf
+		proc.Stderr = &buf
+	}
+
+	err := proc.Run()
+	if err != nil {
+		if len(buf) > 0 {
+			panic(gg.Wrapf(err, `output: %s`, bytes.TrimSpace(buf)))
+		}
+		panic(err)
+	}
+}
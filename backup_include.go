@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitranim/gg"
+	"github.com/rjeczalik/notify"
+)
+
+/*
+Adds the entries of the config files included via the config option `include`,
+for splitting a large config, such as one file per project. Include paths are
+relative to the directory of the including file, and may be glob patterns (see
+`filepath.Glob`). An included file has the format of the config file. Its
+top-level settings such as "limit" apply to its own entries, below their own
+settings and the `BACKUP_*` environment variables, and its entries also inherit
+the settings of the main config like any other entry. Other top-level options
+of included files, such as "otelEndpoint", are ignored. Included files may
+include more files; an include cycle is an error. A file included several
+times, such as by two other included files, is read once, so that its entries
+aren't duplicated. The paths of all read files are collected in `Config.Files`.
+*/
+func includeConfigs(out *Config, dir string, patterns []string, stack []string) {
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		paths := gg.Try1(filepath.Glob(pattern))
+		if len(paths) <= 0 {
+			if !hasGlobMeta(pattern) {
+				panic(gg.Errf(`missing included config file %v`, fmtPath(pattern)))
+			}
+			if FLAGS.Verbose {
+				log.Printf(`include pattern %q matches nothing`, pattern)
+			}
+		}
+
+		for _, path := range paths {
+			includeConfig(out, path, stack)
+		}
+	}
+}
+
+func includeConfig(out *Config, path string, stack []string) {
+	abs := gg.Try1(filepath.Abs(path))
+	if gg.Has(stack, abs) {
+		panic(gg.Errf(`include cycle: %v`, strings.Join(gg.Map(append(stack, abs), fmtPath), ` -> `)))
+	}
+	if gg.Some(out.Files, func(val string) bool { return samePath(val, abs) }) {
+		return
+	}
+
+	defer gg.Detailf(`unable to decode included config file %v`, fmtPath(path))
+
+	var src Config
+	gg.JsonDecodeFile(path, &src)
+	out.Files = append(out.Files, path)
+
+	for _, entry := range src.Entries {
+		entry.CommonConfig = resolveConfig(entry.CommonConfig, ENV, src.CommonConfig)
+		out.Entries = append(out.Entries, entry)
+	}
+	includeConfigs(out, filepath.Dir(abs), src.Include, append(stack, abs))
+}
+
+/*
+Watches the config file and the files it includes, updating the watch when a
+reload changes the includes. Set by `main`, and nil when the config is read
+from a URL or stdin, or in tests. See `watchConfig`.
+*/
+var CONFIG_WATCHER *ConfigWatcher
+
+type ConfigWatcher struct {
+	Events  chan notify.EventInfo
+	Watcher Watcher
+	Files   []string
+}
+
+func (self *ConfigWatcher) Update(files []string) {
+	if self == nil || gg.Equal(self.Files, files) {
+		return
+	}
+	self.Close()
+	self.Watcher = watchConfig(files, self.Events)
+	self.Files = files
+}
+
+func (self *ConfigWatcher) Close() {
+	if self != nil && self.Watcher != nil {
+		_ = self.Watcher.Close()
+	}
+}
+
+// True if the path is the config file or an included file.
+func (self *ConfigWatcher) Has(path string) bool {
+	return self != nil && gg.Some(self.Files, func(val string) bool { return samePath(val, path) })
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Incremental mode, enabled by the config option `incremental`, for large
+directories where most files rarely change. Each backup is a tar archive, named
+like a regular backup plus this suffix, with only the files added or modified
+since the previous backup, compared by size and modification time.
+
+The first entry of each archive is a note (see `Increment`) naming the backup it
+builds on, its base, and listing every file of the input at the time of the
+backup, which allows to restore deletions. A backup without a base is a full
+backup. Every `fullEvery` backups, a new full backup starts a new chain.
+`backup extract <backup> <dir>` restores any backup of a chain by replaying the
+chain up to that backup.
+
+Retention is dependency-aware: a backup is kept when it's within the limit, or
+pinned, or when any kept backup depends on it. Old backups are deleted one chain
+at a time, so the number of backups may exceed the limit by up to `fullEvery`
+minus one. Empty directories are not recorded.
+*/
+const TAR_EXT = `.tar`
+
+/*
+Reserved name of the first entry of each incremental archive. An input file
+with this name at the root of the input is excluded from incremental backups.
+*/
+const INCREMENT_NOTE = `.backup-increment.json`
+
+const DEFAULT_FULL_EVERY = 16
+
+type Increment struct {
+	Base  string              `json:"base"`
+	Files map[string]FileStat `json:"files"`
+}
+
+func (self RunState) IncrementalName() IndexedName {
+	return IndexedName{
+		IndexFormat: self.GetIndexFormat(),
+		Name:        filepath.Base(self.Entry.Input),
+		Ext:         TAR_EXT,
+	}
+}
+
+func incrementalBackup(run *RunState) {
+	if len(run.GetCopyCommand()) > 0 || run.GetStore() || run.GetMove() {
+		panic(gg.Errf(`"incremental" can't be used with "copyCommand", "store" or "mode": "move"`))
+	}
+	if !gg.DirExists(run.Entry.Input) {
+		panic(gg.Errf(`"incremental" requires a directory input`))
+	}
+
+	dir := run.Entry.Output
+	outs := gg.Sorted(relatedNames(dir, run.IncrementalName()))
+	bases := incrementBases(dir, outs)
+	prev := gg.Last(outs)
+
+	defer gg.Ok(func() { finalizeIncremental(run, outs, bases) })
+
+	stats := fileStats(run.Entry.Input, run.Includes)
+	delete(stats, INCREMENT_NOTE)
+
+	note := Increment{Files: stats}
+	changed := gg.SortedPrim(gg.MapKeys(stats))
+
+	if gg.IsNotZero(prev) {
+		prevPath := filepath.Join(dir, prev.String())
+		prevNote, err := gg.Catch11(readIncrement, prevPath)
+
+		if err != nil {
+			logErr(err)
+			logDecision(run, `making a full backup: unable to read the previous backup`)
+		} else {
+			diff := changedStats(stats, prevNote.Files)
+			if len(diff) <= 0 && len(stats) == len(prevNote.Files) {
+				logDecision(run, `skipping backup: %v is already up to date`, fmtPath(prevPath))
+				run.Result = RESULT_UP_TO_DATE
+				run.Counters.UpToDate++
+				return
+			}
+
+			if uint64(len(chainOf(bases, prev.String()))) < run.GetFullEvery() {
+				note.Base = prev.String()
+				changed = diff
+			} else {
+				logDecision(run, `making a full backup: reached "fullEvery" %v`, run.GetFullEvery())
+			}
+		}
+	}
+
+	next := run.IncrementalName()
+	next.Index = run.NextIndex(prev.Index)
+	path := filepath.Join(dir, next.String())
+
+	outs = append(outs, next)
+	bases[next.String()] = note.Base
+
+	if FLAGS.DryRun {
+		log.Printf(`%v would back up %v files of %v to %v`, DRY_RUN_PREFIX, len(changed), fmtPath(run.Entry.Input), fmtPath(path))
+		run.Result = RESULT_DRY_RUN
+		return
+	}
+
+	run.Span.Set(`backup.output`, path)
+	run.Span.Set(`backup.index`, uint64(next.Index))
+	run.Target = path
+	run.Index = next.Index
+
+	writeIncrement(run, path, note, changed)
+
+	if FLAGS.Verbose || FLAGS.Decisions {
+		logRecord(LogRecord{
+			Msg:   fmt.Sprintf(`backed up %v files to %v, base %q`, len(changed), fmtPath(path), note.Base),
+			Entry: run.Entry.GetName(),
+			Path:  path,
+		})
+	}
+}
+
+// Returns the keys of the files which are new or different in `next`.
+func changedStats(next, prev map[string]FileStat) (out []string) {
+	for _, key := range gg.SortedPrim(gg.MapKeys(next)) {
+		val, ok := prev[key]
+		if !ok || val.Size != next[key].Size || !val.ModTime.Equal(next[key].ModTime) {
+			out = append(out, key)
+		}
+	}
+	return
+}
+
+/*
+Maps the names of the given backups to the names of their bases. Backups whose
+note can't be read are treated as full backups.
+*/
+func incrementBases(dir string, outs []IndexedName) map[string]string {
+	out := map[string]string{}
+	for _, val := range outs {
+		note, err := gg.Catch11(readIncrement, filepath.Join(dir, val.String()))
+		logErr(err)
+		out[val.String()] = note.Base
+	}
+	return out
+}
+
+// Returns the given backup followed by the backups it depends on, newest first.
+func chainOf(bases map[string]string, name string) (out []string) {
+	for name != `` && !gg.Has(out, name) {
+		out = append(out, name)
+		name = bases[name]
+	}
+	return
+}
+
+func finalizeIncremental(run *RunState, outs []IndexedName, bases map[string]string) {
+	run.Latest = run.GetClock().Now()
+	touchHealthFile(run)
+	deleted := pruneIncremental(run, outs, bases)
+	if !FLAGS.DryRun {
+		METRICS.SetRetained(run, len(outs)-len(deleted))
+	}
+	runPostHook(run)
+}
+
+/*
+Dependency-aware retention of incremental backups. See `incrementalBackup`.
+Returns the backups selected for deletion, like `prune`.
+*/
+func pruneIncremental(run *RunState, outs []IndexedName, bases map[string]string) []IndexedName {
+	rotated := gg.Reject(outs, run.Pinned)
+	limit := gg.NumConv[int](run.GetLimit())
+	if limit <= 0 {
+		limit = len(rotated)
+	}
+
+	kept := gg.Set[string]{}
+	for _, val := range gg.Concat(gg.Filter(outs, run.Pinned), gg.Drop(rotated, len(rotated)-limit)) {
+		for _, name := range chainOf(bases, val.String()) {
+			kept.Add(name)
+		}
+	}
+
+	deleted := gg.Reject(outs, func(val IndexedName) bool {
+		return kept.Has(val.String())
+	})
+	deleteBackups(run, deleted)
+	return deleted
+}
+
+func readIncrement(path string) (out Increment) {
+	defer gg.Detailf(`unable to read incremental backup %v`, fmtPath(path))
+
+	file := gg.Try1(os.Open(path))
+	defer file.Close()
+
+	src := tar.NewReader(file)
+	head := gg.Try1(src.Next())
+	if head.Name != INCREMENT_NOTE {
+		panic(gg.Errf(`missing %q`, INCREMENT_NOTE))
+	}
+	gg.Try(json.NewDecoder(src).Decode(&out))
+	return
+}
+
+/*
+Writes the archive into a temporary file and renames it into place, so that a
+crash never leaves a partial backup.
+*/
+func writeIncrement(run *RunState, path string, note Increment, changed []string) {
+	defer gg.Detailf(`unable to write %v`, fmtPath(path))
+
+	run.MkdirAll(run.Entry.Output)
+
+	tmp := gg.Try1(os.CreateTemp(run.Entry.Output, filepath.Base(path)+`.tmp-*`))
+	defer os.Remove(tmp.Name()) // Nop after the rename.
+	defer tmp.Close()           // Nop after the explicit close.
+
+	out := tar.NewWriter(tmp)
+
+	body := gg.JsonBytes(note)
+	gg.Try(out.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     INCREMENT_NOTE,
+		Size:     int64(len(body)),
+		Mode:     0o644,
+		ModTime:  run.GetClock().Now(),
+	}))
+	gg.Try1(out.Write(body))
+
+	for _, key := range changed {
+		tarFile(run, out, key, 0)
+	}
+
+	gg.Try(out.Close())
+	gg.Try(tmp.Sync())
+	gg.Try(tmp.Close())
+	gg.Try(os.Rename(tmp.Name(), path))
+}
+
+/*
+Writes the input file at the given key into the tar. The extra memory is that
+of the writer under the tar, if any, such as a gzip compressor. See
+`copyBudgeted`.
+*/
+func tarFile(run *RunState, out *tar.Writer, key string, extra uint64) {
+	file := gg.Try1(os.Open(filepath.Join(run.Entry.Input, filepath.FromSlash(key))))
+	defer file.Close()
+
+	head := gg.Try1(tar.FileInfoHeader(gg.Try1(file.Stat()), ``))
+	head.Name = key
+	gg.Try(out.WriteHeader(head))
+
+	// Fails if the file was truncated in the meantime, failing the backup.
+	size := gg.Try1(copyBudgeted(run.Ctx, out, run.RateReader(io.LimitReader(file, head.Size)), run.GetCopyBufferSize(), extra))
+	if size < head.Size {
+		panic(gg.Errf(`%v was truncated while copying`, fmtPath(file.Name())))
+	}
+	run.Stats.Files++
+	run.Stats.Bytes += uint64(size)
+}
+
+/*
+Restores an incremental backup into the given directory, which must not exist,
+by replaying its chain: each file listed in the note of the backup is extracted
+from the newest archive of the chain which contains it.
+*/
+func extractIncremental(path, tarDir string) {
+	defer gg.Detailf(`unable to extract %v to %v`, fmtPath(path), fmtPath(tarDir))
+
+	if gg.FileExists(tarDir) || gg.DirExists(tarDir) {
+		panic(gg.Errf(`target already exists`))
+	}
+
+	dir := filepath.Dir(path)
+	note := readIncrement(path)
+	pending := gg.Set[string]{}
+	for key := range note.Files {
+		pending.Add(key)
+	}
+
+	gg.MkdirAll(tarDir)
+
+	for name := filepath.Base(path); name != `` && len(pending) > 0; {
+		src := filepath.Join(dir, name)
+		extractIncrement(src, tarDir, pending)
+		name = readIncrement(src).Base
+	}
+
+	if len(pending) > 0 {
+		panic(gg.Errf(`broken chain: missing files %q`, gg.SortedPrim(gg.MapKeys(pending))))
+	}
+}
+
+func extractIncrement(path, tarDir string, pending gg.Set[string]) {
+	file := gg.Try1(os.Open(path))
+	defer file.Close()
+
+	src := tar.NewReader(file)
+	for {
+		head, err := src.Next()
+		if err == io.EOF {
+			return
+		}
+		gg.Try(err)
+
+		if !pending.Has(head.Name) {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(head.Name)) {
+			panic(gg.Errf(`invalid path %q in %v`, head.Name, fmtPath(path)))
+		}
+
+		out := filepath.Join(tarDir, filepath.FromSlash(head.Name))
+		gg.MkdirAll(filepath.Dir(out))
+		writeTarFile(out, head, src)
+		delete(pending, head.Name)
+	}
+}
+
+func writeTarFile(path string, head *tar.Header, src io.Reader) {
+	defer gg.Detailf(`unable to extract %v`, fmtPath(path))
+
+	out := gg.Try1(os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, head.FileInfo().Mode().Perm()))
+	defer out.Close() // Nop after the explicit close.
+
+	gg.Try1(io.Copy(out, src))
+	gg.Try(out.Close())
+	gg.Try(os.Chtimes(path, head.ModTime, head.ModTime))
+}
+
+func isIncrementalPath(path string) bool { return strings.HasSuffix(path, TAR_EXT) }
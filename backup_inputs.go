@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitranim/gg"
+	"github.com/rjeczalik/notify"
+)
+
+/*
+True if the entry has several inputs, via the config option `inputs` instead of
+`input`. They're watched together and backed up together, into one output
+with one index sequence and one retention. Each backup is a directory named
+after the entry's `name`, which is required, like "<name>_<index>". Inside it,
+each input is copied under its absolute path without the volume, like
+"home/me/docs" for "/home/me/docs", or "C/Users/me/docs" for
+"C:\Users\me\docs" (see `inputSubpath`), which is stable when inputs are added
+or removed, and can't collide. Panics on unsupported combinations.
+*/
+func (self RunState) MultiInput() bool {
+	entry := self.Entry
+	if len(entry.Inputs) <= 0 {
+		return false
+	}
+	if entry.Input != `` {
+		panic(gg.Errf(`"input" and "inputs" are mutually exclusive`))
+	}
+	if entry.Name == `` || strings.ContainsAny(entry.Name, `/\`) {
+		panic(gg.Errf(`"inputs" requires a "name" without path separators, which names the backups`))
+	}
+	if self.GetZip() || self.GetIncremental() || self.GetStore() || self.Archived() || len(self.GetCopyCommand()) > 0 || self.GetMove() {
+		panic(gg.Errf(`"inputs" can't be used with "zip", "incremental", "store", "archive", "copyCommand" or "mode": "move"`))
+	}
+	if len(entry.Routes) > 0 || self.GetSkipActive() > 0 {
+		panic(gg.Errf(`"inputs" can't be used with "routes" or "skipActive"`))
+	}
+	for _, path := range entry.GetOutputs() {
+		if _, ok := parseRemote(path); ok {
+			panic(gg.Errf(`"inputs" can't be used with remote outputs`))
+		}
+		if hasRelpath(path) {
+			panic(gg.Errf(`"inputs" can't be used with %q in outputs`, RELPATH_VAR))
+		}
+	}
+
+	for ind, one := range entry.Inputs {
+		if hasGlobMeta(one) {
+			panic(gg.Errf(`"inputs" can't contain patterns, got %q`, one))
+		}
+		if inputSubpath(one) == `` {
+			panic(gg.Errf(`"inputs" can't contain the root directory %v`, fmtPath(one)))
+		}
+		for _, two := range entry.Inputs[ind+1:] {
+			if inputRel(one, two) != `` || inputRel(two, one) != `` {
+				panic(gg.Errf(`inputs %v and %v overlap`, fmtPath(one), fmtPath(two)))
+			}
+		}
+	}
+	return true
+}
+
+// Returns `Entry.Inputs` if set, otherwise `Entry.Input`.
+func (self Entry) GetInputs() []string {
+	if len(self.Inputs) > 0 {
+		return self.Inputs
+	}
+	return []string{self.Input}
+}
+
+// Returns the first input which doesn't exist, or an empty string.
+func (self Entry) MissingInput() string {
+	for _, path := range self.GetInputs() {
+		if inputMissing(path) {
+			return path
+		}
+	}
+	return ``
+}
+
+// Returns the input which contains the given path, for filtering FS events.
+func (self Entry) InputOf(path string) string {
+	for _, val := range self.GetInputs() {
+		if inputRel(resolveInput(val), path) != `` {
+			return val
+		}
+	}
+	return self.Input
+}
+
+// Formats the inputs for logs and errors.
+func (self Entry) FmtInput() string {
+	return strings.Join(gg.Map(self.GetInputs(), fmtPath), `, `)
+}
+
+/*
+Joins the inputs with the OS-specific path list separator, like `PATH`, for
+hooks and traces. See `runPostHook`.
+*/
+func (self Entry) JoinInputs() string {
+	return strings.Join(self.GetInputs(), string(filepath.ListSeparator))
+}
+
+/*
+Calls the function with each input of the entry. For an entry with `inputs`,
+`Entry.Input` is set to the current input during the call, so that functions
+which handle one input, such as `RunState.Includes`, apply to each input in
+turn.
+*/
+func (self *RunState) EachInput(fun func(string)) {
+	if len(self.Entry.Inputs) <= 0 {
+		fun(self.Entry.Input)
+		return
+	}
+
+	defer gg.SnapSwap(&self.Entry.Input, ``).Done()
+	for _, path := range self.Entry.Inputs {
+		self.Entry.Input = path
+		fun(path)
+	}
+}
+
+/*
+Returns the path of the input relative to a backup of an entry with `inputs`:
+the absolute path without the volume, or with the volume as the first
+directory, such as "C" for "C:".
+*/
+func inputSubpath(path string) string {
+	path = gg.Try1(filepath.Abs(path))
+	vol := filepath.VolumeName(path)
+	rest := strings.TrimLeft(path[len(vol):], `/\`)
+	vol = strings.Trim(strings.TrimSuffix(vol, `:`), `/\`)
+	return filepath.Join(vol, rest)
+}
+
+/*
+Returns the path of the copy of the input in the given backup. Single files
+get the suffixes of compression and encryption, like files inside directories.
+*/
+func inputTarget(run *RunState, backup, path string) string {
+	out := filepath.Join(backup, inputSubpath(path))
+	if !gg.DirExists(path) {
+		out += run.CompressExt() + run.EncryptExt()
+	}
+	return out
+}
+
+/*
+Copies each input of an entry with `inputs` into the backup. See
+`RunState.MultiInput`. In dry run mode, only logs the copies.
+*/
+func copyInputs(run *RunState, tar string) {
+	if !FLAGS.DryRun {
+		run.MkdirAll(tar)
+	}
+	run.EachInput(func(path string) {
+		out := inputTarget(run, tar, path)
+		copyTree(run, path, out, filepath.Dir(out))
+	})
+}
+
+// Like `logDiff` for each input of an entry with `inputs`.
+func logInputsDiff(run *RunState, prev, next string) {
+	run.EachInput(func(path string) {
+		var prevPath string
+		if prev != `` {
+			prevPath = inputTarget(run, prev, path)
+		}
+		logDiff(run, prevPath, inputTarget(run, next, path))
+	})
+}
+
+/*
+Like `contentHash` for all inputs of the entry. For an entry with `inputs`,
+combines the hashes of the inputs with their paths in the backup.
+*/
+func inputHash(run *RunState) string {
+	if len(run.Entry.Inputs) <= 0 {
+		return contentHash(run.Entry.Input, run.Includes)
+	}
+
+	out := sha256.New()
+	run.EachInput(func(path string) {
+		gg.Try1(io.WriteString(out, inputSubpath(path)))
+		gg.Try1(out.Write([]byte{0}))
+		gg.Try1(io.WriteString(out, contentHash(path, run.Includes)))
+		gg.Try1(out.Write([]byte{0}))
+	})
+	return hex.EncodeToString(out.Sum(nil))
+}
+
+// Like `maxModTime` for all inputs of the entry.
+func inputModTime(run *RunState) (out time.Time) {
+	run.EachInput(func(path string) {
+		val := maxModTime(path, run.Includes)
+		if val.After(out) {
+			out = val
+		}
+	})
+	return
+}
+
+// Like `walkSize` for all inputs of the entry.
+func inputSize(run *RunState) (out BackupSize) {
+	for _, path := range run.Entry.GetInputs() {
+		size := walkSize(path)
+		out.Files += size.Files
+		out.Bytes += size.Bytes
+	}
+	return
+}
+
+/*
+Watches every input of an entry (see `Entry.GetInputs`) with one
+`InputWatcher` each. The watchers share their channels, and each event is
+filtered by the watcher of the input which it belongs to.
+*/
+type InputWatchers []*InputWatcher
+
+func newInputWatchers(run *RunState) InputWatchers {
+	events := make(chan notify.EventInfo, 2)
+	errs := make(chan error, 1)
+
+	return gg.Map(run.Entry.GetInputs(), func(path string) *InputWatcher {
+		return &InputWatcher{Run: run, Input: path, Events: events, Errors: errs}
+	})
+}
+
+func (self InputWatchers) Watch() {
+	for _, val := range self {
+		val.Watch()
+	}
+}
+
+func (self InputWatchers) Close() {
+	for _, val := range self {
+		val.Close()
+	}
+}
+
+func (self InputWatchers) Rewatch() error {
+	self.Close()
+	return gg.Catch(self.Watch)
+}
+
+func (self InputWatchers) Filter(eve notify.EventInfo) (notify.EventInfo, bool) {
+	if eve == nil {
+		return eve, true
+	}
+	for _, val := range self {
+		if val.Owns(eve.Path()) {
+			return val.Filter(eve)
+		}
+	}
+	return eve, false
+}
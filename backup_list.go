@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+One backup printed by `backup list`. For versioned zip backups, `Path` is the
+archive, and `Name` is the folder of the backup in it.
+*/
+type ListedBackup struct {
+	Entry   string    `json:"entry"`
+	Output  string    `json:"output"`
+	Name    string    `json:"name"`
+	Index   Index     `json:"index"`
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"modTime"`
+	Files   uint64    `json:"files"`
+	Bytes   uint64    `json:"bytes"`
+	Pinned  bool      `json:"pinned,omitempty"`
+}
+
+/*
+Implementation of `backup list [-json] [entry]`. Prints the existing backups of
+all entries or the matching ones, oldest first, with their modification times
+and sizes (see `backupSize`). With `-json`, prints one JSON object per backup
+per line, for scripts. Remote outputs are not listed, since that requires
+connecting to them.
+*/
+func cmdList(args []string) {
+	flags := flag.NewFlagSet(`list`, flag.ContinueOnError)
+	asJson := flags.Bool(`json`, false, `print one JSON object per backup per line`)
+	gg.Try(flags.Parse(args))
+
+	args = flags.Args()
+	if len(args) > 1 {
+		panic(gg.Errf(`expected at most one entry pattern, got %q`, args))
+	}
+
+	conf := readConfig()
+	for _, entry := range conf.Entries {
+		if !entry.Match(args) {
+			continue
+		}
+
+		run := RunState{Config: conf, Entry: entry}
+		for _, tar := range run.Targets() {
+			if *asJson {
+				for _, val := range listBackups(tar) {
+					fmt.Println(gg.JsonString(val))
+				}
+				continue
+			}
+			printBackups(tar)
+		}
+	}
+}
+
+func printBackups(run *RunState) {
+	fmt.Printf("%v -> %v:\n", fmtPath(run.Entry.GetName()), fmtPath(run.Entry.Output))
+
+	if _, ok := parseRemote(run.Entry.Output); ok {
+		fmt.Println(`  remote output, not listed`)
+		return
+	}
+
+	list := listBackups(run)
+	if len(list) <= 0 {
+		fmt.Println(`  no backups`)
+		return
+	}
+
+	for _, val := range list {
+		fmt.Printf(`  %v  %v  %v files  %v bytes`, val.Name, val.ModTime.Format(time.RFC3339), val.Files, val.Bytes)
+		if val.Pinned {
+			fmt.Print(`  pinned`)
+		}
+		fmt.Println()
+	}
+}
+
+// Returns the backups of one output of an entry, oldest first.
+func listBackups(run *RunState) (out []ListedBackup) {
+	dir := run.Entry.Output
+	defer gg.Detailf(`unable to list backups in %v`, fmtPath(dir))
+
+	if _, ok := parseRemote(dir); ok {
+		return nil
+	}
+
+	if run.GetZip() {
+		return listZipBackups(run)
+	}
+
+	for _, name := range gg.Sorted(relatedNames(dir, run.BackupName())) {
+		path := filepath.Join(dir, name.String())
+		size := backupSize(path)
+		out = append(out, ListedBackup{
+			Entry:   run.Entry.GetName(),
+			Output:  dir,
+			Name:    name.String(),
+			Index:   name.Index,
+			Path:    path,
+			ModTime: gg.Try1(os.Lstat(path)).ModTime(),
+			Files:   size.Files,
+			Bytes:   size.Bytes,
+			Pinned:  run.Pinned(name),
+		})
+	}
+	return
+}
+
+/*
+Versioned zip backups are folders of one archive. The time of a folder is the
+latest time of its files.
+*/
+func listZipBackups(run *RunState) (out []ListedBackup) {
+	path := run.ZipPath()
+	if !gg.FileExists(path) {
+		return nil
+	}
+
+	format := run.GetIndexFormat()
+	file := gg.Try1(zip.OpenReader(path))
+	defer file.Close()
+
+	for _, ind := range zipIndices(path, format) {
+		name := format.EncodeIndex(ind)
+		val := ListedBackup{
+			Entry:  run.Entry.GetName(),
+			Output: run.Entry.Output,
+			Name:   name,
+			Index:  ind,
+			Path:   path,
+		}
+
+		for _, head := range file.File {
+			if !strings.HasPrefix(head.Name, name+`/`) {
+				continue
+			}
+			if head.Modified.After(val.ModTime) {
+				val.ModTime = head.Modified
+			}
+			if !head.FileInfo().IsDir() {
+				val.Files++
+				val.Bytes += head.UncompressedSize64
+			}
+		}
+		out = append(out, val)
+	}
+	return
+}
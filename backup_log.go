@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+// Values of `Flags.LogFormat`.
+const (
+	LOG_FORMAT_TEXT = `text`
+	LOG_FORMAT_JSON = `json`
+)
+
+// Values of `LogRecord.Level`.
+const (
+	LOG_LEVEL_INFO  = `info`
+	LOG_LEVEL_ERROR = `error`
+)
+
+/*
+Serializes records written by `logRecord` with records written through the
+`log` package, which has its own lock.
+*/
+var LOG_MUT sync.Mutex
+
+/*
+Log output with `-json-logs-to` or `-log-format json`. Each record is appended
+to `Json`, if any, as a line of JSON (see `LogRecord`), for monitoring agents
+tailing the file. Records written to `Text` are either text, as without this
+writer, or, with `JsonText`, JSON lines. The `log` package calls `Write` once
+per record, which makes each call one complete record.
+
+With `Quiet`, set by `-q`, only records with the level "error" are written to
+`Text`, such as errors logged by `logErr` and `logErrorf`. Records written
+through the `log` package have the level "info", and are dropped. `Json` still
+gets every record, since it's requested explicitly.
+*/
+type LogWriter struct {
+	Text     io.Writer
+	Json     io.Writer
+	JsonText bool
+	Quiet    bool
+}
+
+/*
+One log record in JSON. Records written through the `log` package only have a
+message. Records written by `logRecord` also describe what they're about, and
+errors include their detail chain, outermost first (see `errChain`).
+*/
+type LogRecord struct {
+	Time   time.Time `json:"time"`
+	Level  string    `json:"level"`
+	Msg    string    `json:"msg"`
+	Entry  string    `json:"entry,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Event  string    `json:"event,omitempty"`
+	Errors []string  `json:"errors,omitempty"`
+}
+
+func (self LogWriter) Write(src []byte) (int, error) {
+	err := self.Record(LogRecord{Msg: strings.TrimSuffix(gg.ToString(src), "\n")})
+	return len(src), err
+}
+
+/*
+Prefixes text records with the timestamp which the `log` package would add with
+its default flags, which must be disabled. Failures to write to `Json` are
+ignored, since there's no other place to report them, and they must not affect
+the main output.
+*/
+func (self LogWriter) Record(rec LogRecord) error {
+	LOG_MUT.Lock()
+	defer LOG_MUT.Unlock()
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	if rec.Level == `` {
+		rec.Level = LOG_LEVEL_INFO
+	}
+
+	var line []byte
+	if self.Json != nil || self.JsonText {
+		line = append(gg.JsonBytes(rec), '\n')
+	}
+	if self.Json != nil {
+		_, _ = self.Json.Write(line)
+	}
+	if self.Quiet && rec.Level != LOG_LEVEL_ERROR {
+		return nil
+	}
+
+	if self.JsonText {
+		_, err := self.Text.Write(line)
+		return err
+	}
+	_, err := io.WriteString(self.Text, rec.Time.Format(`2006/01/02 15:04:05 `)+rec.Msg+"\n")
+	return err
+}
+
+/*
+Logs a record with fields for JSON logs. With text logs, only the message is
+printed, exactly as by `log.Println`. Every log call which knows its entry,
+path, or event should use this instead of `log.Printf`, so that JSON consumers
+don't have to parse messages.
+*/
+func logRecord(rec LogRecord) {
+	out, ok := log.Writer().(LogWriter)
+	if !ok {
+		log.Println(rec.Msg)
+		return
+	}
+	_ = out.Record(rec)
+}
+
+/*
+Logs a message at the level "error", for errors which aren't reported by
+`logErr`, such as failures to watch the config file, so that they're still
+printed in quiet mode.
+*/
+func logErrorf(pat string, arg ...any) {
+	logRecord(LogRecord{Level: LOG_LEVEL_ERROR, Msg: fmt.Sprintf(pat, arg...)})
+}
+
+/*
+Returns the messages of the error and its causes, outermost first, such as
+`["unable to back up ...", "open ...: permission denied"]`. Errors other than
+`gg.Err` end the chain with their full message.
+*/
+func errChain(err error) (out []string) {
+	for err != nil {
+		val, ok := err.(gg.Err)
+		if ptr, isPtr := err.(*gg.Err); isPtr && ptr != nil {
+			val, ok = *ptr, true
+		}
+		if !ok {
+			return append(out, err.Error())
+		}
+		if val.Msg != `` {
+			out = append(out, val.Msg)
+		}
+		err = val.Cause
+	}
+	return
+}
+
+/*
+Installs `LogWriter` when JSON logs are enabled by `-log-format` or
+`-json-logs-to`, or in quiet mode. Otherwise, logs are left as they are.
+*/
+func initLogs() {
+	if FLAGS.Quiet && (FLAGS.Verbose || FLAGS.Decisions) {
+		panic(gg.Errf(`"-q" can't be used with "-v" or "-decisions"`))
+	}
+
+	switch FLAGS.LogFormat {
+	case ``, LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+	default:
+		panic(gg.Errf(
+			`unknown log format %q, expected %q or %q`,
+			FLAGS.LogFormat, LOG_FORMAT_TEXT, LOG_FORMAT_JSON,
+		))
+	}
+
+	out := LogWriter{Text: os.Stderr, JsonText: FLAGS.LogFormat == LOG_FORMAT_JSON, Quiet: FLAGS.Quiet}
+
+	if path := FLAGS.JsonLogsTo; path != `` {
+		defer gg.Detailf(`unable to open JSON log file %v`, fmtPath(path))
+		out.Json = gg.Try1(os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666))
+	}
+
+	if out.Json == nil && !out.JsonText && !out.Quiet {
+		return
+	}
+	log.SetFlags(0)
+	log.SetOutput(out)
+}
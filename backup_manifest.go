@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Suffix of manifest files. The manifest of a backup is stored next to it, with
+its name being the backup name plus this suffix. This suffix never decodes as
+a related name of the backup (see `IndexedName.Decode`), which keeps manifests
+out of the backup sequence.
+*/
+const MANIFEST_EXT = `.manifest.json`
+
+/*
+Checksum manifest of one backup, written when the config option `manifest` is
+enabled. Keys of `Files` are slash-separated paths relative to the backup; for
+a single-file backup, the only key is ".".
+*/
+type Manifest struct {
+	Created time.Time               `json:"created"`
+	Size    uint64                  `json:"size"`
+	Files   map[string]ManifestFile `json:"files"`
+
+	// Only in stored backups: path of the store directory, relative to the
+	// directory of the backup. See `STORE_DIR`.
+	Store string `json:"store,omitempty"`
+}
+
+type ManifestFile struct {
+	Size   uint64 `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+func manifestPath(backupPath string) string { return backupPath + MANIFEST_EXT }
+
+func newManifest() *Manifest {
+	return &Manifest{
+		Created: time.Now(),
+		Files:   map[string]ManifestFile{},
+	}
+}
+
+/*
+Returns a hash for computing a file checksum while copying, or nil when
+manifests are disabled, in which case `Manifest.Add` is a nop.
+*/
+func (self *Manifest) Hash() hash.Hash {
+	if self == nil {
+		return nil
+	}
+	return sha256.New()
+}
+
+func (self *Manifest) Add(root, path string, size uint64, hash hash.Hash) {
+	if self == nil {
+		return
+	}
+
+	self.Size += size
+	self.Files[filepath.ToSlash(gg.Try1(filepath.Rel(root, path)))] = ManifestFile{
+		Size:   size,
+		Sha256: hex.EncodeToString(hash.Sum(nil)),
+	}
+}
+
+func (self *Manifest) Write(backupPath string) {
+	if self == nil {
+		return
+	}
+	defer gg.Detailf(`unable to write manifest of %v`, fmtPath(backupPath))
+	gg.JsonEncodeFile(manifestPath(backupPath), self)
+}
+
+// Returns nil if the manifest doesn't exist.
+func readManifest(backupPath string) (out *Manifest) {
+	path := manifestPath(backupPath)
+	if !gg.FileExists(path) {
+		return nil
+	}
+
+	defer gg.Detailf(`unable to read manifest %v`, fmtPath(path))
+	gg.JsonDecodeFile(path, &out)
+	return
+}
+
+/*
+Compares the files of a backup against its manifest. Returns a description of
+each problem: missing files, size mismatches, checksum mismatches. Files not
+listed in the manifest are ignored.
+*/
+func (self Manifest) Verify(backupPath string) (out []string) {
+	for _, key := range gg.SortedPrim(gg.MapKeys(self.Files)) {
+		exp := self.Files[key]
+		path := filepath.Join(backupPath, filepath.FromSlash(key))
+
+		size, sum, err := fileChecksum(path)
+		if err != nil {
+			out = append(out, gg.Str(fmtPath(path), `: `, err.Error()))
+		} else if size != exp.Size {
+			out = append(out, gg.Str(fmtPath(path), `: expected size `, exp.Size, `, found `, size))
+		} else if sum != exp.Sha256 {
+			out = append(out, gg.Str(fmtPath(path), `: checksum mismatch`))
+		}
+	}
+	return
+}
+
+func fileChecksum(path string) (size uint64, sum string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	count, err := io.Copy(hash, file)
+	size = uint64(count)
+	sum = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+/*
+Verifies the most recent backup of the entry against its manifest, if there's
+one. Used on startup, when `verifyOnStart` is enabled, for early warning about
+degradation of the backup storage, such as bit rot. A missing manifest is
+reported as an error when manifests are enabled, since the backup can't be
+verified.
+*/
+func verifyLatest(run *RunState) {
+	defer gg.RecWith(logErr)
+	defer gg.Detailf(`unable to verify latest backup of %v`, run.Entry.FmtInput())
+
+	inp := run.GetIndexFormat().Parse(run.Entry.Input)
+	if run.MultiInput() {
+		inp = run.BackupName()
+	}
+	prev := gg.Last(gg.Sorted(relatedNames(run.Entry.Output, inp)))
+	if gg.IsZero(prev) {
+		return
+	}
+
+	path := filepath.Join(run.Entry.Output, prev.String())
+	manifest := readManifest(path)
+	if manifest == nil {
+		if run.GetManifest() {
+			logErrorf(`unable to verify %v: missing manifest`, fmtPath(path))
+		} else if FLAGS.Verbose {
+			log.Printf(`unable to verify %v: missing manifest`, fmtPath(path))
+		}
+		return
+	}
+
+	problems := manifest.Verify(path)
+	if len(problems) <= 0 {
+		if FLAGS.Verbose {
+			log.Printf(`verified %v: %v files OK`, fmtPath(path), len(manifest.Files))
+		}
+		return
+	}
+
+	logErrorf(`CORRUPTION DETECTED in backup %v:`, fmtPath(path))
+	for _, val := range problems {
+		logErrorf(`  %v`, val)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Default size of the buffer of each copy, the same as in `io.Copy`. Overridden
+by the config option `copyBufferSize`. See `copyBudgeted`.
+*/
+const COPY_BUFFER_SIZE = 32 << 10
+
+/*
+Max value of the config option `copyBufferSize`. Larger buffers don't speed up
+copying, and each copy in flight holds one.
+*/
+const COPY_BUFFER_MAX = 64 << 20
+
+/*
+Approximate memory of one deflate compressor, counted against the budget in
+addition to the copy buffer when compressing. See `zipInput` and
+`writeArchive`.
+*/
+const DEFLATE_MEMORY = 1 << 20
+
+/*
+Global budget of the memory used by copies in flight across all entries: copy
+buffers and compressor windows. Set from the config option `maxCopyMemory` on
+every config load. Zero means unlimited. Copies block until enough memory is
+released by other copies. A copy which needs more than the whole budget runs
+when no other copy is in flight, so it's never blocked forever.
+*/
+var MEMORY MemoryBudget
+
+type MemoryBudget struct {
+	sync.Mutex
+	Limit uint64
+	Used  uint64
+	Free  chan struct{} // Closed and replaced on every release.
+}
+
+func (self *MemoryBudget) SetLimit(val uint64) {
+	self.Lock()
+	defer self.Unlock()
+	self.Limit = val
+	self.notify()
+}
+
+/*
+Blocks until the given amount of memory is available or the context is done.
+On success, the returned function must be called to release the memory.
+*/
+func (self *MemoryBudget) Acquire(ctx context.Context, size uint64) (func(), error) {
+	ctx = gg.Or(ctx, context.Background())
+
+	for {
+		self.Lock()
+		if self.Limit == 0 || self.Used == 0 || self.Used+size <= self.Limit {
+			self.Used += size
+			self.Unlock()
+			return func() { self.release(size) }, nil
+		}
+		if self.Free == nil {
+			self.Free = make(chan struct{})
+		}
+		free := self.Free
+		self.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-free:
+		}
+	}
+}
+
+func (self *MemoryBudget) release(size uint64) {
+	self.Lock()
+	defer self.Unlock()
+	self.Used -= size
+	self.notify()
+}
+
+// Wakes up all waiters. Must be called with the lock held.
+func (self *MemoryBudget) notify() {
+	if self.Free != nil {
+		close(self.Free)
+		self.Free = nil
+	}
+}
+
+/*
+Like `io.Copy`, but with a buffer of the given size, or `COPY_BUFFER_SIZE` when
+zero, taken from `COPY_BUFFERS` and counted against `MEMORY`, plus the given
+additional memory used by the writer, such as a compressor. Fails without
+copying when the context is already cancelled, which interrupts backups
+between files when an entry stops.
+*/
+func copyBudgeted(ctx context.Context, tar io.Writer, src io.Reader, bufSize ByteSize, extra uint64) (int64, error) {
+	ctx = gg.Or(ctx, context.Background())
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	size := gg.Or(uint64(bufSize), COPY_BUFFER_SIZE)
+	done, err := MEMORY.Acquire(ctx, size+extra)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	buf := COPY_BUFFERS.Get(size)
+	defer COPY_BUFFERS.Put(buf)
+	return io.CopyBuffer(tar, src, *buf)
+}
+
+/*
+Copy buffers reused by concurrent and successive copies, rather than allocated
+for every file, with one `sync.Pool` per buffer size, since entries may have
+different values of `copyBufferSize`.
+*/
+var COPY_BUFFERS BufferPools
+
+type BufferPools struct {
+	sync.Mutex
+	Pools map[uint64]*sync.Pool
+}
+
+func (self *BufferPools) Get(size uint64) *[]byte {
+	return self.Pool(size).Get().(*[]byte)
+}
+
+func (self *BufferPools) Put(buf *[]byte) {
+	self.Pool(uint64(len(*buf))).Put(buf)
+}
+
+func (self *BufferPools) Pool(size uint64) *sync.Pool {
+	self.Lock()
+	defer self.Unlock()
+
+	pool := self.Pools[size]
+	if pool == nil {
+		pool = &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		gg.MapInit(&self.Pools)[size] = pool
+	}
+	return pool
+}
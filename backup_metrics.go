@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+const (
+	METRICS_PATH = `/metrics`
+	PAUSE_PATH   = `/pause`
+	RESUME_PATH  = `/resume`
+	STATUS_PATH  = `/status`
+)
+
+const METRICS_SHUTDOWN_TIMEOUT = time.Second * 5
+
+/*
+Upper bounds, in seconds, of the buckets of `backup_duration_seconds`, covering
+both small files and large directories.
+*/
+var METRICS_BUCKETS = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+/*
+Metrics of all entries since the start of the process, served with
+`-metrics-addr`. Updated by `RunState.Finish` and `finalize` regardless of
+whether the server is running. Replaced by tests.
+*/
+var METRICS = new(Metrics)
+
+/*
+Backup metrics in the Prometheus text format, written by hand to avoid depending
+on the Prometheus client. Counters and gauges are keyed by their labels (see
+`MetricLabels`).
+*/
+type Metrics struct {
+	sync.Mutex
+	Completed   map[MetricLabels]uint64
+	Failed      map[MetricLabels]uint64
+	Durations   map[MetricLabels]*Histogram
+	LastSuccess map[MetricLabels]time.Time
+	Retained    map[MetricLabels]uint64
+}
+
+/*
+Labels of one series. `Output` is set only for the gauge of retained backups,
+which is per output.
+*/
+type MetricLabels struct {
+	Entry  string
+	Output string
+}
+
+func (self MetricLabels) String() string {
+	out := `entry="` + escapeLabel(self.Entry) + `"`
+	if self.Output != `` {
+		out += `,output="` + escapeLabel(self.Output) + `"`
+	}
+	return out
+}
+
+type Histogram struct {
+	Counts []uint64 // Per bucket of `METRICS_BUCKETS`, non-cumulative.
+	Count  uint64
+	Sum    float64
+}
+
+func (self *Histogram) Observe(val float64) {
+	if self.Counts == nil {
+		self.Counts = make([]uint64, len(METRICS_BUCKETS))
+	}
+	for ind, max := range METRICS_BUCKETS {
+		if val <= max {
+			self.Counts[ind]++
+			break
+		}
+	}
+	self.Count++
+	self.Sum += val
+}
+
+/*
+Records the outcome of a backup. Skipped backups, such as up-to-date ones and
+dry runs, are neither completed nor failed.
+*/
+func (self *Metrics) Finish(run *RunState) {
+	self.Lock()
+	defer self.Unlock()
+
+	key := MetricLabels{Entry: run.Entry.GetName()}
+
+	switch run.Result {
+	case RESULT_OK:
+		gg.MapInit(&self.Completed)[key]++
+		gg.MapInit(&self.LastSuccess)[key] = time.Now()
+
+		hist := gg.MapInit(&self.Durations)[key]
+		if hist == nil {
+			hist = new(Histogram)
+			self.Durations[key] = hist
+		}
+		hist.Observe(time.Since(run.Started).Seconds())
+
+	case RESULT_ERROR:
+		gg.MapInit(&self.Failed)[key]++
+	}
+}
+
+// Sets the number of backups retained in the output of the run.
+func (self *Metrics) SetRetained(run *RunState, count int) {
+	self.Lock()
+	defer self.Unlock()
+
+	key := MetricLabels{Entry: run.Entry.GetName(), Output: run.Entry.Output}
+	gg.MapInit(&self.Retained)[key] = uint64(count)
+}
+
+func (self *Metrics) WriteTo(out io.Writer) (int64, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	var buf gg.Buf
+
+	writeHead := func(name, kind, help string) {
+		buf.AppendString(`# HELP ` + name + ` ` + help + "\n")
+		buf.AppendString(`# TYPE ` + name + ` ` + kind + "\n")
+	}
+
+	writeHead(`backup_completed_total`, `counter`, `Backups completed successfully.`)
+	for _, key := range sortedLabels(self.Completed) {
+		buf.Fprintf("backup_completed_total{%v} %v\n", key, self.Completed[key])
+	}
+
+	writeHead(`backup_failed_total`, `counter`, `Backups which failed.`)
+	for _, key := range sortedLabels(self.Failed) {
+		buf.Fprintf("backup_failed_total{%v} %v\n", key, self.Failed[key])
+	}
+
+	writeHead(`backup_duration_seconds`, `histogram`, `Durations of successful backups.`)
+	for _, key := range sortedLabels(self.Durations) {
+		hist := self.Durations[key]
+		var count uint64
+		for ind, max := range METRICS_BUCKETS {
+			count += hist.Counts[ind]
+			buf.Fprintf("backup_duration_seconds_bucket{%v,le=\"%v\"} %v\n", key, max, count)
+		}
+		buf.Fprintf("backup_duration_seconds_bucket{%v,le=\"+Inf\"} %v\n", key, hist.Count)
+		buf.Fprintf("backup_duration_seconds_sum{%v} %v\n", key, hist.Sum)
+		buf.Fprintf("backup_duration_seconds_count{%v} %v\n", key, hist.Count)
+	}
+
+	writeHead(`backup_last_success_timestamp_seconds`, `gauge`, `Unix time of the latest successful backup.`)
+	for _, key := range sortedLabels(self.LastSuccess) {
+		buf.Fprintf("backup_last_success_timestamp_seconds{%v} %v\n", key, self.LastSuccess[key].Unix())
+	}
+
+	writeHead(`backup_retained`, `gauge`, `Backups currently retained in the output.`)
+	for _, key := range sortedLabels(self.Retained) {
+		buf.Fprintf("backup_retained{%v} %v\n", key, self.Retained[key])
+	}
+
+	writeHead(`backup_paused`, `gauge`, `1 while backups are paused, otherwise 0.`)
+	paused := 0
+	if PAUSED.Load() {
+		paused = 1
+	}
+	buf.Fprintf("backup_paused %v\n", paused)
+
+	size, err := out.Write(buf)
+	return int64(size), err
+}
+
+func (self *Metrics) ServeHTTP(rew http.ResponseWriter, _ *http.Request) {
+	rew.Header().Set(`Content-Type`, `text/plain; version=0.0.4; charset=utf-8`)
+	_, _ = self.WriteTo(rew)
+}
+
+/*
+Serves `METRICS`, and controls and reports the pause state (see `PAUSED`):
+"POST /pause" and "POST /resume" act like `SIGUSR1` and `SIGUSR2`, and
+"GET /status" responds with JSON such as `{"paused":false}`.
+*/
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, http.HandlerFunc(func(rew http.ResponseWriter, req *http.Request) {
+		METRICS.ServeHTTP(rew, req)
+	}))
+	mux.Handle(PAUSE_PATH, pauseHandler(true))
+	mux.Handle(RESUME_PATH, pauseHandler(false))
+	mux.Handle(STATUS_PATH, http.HandlerFunc(serveStatus))
+	return mux
+}
+
+func pauseHandler(val bool) http.Handler {
+	return http.HandlerFunc(func(rew http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rew.Header().Set(`Allow`, http.MethodPost)
+			http.Error(rew, `method not allowed`, http.StatusMethodNotAllowed)
+			return
+		}
+		setPaused(val)
+		serveStatus(rew, req)
+	})
+}
+
+// Status of the process, served at `STATUS_PATH`.
+type Status struct {
+	Paused bool `json:"paused"`
+}
+
+func serveStatus(rew http.ResponseWriter, _ *http.Request) {
+	rew.Header().Set(`Content-Type`, `application/json`)
+	_, _ = rew.Write(gg.JsonBytes(Status{Paused: PAUSED.Load()}))
+}
+
+/*
+Starts serving `metricsHandler` at the given address when it's non-empty, until
+the context is cancelled. Listening happens synchronously, so that an
+unavailable address fails the startup.
+*/
+func serveMetrics(ctx context.Context, addr string) {
+	if addr == `` {
+		return
+	}
+
+	defer gg.Detailf(`unable to serve metrics at %q`, addr)
+
+	lis := gg.Try1(net.Listen(`tcp`, addr))
+	srv := &http.Server{Handler: metricsHandler()}
+
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), METRICS_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+
+	go func() {
+		defer gg.RecWith(logErr)
+		err := srv.Serve(lis)
+		if err != http.ErrServerClosed {
+			panic(gg.Wrapf(err, `metrics server failed`))
+		}
+	}()
+
+	if FLAGS.Verbose {
+		log.Printf(`serving metrics at http://%v%v`, lis.Addr(), METRICS_PATH)
+	}
+}
+
+func sortedLabels[Val any](src map[MetricLabels]Val) []MetricLabels {
+	out := gg.MapKeys(src)
+	sort.Slice(out, func(one, two int) bool {
+		if out[one].Entry != out[two].Entry {
+			return out[one].Entry < out[two].Entry
+		}
+		return out[one].Output < out[two].Output
+	})
+	return out
+}
+
+// Escapes a label value as required by the Prometheus text format.
+func escapeLabel(src string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(src)
+}
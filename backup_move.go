@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Values of the entry option `mode`. In the default copy mode, the input is left
+untouched. In move mode, for spooling workflows, the files of each successful
+backup are removed from the input, turning the tool into a versioned spooler.
+
+Sources are removed only after the new backup is fully written and verified
+against its manifest, when enabled, and each source is removed only if its
+checksum still matches the backed-up copy. A file modified after being copied
+stays in the input, and the next backup picks it up. The directories of the
+input are kept only when they still contain files; the input itself is kept.
+
+Removing sources produces FS events, which trigger another backup. When the
+input has no files left, that backup is skipped, rather than producing an
+empty one. For the same reason, move mode requires a directory input and an
+output outside of the input, and can't be combined with "routes", "zip" or
+"store".
+*/
+const (
+	MODE_COPY = `copy`
+	MODE_MOVE = `move`
+)
+
+func (self RunState) GetMove() bool {
+	switch self.Entry.Mode {
+	case ``, MODE_COPY:
+		return false
+	case MODE_MOVE:
+		return true
+	default:
+		panic(gg.Errf(`unrecognized mode %q, expected %q or %q`, self.Entry.Mode, MODE_COPY, MODE_MOVE))
+	}
+}
+
+func validateMove(run *RunState) {
+	if len(run.Entry.Routes) > 0 || len(run.Entry.GetOutputs()) > 1 || run.GetZip() || run.GetStore() {
+		panic(gg.Errf(`mode %q can't be combined with "routes", "outputs", "zip" or "store"`, MODE_MOVE))
+	}
+	if !gg.DirExists(run.Entry.Input) {
+		panic(gg.Errf(`mode %q requires a directory input`, MODE_MOVE))
+	}
+	if inputRel(run.Entry.Input, run.Entry.Output) != `` {
+		panic(gg.Errf(`mode %q requires an output outside of the input`, MODE_MOVE))
+	}
+}
+
+// True if the input has at least one file included in backups.
+func hasFiles(run *RunState) (out bool) {
+	gg.Try(filepath.WalkDir(run.Entry.Input, func(path string, src fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !run.Includes(path, src) {
+			return skipEntry(src)
+		}
+		if !src.IsDir() {
+			out = true
+			return fs.SkipAll
+		}
+		return nil
+	}))
+	return
+}
+
+/*
+Removes the sources of the files of the given backup from the input. Failures
+are logged, but don't fail the backup, which is already complete.
+*/
+func moveInput(run *RunState, path string) {
+	defer gg.RecWith(logErr)
+	defer gg.Detailf(`unable to move files from %v`, fmtPath(run.Entry.Input))
+
+	var dirs []string
+
+	gg.Try(filepath.WalkDir(path, func(tar string, val fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		src := filepath.Join(run.Entry.Input, gg.Try1(filepath.Rel(path, tar)))
+		if val.IsDir() {
+			dirs = append(dirs, src)
+		} else {
+			moveFile(run, src, tar)
+		}
+		return nil
+	}))
+
+	// Innermost first. Non-empty directories, and the input itself, are kept.
+	for ind := len(dirs) - 1; ind > 0; ind-- {
+		_ = os.Remove(dirs[ind])
+	}
+}
+
+func moveFile(run *RunState, src, tar string) {
+	defer gg.RecWith(logErr)
+	defer gg.Detailf(`unable to remove moved file %v`, fmtPath(src))
+
+	srcSize, srcSum := gg.Try2(fileChecksum(src))
+	tarSize, tarSum := gg.Try2(fileChecksum(tar))
+
+	if srcSize != tarSize || srcSum != tarSum {
+		logDecision(run, `keeping %v: modified after being copied`, fmtPath(src))
+		return
+	}
+	gg.Try(os.Remove(src))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Values of the config option `naming`. With "index", backups are named with
+incrementing indices, such as "app_<index>.log". With "timestamp", they're named
+with the UTC time of the backup, such as "app_2024-01-02T15-04-05.log", formatted
+with the layout `timestampLayout`, which sorts in wall-clock order across
+restarts and machines. Either way, the encoded value is decoded into `Index`,
+which orders backups; for timestamps, it's the Unix time in nanoseconds.
+*/
+const (
+	NAMING_INDEX     = `index`
+	NAMING_TIMESTAMP = `timestamp`
+)
+
+/*
+Default layout of timestamps in names of backups, in the format of Go's "time"
+package. Unlike RFC 3339, it avoids colons, which are invalid in file names on
+Windows.
+*/
+const TIMESTAMP_LAYOUT = `2006-01-02T15-04-05`
+
+/*
+When the current time encodes to a name not after the latest backup, such as for
+backups made within one second with the default layout, the next name is the
+latest one plus the first of these steps that changes it.
+*/
+var TIMESTAMP_STEPS = []time.Duration{
+	time.Millisecond, time.Second, time.Minute, time.Hour, time.Hour * 24,
+}
+
+func (self IndexFormat) IsTimestamp() bool { return self.Naming == NAMING_TIMESTAMP }
+
+func (self IndexFormat) GetLayout() string { return gg.Or(self.Layout, TIMESTAMP_LAYOUT) }
+
+func (self IndexFormat) validateNaming() {
+	switch self.Naming {
+	case ``, NAMING_INDEX:
+		return
+	case NAMING_TIMESTAMP:
+	default:
+		panic(gg.Errf(`unrecognized "naming" %q, expected %q or %q`, self.Naming, NAMING_INDEX, NAMING_TIMESTAMP))
+	}
+
+	// Separators would make decoding ambiguous.
+	layout := self.GetLayout()
+	if strings.Contains(layout, self.GetSep()) || strings.ContainsAny(layout, `./\:`) {
+		panic(gg.Errf(`invalid "timestampLayout" %q: must not contain %q, ".", ":" or slashes`, layout, self.GetSep()))
+	}
+
+	ref := self.TimestampIndex(time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC))
+	if _, ok := self.decodeTimestamp(self.encodeTimestamp(ref)); !ok {
+		panic(gg.Errf(`invalid "timestampLayout" %q: unable to decode the timestamps it encodes`, layout))
+	}
+}
+
+func (self IndexFormat) encodeTimestamp(val Index) string {
+	return time.Unix(0, int64(val)).UTC().Format(self.GetLayout())
+}
+
+func (self IndexFormat) decodeTimestamp(src string) (Index, bool) {
+	val, err := time.ParseInLocation(self.GetLayout(), src, time.UTC)
+	if err != nil || val.UnixNano() <= 0 {
+		return 0, false
+	}
+	return Index(val.UnixNano()), true
+}
+
+// Returns the index of the given time, truncated to the precision of the layout.
+func (self IndexFormat) TimestampIndex(val time.Time) Index {
+	out, _ := self.decodeTimestamp(time.Unix(0, val.UnixNano()).UTC().Format(self.GetLayout()))
+	return out
+}
+
+/*
+Returns the timestamp index of a backup made at the given time, which is always
+after the previous one. See `TIMESTAMP_STEPS`.
+*/
+func (self IndexFormat) NextTimestamp(prev Index, now time.Time) Index {
+	next := self.TimestampIndex(now)
+	if next > prev {
+		return next
+	}
+
+	for _, step := range TIMESTAMP_STEPS {
+		next = self.TimestampIndex(time.Unix(0, int64(prev)).Add(step))
+		if next > prev {
+			return next
+		}
+	}
+	panic(gg.Errf(`unable to name the backup following %q with "timestampLayout" %q`, self.encodeTimestamp(prev), self.GetLayout()))
+}
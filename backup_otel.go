@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Minimal OpenTelemetry tracing: spans are batched and exported to an OTLP/HTTP
+collector as JSON, which avoids depending on the OTel SDK. Tracing is enabled
+by the config field `otelEndpoint`, for example "http://localhost:4318".
+
+Every config load, including restarts on config changes, produces a short "run"
+span linked to the previous one. Every backup is the root span of its own trace,
+linked to the "run" span of its config. In verbose mode, each file copy is a
+child span of the backup.
+
+All span methods are nil-safe, allowing call sites to ignore whether tracing is
+enabled.
+*/
+
+const OTEL_TRACES_PATH = `/v1/traces`
+
+const OTEL_FLUSH_INTERVAL = time.Second * 5
+
+const OTEL_EXPORT_TIMEOUT = time.Second * 10
+
+const OTEL_BATCH_SIZE = 512
+
+const OTEL_SCOPE = `github.com/mitranim/backup`
+
+// Used for linking the "run" span of each config load to the previous one.
+var OTEL_PREV_RUN gg.Atom[SpanRef]
+
+type TraceId [16]byte
+
+func (self TraceId) String() string { return hex.EncodeToString(self[:]) }
+
+type SpanId [8]byte
+
+func (self SpanId) String() string { return hex.EncodeToString(self[:]) }
+
+type SpanRef struct {
+	Trace TraceId
+	Span  SpanId
+}
+
+func (self SpanRef) IsZero() bool { return self == SpanRef{} }
+
+type Tracer struct {
+	Exporter *OtelExporter
+	Run      SpanRef
+}
+
+/*
+Creates a tracer for one config load when tracing is enabled, starting the
+exporter in the background. The exporter flushes pending spans and stops when
+the context is cancelled. Returns nil when tracing is disabled.
+*/
+func newTracer(ctx context.Context, conf Config) *Tracer {
+	if conf.OtelEndpoint == `` {
+		return nil
+	}
+
+	exp := &OtelExporter{
+		Url:   strings.TrimSuffix(conf.OtelEndpoint, `/`) + OTEL_TRACES_PATH,
+		Spans: make(chan *Span, OTEL_BATCH_SIZE),
+		Done:  make(chan struct{}),
+	}
+	go exp.Run(ctx)
+
+	tracer := &Tracer{Exporter: exp}
+	span := tracer.Start(`run`)
+	span.Set(`config.path`, FLAGS.Config)
+	span.Set(`config.entries`, len(conf.Entries))
+
+	prev := OTEL_PREV_RUN.Swap(span.Ref())
+	if !prev.IsZero() {
+		span.Links = append(span.Links, prev)
+		span.Set(`config.restart`, true)
+	}
+
+	tracer.Run = span.Ref()
+	span.End(nil)
+	return tracer
+}
+
+/*
+Waits until the exporter flushes the pending spans and stops, after the context
+of the tracer is cancelled. For commands which exit after their backups.
+*/
+func (self *Tracer) Wait() {
+	if self != nil {
+		<-self.Exporter.Done
+	}
+}
+
+// Starts a new trace, linked to the "run" span, if any.
+func (self *Tracer) Start(name string) *Span {
+	if self == nil {
+		return nil
+	}
+
+	span := &Span{
+		Exporter: self.Exporter,
+		Trace:    newTraceId(),
+		Id:       newSpanId(),
+		Name:     name,
+		Start:    time.Now(),
+	}
+	if !self.Run.IsZero() {
+		span.Links = append(span.Links, self.Run)
+	}
+	return span
+}
+
+type Span struct {
+	Exporter *OtelExporter
+	Trace    TraceId
+	Id       SpanId
+	Parent   SpanId
+	Name     string
+	Start    time.Time
+	Finish   time.Time
+	Attrs    []OtelAttr
+	Links    []SpanRef
+	Err      error
+}
+
+func (self *Span) Ref() (_ SpanRef) {
+	if self == nil {
+		return
+	}
+	return SpanRef{self.Trace, self.Id}
+}
+
+func (self *Span) Child(name string) *Span {
+	if self == nil {
+		return nil
+	}
+	return &Span{
+		Exporter: self.Exporter,
+		Trace:    self.Trace,
+		Id:       newSpanId(),
+		Parent:   self.Id,
+		Name:     name,
+		Start:    time.Now(),
+	}
+}
+
+// Supports strings, booleans, and integers. Other values are stringified.
+func (self *Span) Set(key string, val any) {
+	if self != nil {
+		self.Attrs = append(self.Attrs, OtelAttr{key, otelValue(val)})
+	}
+}
+
+// Must be called once. Queues the span for export, dropping it if the queue
+// is full or the exporter has stopped.
+func (self *Span) End(err error) {
+	if self == nil {
+		return
+	}
+
+	self.Finish = time.Now()
+	self.Err = err
+
+	select {
+	case self.Exporter.Spans <- self:
+	default:
+		if FLAGS.Verbose {
+			log.Printf(`dropping trace span %q: export queue is full`, self.Name)
+		}
+	}
+}
+
+func (self *Span) Encode() OtelSpan {
+	out := OtelSpan{
+		TraceId:           self.Trace.String(),
+		SpanId:            self.Id.String(),
+		Name:              self.Name,
+		Kind:              OTEL_SPAN_KIND_INTERNAL,
+		StartTimeUnixNano: otelTime(self.Start),
+		EndTimeUnixNano:   otelTime(self.Finish),
+		Attributes:        self.Attrs,
+		Status:            OtelStatus{Code: OTEL_STATUS_OK},
+	}
+
+	if self.Parent != (SpanId{}) {
+		out.ParentSpanId = self.Parent.String()
+	}
+
+	for _, link := range self.Links {
+		out.Links = append(out.Links, OtelLink{
+			TraceId: link.Trace.String(),
+			SpanId:  link.Span.String(),
+		})
+	}
+
+	if self.Err != nil {
+		out.Status = OtelStatus{Code: OTEL_STATUS_ERROR, Message: self.Err.Error()}
+	}
+	return out
+}
+
+type OtelExporter struct {
+	Url    string
+	Spans  chan *Span
+	Client http.Client
+	Done   chan struct{} // Closed after the final flush.
+}
+
+func (self *OtelExporter) Run(ctx context.Context) {
+	defer close(self.Done)
+
+	ticker := time.NewTicker(OTEL_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	var buf []*Span
+
+	for {
+		select {
+		case <-ctx.Done():
+			self.Drain(&buf)
+			self.Flush(buf)
+			return
+
+		case span := <-self.Spans:
+			buf = append(buf, span)
+			if len(buf) >= OTEL_BATCH_SIZE {
+				self.Flush(buf)
+				buf = buf[:0]
+			}
+
+		case <-ticker.C:
+			self.Flush(buf)
+			buf = buf[:0]
+		}
+	}
+}
+
+func (self *OtelExporter) Drain(buf *[]*Span) {
+	for {
+		select {
+		case span := <-self.Spans:
+			*buf = append(*buf, span)
+		default:
+			return
+		}
+	}
+}
+
+// Export errors are logged but otherwise ignored: tracing must never affect
+// backups.
+func (self *OtelExporter) Flush(src []*Span) {
+	if len(src) <= 0 {
+		return
+	}
+
+	err := gg.Catch(func() { self.Export(src) })
+	if err != nil {
+		logErr(gg.Wrapf(err, `unable to export %v trace spans to %q`, len(src), self.Url))
+	}
+}
+
+func (self *OtelExporter) Export(src []*Span) {
+	ctx, cancel := context.WithTimeout(context.Background(), OTEL_EXPORT_TIMEOUT)
+	defer cancel()
+
+	body := gg.JsonBytes(OtelRequest{ResourceSpans: []OtelResourceSpans{{
+		Resource: OtelResource{Attributes: otelResourceAttrs()},
+		ScopeSpans: []OtelScopeSpans{{
+			Scope: OtelScope{Name: OTEL_SCOPE},
+			Spans: gg.Map(src, (*Span).Encode),
+		}},
+	}}})
+
+	req := gg.Try1(http.NewRequestWithContext(ctx, http.MethodPost, self.Url, bytes.NewReader(body)))
+	req.Header.Set(`Content-Type`, `application/json`)
+
+	res := gg.Try1(self.Client.Do(req))
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		panic(gg.Errf(`unexpected response status %v`, res.Status))
+	}
+}
+
+func otelResourceAttrs() []OtelAttr {
+	host, _ := os.Hostname()
+	return []OtelAttr{
+		{`service.name`, otelValue(`backup`)},
+		{`host.name`, otelValue(host)},
+	}
+}
+
+func otelTime(src time.Time) string { return strconv.FormatInt(src.UnixNano(), 10) }
+
+func otelValue(src any) OtelValue {
+	switch src := src.(type) {
+	case string:
+		return OtelValue{StringValue: &src}
+	case bool:
+		return OtelValue{BoolValue: &src}
+	case int:
+		return otelInt(int64(src))
+	case int64:
+		return otelInt(src)
+	case uint64:
+		return otelInt(int64(src))
+	default:
+		str := fmt.Sprint(src)
+		return OtelValue{StringValue: &str}
+	}
+}
+
+// OTLP JSON encodes 64-bit integers as strings.
+func otelInt(src int64) OtelValue {
+	str := strconv.FormatInt(src, 10)
+	return OtelValue{IntValue: &str}
+}
+
+func newTraceId() (out TraceId) {
+	gg.Try1(rand.Read(out[:]))
+	return
+}
+
+func newSpanId() (out SpanId) {
+	gg.Try1(rand.Read(out[:]))
+	return
+}
+
+// Subset of the OTLP JSON encoding. See
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+
+const OTEL_SPAN_KIND_INTERNAL = 1
+
+const (
+	OTEL_STATUS_OK    = 1
+	OTEL_STATUS_ERROR = 2
+)
+
+type OtelRequest struct {
+	ResourceSpans []OtelResourceSpans `json:"resourceSpans"`
+}
+
+type OtelResourceSpans struct {
+	Resource   OtelResource     `json:"resource"`
+	ScopeSpans []OtelScopeSpans `json:"scopeSpans"`
+}
+
+type OtelResource struct {
+	Attributes []OtelAttr `json:"attributes"`
+}
+
+type OtelScopeSpans struct {
+	Scope OtelScope  `json:"scope"`
+	Spans []OtelSpan `json:"spans"`
+}
+
+type OtelScope struct {
+	Name string `json:"name"`
+}
+
+type OtelSpan struct {
+	TraceId           string     `json:"traceId"`
+	SpanId            string     `json:"spanId"`
+	ParentSpanId      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []OtelAttr `json:"attributes,omitempty"`
+	Links             []OtelLink `json:"links,omitempty"`
+	Status            OtelStatus `json:"status"`
+}
+
+type OtelLink struct {
+	TraceId string `json:"traceId"`
+	SpanId  string `json:"spanId"`
+}
+
+type OtelStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type OtelAttr struct {
+	Key   string    `json:"key"`
+	Value OtelValue `json:"value"`
+}
+
+type OtelValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Suffix of pin files. A backup with a pin file next to it, named like the backup
+plus this suffix, is exempt from retention. Like `MANIFEST_EXT`, this suffix
+never decodes as a related name of the backup. Created by `backup pin`; delete
+the file to unpin the backup.
+*/
+const PIN_EXT = `.pin`
+
+func pinPath(backupPath string) string { return backupPath + PIN_EXT }
+
+/*
+True if retention must never delete the given backup: its name matches one of
+the `keep` patterns of the entry, or it has a pin file. Pinned backups don't
+count towards the limit.
+*/
+func (self RunState) Pinned(name IndexedName) bool {
+	str := name.String()
+	for _, pattern := range self.Entry.Keep {
+		if globMatch(pattern, str) {
+			return true
+		}
+	}
+	return gg.FileExists(pinPath(filepath.Join(self.Entry.Output, str)))
+}
+
+func cmdPin(args []string) {
+	if len(args) != 2 {
+		panic(gg.Errf(`expected an entry pattern and a backup index, got %q`, args))
+	}
+
+	conf := readConfig()
+	var count int
+
+	for _, entry := range conf.Entries {
+		if !entry.Match(args[:1]) {
+			continue
+		}
+
+		run := RunState{Config: conf, Entry: entry}
+		for _, tar := range run.Targets() {
+			if pinBackup(tar, args[1]) {
+				count++
+			}
+		}
+	}
+
+	if count <= 0 {
+		panic(gg.Errf(`found no backup with index %q in entries matching %q`, args[1], args[0]))
+	}
+}
+
+func pinBackup(run *RunState, src string) bool {
+	format := run.GetIndexFormat()
+	ind, ok := format.DecodeIndex(src)
+	if !ok {
+		panic(gg.Errf(`invalid backup index %q`, src))
+	}
+
+	for _, name := range relatedNames(run.Entry.Output, run.BackupName()) {
+		if name.Index != ind {
+			continue
+		}
+
+		path := filepath.Join(run.Entry.Output, name.String())
+		defer gg.Detailf(`unable to pin %v`, fmtPath(path))
+
+		gg.Try(os.WriteFile(pinPath(path), nil, 0o666))
+		log.Printf(`pinned %v`, fmtPath(path))
+		return true
+	}
+	return false
+}
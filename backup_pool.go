@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Bounded pool of the file copies of one backup, used by the built-in copying
+when `concurrency` is above 1 (see `copyTree`). The walk of the input stays
+sequential: it creates each directory before submitting the copies of its
+files, and defers finishing directories, such as copying their times, until
+every copy is done, since writing files into a directory changes its time.
+
+All methods are nil-safe: without a pool, copies and deferred functions run
+immediately, which keeps call sites the same for sequential copying.
+
+Workers must not modify the run state, which the walk reads and copies without
+locking. Their copy stats are collected in `Stats`, and added to the run by
+`copyTree` once they're done. See `RunState.AddStats`.
+*/
+type CopyPool struct {
+	sync.Mutex
+	Group  sync.WaitGroup
+	Slots  chan struct{}
+	Err    error
+	Finish []func()
+	Stats  CopyStats
+}
+
+func newCopyPool(size int) *CopyPool {
+	return &CopyPool{Slots: make(chan struct{}, size)}
+}
+
+/*
+Runs the function on a worker, waiting for a free one. The first failure of a
+worker is stored and re-panicked by the next call, which stops the walk early.
+*/
+func (self *CopyPool) Go(fun func()) {
+	if self == nil {
+		fun()
+		return
+	}
+
+	gg.Try(self.Failure())
+	self.Slots <- struct{}{}
+	self.Group.Add(1)
+
+	go func() {
+		defer self.Group.Done()
+		defer func() { <-self.Slots }()
+
+		err := gg.Catch(fun)
+		if err != nil {
+			self.Lock()
+			defer self.Unlock()
+			if self.Err == nil {
+				self.Err = err
+			}
+		}
+	}()
+}
+
+func (self *CopyPool) Failure() error {
+	self.Lock()
+	defer self.Unlock()
+	return self.Err
+}
+
+// Guards the state of the run shared by workers, such as copy stats.
+func (self *CopyPool) Locked(fun func()) {
+	if self == nil {
+		fun()
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	fun()
+}
+
+/*
+Adds to the copy stats of the run, or, while copying in parallel, to the stats
+of the pool. Safe to call from workers.
+*/
+func (self *RunState) AddStats(val CopyStats) {
+	if self.Pool == nil {
+		self.Stats.Add(val)
+		return
+	}
+	self.Pool.Locked(func() { self.Pool.Stats.Add(val) })
+}
+
+// Must be called only by the walk, which is sequential.
+func (self *CopyPool) Defer(fun func()) {
+	if self == nil {
+		fun()
+		return
+	}
+	self.Finish = append(self.Finish, fun)
+}
+
+/*
+Waits for all copies, then runs the deferred functions in order, which finishes
+directories bottom-up. Panics with the first failure of a worker.
+*/
+func (self *CopyPool) Wait() {
+	self.Group.Wait()
+	gg.Try(self.Failure())
+	for _, fun := range self.Finish {
+		fun()
+	}
+}
+
+/*
+Copies the input to the target like `copyRecursive`, on a pool of
+`concurrency` workers when it's above 1. Dry runs only log, and stay
+sequential. On failure, waits for running copies before returning, so that
+removing the incomplete backup doesn't race with them.
+*/
+func copyTree(run *RunState, src, tar, dir string) {
+	if run.Limiter == nil {
+		run.Limiter = newRateLimiter(run)
+	}
+	run.Cipher = run.GetEncrypt().Cipher()
+
+	size := run.GetConcurrency()
+	if size <= 1 || FLAGS.DryRun {
+		copyRecursive(run, src, tar, dir)
+		return
+	}
+
+	pool := newCopyPool(gg.NumConv[int](size))
+	run.Pool = pool
+	defer func() {
+		pool.Group.Wait()
+		run.Pool = nil
+		run.Stats.Add(pool.Stats)
+	}()
+
+	copyRecursive(run, src, tar, dir)
+	pool.Wait()
+}
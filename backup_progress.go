@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/mitranim/gg"
+)
+
+const DEFAULT_PROGRESS_THRESHOLD = ByteSize(100 << 20)
+
+const DEFAULT_PROGRESS_INTERVAL = Duration(10e9)
+
+/*
+Progress of copying one large file, logged periodically in verbose mode, so
+that a long copy can be told apart from a stuck one. Enabled for files of at
+least `progressThreshold` bytes, logged every `progressInterval`. Counts the
+bytes read from the input, which, unlike the written bytes, are comparable to
+its size when compressing.
+*/
+type Progress struct {
+	Path  string
+	Total int64
+	Done  atomic.Int64
+}
+
+/*
+Wraps the reader into one counting the bytes read, or returns it as-is when
+the progress is nil.
+*/
+func (self *Progress) Reader(src io.Reader) io.Reader {
+	if self == nil {
+		return src
+	}
+	return ProgressReader{src, self}
+}
+
+func (self *Progress) Log() {
+	done := self.Done.Load()
+	percent := float64(100)
+	if self.Total > 0 {
+		percent = float64(done) * 100 / float64(self.Total)
+	}
+	log.Printf(`copying %v: copied %v / %v bytes, %.0f%%`, fmtPath(self.Path), done, self.Total, percent)
+}
+
+type ProgressReader struct {
+	Reader   io.Reader
+	Progress *Progress
+}
+
+func (self ProgressReader) Read(buf []byte) (int, error) {
+	size, err := self.Reader.Read(buf)
+	self.Progress.Done.Add(int64(size))
+	return size, err
+}
+
+/*
+Starts logging the progress of copying the given file, if enabled for it.
+Returns nil when disabled. The returned function stops logging, and must be
+called when the copy is done; it waits for the logging goroutine to exit.
+Logging also stops when the context is cancelled.
+*/
+func startProgress(run *RunState, path string) (*Progress, func()) {
+	interval := run.GetProgressInterval().Duration()
+	if !FLAGS.Verbose || interval <= 0 {
+		return nil, func() {}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || ByteSize(info.Size()) < run.GetProgressThreshold() {
+		return nil, func() {}
+	}
+
+	out := &Progress{Path: path, Total: info.Size()}
+	ctx := gg.Or(run.Ctx, context.Background())
+	clock := run.GetClock()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-clock.After(interval):
+				out.Log()
+			}
+		}
+	}()
+
+	return out, func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Implementation of `backup prune [entry]`. Applies retention to the backups of
+all entries or the matching ones, the same way as after a backup, for example
+right after lowering `limit`, without waiting for the next change. With `-n`,
+only prints what would be deleted. Remote outputs and versioned zip backups are
+skipped: their retention is applied by their next backup.
+*/
+func cmdPrune(args []string) {
+	if len(args) > 1 {
+		panic(gg.Errf(`expected at most one entry pattern, got %q`, args))
+	}
+
+	conf := readConfig()
+	var failed int
+
+	for _, entry := range conf.Entries {
+		if !entry.Match(args) {
+			continue
+		}
+
+		run := RunState{Config: conf, Entry: entry}
+		for _, tar := range run.Targets() {
+			err := gg.Catch(func() { pruneOutput(tar) })
+			if err == nil {
+				err = tar.Retention
+			}
+			if err != nil {
+				logErr(err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		panic(gg.Errf(`unable to prune %v outputs`, failed))
+	}
+}
+
+func pruneOutput(run *RunState) {
+	dir := run.Entry.Output
+	defer gg.Detailf(`unable to prune %v`, fmtPath(dir))
+
+	if _, ok := parseRemote(dir); ok {
+		log.Printf(`skipping remote output %v`, fmtPath(dir))
+		return
+	}
+	if run.GetZip() {
+		log.Printf(`skipping %v: versioned zip backups are pruned by the next backup`, fmtPath(run.ZipPath()))
+		return
+	}
+
+	var deleted []IndexedName
+	if run.GetIncremental() {
+		outs := gg.Sorted(relatedNames(dir, run.IncrementalName()))
+		deleted = pruneIncremental(run, outs, incrementBases(dir, outs))
+	} else {
+		deleted = prune(run, gg.Sorted(relatedNames(dir, run.BackupName())))
+	}
+
+	if !FLAGS.DryRun {
+		log.Printf(`pruned %v backups in %v`, len(deleted), fmtPath(dir))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Bytes per second, such as "20MB/s" or "512KiB/s", with the units of
+`parseByteSize`. The suffix "/s" is optional. Zero means unlimited.
+*/
+type ByteRate uint64
+
+func (self ByteRate) String() string { return ByteSize(self).String() + `/s` }
+
+func (self *ByteRate) UnmarshalJSON(src []byte) error {
+	var str string
+	if json.Unmarshal(src, &str) == nil {
+		return self.UnmarshalText([]byte(str))
+	}
+	return json.Unmarshal(src, (*uint64)(self))
+}
+
+func (self *ByteRate) UnmarshalText(src []byte) error {
+	text := strings.TrimSpace(gg.ToString(src))
+	if len(text) >= 2 && strings.EqualFold(text[len(text)-2:], `/s`) {
+		text = text[:len(text)-2]
+	}
+
+	val, err := parseByteSize(text)
+	if err != nil {
+		return gg.Errf(`invalid byte rate %q, expected a byte size per second such as "20MB/s"`, src)
+	}
+	*self = ByteRate(val)
+	return nil
+}
+
+/*
+Limits the aggregate throughput of the file copies of one entry, including
+parallel copies and copies to several outputs, as set by `rateLimit`. Created
+once per entry (see `newRunState`), and shared by its targets.
+
+Each read reserves the next slot of time for its bytes, and waits until the
+slot begins, so the throughput over any period stays within the rate, plus at
+most one read buffer per copy. Uses the clock of the entry, which allows to
+test it deterministically.
+*/
+type RateLimiter struct {
+	sync.Mutex
+	Rate  ByteRate
+	Clock Clock
+	Next  time.Time
+}
+
+// Returns nil when the rate is unlimited.
+func newRateLimiter(run *RunState) *RateLimiter {
+	rate := run.GetRateLimit()
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{Rate: rate, Clock: run.GetClock()}
+}
+
+// Waits until the given number of bytes may pass. Nil-safe.
+func (self *RateLimiter) Wait(ctx context.Context, size int) error {
+	if self == nil || size <= 0 {
+		return nil
+	}
+
+	self.Lock()
+	now := self.Clock.Now()
+	if self.Next.Before(now) {
+		self.Next = now
+	}
+	delay := self.Next.Sub(now)
+	self.Next = self.Next.Add(time.Duration(float64(size) / float64(self.Rate) * float64(time.Second)))
+	self.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-self.Clock.After(delay):
+		return nil
+	}
+}
+
+/*
+Wraps the reader into one limited by the rate, or returns it as-is when the
+limiter is nil.
+*/
+func (self *RateLimiter) Reader(ctx context.Context, src io.Reader) io.Reader {
+	if self == nil {
+		return src
+	}
+	return RateReader{gg.Or(ctx, context.Background()), src, self}
+}
+
+/*
+Wraps the reader of a copy into one limited by the rate of the entry. Used by
+the copy paths other than `copyTree`, which creates the limiter up front for its
+workers. The limiter is created here when missing, such as when the run state
+wasn't made by `newRunState`.
+*/
+func (self *RunState) RateReader(src io.Reader) io.Reader {
+	if self.Limiter == nil {
+		self.Limiter = newRateLimiter(self)
+	}
+	return self.Limiter.Reader(self.Ctx, src)
+}
+
+type RateReader struct {
+	Ctx     context.Context
+	Reader  io.Reader
+	Limiter *RateLimiter
+}
+
+func (self RateReader) Read(buf []byte) (int, error) {
+	size, err := self.Reader.Read(buf)
+	if waitErr := self.Limiter.Wait(self.Ctx, size); waitErr != nil {
+		return size, waitErr
+	}
+	return size, err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Values of the config option `reflink`. With "auto" (default), copying a file
+to the same filesystem first tries to clone it as a reflink, which is nearly
+instant and shares the storage of the file until either copy is modified, on
+filesystems with copy-on-write support, such as Btrfs, XFS and APFS. On any
+failure, such as an unsupported filesystem, the file is copied as usual. With
+"never", files are always copied.
+*/
+const (
+	REFLINK_AUTO  = `auto`
+	REFLINK_NEVER = `never`
+)
+
+func validateReflink(val string) {
+	switch val {
+	case ``, REFLINK_AUTO, REFLINK_NEVER:
+	default:
+		panic(gg.Errf(`unrecognized "reflink" %q, expected %q or %q`, val, REFLINK_AUTO, REFLINK_NEVER))
+	}
+}
+
+/*
+Called by `copyFile`. Tries to clone the file, returning its size and true on
+success. Files which are transformed while copying, by compression or
+encryption, or hashed for a manifest, are always copied.
+*/
+func reflinkFile(run *RunState, srcPath, tarPath string) (int64, bool) {
+	if run.GetReflink() == REFLINK_NEVER || run.Manifest != nil || run.Cipher != nil || run.CompressExt() != `` {
+		return 0, false
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil || !sameDevice(srcPath, filepath.Dir(tarPath)) {
+		return 0, false
+	}
+
+	err = cloneFile(srcPath, tarPath)
+	if err == nil && run.GetFsync() {
+		err = syncFile(tarPath)
+	}
+	if err != nil {
+		_ = os.Remove(tarPath)
+		return 0, false
+	}
+	return info.Size(), true
+}
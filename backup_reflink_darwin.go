@@ -0,0 +1,17 @@
+//go:build darwin
+
+package main
+
+import "golang.org/x/sys/unix"
+
+/*
+Clones the file with `clonefile`, supported by APFS. The target must not
+exist.
+*/
+func cloneFile(srcPath, tarPath string) error {
+	return unix.Clonefile(srcPath, tarPath, unix.CLONE_NOFOLLOW)
+}
+
+func reflinkFormats() []Format {
+	return []Format{{`link`, `reflink`, `clonefile, see "reflink"`}}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package main
+
+import "github.com/mitranim/gg"
+
+// Reflinks are not supported on this platform. See `reflinkFile`.
+func cloneFile(string, string) error {
+	return gg.Errf(`reflinks are unsupported on this platform`)
+}
+
+func reflinkFormats() []Format { return nil }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Directory, inside the output directory, where `backup repair` moves the files
+which look like backups of the entry, but have malformed names, such as
+"inp_draft.txt" for the input "inp.txt". Nothing is deleted, so a wrong guess
+is easy to undo.
+*/
+const QUARANTINE_DIR = `.quarantine`
+
+// One step planned by `backup repair`: renaming a file of the output directory.
+type Repair struct {
+	From   string
+	To     string
+	Reason string
+}
+
+/*
+Implementation of `backup repair <entry>`. Fixes the names of the backups of
+the matching entries: wrong padding, such as after a manual rename or a change
+of the index radix, and duplicate indices, which are resolved by renumbering
+the later duplicates and the backups after them, preserving the order by index
+and then by modification time. Manifests and pin files are renamed along with
+their backups. With `-n`, only prints the plan.
+*/
+func cmdRepair(args []string) {
+	if len(args) != 1 {
+		panic(gg.Errf(`expected an entry pattern, got %q`, args))
+	}
+
+	conf := readConfig()
+	var count int
+
+	for _, entry := range conf.Entries {
+		if !entry.Match(args) {
+			continue
+		}
+
+		run := RunState{Config: conf, Entry: entry}
+		for _, tar := range run.Targets() {
+			count += repairOutput(tar)
+		}
+	}
+
+	if count <= 0 {
+		log.Printf(`found no problems in entries matching %q`, args[0])
+	}
+}
+
+func repairOutput(run *RunState) int {
+	dir := run.Entry.Output
+	defer gg.Detailf(`unable to repair %v`, fmtPath(dir))
+
+	plan := repairPlan(run)
+
+	// Renumbering only increases indices. Going from the highest one makes
+	// room for the lower ones.
+	for _, val := range gg.Reversed(plan) {
+		from := filepath.Join(dir, val.From)
+		to := filepath.Join(dir, val.To)
+
+		if FLAGS.DryRun {
+			log.Printf(`%v would rename %v to %v: %v`, DRY_RUN_PREFIX, fmtPath(from), fmtPath(to), val.Reason)
+			continue
+		}
+
+		if gg.FileExists(to) || gg.DirExists(to) {
+			panic(gg.Errf(`%v already exists`, fmtPath(to)))
+		}
+
+		gg.MkdirAll(filepath.Dir(to))
+		gg.Try(os.Rename(from, to))
+		for _, ext := range SIDECAR_EXTS {
+			if gg.FileExists(from + ext) {
+				gg.Try(os.Rename(from+ext, to+ext))
+			}
+		}
+		log.Printf(`renamed %v to %v: %v`, fmtPath(from), fmtPath(to), val.Reason)
+	}
+	return len(plan)
+}
+
+/*
+Returns the renames which fix the output directory of the entry, in order of
+the original indices. Versioned zip backups are a single file, and have nothing
+to repair.
+*/
+func repairPlan(run *RunState) (out []Repair) {
+	if run.GetZip() {
+		return nil
+	}
+
+	dir := run.Entry.Output
+	format := run.GetIndexFormat()
+	inp := run.BackupName()
+
+	type Found struct {
+		IndexedName
+		File string
+		Info os.FileInfo
+	}
+	var found []Found
+
+	for _, file := range gg.SortedPrim(readDir(dir)) {
+		val := format.Parse(file)
+
+		if inp.Related(val) && val.Index != 0 {
+			found = append(found, Found{val, file, gg.Try1(os.Lstat(filepath.Join(dir, file)))})
+			continue
+		}
+
+		if val.Index == 0 && val.Ext == inp.Ext && strings.HasPrefix(val.Name, inp.Name+format.GetSep()) {
+			out = append(out, Repair{file, filepath.Join(QUARANTINE_DIR, file), `malformed name`})
+		}
+	}
+
+	sort.SliceStable(found, func(one, two int) bool {
+		if found[one].Index != found[two].Index {
+			return found[one].Index < found[two].Index
+		}
+		return found[one].Info.ModTime().Before(found[two].Info.ModTime())
+	})
+
+	var prev Index
+	for _, val := range found {
+		next := val.IndexedName
+		next.IndexFormat = format
+		reason := `wrong padding`
+
+		if next.Index <= prev {
+			next.Index = format.Successor(prev)
+			reason = gg.Str(`duplicate index `, format.EncodeIndex(val.Index))
+		}
+		prev = next.Index
+
+		if next.String() != val.File {
+			out = append(out, Repair{val.File, next.String(), reason})
+		}
+	}
+	return
+}
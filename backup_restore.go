@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Implementation of `backup restore [-force] <entry> [index]`. Copies a backup of
+the one entry matching the pattern back to its input path: the backup with the
+given index, or the latest one. The first local output which has the backup is
+used. The backup replaces the input, rather than merging into it: files added
+to a directory input after the backup are gone after restoring it.
+
+An existing input is replaced only with `-force`; otherwise, the command prints
+what it would restore and fails. With `-n`, it only prints the plan. The backup
+is first copied next to the input under a temporary name, and then renamed into
+place, so a failed restore leaves the input as it was.
+*/
+func cmdRestore(args []string) {
+	flags := flag.NewFlagSet(`restore`, flag.ContinueOnError)
+	force := flags.Bool(`force`, false, `replace the existing input`)
+	gg.Try(flags.Parse(args))
+
+	args = flags.Args()
+	if len(args) < 1 || len(args) > 2 {
+		panic(gg.Errf(`expected an entry pattern and an optional backup index, got %q`, args))
+	}
+
+	conf := readConfig()
+	entries := gg.Filter(conf.Entries, func(val Entry) bool { return val.Match(args[:1]) })
+	if len(entries) != 1 {
+		panic(gg.Errf(`expected exactly one entry matching %q, found %v`, args[0], len(entries)))
+	}
+
+	var ind string
+	if len(args) > 1 {
+		ind = args[1]
+	}
+
+	run := RunState{Config: conf, Entry: entries[0]}
+	tar, name := findRestorable(run.Targets(), ind)
+	restoreBackup(tar, name, *force)
+}
+
+/*
+Returns the output and the name of the backup with the given encoded index, or
+of the latest backup when the index is empty.
+*/
+func findRestorable(targets []*RunState, src string) (*RunState, IndexedName) {
+	for _, tar := range targets {
+		if _, ok := parseRemote(tar.Entry.Output); ok {
+			continue
+		}
+		if tar.GetZip() {
+			panic(gg.Errf(`restoring versioned zip backups is unsupported; extract a folder of %v with any zip tool`, fmtPath(tar.ZipPath())))
+		}
+
+		format := tar.GetIndexFormat()
+		names := gg.Sorted(relatedNames(tar.Entry.Output, tar.BackupName()))
+
+		if src == `` {
+			if len(names) > 0 {
+				return tar, gg.Last(names)
+			}
+			continue
+		}
+
+		ind, ok := format.DecodeIndex(src)
+		if !ok {
+			panic(gg.Errf(`invalid backup index %q`, src))
+		}
+		for _, name := range names {
+			if name.Index == ind {
+				return tar, name
+			}
+		}
+	}
+
+	if src == `` {
+		panic(gg.Errf(`found no backups to restore`))
+	}
+	panic(gg.Errf(`found no backup with index %q`, src))
+}
+
+func restoreBackup(run *RunState, name IndexedName, force bool) {
+	inp := run.Entry.Input
+	path := filepath.Join(run.Entry.Output, name.String())
+	defer gg.Detailf(`unable to restore %v to %v`, fmtPath(path), fmtPath(inp))
+
+	if run.MultiInput() {
+		panic(gg.Errf(`restoring backups of entries with "inputs" is unsupported; copy the inputs back from %v`, fmtPath(path)))
+	}
+	if run.Archived() {
+		panic(gg.Errf(`restoring archived backups is unsupported; extract the backup with any tar tool`))
+	}
+	if name.Compress != `` || run.GetCompress() == COMPRESS_GZIP {
+		panic(gg.Errf(`restoring compressed backups is unsupported; decompress the backup with any gzip tool`))
+	}
+
+	_, err := os.Lstat(inp)
+	exists := err == nil
+
+	if FLAGS.DryRun || (exists && !force) {
+		if exists {
+			log.Printf(`%v would replace %v with %v`, DRY_RUN_PREFIX, fmtPath(inp), fmtPath(path))
+		} else {
+			log.Printf(`%v would restore %v to %v`, DRY_RUN_PREFIX, fmtPath(path), fmtPath(inp))
+		}
+		if !FLAGS.DryRun {
+			panic(gg.Errf(`the input already exists; pass "-force" to replace it`))
+		}
+		return
+	}
+
+	tmp := tempPath(inp)
+	defer removeIncomplete(tmp)
+
+	switch {
+	case run.GetStore():
+		extractStored(path, tmp)
+	case run.GetIncremental():
+		extractIncremental(path, tmp)
+	default:
+		var src RunState
+		src.Entry.Input = path
+		copyTree(&src, path, tmp, filepath.Dir(tmp))
+		decryptRestored(run, name, tmp)
+	}
+
+	if exists {
+		// Moved aside rather than deleted first, so that the input is never
+		// missing if the rename fails.
+		old := tmp + `.old`
+		gg.Try(os.Rename(inp, old))
+		err := os.Rename(tmp, inp)
+		if err != nil {
+			_ = os.Rename(old, inp)
+			panic(err)
+		}
+		gg.Try(removeBackup(old))
+	} else {
+		gg.Try(os.Rename(tmp, inp))
+	}
+
+	log.Printf(`restored %v to %v`, fmtPath(path), fmtPath(inp))
+}
+
+/*
+Decrypts the restored copy of an encrypted backup, using the current key of the
+entry. See `Encryption`.
+*/
+func decryptRestored(run *RunState, name IndexedName, path string) {
+	single := !gg.DirExists(path)
+	if single && name.Encrypt == `` {
+		return
+	}
+
+	aead := run.GetEncrypt().Cipher()
+	if aead == nil {
+		if single {
+			panic(gg.Errf(`the backup is encrypted, but "encrypt" has no key`))
+		}
+		return
+	}
+	decryptTree(aead, path, single)
+}
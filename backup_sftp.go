@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitranim/gg"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/*
+Scheme of remote outputs, such as "sftp://user@host:22/path/to/backups", where
+backups are uploaded over SFTP. The SSH key is taken from `Entry.SshKey`, and
+the server is verified against `Entry.SshKnownHosts`. Each backup opens its own
+connection, so a connection failure fails only that backup, and the next one
+connects again. See `remoteBackup`.
+*/
+const SFTP_SCHEME = `sftp`
+
+const SFTP_DEFAULT_PORT = `22`
+
+const SFTP_DIAL_TIMEOUT = time.Second * 30
+
+// Default of `Entry.SshKnownHosts`, relative to the home directory.
+const SSH_KNOWN_HOSTS = `.ssh/known_hosts`
+
+/*
+File operations on the output of a backup. Remote outputs are written through
+this interface (see `SftpStorage`). `LocalStorage` implements it for local
+directories, which allows to use and test the same logic locally.
+*/
+type Storage interface {
+	ReadDir(path string) ([]string, error)
+	MkdirAll(path string) error
+	Create(path string) (io.WriteCloser, error)
+	Chmod(path string, mode fs.FileMode) error
+	Chtimes(path string, atime, mtime time.Time) error
+	Rename(src, tar string) error
+	RemoveAll(path string) error
+	ModTime(path string) time.Time // Latest in the subtree. See `maxModTime`.
+	Join(...string) string
+	Close() error
+}
+
+type LocalStorage struct{}
+
+func (LocalStorage) ReadDir(path string) ([]string, error) { return gg.Catch11(readDir, path) }
+
+func (LocalStorage) MkdirAll(path string) error { return os.MkdirAll(path, os.ModePerm) }
+
+func (LocalStorage) Create(path string) (io.WriteCloser, error) { return os.Create(path) }
+
+func (LocalStorage) Chmod(path string, mode fs.FileMode) error { return os.Chmod(path, mode) }
+
+func (LocalStorage) Chtimes(path string, atime, mtime time.Time) error {
+	return os.Chtimes(path, atime, mtime)
+}
+
+func (LocalStorage) Rename(src, tar string) error { return os.Rename(src, tar) }
+
+func (LocalStorage) RemoveAll(path string) error { return removeBackup(path) }
+
+func (LocalStorage) Join(src ...string) string { return filepath.Join(src...) }
+
+func (LocalStorage) ModTime(path string) time.Time { return maxModTime(path, nil) }
+
+func (LocalStorage) Close() error { return nil }
+
+// Storage on an SFTP server. Paths are slash-separated.
+type SftpStorage struct {
+	Client *sftp.Client
+	Conn   io.Closer // SSH connection, if any.
+}
+
+func (self SftpStorage) ReadDir(path string) ([]string, error) {
+	infos, err := self.Client.ReadDir(path)
+	if isErrFileNotFound(err) {
+		return nil, nil
+	}
+	return gg.Map(infos, fs.FileInfo.Name), err
+}
+
+func (self SftpStorage) MkdirAll(path string) error { return self.Client.MkdirAll(path) }
+
+func (self SftpStorage) Create(path string) (io.WriteCloser, error) { return self.Client.Create(path) }
+
+func (self SftpStorage) Chmod(path string, mode fs.FileMode) error {
+	return self.Client.Chmod(path, mode)
+}
+
+func (self SftpStorage) Chtimes(path string, atime, mtime time.Time) error {
+	return self.Client.Chtimes(path, atime, mtime)
+}
+
+func (self SftpStorage) Rename(src, tar string) error { return self.Client.Rename(src, tar) }
+
+func (self SftpStorage) RemoveAll(path string) error { return self.Client.RemoveAll(path) }
+
+func (self SftpStorage) Join(src ...string) string { return path.Join(src...) }
+
+// Like `maxModTime`, ignores files which can't be read.
+func (self SftpStorage) ModTime(path string) (out time.Time) {
+	walk := self.Client.Walk(path)
+	for walk.Step() {
+		if walk.Err() != nil {
+			continue
+		}
+		if val := walk.Stat().ModTime(); val.After(out) {
+			out = val
+		}
+	}
+	return
+}
+
+func (self SftpStorage) Close() error {
+	err := self.Client.Close()
+	if self.Conn != nil {
+		_ = self.Conn.Close()
+	}
+	return err
+}
+
+// Parsed remote output. See `SFTP_SCHEME`.
+type RemoteOutput struct {
+	User string
+	Host string // With port.
+	Path string
+}
+
+func (self RemoteOutput) String() string {
+	return SFTP_SCHEME + `://` + self.User + `@` + self.Host + self.Path
+}
+
+/*
+Parses an output such as "sftp://user@host:22/path/to/backups". Returns false
+for local outputs. The path on the server is absolute.
+*/
+func parseRemote(src string) (out RemoteOutput, ok bool) {
+	if !strings.HasPrefix(src, SFTP_SCHEME+`://`) {
+		return
+	}
+
+	defer gg.Detailf(`invalid remote output %q`, src)
+	val := gg.Try1(url.Parse(src))
+
+	if val.User == nil || val.User.Username() == `` {
+		panic(gg.Errf(`missing user, expected %q`, SFTP_SCHEME+`://user@host/path`))
+	}
+	if val.Hostname() == `` {
+		panic(gg.Errf(`missing host`))
+	}
+
+	out.User = val.User.Username()
+	out.Host = net.JoinHostPort(val.Hostname(), gg.Or(val.Port(), SFTP_DEFAULT_PORT))
+	out.Path = gg.Or(val.Path, `/`)
+	return out, true
+}
+
+/*
+Connects to the SFTP server of the remote output, authenticating with the SSH
+key of the entry.
+*/
+func (self RemoteOutput) Dial(entry Entry) Storage {
+	defer gg.Detailf(`unable to connect to %v`, self)
+
+	if entry.SshKey == `` {
+		panic(gg.Errf(`remote outputs require "sshKey"`))
+	}
+	signer := gg.Try1(ssh.ParsePrivateKey(gg.ReadFile[[]byte](expandHome(entry.SshKey))))
+
+	known := entry.SshKnownHosts
+	if known == `` {
+		known = filepath.Join(gg.Try1(os.UserHomeDir()), SSH_KNOWN_HOSTS)
+	}
+	hostKey := gg.Try1(knownhosts.New(expandHome(known)))
+
+	conn := gg.Try1(ssh.Dial(`tcp`, self.Host, &ssh.ClientConfig{
+		User:            self.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKey,
+		Timeout:         SFTP_DIAL_TIMEOUT,
+	}))
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		panic(err)
+	}
+	return SftpStorage{Client: client, Conn: conn}
+}
+
+// Replaces a leading "~" with the home directory.
+func expandHome(src string) string {
+	rest, ok := strings.CutPrefix(src, `~`)
+	if !ok || (rest != `` && rest[0] != '/' && rest[0] != filepath.Separator) {
+		return src
+	}
+	return gg.Try1(os.UserHomeDir()) + rest
+}
+
+/*
+Backs up to a remote output, via `storageBackup`. Called by `backup`. Features
+which read or write the output as local files are not supported for remote
+outputs (see `validateRemote`).
+*/
+func remoteBackup(run *RunState, remote RemoteOutput) {
+	validateRemote(run)
+
+	if FLAGS.DryRun {
+		storageBackup(run, nil, remote.Path)
+		return
+	}
+
+	store := remote.Dial(run.Entry)
+	defer store.Close()
+	storageBackup(run, store, remote.Path)
+}
+
+func validateRemote(run *RunState) {
+	if run.GetZip() || run.GetIncremental() || run.GetStore() || run.GetStaging() ||
+		run.GetManifest() || run.GetVerify() || run.GetHistory() || run.GetRecordSize() ||
+		len(run.GetCopyCommand()) > 0 || run.GetMove() || run.CompressExt() != `` || run.EncryptExt() != `` ||
+		run.GetMaxAge() > 0 || run.GetMaxBytes() > 0 {
+		panic(gg.Errf(
+			`remote outputs can't be combined with "zip", "incremental", "store", "staging", "manifest", "verify", "history", "recordSize", "copyCommand", "compress", "encrypt", "maxAge", "maxBytes" or move mode`,
+		))
+	}
+}
+
+/*
+Makes a new backup in the given directory of the storage and deletes the old
+ones over `limit`, except those matching `keep`. Like `backup`, the backup is
+written under a temporary name (see `tempPath`) and renamed into place when
+complete. Temporary backups left by earlier failures are removed by the first
+backup of the entry. Also like `backup`, skips the backup when the latest one
+is up to date on startup, or when the input is unchanged with `skipUnchanged`.
+A nil storage means dry run.
+*/
+func storageBackup(run *RunState, store Storage, dir string) {
+	format := run.GetIndexFormat()
+	inp := format.Parse(run.Entry.Input)
+
+	var names []string
+	if store != nil {
+		names = gg.Try1(store.ReadDir(dir))
+	}
+	outs := gg.Sorted(gg.Filter(gg.Map(names, format.Parse), inp.Related))
+	prev := gg.Last(outs)
+
+	// Like in `backup`. A dry run has no previous backups. SFTP times have a
+	// precision of seconds.
+	if run.CheckUpToDate() && gg.IsNotZero(prev) {
+		path := store.Join(dir, prev.String())
+		if isUpToDateAt(run, store.ModTime(path), time.Second) {
+			logDecision(run, `skipping backup: %v is already up to date`, fmtPath(path))
+			run.Result = RESULT_UP_TO_DATE
+			run.Counters.UpToDate++
+			return
+		}
+	}
+
+	var hash string
+	if run.GetSkipUnchanged() {
+		hash = inputHash(run)
+		if hash == run.LastHash && gg.IsNotZero(prev) {
+			logDecision(run, `skipping backup: the content of %v is unchanged since the previous backup`, run.Entry.FmtInput())
+			run.Result = RESULT_UP_TO_DATE
+			run.Counters.UpToDate++
+			return
+		}
+	}
+
+	next := inp
+	next.Index = run.NextIndex(gg.MaxPrim2(prev.Index, run.PeerMax))
+	name := next.String()
+
+	if store == nil {
+		log.Printf(`%v would back up %v to %v`, DRY_RUN_PREFIX, fmtPath(run.Entry.Input), fmtPath(path.Join(run.Entry.Output, name)))
+		run.Result = RESULT_DRY_RUN
+		return
+	}
+
+	if run.Initial() {
+		removeStorageTemps(store, dir, inp, names)
+	}
+
+	run.Span.Set(`backup.output`, run.Entry.Output)
+	run.Span.Set(`backup.index`, uint64(next.Index))
+	run.Target = store.Join(dir, name)
+	run.Index = next.Index
+
+	temp := store.Join(dir, `.`+name+TEMP_INFIX+strconv.Itoa(os.Getpid()))
+	defer gg.Fail(func(error) { _ = store.RemoveAll(temp) })
+
+	gg.Try(store.MkdirAll(dir))
+	storageCopy(run, store, temp)
+	gg.Try(store.Rename(temp, run.Target))
+	run.LastHash = hash
+
+	if FLAGS.Verbose || FLAGS.Decisions {
+		logRecord(LogRecord{
+			Msg:   fmt.Sprintf(`backed up %v to %v`, fmtPath(run.Entry.Input), fmtPath(run.Target)),
+			Entry: run.Entry.GetName(),
+			Path:  run.Target,
+		})
+	}
+
+	run.Latest = run.GetClock().Now()
+	touchHealthFile(run)
+	defer runPostHook(run)
+
+	rotated := gg.Reject(append(outs, next), run.Pinned)
+	limit := gg.NumConv[int](run.GetLimit())
+	if limit <= 0 {
+		return
+	}
+
+	for _, val := range gg.Take(rotated, len(rotated)-limit) {
+		path := store.Join(dir, val.String())
+		err := store.RemoveAll(path)
+		if err != nil {
+			err = gg.Wrapf(err, `unable to delete old backup %v`, fmtPath(path))
+			logErr(err)
+			run.Retention = errors.Join(run.Retention, err)
+			continue
+		}
+		if FLAGS.Verbose {
+			log.Printf(`deleted %v`, fmtPath(path))
+		}
+	}
+}
+
+// Removes the temporary backups of the given name among the given names.
+func removeStorageTemps(store Storage, dir string, inp IndexedName, names []string) {
+	for _, name := range names {
+		base, ok := cutTempName(name)
+		if !ok || !inp.Related(inp.IndexFormat.Parse(base)) {
+			continue
+		}
+
+		path := store.Join(dir, name)
+		err := store.RemoveAll(path)
+		if err != nil {
+			logErr(gg.Wrapf(err, `unable to remove incomplete backup %v`, fmtPath(path)))
+		} else if FLAGS.Verbose {
+			log.Printf(`removed incomplete backup %v`, fmtPath(path))
+		}
+	}
+}
+
+/*
+Copies the input into the storage, applying the filters of the entry (see
+`RunState.Includes`). Copies file modes, and, with `preserveTimes`, the times
+of files and directories, where the latter are applied after their contents.
+*/
+func storageCopy(run *RunState, store Storage, tar string) {
+	root := run.Entry.Input
+	var dirs []string
+	var times []time.Time
+
+	gg.Try(filepath.WalkDir(root, func(src string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !run.Includes(src, entry) {
+			return skipEntry(entry)
+		}
+
+		rel := gg.Try1(filepath.Rel(root, src))
+		out := tar
+		if rel != `.` {
+			out = store.Join(tar, filepath.ToSlash(rel))
+		}
+		info := gg.Try1(entry.Info())
+
+		if entry.IsDir() {
+			gg.Try(store.MkdirAll(out))
+			dirs = append(dirs, out)
+			times = append(times, info.ModTime())
+			return nil
+		}
+
+		storageCopyFile(run, store, src, out, info)
+		return nil
+	}))
+
+	if !run.GetPreserveTimes() {
+		return
+	}
+	for ind := len(dirs) - 1; ind >= 0; ind-- {
+		gg.Try(store.Chtimes(dirs[ind], times[ind], times[ind]))
+	}
+}
+
+func storageCopyFile(run *RunState, store Storage, srcPath, tarPath string, info fs.FileInfo) {
+	defer gg.Detailf(`unable to copy %v to %v`, fmtPath(srcPath), fmtPath(tarPath))
+
+	src := gg.Try1(os.Open(srcPath))
+	defer src.Close()
+
+	out := gg.Try1(store.Create(tarPath))
+	defer out.Close() // Nop after the explicit close.
+
+	size := gg.Try1(copyBudgeted(run.Ctx, out, run.RateReader(src), run.GetCopyBufferSize(), 0))
+	gg.Try(out.Close())
+
+	gg.Try(store.Chmod(tarPath, info.Mode().Perm()))
+	if run.GetPreserveTimes() {
+		gg.Try(store.Chtimes(tarPath, info.ModTime(), info.ModTime()))
+	}
+
+	run.Stats.Files++
+	run.Stats.Bytes += uint64(size)
+}
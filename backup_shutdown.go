@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Entries currently running, for waiting on them during shutdown. See
+`watchShutdown` and `Flags.ShutdownGrace`.
+*/
+var RUNNING Running
+
+/*
+Tracks running entries by name, like `sync.WaitGroup`, but able to report
+which entries are still running when waiting times out. The same name may run
+several times at once, such as during a config reload.
+*/
+type Running struct {
+	sync.Mutex
+	sync.WaitGroup
+	Names map[string]int
+}
+
+// Must be called before starting the goroutine, and paired with `.Done`.
+func (self *Running) Add(name string) {
+	self.Lock()
+	defer self.Unlock()
+
+	if self.Names == nil {
+		self.Names = map[string]int{}
+	}
+	self.Names[name]++
+	self.WaitGroup.Add(1)
+}
+
+func (self *Running) Done(name string) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.Names[name]--
+	if self.Names[name] <= 0 {
+		delete(self.Names, name)
+	}
+	self.WaitGroup.Done()
+}
+
+// Returns the names of the running entries, sorted.
+func (self *Running) List() []string {
+	self.Lock()
+	defer self.Unlock()
+
+	out := gg.MapKeys(self.Names)
+	sort.Strings(out)
+	return out
+}
+
+/*
+Waits until every entry stops, or until the timeout elapses, in which case it
+returns false. A non-positive timeout doesn't wait.
+*/
+func (self *Running) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		self.WaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+/*
+Returns a context which is cancelled on `SIGINT` or `SIGTERM`, for stopping the
+tool gracefully. Cancellation stops the running entries, and interrupts their
+backups between files, removing the incomplete ones. After the first signal,
+the default handling is restored, so that a second signal kills the process
+without waiting.
+*/
+func watchShutdown() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Println(`shutting down`)
+	}()
+	return ctx
+}
+
+/*
+Waits up to `Flags.ShutdownGrace` for the entries to stop after cancellation,
+which allows a file being copied to finish, then logs the entries which are
+still running, if any.
+*/
+func awaitShutdown() {
+	grace := FLAGS.ShutdownGrace
+	if RUNNING.Wait(grace) {
+		if FLAGS.Verbose {
+			log.Println(`all entries stopped`)
+		}
+		return
+	}
+	log.Printf(`exiting after the shutdown grace period %v; entries still running: %q`, grace, RUNNING.List())
+}
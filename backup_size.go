@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Suffix of size records. When the config option `recordSize` is enabled, each
+new backup gets a size record next to it, named like the backup plus this
+suffix, which allows reporting commands to show the sizes of many large backups
+without walking them. Like `MANIFEST_EXT`, this suffix never decodes as a
+related name of the backup.
+*/
+const SIZE_EXT = `.size.json`
+
+/*
+Total size of the files of one backup. For stored backups, this is the size of
+the restored files, not of the store (see `STORE_DIR`).
+*/
+type BackupSize struct {
+	Files uint64 `json:"files"`
+	Bytes uint64 `json:"bytes"`
+}
+
+func sizePath(backupPath string) string { return backupPath + SIZE_EXT }
+
+/*
+Called by `backup` after the copy. Failures are logged, but don't fail the
+backup, since the size can always be computed by walking the backup.
+*/
+func writeSize(run *RunState, path string) {
+	if !run.GetRecordSize() {
+		return
+	}
+
+	defer gg.RecWith(logErr)
+	defer gg.Detailf(`unable to write size record of %v`, fmtPath(path))
+
+	// External commands don't report what they copied.
+	size := BackupSize{Files: run.Stats.Files, Bytes: run.Stats.Bytes}
+	if len(run.GetCopyCommand()) > 0 {
+		size = walkSize(path)
+	}
+	writeFileAtomic(sizePath(path), gg.JsonBytes(size))
+}
+
+/*
+Returns the size of the given backup, preferring its size record, then its
+manifest, and walking the backup when it has neither, which is the case for
+backups made without `recordSize` or by other tools.
+*/
+func backupSize(path string) BackupSize {
+	defer gg.Detailf(`unable to determine size of %v`, fmtPath(path))
+
+	if rec := sizePath(path); gg.FileExists(rec) {
+		var out BackupSize
+		gg.JsonDecodeFile(rec, &out)
+		return out
+	}
+
+	if manifest := readManifest(path); manifest != nil {
+		return BackupSize{Files: uint64(len(manifest.Files)), Bytes: manifest.Size}
+	}
+
+	return walkSize(path)
+}
+
+// Works for both directory backups and single file backups.
+func walkSize(path string) (out BackupSize) {
+	gg.Try(filepath.WalkDir(path, func(_ string, src fs.DirEntry, err error) error {
+		if err != nil || src.IsDir() {
+			return err
+		}
+		out.Files++
+		out.Bytes += uint64(gg.Try1(src.Info()).Size())
+		return nil
+	}))
+	return
+}
+
+/*
+Returns the backups to be deleted, oldest first, so that the total size of the
+backups of the entry fits within the setting `maxBytes`. The given `deleted`
+backups are already being deleted and don't count. Pinned backups count towards
+the total, but are never deleted (see `RunState.Pinned`), and neither is the
+latest backup, even when it alone exceeds the budget. Sizes are determined by
+`backupSize`.
+*/
+func overBudget(run *RunState, outs, deleted []IndexedName) (out []IndexedName) {
+	budget := uint64(run.GetMaxBytes())
+	if budget == 0 || len(outs) <= 0 {
+		return
+	}
+
+	outs = gg.Reject(outs, func(val IndexedName) bool { return gg.Has(deleted, val) })
+	sizes := make([]uint64, len(outs))
+	var total uint64
+	for ind, val := range outs {
+		// In dry run mode, the new backup doesn't exist.
+		path := filepath.Join(run.Entry.Output, val.String())
+		if _, err := os.Lstat(path); err == nil {
+			sizes[ind] = backupSize(path).Bytes
+			total += sizes[ind]
+		}
+	}
+
+	var reclaimed uint64
+	latest := gg.Last(outs)
+	for ind, val := range outs {
+		if total <= budget {
+			break
+		}
+		if val == latest || run.Pinned(val) {
+			continue
+		}
+		out = append(out, val)
+		total -= sizes[ind]
+		reclaimed += sizes[ind]
+	}
+
+	if FLAGS.Verbose && len(out) > 0 {
+		log.Printf(
+			`entry %v: %v backups over max bytes %v, reclaiming %v bytes`,
+			fmtPath(run.Entry.GetName()), len(out), budget, reclaimed,
+		)
+	}
+	return
+}
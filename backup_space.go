@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+const DEFAULT_SPACE_MARGIN = ByteSize(64 << 20)
+
+/*
+Called by `backup` before copying. Estimates the size of the new backup as the
+size of the input (see `walkSize`) plus the setting `spaceMargin`, and fails
+the backup without copying when the volume of the output has less free space,
+since the copy would fill the volume and fail anyway. When deleting the backups
+which retention would delete after the new backup (see `prune`) makes enough
+room, deletes them first. Returns the remaining backups.
+
+Store mode is skipped, since deduplication makes the input size meaningless as
+an estimate. Disabled with `checkSpace: false`.
+*/
+func checkSpace(run *RunState, outs []IndexedName, next IndexedName) []IndexedName {
+	if !run.GetCheckSpace() || run.GetStore() {
+		return outs
+	}
+
+	dir := run.Entry.Output
+	for !gg.DirExists(dir) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+	}
+
+	need := inputSize(run).Bytes + uint64(run.GetSpaceMargin())
+	free := gg.Try1(run.GetDiskFree(dir))
+	if need <= free {
+		return outs
+	}
+
+	// The same selection as `prune` after the new backup.
+	all := append(gg.Clone(outs), next)
+	expired := expiredBackups(run, gg.Reject(all, run.Pinned), next)
+	expired = append(expired, overBudget(run, all, expired)...)
+
+	var reclaimed uint64
+	for _, val := range expired {
+		reclaimed += backupSize(filepath.Join(run.Entry.Output, val.String())).Bytes
+	}
+
+	if need > free+reclaimed {
+		panic(gg.Errf(
+			`not enough free space in %v: the backup needs about %v bytes, but only %v bytes are free, and retention would reclaim %v bytes`,
+			fmtPath(dir), need, free, reclaimed,
+		))
+	}
+
+	if FLAGS.Verbose {
+		log.Printf(
+			`entry %v: not enough free space in %v, deleting %v old backups first`,
+			fmtPath(run.Entry.GetName()), fmtPath(dir), len(expired),
+		)
+	}
+	deleteBackups(run, expired)
+	outs = gg.Reject(outs, func(val IndexedName) bool { return gg.Has(expired, val) })
+
+	free = gg.Try1(run.GetDiskFree(dir))
+	if need > free {
+		panic(gg.Errf(
+			`not enough free space in %v: the backup needs about %v bytes, but only %v bytes are free after deleting old backups`,
+			fmtPath(dir), need, free,
+		))
+	}
+	return outs
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Staging mode, enabled by the config option `staging`, for consumers that read
+from the output directory and must never see a partially rotated backup set.
+
+The output path becomes a symlink to a complete backup set, stored in a
+directory named like the output plus this suffix. Each backup prepares a new
+set in a staging directory, starting with hard links to the current set, then
+writes, verifies (when manifests are enabled), and prunes there. Finally, the
+output symlink is atomically replaced to point to the new set, and the old set
+is deleted. A failed backup leaves the current set untouched.
+
+An existing output directory is converted to a set on the first staged backup.
+That step moves the directory, and is not atomic. Staging requires an output
+directory dedicated to one entry, and symlink support; on Windows, creating
+symlinks requires special privileges.
+*/
+const STAGING_EXT = `.sets`
+
+type Stage struct {
+	Run    *RunState
+	Output string
+	Dir    string
+}
+
+/*
+Prepares a new backup set and redirects the backup to it by changing the output
+of the entry until `Stage.Done` is called.
+*/
+func newStage(run *RunState) *Stage {
+	out := run.Entry.Output
+	defer gg.Detailf(`unable to stage backup set for %v`, fmtPath(out))
+
+	sets := out + STAGING_EXT
+	gg.MkdirAll(sets)
+
+	dir := filepath.Join(sets, strconv.FormatInt(time.Now().UnixNano(), 10))
+	gg.Try(os.Mkdir(dir, os.ModePerm))
+
+	stage := &Stage{Run: run, Output: out, Dir: dir}
+	defer gg.Fail(func(error) { _ = os.RemoveAll(dir) })
+
+	cur := stage.Current()
+	if cur != `` {
+		linkTree(cur, dir)
+	}
+
+	run.Entry.Output = dir
+	return stage
+}
+
+/*
+Returns the directory of the current backup set: the target of the output
+symlink, or the output itself if it's a regular directory, or an empty string
+if there's no output yet.
+*/
+func (self Stage) Current() string {
+	info, err := os.Lstat(self.Output)
+	if isErrFileNotFound(err) {
+		return ``
+	}
+	gg.Try(err)
+
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return self.Output
+	}
+
+	link := gg.Try1(os.Readlink(self.Output))
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(self.Output), link)
+	}
+	return link
+}
+
+/*
+Restores the output of the entry. If the backup succeeded, makes the new set
+current and deletes the old one, otherwise deletes the new set.
+*/
+func (self Stage) Done(err error) {
+	run := self.Run
+	run.Entry.Output = self.Output
+
+	if err != nil || run.Result == RESULT_UP_TO_DATE {
+		_ = os.RemoveAll(self.Dir)
+		return
+	}
+
+	defer gg.Detailf(`unable to swap backup set %v`, fmtPath(self.Output))
+
+	prev := self.Current()
+	if prev == self.Output {
+		if FLAGS.Verbose {
+			log.Printf(`converting %v into a staged backup set`, fmtPath(self.Output))
+		}
+		tmp := filepath.Join(self.Output+STAGING_EXT, `prev-`+filepath.Base(self.Dir))
+		gg.Try(os.Rename(self.Output, tmp))
+		prev = tmp
+	}
+
+	link := self.Output + `.tmp-link`
+	_ = os.Remove(link)
+	gg.Try(os.Symlink(gg.Try1(filepath.Rel(filepath.Dir(self.Output), self.Dir)), link))
+	gg.Try(os.Rename(link, self.Output))
+
+	if run.Target != `` {
+		run.Target = filepath.Join(self.Output, gg.Try1(filepath.Rel(self.Dir, run.Target)))
+	}
+
+	if prev != `` {
+		_ = os.RemoveAll(prev)
+	}
+
+	if FLAGS.Verbose {
+		log.Printf(`swapped backup set %v to %v`, fmtPath(self.Output), fmtPath(self.Dir))
+	}
+}
+
+/*
+Recreates the tree of the source directory in the target directory, using hard
+links for files, which makes the copy cheap and leaves the source unchanged as
+long as the files are replaced rather than modified in place.
+*/
+func linkTree(src, tar string) {
+	gg.Try(filepath.WalkDir(src, func(path string, val fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		out := filepath.Join(tar, gg.Try1(filepath.Rel(src, path)))
+		if val.IsDir() {
+			gg.Try(os.MkdirAll(out, os.ModePerm))
+			return nil
+		}
+		gg.Try(os.Link(path, out))
+		return nil
+	}))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Content-addressed storage, enabled by the config option `store`. Each file is
+stored once, under its SHA-256 checksum, in a store directory inside the output
+directory. Instead of a copy of the input, each backup is a manifest (see
+`Manifest`) mapping relative paths to checksums. Identical files are shared
+across all backups of an entry, which saves space when most files don't change
+between backups.
+
+Each input has its own store, named after the input, under `STORE_DIR`. This
+allows `finalize` to garbage-collect objects by looking only at the retained
+backups of one entry, even when several entries share an output directory.
+
+Empty directories are not recorded. Stored backups are reconstructed by
+`backup extract`.
+*/
+const STORE_DIR = `.store`
+
+// Prefix of temporary files in the store, renamed to their checksum when done.
+const STORE_TEMP_PREFIX = `.tmp-`
+
+func (self RunState) StoreDir() string {
+	return filepath.Join(self.Entry.Output, STORE_DIR, filepath.Base(self.Entry.Input))
+}
+
+func storeObjectPath(dir, sum string) string {
+	return filepath.Join(dir, sum[:2], sum)
+}
+
+/*
+Stores the files of the input, and writes the manifest of the new backup to the
+given path. Objects already present in the store are not written again.
+*/
+func storeBackup(run *RunState, path string) {
+	if len(run.GetCopyCommand()) > 0 {
+		panic(gg.Errf(`"copyCommand" can't be used with "store"`))
+	}
+
+	dir := run.StoreDir()
+	run.MkdirAll(dir)
+
+	rel := gg.Try1(filepath.Rel(run.Entry.Output, dir))
+	manifest := newManifest()
+	manifest.Store = filepath.ToSlash(rel)
+
+	var added uint64
+	root := run.Entry.Input
+
+	gg.Try(filepath.WalkDir(root, func(path string, src fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !run.Includes(path, src) {
+			return skipEntry(src)
+		}
+		if src.IsDir() {
+			return nil
+		}
+
+		file, ok := storeFile(run, dir, path)
+		if ok {
+			added++
+		}
+
+		manifest.Size += file.Size
+		manifest.Files[filepath.ToSlash(gg.Try1(filepath.Rel(root, path)))] = file
+		run.Stats.Files++
+		run.Stats.Bytes += file.Size
+		return nil
+	}))
+
+	gg.JsonEncodeFile(path, manifest)
+	run.Span.Set(`store.added`, added)
+
+	if FLAGS.Verbose {
+		log.Printf(`stored %v new of %v files in %v`, added, run.Stats.Files, fmtPath(dir))
+	}
+}
+
+/*
+Copies the file into the store under its checksum. Returns true if the file
+wasn't already stored.
+*/
+func storeFile(run *RunState, dir, srcPath string) (_ ManifestFile, added bool) {
+	defer gg.Detailf(`unable to store %v`, fmtPath(srcPath))
+
+	src := gg.Try1(os.Open(srcPath))
+	defer src.Close()
+
+	tmp := gg.Try1(os.CreateTemp(dir, STORE_TEMP_PREFIX+`*`))
+	defer os.Remove(tmp.Name()) // Nop after the rename.
+	defer tmp.Close()           // Nop after the explicit close.
+
+	hash := sha256.New()
+	size := gg.Try1(copyBudgeted(run.Ctx, io.MultiWriter(tmp, hash), run.RateReader(src), run.GetCopyBufferSize(), 0))
+	gg.Try(tmp.Close())
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	path := storeObjectPath(dir, sum)
+
+	if !gg.FileExists(path) {
+		run.MkdirAll(filepath.Dir(path))
+		gg.Try(os.Rename(tmp.Name(), path))
+		added = true
+	}
+	return ManifestFile{Size: uint64(size), Sha256: sum}, added
+}
+
+/*
+Returns the manifest of a stored backup, or nil if the given backup is not a
+stored backup, such as a regular backup made before enabling the store.
+*/
+func readStored(path string) *Manifest {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+
+	var out Manifest
+	if gg.Catch(func() { gg.JsonDecodeFile(path, &out) }) != nil || out.Store == `` {
+		return nil
+	}
+	return &out
+}
+
+/*
+Deletes store objects not referenced by any of the given retained backups. To
+avoid deleting objects still in use, nothing is deleted when a retained backup
+is a regular file which can't be read as a manifest.
+*/
+func collectStore(run *RunState, kept []IndexedName) {
+	defer gg.RecWith(logErr)
+	defer gg.Detailf(`unable to garbage-collect store of %v`, fmtPath(run.Entry.Input))
+
+	dir := run.StoreDir()
+	if !gg.DirExists(dir) {
+		return
+	}
+
+	refs := gg.Set[string]{}
+
+	for _, name := range kept {
+		path := filepath.Join(run.Entry.Output, name.String())
+		manifest := readStored(path)
+
+		if manifest == nil {
+			if gg.FileExists(path) {
+				if FLAGS.Verbose {
+					log.Printf(`skipping store garbage collection: %v is not a stored backup`, fmtPath(path))
+				}
+				return
+			}
+			continue
+		}
+
+		for _, file := range manifest.Files {
+			refs.Add(file.Sha256)
+		}
+	}
+
+	var removed int
+
+	gg.Try(filepath.WalkDir(dir, func(path string, src fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if src.IsDir() || refs.Has(src.Name()) {
+			return nil
+		}
+		gg.Try(os.Remove(path))
+		removed++
+		return nil
+	}))
+
+	if removed > 0 && FLAGS.Verbose {
+		log.Printf(`deleted %v unreferenced objects from %v`, removed, fmtPath(dir))
+	}
+}
+
+/*
+Reconstructs a stored backup into the given directory, which must not exist,
+verifying the checksum of every file.
+*/
+func extractStored(path, tar string) {
+	defer gg.Detailf(`unable to extract %v to %v`, fmtPath(path), fmtPath(tar))
+
+	manifest := readStored(path)
+	if manifest == nil {
+		panic(gg.Errf(`not a stored backup`))
+	}
+	if gg.FileExists(tar) || gg.DirExists(tar) {
+		panic(gg.Errf(`target already exists`))
+	}
+
+	dir := filepath.Join(filepath.Dir(path), filepath.FromSlash(manifest.Store))
+
+	// The only key of a single-file backup is ".", which makes the target a file.
+	if _, ok := manifest.Files[`.`]; !ok {
+		gg.MkdirAll(tar)
+	}
+
+	for _, key := range gg.SortedPrim(gg.MapKeys(manifest.Files)) {
+		file := manifest.Files[key]
+		extractFile(storeObjectPath(dir, file.Sha256), filepath.Join(tar, filepath.FromSlash(key)), file)
+	}
+}
+
+func extractFile(srcPath, tarPath string, exp ManifestFile) {
+	defer gg.Detailf(`unable to extract %v`, fmtPath(tarPath))
+
+	src := gg.Try1(os.Open(srcPath))
+	defer src.Close()
+
+	gg.MkdirAll(filepath.Dir(tarPath))
+	out := gg.Try1(os.Create(tarPath))
+	defer gg.Close(out)
+
+	hash := sha256.New()
+	gg.Try1(io.Copy(io.MultiWriter(out, hash), src))
+
+	if hex.EncodeToString(hash.Sum(nil)) != exp.Sha256 {
+		panic(gg.Errf(`checksum mismatch in store object %v`, fmtPath(srcPath)))
+	}
+}
+
+func cmdExtract(args []string) {
+	if len(args) != 2 {
+		panic(gg.Errf(`expected a stored backup path and a target directory, got %q`, args))
+	}
+	if isIncrementalPath(args[0]) {
+		extractIncremental(args[0], args[1])
+	} else {
+		extractStored(args[0], args[1])
+	}
+}
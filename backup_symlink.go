@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Values of the config option `symlinks`, which decides how the built-in copying
+handles symlinks inside a directory input:
+
+	"copy"    recreate the symlink in the backup, with the same target (default)
+	"follow"  copy the file or directory which the symlink points to
+	"skip"    leave the symlink out of the backup
+
+Targets are copied verbatim, so relative symlinks within the input keep
+pointing within the backup. The input itself is always followed when it's a
+symlink (see `InputWatcher`). In follow mode, symlinks to a directory which is
+already being copied, such as a parent, are skipped, since following them would
+never end.
+*/
+const (
+	SYMLINKS_COPY   = `copy`
+	SYMLINKS_FOLLOW = `follow`
+	SYMLINKS_SKIP   = `skip`
+)
+
+func validateSymlinks(val string) {
+	switch val {
+	case ``, SYMLINKS_COPY, SYMLINKS_FOLLOW, SYMLINKS_SKIP:
+	default:
+		panic(gg.Errf(
+			`unrecognized "symlinks" %q, expected %q, %q or %q`,
+			val, SYMLINKS_COPY, SYMLINKS_FOLLOW, SYMLINKS_SKIP,
+		))
+	}
+}
+
+func isSymlink(info fs.FileInfo) bool { return info.Mode()&fs.ModeSymlink != 0 }
+
+/*
+Returns the info of the file which the symlink points to, for follow mode, or
+nil when the symlink points to a directory being copied. See `RunState.Ancestors`.
+*/
+func followSymlink(run *RunState, path string) fs.FileInfo {
+	info := gg.Try1(os.Stat(path))
+	if !info.IsDir() {
+		return info
+	}
+
+	real := gg.Try1(filepath.EvalSymlinks(path))
+	if gg.Has(run.Ancestors, real) {
+		if FLAGS.Verbose {
+			log.Printf(`skipping symlink %v: it points to %v, which is already being copied`, fmtPath(path), fmtPath(real))
+		}
+		return nil
+	}
+	return info
+}
+
+// Copies or skips a symlink which isn't followed.
+func copySymlink(run *RunState, src, tar, dir string) {
+	mode := run.GetSymlinks()
+	validateSymlinks(mode)
+
+	if mode == SYMLINKS_SKIP {
+		if FLAGS.Verbose {
+			log.Printf(`skipping symlink %v`, fmtPath(src))
+		}
+		return
+	}
+
+	link := gg.Try1(os.Readlink(src))
+	run.AddStats(CopyStats{Files: 1})
+
+	if FLAGS.DryRun {
+		log.Printf(`%v would link %v to %q`, DRY_RUN_PREFIX, fmtPath(tar), link)
+		return
+	}
+
+	run.MkdirAll(dir)
+	gg.Try(os.Symlink(link, tar))
+}
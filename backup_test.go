@@ -1,14 +1,40 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
 	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/mitranim/gg"
 	"github.com/mitranim/gg/gtest"
+	"github.com/pkg/sftp"
+	"github.com/rjeczalik/notify"
 )
 
-// TODO: actual tests.
-
 func TestIndex(t *testing.T) {
 	defer gtest.Catch(t)
 
@@ -32,3 +58,4715 @@ func TestIndex(t *testing.T) {
 	gtest.Eq(Index(199).String(), `00000000000000000199`)
 	gtest.Eq(Index(math.MaxUint64).String(), `18446744073709551615`)
 }
+
+func TestIndex_radix(t *testing.T) {
+	defer gtest.Catch(t)
+
+	gtest.Eq(Index(math.MaxUint64).WidthIn(2), 64)
+	gtest.Eq(Index(math.MaxUint64).WidthIn(16), 16)
+	gtest.Eq(Index(math.MaxUint64).WidthIn(36), 13)
+	gtest.Eq(Index(15).WidthIn(16), 1)
+	gtest.Eq(Index(16).WidthIn(16), 2)
+	gtest.Eq(Index(35).WidthIn(36), 1)
+	gtest.Eq(Index(36).WidthIn(36), 2)
+
+	gtest.Eq(Index(0).Encode(16), `0000000000000000`)
+	gtest.Eq(Index(255).Encode(16), `00000000000000ff`)
+	gtest.Eq(Index(math.MaxUint64).Encode(16), `ffffffffffffffff`)
+
+	gtest.Eq(Index(0).Encode(36), `0000000000000`)
+	gtest.Eq(Index(35).Encode(36), `000000000000z`)
+	gtest.Eq(Index(36).Encode(36), `0000000000010`)
+	gtest.Eq(Index(math.MaxUint64).Encode(36), `3w5e11264sgsf`)
+}
+
+func TestIndexedName_radix(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(radix int, src IndexedName, exp string) {
+		src.IndexFormat = IndexFormat{Radix: radix}
+		gtest.Eq(src.String(), exp)
+		gtest.Eq(src.IndexFormat.Parse(exp), src)
+	}
+
+	test(10, IndexedName{Name: `one`, Index: 3, Ext: `.txt`}, `one_00000000000000000003.txt`)
+	test(16, IndexedName{Name: `one`, Index: 255, Ext: `.txt`}, `one_00000000000000ff.txt`)
+	test(16, IndexedName{Name: `one`, Index: math.MaxUint64}, `one_ffffffffffffffff`)
+	test(36, IndexedName{Name: `one`, Index: 36, Ext: `.txt`}, `one_0000000000010.txt`)
+	test(36, IndexedName{Name: `one`, Index: math.MaxUint64}, `one_3w5e11264sgsf`)
+
+	// Letters are valid digits in high radixes, but words are not indices.
+	gtest.Eq(
+		IndexFormat{Radix: 36}.Parse(`notes_draft.txt`),
+		IndexedName{IndexFormat: IndexFormat{Radix: 36}, Name: `notes_draft`, Ext: `.txt`},
+	)
+}
+
+func TestBackup_index_overflow(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+	gg.MkdirAll(out)
+
+	last := `inp_` + INDEX_MAX.String() + `.txt`
+	gg.WriteFile(filepath.Join(out, last), `old`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+
+	gtest.PanicStr(`the latest backup has the largest possible index 18446744073709551615`, func() {
+		run.NextIndex(INDEX_MAX)
+	})
+
+	// The failure is logged like any other, without overwriting backups.
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_ERROR)
+	gtest.Equal(readDir(out), []string{last})
+}
+
+func TestIndexedName_width(t *testing.T) {
+	defer gtest.Catch(t)
+
+	format := IndexFormat{Width: 6}
+	name := format.Parse(`one.txt`)
+	name.Index = 3
+	gtest.Eq(name.String(), `one_000003.txt`)
+
+	name.Index = 1234567
+	gtest.Eq(name.String(), `one_1234567.txt`)
+
+	// Other padding decodes to the same index, and encodes back to the same
+	// name, so backups made with another width stay in one sequence.
+	for _, src := range []string{`one_00000000000000000003.txt`, `one_3.txt`} {
+		name = format.Parse(src)
+		gtest.Eq(name.Index, 3)
+		gtest.Eq(name.String(), src)
+		gtest.True(name.Related(format.Parse(`one.txt`)))
+	}
+
+	gtest.Eq(IndexFormat{Radix: 36, Width: 6}.Parse(`notes_draft.txt`).Index, 0)
+	gtest.Eq(IndexFormat{Radix: 36, Width: 6}.Parse(`notes_00000z.txt`).Index, 35)
+
+	gtest.PanicStr(`invalid index width 21`, IndexFormat{Width: 21}.Validate)
+}
+
+func TestIndexedName_sep(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(format IndexFormat, src IndexedName, exp string) {
+		src.IndexFormat = format
+		gtest.Eq(src.String(), exp)
+		gtest.Eq(format.Parse(exp), src)
+	}
+
+	dot := IndexFormat{Width: 6, Sep: `.v`}
+	test(dot, IndexedName{Name: `my_file`, Index: 3, Ext: `.txt`}, `my_file.v000003.txt`)
+	test(dot, IndexedName{Name: `my_file`, Index: 3}, `my_file.v000003`)
+	test(dot, IndexedName{Name: `my_file_2024`, Ext: `.txt`}, `my_file_2024.txt`)
+	test(dot, IndexedName{Name: `one.v2`, Index: 3, Ext: `.txt`}, `one.v2.v000003.txt`)
+
+	dash := IndexFormat{Width: 6, Sep: `--`}
+	test(dash, IndexedName{Name: `one--two`, Index: 3, Ext: `.txt`}, `one--two--000003.txt`)
+
+	// With the default separator, a trailing number in the name of the input
+	// looks like an index.
+	gtest.Eq(IndexFormat{}.Parse(`data_2024.csv`).Index, 2024)
+
+	gtest.PanicStr(`invalid index separator`, IndexFormat{Sep: `/`}.Validate)
+	gtest.PanicStr(`invalid index separator`, IndexFormat{Sep: `.`}.Validate)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `data_2024.csv`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.IndexSep = `.v`
+	backup(&run)
+	backup(&run)
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{`data_2024.v000001.csv`, `data_2024.v000002.csv`})
+}
+
+func TestBackup_empty_dir(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `empty_sub`))
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+
+	backup(&run)
+	gtest.Equal(readDir(out), []string{`inp_000001`})
+	gtest.Equal(readDir(filepath.Join(out, `inp_000001`)), []string{`empty_sub`})
+
+	gg.Try(os.Remove(filepath.Join(inp, `empty_sub`)))
+
+	backup(&run)
+	gtest.Equal(
+		gg.SortedPrim(readDir(out)),
+		[]string{`inp_000001`, `inp_000002`},
+	)
+	gtest.True(gg.DirExists(filepath.Join(out, `inp_000002`)))
+	gtest.Empty(readDir(filepath.Join(out, `inp_000002`)))
+}
+
+func TestMatchGlob(t *testing.T) {
+	defer gtest.Catch(t)
+
+	gtest.True(matchGlob(`*.log`, `one.log`))
+	gtest.False(matchGlob(`*.log`, `dir/one.log`))
+	gtest.True(matchGlob(`src/**`, `src/one.go`))
+	gtest.True(matchGlob(`src/**`, `src/dir/one.go`))
+	gtest.False(matchGlob(`src/**`, `docs/src/one.go`))
+	gtest.True(matchGlob(`**/node_modules`, `node_modules`))
+	gtest.True(matchGlob(`**/node_modules`, `one/two/node_modules`))
+	gtest.False(matchGlob(`**/node_modules`, `one/node_modules/two`))
+	gtest.True(matchGlob(`**/*.tmp`, `one/two.tmp`))
+	gtest.True(matchGlob(`one/**/two`, `one/two`))
+	gtest.True(matchGlob(`one/**/two`, `one/a/b/two`))
+	gtest.False(matchGlob(`one/**/two`, `one/a/b/three`))
+}
+
+func TestRunState_precedence(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&ENV, CommonConfig{}).Done()
+	defer gg.SnapSwap(&FLAGS.Defaults, CommonConfig{}).Done()
+
+	var run RunState
+	gtest.Eq(run.GetLimit(), DEFAULT_LIMIT)
+	gtest.Eq(run.GetDebounce(), DEFAULT_DEBOUNCE)
+
+	FLAGS.Defaults.Limit.Set(4)
+	FLAGS.Defaults.Debounce.Set(Duration(time.Second * 4))
+	gtest.Eq(run.GetLimit(), 4)
+	gtest.Eq(run.GetDebounce(), Duration(time.Second*4))
+
+	run.Config.Limit.Set(3)
+	run.Config.Debounce.Set(Duration(time.Second * 3))
+	gtest.Eq(run.GetLimit(), 3)
+	gtest.Eq(run.GetDebounce(), Duration(time.Second*3))
+
+	// The environment overrides the top level of the config file.
+	path := filepath.Join(t.TempDir(), `config.json`)
+	gg.WriteFile(path, `{"limit": 3, "debounce": "3s", "deadline": "3s"}`)
+	defer gg.SnapSwap(&FLAGS.Config, path).Done()
+
+	ENV = readEnv(func(key string) string {
+		return map[string]string{`BACKUP_LIMIT`: `2`, `BACKUP_DEBOUNCE`: `2s`}[key]
+	})
+	run.Config = readConfig()
+	gtest.Eq(run.GetLimit(), 2)
+	gtest.Eq(run.GetDebounce(), Duration(time.Second*2))
+	gtest.Eq(run.GetDeadline(), Duration(time.Second*3))
+
+	// The environment also overrides the top level of an included file.
+	gg.WriteFile(path, `{"include": ["inc.json"]}`)
+	gg.WriteFile(filepath.Join(filepath.Dir(path), `inc.json`), `{"limit": 5, "deadline": "5s", "entries": [{"input": "inp"}]}`)
+	conf := readConfig()
+	inc := RunState{Config: conf, Entry: conf.Entries[0]}
+	gtest.Eq(inc.GetLimit(), 2)
+	gtest.Eq(inc.GetDeadline(), Duration(time.Second*5))
+
+	run.Entry.Limit.Set(1)
+	run.Entry.Debounce.Set(Duration(time.Second))
+	gtest.Eq(run.GetLimit(), 1)
+	gtest.Eq(run.GetDebounce(), Duration(time.Second))
+}
+
+func TestResolveConfig(t *testing.T) {
+	defer gtest.Catch(t)
+
+	opt := gg.OptVal[Duration]
+
+	type Case struct {
+		Name string
+		Src  []CommonConfig
+		Exp  CommonConfig
+	}
+
+	for _, val := range []Case{
+		{
+			Name: `no sources`,
+		},
+		{
+			Name: `first source wins`,
+			Src: []CommonConfig{
+				{Debounce: opt(1), HealthFile: `one`},
+				{Debounce: opt(2), HealthFile: `two`},
+			},
+			Exp: CommonConfig{Debounce: opt(1), HealthFile: `one`},
+		},
+		{
+			Name: `unset fields fall through`,
+			Src: []CommonConfig{
+				{Debounce: opt(1)},
+				{Debounce: opt(2), Deadline: opt(3)},
+				{Throttle: opt(4), HealthFile: `three`},
+			},
+			Exp: CommonConfig{Debounce: opt(1), Deadline: opt(3), Throttle: opt(4), HealthFile: `three`},
+		},
+		{
+			Name: `set zero values take precedence`,
+			Src: []CommonConfig{
+				{SkipActive: opt(0), Zip: gg.OptVal(false)},
+				{SkipActive: opt(1), Zip: gg.OptVal(true)},
+			},
+			Exp: CommonConfig{SkipActive: opt(0), Zip: gg.OptVal(false)},
+		},
+		{
+			Name: `slices`,
+			Src: []CommonConfig{
+				{},
+				{CopyCommand: Command{`cp`}, ContentTypes: []string{`text/*`}},
+				{CopyCommand: Command{`rsync`}},
+			},
+			Exp: CommonConfig{CopyCommand: Command{`cp`}, ContentTypes: []string{`text/*`}},
+		},
+	} {
+		gtest.Equal(resolveConfig(val.Src...), val.Exp, val.Name)
+	}
+
+	// Every option except `DirMode` has a default.
+	out := reflect.ValueOf(resolveConfig(DEFAULTS))
+	for ind := 0; ind < out.NumField(); ind++ {
+		field := out.Type().Field(ind)
+		if field.Type.Kind() == reflect.Struct && field.Name != `DirMode` {
+			gtest.True(out.Field(ind).FieldByName(`Ok`).Bool(), field.Name)
+		}
+	}
+}
+
+func TestNewRunState(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&ENV, CommonConfig{}).Done()
+	defer gg.SnapSwap(&FLAGS.Defaults, CommonConfig{}).Done()
+
+	var conf Config
+	conf.Debounce.Set(Duration(time.Second))
+
+	var entry Entry
+	entry.Output = `one`
+	entry.Outputs = []Output{{Path: `two`, Archive: ARCHIVE_TAR}}
+
+	run := newRunState(context.Background(), conf, entry, nil)
+	gtest.Eq(run.GetDebounce(), Duration(time.Second))
+	gtest.Eq(run.GetThrottle(), DEFAULT_THROTTLE)
+
+	// Options are resolved once, rather than by every getter.
+	FLAGS.Defaults.Throttle.Set(Duration(time.Minute))
+	gtest.Eq(run.GetThrottle(), DEFAULT_THROTTLE)
+	gtest.Zero(testing.AllocsPerRun(10, func() { run.GetThrottle() }))
+
+	targets := run.Targets()
+	gtest.Len(targets, 2)
+	gtest.Eq(targets[0].GetArchive(), ARCHIVE_NONE)
+	gtest.Eq(targets[1].GetArchive(), ARCHIVE_TAR)
+	gtest.Eq(targets[1].GetDebounce(), Duration(time.Second))
+}
+
+func TestRunState_Warnings(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&ENV, CommonConfig{}).Done()
+	defer gg.SnapSwap(&FLAGS.Defaults, CommonConfig{}).Done()
+
+	var run RunState
+	gtest.Empty(run.Warnings())
+
+	run.Entry.Throttle.Set(Duration(time.Millisecond * 500))
+	run.Entry.Deadline.Set(Duration(time.Millisecond * 200))
+	run.Entry.Limit.Set(1)
+	run.Entry.Manifest.Set(true)
+	gtest.Len(run.Warnings(), 3)
+
+	run.Entry.Debounce.Set(0)
+	gtest.Len(run.Warnings(), 1)
+}
+
+func TestReadEnv(t *testing.T) {
+	defer gtest.Catch(t)
+
+	env := func(src map[string]string) func(string) string {
+		return func(key string) string { return src[key] }
+	}
+
+	gtest.Zero(readEnv(env(nil)))
+
+	out := readEnv(env(map[string]string{
+		`BACKUP_DEBOUNCE`: `2s`,
+		`BACKUP_DEADLINE`: `1m`,
+		`BACKUP_THROTTLE`: `1h`,
+		`BACKUP_LIMIT`:    `16`,
+	}))
+	gtest.Eq(out.Debounce, gg.OptVal(Duration(time.Second*2)))
+	gtest.Eq(out.Deadline, gg.OptVal(Duration(time.Minute)))
+	gtest.Eq(out.Throttle, gg.OptVal(Duration(time.Hour)))
+	gtest.Eq(out.Limit, gg.OptVal(uint64(16)))
+
+	gtest.PanicStr(`BACKUP_LIMIT`, func() {
+		readEnv(env(map[string]string{`BACKUP_LIMIT`: `many`}))
+	})
+}
+
+func TestBackup_store(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub/two.txt`), `one`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Store.Set(true)
+	run.Entry.Limit.Set(1)
+
+	objects := func() (out []string) {
+		gg.Try(filepath.WalkDir(run.StoreDir(), func(path string, src fs.DirEntry, err error) error {
+			if err == nil && !src.IsDir() {
+				out = append(out, gg.ReadFile[string](path))
+			}
+			return err
+		}))
+		return gg.SortedPrim(out)
+	}
+
+	backup(&run)
+	gtest.Equal(objects(), []string{`one`})
+
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `two`)
+	backup(&run)
+	gtest.Equal(objects(), []string{`one`, `two`})
+
+	gg.WriteFile(filepath.Join(inp, `sub/two.txt`), `two`)
+	backup(&run)
+	gtest.Equal(objects(), []string{`two`})
+	gtest.Equal(
+		gg.SortedPrim(readDir(out)),
+		[]string{STORE_DIR, `inp_000003`},
+	)
+
+	tar := filepath.Join(dir, `extracted`)
+	extractStored(filepath.Join(out, `inp_000003`), tar)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `one.txt`)), `two`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `sub/two.txt`)), `two`)
+}
+
+func TestBackup_dir_mode(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` {
+		t.Skip(`directory modes are not supported on Windows`)
+	}
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out/nested`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.DirMode.Set(0o777)
+
+	backup(&run)
+
+	mode := func(path string) fs.FileMode {
+		return gg.Try1(os.Stat(path)).Mode().Perm()
+	}
+	gtest.Eq(mode(out), 0o777)
+	gtest.Eq(mode(filepath.Join(out, `inp_000001`)), 0o777)
+	gtest.Eq(mode(filepath.Join(out, `inp_000001/sub`)), 0o777)
+
+	var val FileMode
+	gtest.NoErr(val.UnmarshalText([]byte(`0750`)))
+	gtest.Eq(val, 0o750)
+	gtest.Eq(val.String(), `0750`)
+	gtest.ErrAny(val.UnmarshalText([]byte(`1777`)))
+	gtest.ErrAny(val.UnmarshalText([]byte(`999`)))
+}
+
+func TestBackup_zip(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Zip.Set(true)
+	run.Entry.Limit.Set(2)
+
+	for _, val := range []string{`one`, `two`, `three`} {
+		gg.WriteFile(filepath.Join(inp, `sub/file.txt`), val)
+		backup(&run)
+	}
+
+	gtest.Equal(readDir(out), []string{`inp.zip`})
+	gtest.Equal(zipIndices(run.ZipPath(), IndexFormat{}), []Index{2, 3})
+
+	file := gg.Try1(zip.OpenReader(run.ZipPath()))
+	defer file.Close()
+
+	gtest.Eq(
+		string(gg.Try1(fs.ReadFile(file, `000003/sub/file.txt`))),
+		`three`,
+	)
+}
+
+type testEvent string
+
+func (self testEvent) Event() notify.Event { return notify.Write }
+func (self testEvent) Path() string        { return string(self) }
+func (self testEvent) Sys() any            { return nil }
+
+func TestPendingTargets_counters(t *testing.T) {
+	defer gtest.Catch(t)
+
+	inp := t.TempDir()
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Throttle.Set(Duration(time.Hour))
+
+	src := &RunState{Entry: run.Entry, Route: &Route{Pattern: `src/**`}}
+	other := &RunState{Entry: run.Entry}
+	targets := []*RunState{src, other}
+
+	pending := pendingTargets(targets, testEvent(filepath.Join(inp, `docs/one.md`)), nil)
+	gtest.Equal(pending, []*RunState{other})
+	gtest.Eq(src.Counters, Counters{Filtered: 1})
+
+	pending = pendingTargets(targets, testEvent(filepath.Join(inp, `src/one.go`)), pending)
+	gtest.Equal(pending, []*RunState{other, src})
+	gtest.Eq(other.Counters, Counters{Coalesced: 1})
+
+	src.Latest = time.Now()
+	pending = pendingTargets(targets, testEvent(filepath.Join(inp, `src/one.go`)), nil)
+	gtest.Equal(pending, []*RunState{other})
+	gtest.Eq(src.Counters, Counters{Filtered: 1, Throttled: 1})
+}
+
+func TestRunState_Accepts_watchEvents(t *testing.T) {
+	defer gtest.Catch(t)
+
+	inp := t.TempDir()
+	path := filepath.Join(inp, `one.txt`)
+	eve := func(val notify.Event) notify.EventInfo { return FsEvent{Name: path, Op: val} }
+
+	var run RunState
+	run.Entry.Input = inp
+
+	// By default, all types are accepted.
+	gtest.Eq(run.GetWatchEvents(), notify.All)
+	for _, val := range WATCH_EVENTS {
+		gtest.True(run.Accepts(eve(val)))
+	}
+
+	gg.JsonDecode(`["create", "write"]`, &run.Entry.WatchEvents)
+	gtest.Eq(run.GetWatchEvents(), notify.Create|notify.Write)
+
+	gtest.True(run.Accepts(nil))
+	gtest.True(run.Accepts(eve(notify.Create)))
+	gtest.True(run.Accepts(eve(notify.Write)))
+	gtest.True(run.Accepts(eve(notify.Write | notify.Remove)))
+	gtest.False(run.Accepts(eve(notify.Remove)))
+	gtest.False(run.Accepts(eve(notify.Rename)))
+
+	// Filtered events don't make backups pending.
+	targets := []*RunState{&run}
+	gtest.Zero(pendingTargets(targets, eve(notify.Remove), nil))
+	gtest.Eq(run.Counters, Counters{Filtered: 1})
+	gtest.Equal(pendingTargets(targets, eve(notify.Write), nil), targets)
+
+	var val WatchEvent
+	gtest.ErrStr(`unknown watch event "chmod"`, val.UnmarshalText([]byte(`chmod`)))
+}
+
+func TestBackup_staging(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` {
+		t.Skip(`symlinks require special privileges on Windows`)
+	}
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+
+	// Existing regular output directory, converted on the first staged backup.
+	gg.MkdirAll(out)
+	gg.WriteFile(filepath.Join(out, `inp_000001.txt`), `zero`)
+	earlier := time.Now().Add(-time.Hour)
+	gg.Try(os.Chtimes(filepath.Join(out, `inp_000001.txt`), earlier, earlier))
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Staging.Set(true)
+	run.Entry.Limit.Set(2)
+
+	for _, val := range []string{`one`, `two`} {
+		gg.WriteFile(inp, val)
+		backup(&run)
+		gtest.Eq(run.Entry.Output, out)
+		gtest.Eq(run.Result, RESULT_OK)
+	}
+
+	gtest.Eq(gg.Try1(os.Lstat(out)).Mode()&fs.ModeSymlink, fs.ModeSymlink)
+	gtest.Eq(len(readDir(out+STAGING_EXT)), 1)
+	gtest.Eq(run.Target, filepath.Join(out, `inp_000003.txt`))
+
+	gtest.Equal(
+		gg.SortedPrim(readDir(out)),
+		[]string{`inp_000002.txt`, `inp_000003.txt`},
+	)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(out, `inp_000002.txt`)), `one`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(out, `inp_000003.txt`)), `two`)
+}
+
+func TestRemoveTemps(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+	gg.WriteFile(filepath.Join(inp, `file.txt`), `one`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+
+	// Left by a killed process.
+	gg.MkdirAll(filepath.Join(out, `.inp_000002.tmp-123`, `sub`))
+	gg.WriteFile(filepath.Join(out, `.inp_000002.tmp-123`, `sub/file.txt`), `partial`)
+
+	// Not ours.
+	gg.WriteFile(filepath.Join(out, `.other_000001.tmp-123`), ``)
+	gg.WriteFile(filepath.Join(out, `inp_000001`), ``)
+
+	// Temporary backups are never related names.
+	gtest.Equal(
+		gg.Map(relatedNames(out, run.BackupName()), IndexedName.String),
+		[]string{`inp_000001`},
+	)
+
+	removeTemps(&run)
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{
+		`.other_000001.tmp-123`,
+		`inp_000001`,
+	})
+
+	backup(&run)
+	gtest.Eq(run.Target, filepath.Join(out, `inp_000002`))
+	gtest.Eq(gg.ReadFile[string](filepath.Join(run.Target, `file.txt`)), `one`)
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{
+		`.other_000001.tmp-123`,
+		`inp_000001`,
+		`inp_000002`,
+	})
+}
+
+func TestResolveInput(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` {
+		t.Skip(`symlinks require special privileges on Windows`)
+	}
+
+	dir := t.TempDir()
+	tar := filepath.Join(dir, `target`)
+	link := filepath.Join(dir, `link`)
+	gg.MkdirAll(tar)
+	gg.Try(os.Symlink(`target`, link))
+
+	gtest.Eq(resolveInput(tar), tar)
+	gtest.Eq(resolveInput(link), tar)
+	gtest.Eq(resolveInput(filepath.Join(dir, `missing`)), filepath.Join(dir, `missing`))
+}
+
+func TestBackup_skip_active(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+
+	old := time.Now().Add(-time.Hour)
+	gg.WriteFile(filepath.Join(inp, `old.log`), `old`)
+	gg.Try(os.Chtimes(filepath.Join(inp, `old.log`), old, old))
+	gg.WriteFile(filepath.Join(inp, `current.log`), `current`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.SkipActive.Set(Duration(time.Minute))
+
+	backup(&run)
+	gtest.Equal(readDir(filepath.Join(out, `inp_000001`)), []string{`old.log`})
+
+	gg.Try(os.Chtimes(filepath.Join(inp, `current.log`), old, old))
+	backup(&run)
+	gtest.Equal(
+		gg.SortedPrim(readDir(filepath.Join(out, `inp_000002`))),
+		[]string{`current.log`, `old.log`},
+	)
+}
+
+func TestBackup_start_index(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	var conf Config
+	gg.JsonDecode(`{"startIndex": 1000, "limit": 2}`, &conf)
+
+	start := func() *RunState {
+		run := RunState{Config: conf}
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		backup(&run)
+		return &run
+	}
+
+	gtest.Eq(start().Index, 1000)
+	gtest.Eq(start().Index, 1001)
+	gtest.Eq(start().Index, 1002)
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{
+		`inp_001001.txt`,
+		`inp_001002.txt`,
+	})
+
+	// Zero is not a valid index.
+	var run RunState
+	run.Entry.StartIndex.Set(0)
+	gtest.Eq(run.NextIndex(0), 1)
+	gtest.Eq(run.NextIndex(7), 8)
+}
+
+func TestRepairOutput(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(out)
+
+	write := func(name string, min int) {
+		path := filepath.Join(out, name)
+		gg.WriteFile(path, name)
+		val := time.Date(2020, 1, 1, 0, min, 0, 0, time.UTC)
+		gg.Try(os.Chtimes(path, val, val))
+	}
+
+	write(`inp_000001.txt`, 1)
+	write(`inp_2.txt`, 2)
+	write(`inp_000002.txt`, 3)
+	write(`inp_000002.txt`+PIN_EXT, 3)
+	write(`inp_000003.txt`, 4)
+	write(`inp_draft.txt`, 5)
+	write(`other_000001.txt`, 6)
+
+	var run RunState
+	run.Entry.Input = filepath.Join(dir, `inp.txt`)
+	run.Entry.Output = out
+
+	gtest.Equal(repairPlan(&run), []Repair{
+		{`inp_draft.txt`, filepath.Join(QUARANTINE_DIR, `inp_draft.txt`), `malformed name`},
+		{`inp_2.txt`, `inp_000002.txt`, `wrong padding`},
+		{`inp_000002.txt`, `inp_000003.txt`, `duplicate index 000002`},
+		{`inp_000003.txt`, `inp_000004.txt`, `duplicate index 000003`},
+	})
+
+	func() {
+		defer gg.SnapSwap(&FLAGS.DryRun, true).Done()
+		gtest.Eq(repairOutput(&run), 4)
+		gtest.Len(readDir(out), 7)
+	}()
+
+	gtest.Eq(repairOutput(&run), 4)
+	gtest.Zero(repairPlan(&run))
+
+	read := func(name string) string { return gg.ReadFile[string](filepath.Join(out, name)) }
+	gtest.Eq(read(`inp_000002.txt`), `inp_2.txt`)
+	gtest.Eq(read(`inp_000003.txt`), `inp_000002.txt`)
+	gtest.Eq(read(`inp_000003.txt`+PIN_EXT), `inp_000002.txt`+PIN_EXT)
+	gtest.Eq(read(`inp_000004.txt`), `inp_000003.txt`)
+	gtest.Eq(read(filepath.Join(QUARANTINE_DIR, `inp_draft.txt`)), `inp_draft.txt`)
+	gtest.Eq(read(`other_000001.txt`), `other_000001.txt`)
+}
+
+func TestBackup_force_initial(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	initial := func() *RunState {
+		var run RunState
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		backup(&run)
+		return &run
+	}
+
+	gtest.Eq(initial().Result, RESULT_OK)
+	gtest.Eq(initial().Result, RESULT_UP_TO_DATE)
+
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+	gtest.Eq(initial().Result, RESULT_OK)
+	gtest.Eq(len(readDir(out)), 2)
+}
+
+func TestBackup_move(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub/two.txt`), `two`)
+
+	move := func() *RunState {
+		var run RunState
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		run.Entry.Mode = MODE_MOVE
+		run.Entry.Manifest.Set(true)
+		backup(&run)
+		return &run
+	}
+
+	run := move()
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(run.Target, `one.txt`)), `one`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(run.Target, `sub/two.txt`)), `two`)
+	gtest.True(gg.DirExists(inp))
+	gtest.Empty(readDir(inp))
+
+	gtest.Eq(move().Result, RESULT_UP_TO_DATE)
+
+	gg.WriteFile(filepath.Join(inp, `three.txt`), `three`)
+	run = move()
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Equal(readDir(run.Target), []string{`three.txt`})
+	gtest.Empty(readDir(inp))
+
+	gg.WriteFile(filepath.Join(inp, `four.txt`), `four`)
+	{
+		var run RunState
+		run.Entry.Input = inp
+		run.Entry.Output = filepath.Join(inp, `out`)
+		run.Entry.Mode = MODE_MOVE
+		backup(&run)
+		gtest.Eq(run.Result, RESULT_ERROR)
+		gtest.Equal(readDir(inp), []string{`four.txt`})
+	}
+}
+
+func TestBackup_incremental(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+
+	write := func(name, body string, min int) {
+		path := filepath.Join(inp, name)
+		gg.WriteFile(path, body)
+		val := time.Date(2020, 1, 1, 0, min, 0, 0, time.UTC)
+		gg.Try(os.Chtimes(path, val, val))
+	}
+
+	incremental := func() *RunState {
+		var run RunState
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		run.Entry.Incremental.Set(true)
+		run.Entry.FullEvery.Set(2)
+		run.Entry.Limit.Set(2)
+		backup(&run)
+		return &run
+	}
+
+	extract := func(ind int) string {
+		tar := filepath.Join(dir, `extract`, strconv.Itoa(ind))
+		extractIncremental(filepath.Join(out, `inp_00000`+strconv.Itoa(ind)+`.tar`), tar)
+		return tar
+	}
+
+	write(`one.txt`, `one`, 1)
+	write(`sub/two.txt`, `two`, 1)
+	run := incremental()
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Zero(readIncrement(run.Target).Base)
+	gtest.Eq(run.Stats.Files, 2)
+
+	write(`one.txt`, `one one`, 2)
+	write(`three.txt`, `three`, 2)
+	gg.Try(os.Remove(filepath.Join(inp, `sub/two.txt`)))
+	run = incremental()
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(readIncrement(run.Target).Base, `inp_000001.tar`)
+	gtest.Eq(run.Stats.Files, 2)
+
+	gtest.Eq(incremental().Result, RESULT_UP_TO_DATE)
+
+	tar := extract(1)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `one.txt`)), `one`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `sub/two.txt`)), `two`)
+
+	tar = extract(2)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `one.txt`)), `one one`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `three.txt`)), `three`)
+	gtest.False(gg.FileExists(filepath.Join(tar, `sub/two.txt`)))
+
+	// Reached "fullEvery": starts a new chain. The old chain is still needed
+	// by the second backup, which is within the limit.
+	write(`three.txt`, `three three`, 3)
+	run = incremental()
+	gtest.Zero(readIncrement(run.Target).Base)
+	gtest.Len(readDir(out), 3)
+
+	// The old chain is no longer needed.
+	write(`four.txt`, `four`, 4)
+	run = incremental()
+	gtest.Eq(readIncrement(run.Target).Base, `inp_000003.tar`)
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{`inp_000003.tar`, `inp_000004.tar`})
+
+	tar = extract(4)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `three.txt`)), `three three`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `four.txt`)), `four`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `one.txt`)), `one one`)
+}
+
+func TestLogWriter(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var text, json bytes.Buffer
+	out := log.New(LogWriter{Text: &text, Json: &json}, ``, 0)
+
+	out.Print(`one`)
+	out.Printf("two %v", `three`)
+
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	gtest.Len(lines, 2)
+	gtest.True(strings.HasSuffix(lines[0], ` one`))
+	gtest.True(strings.HasSuffix(lines[1], ` two three`))
+
+	lines = strings.Split(strings.TrimSpace(json.String()), "\n")
+	gtest.Len(lines, 2)
+
+	var rec LogRecord
+	gg.JsonDecode(lines[1], &rec)
+	gtest.Eq(rec.Msg, `two three`)
+	gtest.False(rec.Time.IsZero())
+}
+
+func TestLogWriter_quiet(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var text, json bytes.Buffer
+	prevOut, prevFlags := log.Writer(), log.Flags()
+	defer log.SetFlags(prevFlags)
+	defer log.SetOutput(prevOut)
+	log.SetFlags(0)
+	log.SetOutput(LogWriter{Text: &text, Json: &json, Quiet: true})
+
+	log.Println(`plain`)
+	logRecord(LogRecord{Msg: `backed up`, Entry: `notes`})
+	logErr(gg.Errf(`permission denied`))
+	logErrorf(`unable to watch config file %v`, fmtPath(`backup.json`))
+
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	gtest.Len(lines, 2)
+	gtest.True(strings.HasSuffix(lines[0], ` permission denied`))
+	gtest.True(strings.HasSuffix(lines[1], ` unable to watch config file "backup.json"`))
+
+	// JSON logs are not affected.
+	gtest.Len(strings.Split(strings.TrimSpace(json.String()), "\n"), 4)
+
+	defer gg.SnapSwap(&FLAGS.Quiet, true).Done()
+	defer gg.SnapSwap(&FLAGS.Verbose, true).Done()
+	gtest.ErrStr(`"-q" can't be used with "-v"`, gg.Catch(initLogs))
+}
+
+func TestLogRecord(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var text bytes.Buffer
+	prevOut, prevFlags := log.Writer(), log.Flags()
+	defer log.SetFlags(prevFlags)
+	defer log.SetOutput(prevOut)
+	log.SetFlags(0)
+	log.SetOutput(LogWriter{Text: &text, JsonText: true})
+
+	log.Println(`plain`)
+	logRecord(LogRecord{Msg: `backed up`, Entry: `notes`, Path: `out/notes_000001`})
+	logErr(gg.Wrapf(gg.Wrapf(gg.Errf(`permission denied`), `unable to copy`), `unable to back up`))
+
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	gtest.Len(lines, 3)
+
+	recs := gg.Map(lines, func(src string) (out LogRecord) {
+		gg.JsonDecode(src, &out)
+		return
+	})
+
+	gtest.Eq(recs[0].Level, LOG_LEVEL_INFO)
+	gtest.Eq(recs[0].Msg, `plain`)
+
+	gtest.Eq(recs[1].Entry, `notes`)
+	gtest.Eq(recs[1].Path, `out/notes_000001`)
+
+	gtest.Eq(recs[2].Level, LOG_LEVEL_ERROR)
+	gtest.Equal(recs[2].Errors, []string{`unable to back up`, `unable to copy`, `permission denied`})
+}
+
+func TestWithTimeout(t *testing.T) {
+	defer gtest.Catch(t)
+
+	val, err := withTimeout(context.Background(), 0, func(context.Context) (int, error) { return 1, nil })
+	gtest.NoErr(err)
+	gtest.Eq(val, 1)
+
+	val, err = withTimeout(context.Background(), time.Second, func(context.Context) (int, error) { return 2, nil })
+	gtest.NoErr(err)
+	gtest.Eq(val, 2)
+
+	block := make(chan struct{})
+	defer close(block)
+
+	val, err = withTimeout(context.Background(), time.Millisecond, func(context.Context) (int, error) {
+		<-block
+		return 3, nil
+	})
+	gtest.True(errors.Is(err, context.DeadlineExceeded))
+	gtest.Zero(val)
+}
+
+/*
+Clock for deterministic tests of timing logic. Time moves only via `Advance`,
+which fires the timers whose time has come.
+*/
+type FakeClock struct {
+	sync.Mutex
+	Time   time.Time
+	Timers []FakeTimer
+	Count  int
+}
+
+type FakeTimer struct {
+	Time time.Time
+	Chan chan time.Time
+}
+
+func (self *FakeClock) Now() time.Time {
+	self.Lock()
+	defer self.Unlock()
+	return self.Time
+}
+
+func (self *FakeClock) Since(val time.Time) time.Duration { return self.Now().Sub(val) }
+
+func (self *FakeClock) After(val time.Duration) <-chan time.Time {
+	self.Lock()
+	defer self.Unlock()
+
+	out := make(chan time.Time, 1)
+	self.Timers = append(self.Timers, FakeTimer{self.Time.Add(val), out})
+	self.Count++
+	return out
+}
+
+func (self *FakeClock) Advance(val time.Duration) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.Time = self.Time.Add(val)
+	self.Timers = gg.Filter(self.Timers, func(timer FakeTimer) bool {
+		if timer.Time.After(self.Time) {
+			return true
+		}
+		timer.Chan <- self.Time
+		return false
+	})
+}
+
+// Waits until the total count of created timers reaches the given number.
+func (self *FakeClock) WaitTimers(count int) {
+	waitFor(func() bool {
+		self.Lock()
+		defer self.Unlock()
+		return self.Count >= count
+	})
+}
+
+func waitFor(fun func() bool) {
+	for start := time.Now(); !fun(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second*5 {
+			panic(gg.Errf(`timed out`))
+		}
+	}
+}
+
+func TestFsnotifyWatcher(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := gg.Try1(filepath.EvalSymlinks(t.TempDir()))
+	events := make(chan notify.EventInfo, 16)
+	watcher := newFsnotifyWatcher(events, make(chan error, 1))
+	defer watcher.Close()
+
+	gtest.NoErr(watcher.Add(dir, true, notify.Create|notify.Write))
+
+	// Waits for an event for the given path, returning all events until then.
+	wait := func(path string) (out []notify.EventInfo) {
+		timeout := time.After(time.Second * 5)
+		for {
+			select {
+			case eve := <-events:
+				out = append(out, eve)
+				if eve.Path() == path {
+					return
+				}
+			case <-timeout:
+				panic(gg.Errf(`timed out waiting for an event for %q`, path))
+			}
+		}
+	}
+
+	sub := filepath.Join(dir, `sub`)
+	gg.MkdirAll(sub)
+	gtest.Eq(gg.Last(wait(sub)).Event(), notify.Create)
+
+	// New directories are watched too.
+	file := filepath.Join(sub, `file.txt`)
+	gg.WriteFile(file, `one`)
+	wait(file)
+
+	// Removal is not in the mask.
+	gg.Try(os.Remove(file))
+	gg.WriteFile(filepath.Join(dir, `two.txt`), `two`)
+	for _, eve := range wait(filepath.Join(dir, `two.txt`)) {
+		gtest.Zero(eve.Event() & notify.Remove)
+	}
+}
+
+func TestInputWatcher_file(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := gg.Try1(filepath.EvalSymlinks(t.TempDir()))
+	inp := filepath.Join(dir, `inp.txt`)
+	gg.WriteFile(inp, `one`)
+
+	var run RunState
+	run.Entry.Input = inp
+
+	watcher := InputWatcher{
+		Run:    &run,
+		Input:  inp,
+		Events: make(chan notify.EventInfo, 16),
+		Errors: make(chan error, 1),
+	}
+	watcher.Watch()
+	defer watcher.Close()
+	gtest.Eq(watcher.File, inp)
+
+	// Waits for an accepted event, failing on any other file.
+	wait := func() {
+		timeout := time.After(time.Second * 5)
+		for {
+			select {
+			case eve := <-watcher.Events:
+				eve, ok := watcher.Filter(eve)
+				if ok {
+					gtest.Eq(eve.Path(), inp)
+					return
+				}
+			case <-timeout:
+				panic(gg.Errf(`timed out waiting for an event for %q`, inp))
+			}
+		}
+	}
+
+	gg.WriteFile(filepath.Join(dir, `other.txt`), `other`)
+	gg.WriteFile(inp, `two`)
+	wait()
+
+	// Replacing the file by renaming keeps the watch.
+	gg.WriteFile(filepath.Join(dir, `inp.txt.tmp`), `three`)
+	gg.Try(os.Rename(filepath.Join(dir, `inp.txt.tmp`), inp))
+	wait()
+	gtest.Eq(len(watcher.Errors), 0)
+
+	gg.WriteFile(inp, `four`)
+	wait()
+
+	defer gg.SnapSwap(&FLAGS.Config, filepath.Join(dir, `config.json`)).Done()
+	gtest.True(isConfigEvent(nil))
+	gtest.True(isConfigEvent(testEvent(filepath.Join(dir, `config.json`))))
+	gtest.False(isConfigEvent(testEvent(inp)))
+}
+
+func TestRunEvents_debounce_deadline(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	clock := &FakeClock{Time: time.Now()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var run RunState
+	run.Ctx = ctx
+	run.Clock = clock
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Debounce.Set(Duration(time.Second))
+	run.Entry.Deadline.Set(Duration(time.Second * 3))
+	run.Entry.Throttle.Set(0)
+
+	events := make(chan notify.EventInfo)
+	go runEvents(ctx, &run, run.Targets(), events, func(eve notify.EventInfo) (notify.EventInfo, bool) {
+		return eve, true
+	}, nil, nil)
+
+	backups := func() int { return len(readDir(out)) }
+	event := testEvent(inp)
+
+	// Startup backup. Sending the event waits for it to finish.
+	waitFor(func() bool { return backups() == 1 })
+
+	// Debounce: each event restarts the debounce timer.
+	events <- event
+	clock.WaitTimers(2)
+	clock.Advance(time.Millisecond * 500)
+	events <- event
+	clock.WaitTimers(3)
+	clock.Advance(time.Millisecond * 600)
+	gtest.Eq(backups(), 1)
+	clock.Advance(time.Millisecond * 400)
+	waitFor(func() bool { return backups() == 2 })
+
+	// Deadline: a steady stream of events eventually results in a backup.
+	events <- event
+	clock.WaitTimers(5)
+	for ind := 0; backups() == 2; ind++ {
+		gtest.True(ind <= 6)
+		clock.Advance(time.Millisecond * 500)
+		events <- event
+	}
+	gtest.Eq(backups(), 3)
+
+	// Received only after the backup is finished.
+	events <- event
+	gtest.True(clock.Since(run.Latest) <= time.Millisecond*500)
+}
+
+func TestRunState_Throttled(t *testing.T) {
+	defer gtest.Catch(t)
+
+	clock := &FakeClock{Time: time.Now()}
+
+	var run RunState
+	run.Clock = clock
+	run.Entry.Throttle.Set(Duration(time.Minute))
+
+	gtest.False(run.Throttled())
+
+	run.Latest = clock.Now()
+	gtest.True(run.Throttled())
+
+	clock.Advance(time.Second * 59)
+	gtest.True(run.Throttled())
+
+	clock.Advance(time.Second)
+	gtest.False(run.Throttled())
+	gtest.Eq(run.Counters.Throttled, 2)
+}
+
+func TestFinalize_pinned(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Limit.Set(2)
+	run.Entry.Keep = []string{`*_000001`}
+
+	backup(&run)
+	backup(&run)
+	gtest.True(pinBackup(&run, `2`))
+	gtest.False(pinBackup(&run, `3`))
+	backup(&run)
+	backup(&run)
+	backup(&run)
+
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{
+		`inp_000001`,
+		`inp_000002`,
+		`inp_000002` + PIN_EXT,
+		`inp_000004`,
+		`inp_000005`,
+	})
+}
+
+func TestFinalize_max_age(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	clock := &FakeClock{Time: time.Now()}
+	var run RunState
+	run.Clock = clock
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.MaxAge.Set(Duration(time.Hour * 24))
+
+	ages := []time.Duration{time.Hour * 72, time.Hour * 48, time.Hour * 12, time.Hour}
+	for ind, age := range ages {
+		path := filepath.Join(out, `inp_`+Index(ind+1).String()+`.txt`)
+		gg.MkdirAll(out)
+		gg.WriteFile(path, `old`)
+		val := clock.Now().Add(-age)
+		gg.Try(os.Chtimes(path, val, val))
+	}
+
+	names := func() []IndexedName {
+		return gg.Sorted(relatedNames(out, run.BackupName()))
+	}
+	indexes := func(src []IndexedName) []Index {
+		return gg.Map(src, func(val IndexedName) Index { return val.Index })
+	}
+
+	// Over the limit, but not older than the max age.
+	run.Entry.Limit.Set(1)
+	run.Entry.MaxAge.Set(Duration(time.Hour * 100))
+	gtest.Zero(expiredBackups(&run, names(), gg.Last(names())))
+
+	// Older than the max age, but not over the limit.
+	run.Entry.Limit.Set(4)
+	run.Entry.MaxAge.Set(Duration(time.Hour * 24))
+	gtest.Zero(expiredBackups(&run, names(), gg.Last(names())))
+
+	// Both over the limit and older than the max age.
+	run.Entry.Limit.Set(1)
+	gtest.Equal(indexes(expiredBackups(&run, names(), gg.Last(names()))), []Index{1, 2})
+
+	// Only the age counts.
+	run.Entry.Limit.Set(0)
+	gtest.Equal(indexes(expiredBackups(&run, names(), gg.Last(names()))), []Index{1, 2})
+
+	// The latest backup is never deleted by age.
+	run.Entry.MaxAge.Set(Duration(time.Minute))
+	gtest.Equal(indexes(expiredBackups(&run, names(), gg.Last(names()))), []Index{1, 2, 3})
+
+	// Without a max age, only the limit counts.
+	run.Entry.MaxAge.Set(0)
+	run.Entry.Limit.Set(3)
+	gtest.Equal(indexes(expiredBackups(&run, names(), gg.Last(names()))), []Index{1})
+}
+
+func TestFinalize_deletion_error(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` || os.Geteuid() == 0 {
+		t.Skip(`requires permissions that prevent deletion`)
+	}
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `sub/file.txt`), `one`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Limit.Set(1)
+
+	backup(&run)
+
+	// Prevents deleting the contents of the first backup. Without the read
+	// permission, making the directory writable doesn't help (see
+	// `removeBackup`).
+	locked := filepath.Join(out, `inp_000001/sub`)
+	gg.Try(os.Chmod(locked, 0o000))
+	defer os.Chmod(locked, 0o777)
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.ErrAny(run.Retention)
+	gtest.Eq(len(readDir(out)), 2)
+
+	gg.Try(os.Chmod(locked, 0o777))
+	backup(&run)
+	gtest.NoErr(run.Retention)
+	gtest.Equal(readDir(out), []string{`inp_000003`})
+}
+
+func TestWindow(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var window Window
+	gg.JsonDecode(`{"days": ["mon", "Tuesday"], "hours": ["22:00-06:00", "12:00-12:30"]}`, &window)
+
+	gtest.Equal(window.Days, []Weekday{Weekday(time.Monday), Weekday(time.Tuesday)})
+	gtest.Equal(window.Hours, []TimeRange{
+		{time.Hour * 22, time.Hour * 6},
+		{time.Hour * 12, time.Hour*12 + time.Minute*30},
+	})
+
+	at := func(day, hour, min int) time.Time {
+		// 2024-01-01 is a Monday.
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.Local)
+	}
+
+	gtest.True(window.Allows(at(1, 23, 0)))
+	gtest.True(window.Allows(at(1, 3, 0)))
+	gtest.True(window.Allows(at(2, 12, 29)))
+	gtest.False(window.Allows(at(2, 12, 30)))
+	gtest.False(window.Allows(at(1, 6, 0)))
+	gtest.False(window.Allows(at(3, 23, 0)))
+
+	next := func(val time.Time) time.Time {
+		out, ok := window.Next(val)
+		gtest.True(ok)
+		return out
+	}
+
+	gtest.Eq(next(at(1, 13, 0)), at(1, 22, 0))
+	gtest.Eq(next(at(2, 23, 0)), at(2, 23, 0))
+	gtest.Eq(next(at(3, 1, 0)), at(8, 0, 0))
+
+	var val TimeRange
+	gtest.ErrAny(val.UnmarshalText([]byte(`22:00`)))
+	gtest.ErrAny(val.UnmarshalText([]byte(`22:00-25:00`)))
+
+	var day Weekday
+	gtest.ErrAny(day.UnmarshalText([]byte(`someday`)))
+}
+
+func TestRunEvents_window(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	clock := &FakeClock{Time: time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var run RunState
+	run.Ctx = ctx
+	run.Clock = clock
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Debounce.Set(Duration(time.Second))
+	run.Entry.Deadline.Set(0)
+	run.Entry.Throttle.Set(0)
+	run.Entry.Window.Hours = []TimeRange{{time.Hour * 13, time.Hour * 14}}
+
+	events := make(chan notify.EventInfo)
+	go runEvents(ctx, &run, run.Targets(), events, func(eve notify.EventInfo) (notify.EventInfo, bool) {
+		return eve, true
+	}, nil, nil)
+
+	// The startup backup is deferred until 13:00, and so is the next one.
+	clock.WaitTimers(1)
+	events <- testEvent(inp)
+	clock.WaitTimers(2)
+	clock.Advance(time.Second)
+	clock.WaitTimers(3)
+	gtest.Zero(len(readDir(out)))
+
+	// Both deferred backups result in one.
+	clock.Advance(time.Hour)
+	events <- testEvent(inp)
+	gtest.Equal(readDir(out), []string{`inp_000001.txt`})
+}
+
+func TestRunEvents_watch_error(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	clock := &FakeClock{Time: time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var run RunState
+	run.Ctx = ctx
+	run.Clock = clock
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Debounce.Set(Duration(time.Second))
+	run.Entry.Deadline.Set(0)
+	run.Entry.Throttle.Set(0)
+
+	events := make(chan notify.EventInfo)
+	errs := make(chan error)
+	var count int
+	rewatch := func() error {
+		count++
+		if count < 2 {
+			return gg.Errf(`fake rewatch failure`)
+		}
+		return nil
+	}
+
+	go runEvents(ctx, &run, run.Targets(), events, func(eve notify.EventInfo) (notify.EventInfo, bool) {
+		return eve, true
+	}, errs, rewatch)
+
+	errs <- gg.Errf(`fake watch error`)
+	clock.WaitTimers(1)
+
+	// Further errors don't schedule more retries.
+	errs <- gg.Errf(`fake watch error`)
+	gtest.Eq(clock.Count, 1)
+
+	clock.Advance(WATCH_RETRY_DELAY)
+	clock.WaitTimers(2)
+	gtest.Eq(count, 1)
+
+	// Changes made while the watch was broken are backed up after it's
+	// re-established.
+	gg.WriteFile(inp, `two`)
+	later := time.Now().Add(time.Hour)
+	gg.Try(os.Chtimes(inp, later, later))
+
+	clock.Advance(WATCH_RETRY_DELAY)
+	errs <- gg.Errf(`fake watch error`)
+	gtest.Eq(count, 2)
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{`inp_000001.txt`, `inp_000002.txt`})
+}
+
+func TestRunEvents_missing_input(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+
+	clock := &FakeClock{Time: time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var run RunState
+	run.Ctx = ctx
+	run.Clock = clock
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Debounce.Set(0)
+	run.Entry.Deadline.Set(0)
+	run.Entry.Throttle.Set(0)
+
+	// Only counts complete backups, since a backup in progress has a temporary
+	// name. See `tempPath`.
+	name := run.GetIndexFormat().Parse(inp)
+
+	events := make(chan notify.EventInfo)
+	var count atomic.Int64
+	rewatch := func() error {
+		count.Add(1)
+		return nil
+	}
+
+	go runEvents(ctx, &run, run.Targets(), events, func(eve notify.EventInfo) (notify.EventInfo, bool) {
+		return eve, true
+	}, nil, rewatch)
+
+	backups := func() int { return len(relatedNames(out, name)) }
+
+	// No startup backup: the input is awaited.
+	clock.WaitTimers(1)
+	events <- testEvent(inp)
+	gtest.Zero(backups())
+
+	clock.Advance(WATCH_RETRY_DELAY)
+	clock.WaitTimers(2)
+	gtest.Zero(count.Load())
+
+	gg.WriteFile(inp, `one`)
+	clock.Advance(WATCH_RETRY_DELAY)
+	waitFor(func() bool { return backups() == 1 })
+	gtest.Eq(count.Load(), 1)
+
+	// Removal is noticed on the next event, and recreation too.
+	gg.Try(os.Remove(inp))
+	events <- testEvent(inp)
+	clock.WaitTimers(3)
+	gtest.Eq(backups(), 1)
+
+	gg.WriteFile(inp, `two`)
+	events <- testEvent(inp)
+	waitFor(func() bool { return backups() == 2 })
+	gtest.Eq(count.Load(), 2)
+}
+
+func TestBackupSize(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub/two.txt`), `two!`)
+
+	start := func(record bool) string {
+		run := RunState{}
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		run.Entry.RecordSize.Set(record)
+		backup(&run)
+		return run.Target
+	}
+
+	exp := BackupSize{Files: 2, Bytes: 7}
+
+	path := start(true)
+	gtest.True(gg.FileExists(sizePath(path)))
+	gtest.Eq(backupSize(path), exp)
+
+	// The record is preferred over walking.
+	writeFileAtomic(sizePath(path), gg.JsonBytes(BackupSize{Files: 3, Bytes: 11}))
+	gtest.Eq(backupSize(path), BackupSize{Files: 3, Bytes: 11})
+
+	gtest.NoErr(removeBackup(path))
+	gtest.False(gg.FileExists(sizePath(path)))
+
+	path = start(false)
+	gtest.False(gg.FileExists(sizePath(path)))
+	gtest.Eq(backupSize(path), exp)
+}
+
+func TestFinalize_max_bytes(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.MaxBytes.Set(10)
+
+	for _, val := range []string{`1234`, `5678`, `90`, `1234`} {
+		gg.WriteFile(inp, val)
+		backup(&run)
+		gtest.Eq(run.Result, RESULT_OK)
+	}
+
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{
+		`inp_000002.txt`,
+		`inp_000003.txt`,
+		`inp_000004.txt`,
+	})
+
+	// The latest backup is kept even when it alone exceeds the budget.
+	gg.WriteFile(inp, `12345678901`)
+	backup(&run)
+	gtest.Equal(readDir(out), []string{`inp_000005.txt`})
+
+	var val ByteSize
+	gtest.NoErr(val.UnmarshalText([]byte(`512`)))
+	gtest.Eq(val, 512)
+	gtest.NoErr(val.UnmarshalText([]byte(`100MB`)))
+	gtest.Eq(val, 100_000_000)
+	gtest.NoErr(val.UnmarshalText([]byte(`1.5 GiB`)))
+	gtest.Eq(val, 3<<29)
+	gtest.NoErr(val.UnmarshalText([]byte(`2kib`)))
+	gtest.Eq(val, 2048)
+	gtest.ErrAny(val.UnmarshalText([]byte(`10 parsecs`)))
+	gtest.ErrAny(val.UnmarshalText([]byte(`-1MB`)))
+	gtest.ErrAny(val.UnmarshalText([]byte(`MB`)))
+
+	var conf CommonConfig
+	gg.JsonDecode(`{"maxBytes": 1024}`, &conf)
+	gtest.Eq(conf.MaxBytes.Val, 1024)
+	gg.JsonDecode(`{"maxBytes": "1KiB"}`, &conf)
+	gtest.Eq(conf.MaxBytes.Val, 1024)
+}
+
+func TestMemoryBudget(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var budget MemoryBudget
+	budget.SetLimit(100)
+
+	one := gg.Try1(budget.Acquire(nil, 60))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err := budget.Acquire(ctx, 60)
+	gtest.True(errors.Is(err, context.DeadlineExceeded))
+
+	acquired := make(chan func())
+	go func() { acquired <- gg.Try1(budget.Acquire(nil, 60)) }()
+
+	select {
+	case <-acquired:
+		panic(gg.Errf(`expected the acquisition to wait for memory`))
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	one()
+	two := <-acquired
+	two()
+	gtest.Zero(budget.Used)
+
+	// Oversized acquisitions don't wait forever.
+	gg.Try1(budget.Acquire(nil, 1000))()
+
+	// Raising the limit wakes up waiters.
+	three := gg.Try1(budget.Acquire(nil, 100))
+	go func() { acquired <- gg.Try1(budget.Acquire(nil, 50)) }()
+	budget.SetLimit(200)
+	(<-acquired)()
+	three()
+	gtest.Zero(budget.Used)
+}
+
+// Records the size of the buffers passed to `Read`.
+type BufReader struct {
+	io.Reader
+	Size int
+}
+
+func (self *BufReader) Read(buf []byte) (int, error) {
+	self.Size = len(buf)
+	return self.Reader.Read(buf)
+}
+
+func TestCopyBudgeted(t *testing.T) {
+	defer gtest.Catch(t)
+
+	test := func(bufSize ByteSize, exp int) {
+		src := &BufReader{Reader: strings.NewReader(`one`)}
+		var tar gg.Buf
+		gtest.Eq(gg.Try1(copyBudgeted(nil, &tar, src, bufSize, 0)), 3)
+		gtest.Eq(tar.String(), `one`)
+		gtest.Eq(src.Size, exp)
+	}
+
+	test(0, COPY_BUFFER_SIZE)
+	test(1<<20, 1<<20)
+	test(1<<10, 1<<10)
+
+	buf := COPY_BUFFERS.Get(1 << 10)
+	gtest.Eq(len(*buf), 1<<10)
+	COPY_BUFFERS.Put(buf)
+	gtest.Eq(len(*COPY_BUFFERS.Get(1 << 10)), 1<<10)
+}
+
+func TestValidateConfig_copyBufferSize(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	gg.WriteFile(inp, `one`)
+
+	validate := func(size ByteSize, maxCopyMemory uint64) error {
+		entry := Entry{Name: `notes`, Input: inp, Output: filepath.Join(dir, `out`)}
+		entry.CopyBufferSize.Set(size)
+		return validateConfig(Config{MaxCopyMemory: maxCopyMemory, Entries: []Entry{entry}})
+	}
+
+	gtest.NoErr(validate(0, 0))
+	gtest.NoErr(validate(COPY_BUFFER_MAX, 0))
+	gtest.NoErr(validate(1<<20, 1<<20))
+
+	gtest.ErrStr(
+		`entry "notes": field "copyBufferSize": 67108865 is too large, the maximum is 67108864`,
+		validate(COPY_BUFFER_MAX+1, 0),
+	)
+	gtest.ErrStr(
+		`entry "notes": field "copyBufferSize": 2097152 is larger than "maxCopyMemory" 1048576`,
+		validate(2<<20, 1<<20),
+	)
+}
+
+/*
+Copies a large file between files on disk with different buffer sizes, through
+wrappers which hide `io.WriterTo` and `io.ReaderFrom`, like in `copyFileData`.
+Run with "go test -run - -bench CopyBudgeted".
+*/
+func BenchmarkCopyBudgeted(b *testing.B) {
+	dir := b.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	gg.WriteFile(inp, bytes.Repeat([]byte(`a`), 64<<20))
+
+	for _, size := range []ByteSize{0, 256 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprint(gg.Or(uint64(size), COPY_BUFFER_SIZE)), func(b *testing.B) {
+			b.SetBytes(64 << 20)
+			for ind := 0; ind < b.N; ind++ {
+				src := gg.Try1(os.Open(inp))
+				tar := gg.Try1(os.Create(filepath.Join(dir, `out`)))
+				gg.Try1(copyBudgeted(nil, struct{ io.Writer }{tar}, struct{ io.Reader }{src}, size, 0))
+				gg.Try(src.Close())
+				gg.Try(tar.Close())
+			}
+		})
+	}
+}
+
+func TestExpandEntries(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, `src`)
+	gg.MkdirAll(filepath.Join(src, `a`))
+	gg.MkdirAll(filepath.Join(src, `b`, `c`))
+	gg.WriteFile(filepath.Join(src, `a`, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(src, `b`, `two.txt`), `two`)
+	gg.WriteFile(filepath.Join(src, `b`, `c`, `three.txt`), `three`)
+
+	outputs := func(src []Entry) []string {
+		return gg.Map(src, func(val Entry) string { return val.Output })
+	}
+
+	// The default root is the leading directory without glob characters.
+	gtest.Equal(outputs(expandEntries([]Entry{{
+		Input:  filepath.Join(src, `*`, `*.txt`),
+		Output: filepath.Join(`backups`, RELPATH_VAR),
+	}})), []string{
+		filepath.Join(`backups`, `a`),
+		filepath.Join(`backups`, `b`),
+	})
+
+	gtest.Equal(outputs(expandEntries([]Entry{{
+		Input:  filepath.Join(src, `b`, `*`, `*.txt`),
+		Output: filepath.Join(`backups`, RELPATH_VAR),
+		Root:   src,
+		Routes: map[string]string{`*`: filepath.Join(`routed`, RELPATH_VAR)},
+	}})), []string{filepath.Join(`backups`, `b`, `c`)})
+
+	entry := expandEntries([]Entry{{
+		Input:  filepath.Join(src, `b`, `two.txt`),
+		Output: filepath.Join(`backups`, RELPATH_VAR, `sub`),
+		Root:   src,
+		Routes: map[string]string{`*`: filepath.Join(`routed`, RELPATH_VAR)},
+	}})[0]
+	gtest.Eq(entry.Output, filepath.Join(`backups`, `b`, `sub`))
+	gtest.Eq(entry.Routes[`*`], filepath.Join(`routed`, `b`))
+
+	gtest.Empty(expandEntries([]Entry{{Input: filepath.Join(src, `*`, `*.md`)}}))
+
+	gtest.PanicStr(`is outside of the root`, func() {
+		expandEntries([]Entry{{
+			Input:  filepath.Join(src, `a`, `one.txt`),
+			Output: RELPATH_VAR,
+			Root:   filepath.Join(src, `b`),
+		}})
+	})
+}
+
+func TestIsBug(t *testing.T) {
+	defer gtest.Catch(t)
+
+	gtest.False(isBug(nil))
+	gtest.False(isBug(gg.Catch(func() { panic(gg.Errf(`failed`)) })))
+	gtest.False(isBug(gg.Catch(func() { gg.Try(os.Remove(filepath.Join(t.TempDir(), `missing`))) })))
+
+	gtest.True(isBug(gg.Catch(func() {
+		var val map[string]int
+		val[`one`] = 1
+	})))
+	gtest.True(isBug(gg.Catch(func() { panic(123) })))
+	gtest.True(isBug(gg.Wrapf(gg.Catch(func() {
+		var val []int
+		_ = val[1]
+	}), `failed to backup`)))
+}
+
+func TestAudit(t *testing.T) {
+	defer gtest.Catch(t)
+
+	path := filepath.Join(t.TempDir(), `audit.jsonl`)
+
+	var audit Audit
+	audit.Append(path, AuditRecord{Entry: `one`, Result: RESULT_OK, Files: 1})
+	audit.Append(path, AuditRecord{Entry: `one`, Result: RESULT_ERROR, Error: `failed`})
+
+	// A new process continues the chain.
+	audit = Audit{}
+	audit.Append(path, AuditRecord{Entry: `two`, Result: RESULT_UP_TO_DATE})
+
+	count, last, problems := verifyAudit(path)
+	gtest.Eq(count, 3)
+	gtest.Eq(last, audit.Last)
+	gtest.Empty(problems)
+
+	lines := readHistoryLines(path)
+	write := func(lines ...[]byte) {
+		gg.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'))
+	}
+
+	write(lines[0], bytes.Replace(lines[1], []byte(`"files":0`), []byte(`"files":9`), 1), lines[2])
+	_, _, problems = verifyAudit(path)
+	gtest.Len(problems, 1)
+	gtest.True(strings.Contains(problems[0], `record 2: hash mismatch`))
+
+	write(lines[0], lines[2])
+	_, _, problems = verifyAudit(path)
+	gtest.Len(problems, 1)
+	gtest.True(strings.Contains(problems[0], `record 2: doesn't follow`))
+}
+
+func TestBackup_preserve_times(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`, `nested`))
+	gg.WriteFile(filepath.Join(inp, `sub`, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub`, `nested`, `two.txt`), `two`)
+
+	times := map[string]time.Time{
+		`.`:                  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		`sub`:                time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		`sub/one.txt`:        time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC),
+		`sub/nested`:         time.Date(2020, 1, 4, 0, 0, 0, 0, time.UTC),
+		`sub/nested/two.txt`: time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC),
+	}
+
+	// Children first, since changing them changes their parents.
+	for _, key := range gg.Reversed(gg.SortedPrim(gg.MapKeys(times))) {
+		gg.Try(os.Chtimes(filepath.Join(inp, filepath.FromSlash(key)), times[key], times[key]))
+	}
+
+	start := func() *RunState {
+		run := RunState{}
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		run.Entry.PreserveTimes.Set(true)
+		backup(&run)
+		return &run
+	}
+
+	path := start().Target
+	for key, val := range times {
+		info := gg.Try1(os.Stat(filepath.Join(path, filepath.FromSlash(key))))
+		gtest.True(info.ModTime().Equal(val), key)
+	}
+
+	// Preserved times are up to date.
+	gtest.Eq(start().Result, RESULT_UP_TO_DATE)
+}
+
+func TestBackup_preserve_mode(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` {
+		t.Skip(`Windows doesn't have Unix permission bits`)
+	}
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `run.sh`), `echo`)
+	gg.WriteFile(filepath.Join(inp, `sub`, `data.txt`), `data`)
+	gg.Try(os.Chmod(filepath.Join(inp, `run.sh`), 0o750))
+	gg.Try(os.Chmod(filepath.Join(inp, `sub`, `data.txt`), 0o400))
+	gg.Try(os.Chmod(filepath.Join(inp, `sub`), 0o500))
+	defer os.Chmod(filepath.Join(inp, `sub`), 0o700)
+	defer makeDirsWritable(out)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Limit.Set(1)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+
+	mode := func(path string) fs.FileMode {
+		return gg.Try1(os.Stat(filepath.Join(run.Target, path))).Mode().Perm()
+	}
+	gtest.Eq(mode(`run.sh`), 0o750)
+	gtest.Eq(mode(`sub/data.txt`), 0o400)
+	gtest.Eq(mode(`sub`), 0o500)
+
+	// Read-only backups are still deleted by retention.
+	prev := run.Target
+	gg.WriteFile(filepath.Join(inp, `run.sh`), `echo again`)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.NotEq(run.Target, prev)
+	gtest.False(gg.DirExists(prev))
+}
+
+func TestBackup_first_run(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	gg.WriteFile(inp, `one`)
+
+	populate := func(name string) string {
+		out := filepath.Join(dir, name)
+		gg.MkdirAll(out)
+		for _, ind := range []string{`1`, `2`, `3`} {
+			gg.WriteFile(filepath.Join(out, `inp_00000`+ind+`.txt`), ind)
+		}
+		return out
+	}
+
+	start := func(out, mode string) *RunState {
+		run := RunState{}
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		run.Entry.FirstRun = mode
+		backup(&run)
+		return &run
+	}
+
+	out := populate(`adopt`)
+	gtest.Eq(start(out, ``).Index, 4)
+
+	out = populate(`fresh`)
+	gtest.Eq(start(out, FIRST_RUN_FRESH).Index, 1)
+	prev := readDir(filepath.Join(out, PREVIOUS_DIR))
+	gtest.Len(prev, 1)
+	gtest.Len(readDir(filepath.Join(out, PREVIOUS_DIR, prev[0])), 3)
+	gtest.True(gg.FileExists(filepath.Join(out, `inp.txt`+FIRST_RUN_EXT)))
+
+	// Later runs continue the new sequence.
+	gtest.Eq(start(out, FIRST_RUN_FRESH).Index, 2)
+
+	out = populate(`validate`)
+	gg.WriteFile(filepath.Join(out, `inp_3.txt`), `3`)
+
+	// Each problem is reported as an error, even in quiet mode.
+	var text bytes.Buffer
+	func() {
+		defer log.SetOutput(log.Writer())
+		log.SetOutput(LogWriter{Text: &text, Quiet: true})
+		gtest.Eq(start(out, FIRST_RUN_VALIDATE).Result, RESULT_ERROR)
+	}()
+	gtest.True(strings.Contains(text.String(), `  `+fmtPath(filepath.Join(out, `inp_3.txt`))+`: `))
+	gtest.False(gg.FileExists(filepath.Join(out, `inp.txt`+FIRST_RUN_EXT)))
+
+	gg.Try(os.Remove(filepath.Join(out, `inp_3.txt`)))
+	gtest.Eq(start(out, FIRST_RUN_VALIDATE).Index, 4)
+	gtest.True(gg.FileExists(filepath.Join(out, `inp.txt`+FIRST_RUN_EXT)))
+}
+
+func TestDoctor(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	gg.MkdirAll(inp)
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	diagnose := func(entries ...Entry) Doctor {
+		gg.WriteFile(conf, gg.JsonString(Config{Entries: entries}))
+		var doc Doctor
+		doc.Run(nil)
+		return doc
+	}
+
+	doc := diagnose(Entry{Input: inp, Output: filepath.Join(dir, `out`, `nested`)})
+	gtest.Empty(doc.Fatal)
+	gtest.Empty(doc.Warnings)
+
+	doc = diagnose(
+		Entry{Name: `missing`, Input: filepath.Join(dir, `missing`), Output: filepath.Join(dir, `out`)},
+		Entry{Name: `one`, Input: inp, Output: filepath.Join(dir, `out`)},
+		Entry{Name: `two`, Input: inp, Output: filepath.Join(dir, `out`)},
+		Entry{Name: `inside`, Input: inp, Output: filepath.Join(inp, `backups`)},
+	)
+
+	gtest.Len(doc.Fatal, 2)
+	gtest.True(strings.Contains(doc.Fatal[0], `entry "missing": unreadable input`))
+	gtest.True(strings.Contains(doc.Fatal[1], `entries "one" and "two" make backups of the same name`))
+
+	gtest.Len(doc.Warnings, 1)
+	gtest.True(strings.Contains(doc.Warnings[0], `entry "inside": output`))
+}
+
+func TestBackup_compress(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	start := func(inp, compress string) *RunState {
+		run := RunState{}
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		run.Entry.Limit.Set(2)
+		run.Entry.Compress = compress
+		backup(&run)
+		return &run
+	}
+
+	readGzip := func(path string) string {
+		file := gg.Try1(os.Open(path))
+		defer file.Close()
+		return string(gg.Try1(io.ReadAll(gg.Try1(gzip.NewReader(file)))))
+	}
+
+	start(inp, ``)
+	start(inp, COMPRESS_GZIP)
+	path := start(inp, COMPRESS_GZIP).Target
+
+	// Compressed backups continue the sequence, and count towards the limit.
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{
+		`inp_000002.txt.gz`,
+		`inp_000003.txt.gz`,
+	})
+	gtest.Eq(readGzip(path), `one`)
+
+	name := IndexFormat{}.Parse(`inp_000003.txt.gz`)
+	gtest.Eq(name.Index, 3)
+	gtest.Eq(name.Compress, GZIP_EXT)
+	gtest.Eq(name.String(), `inp_000003.txt.gz`)
+	gtest.True(name.Related(IndexFormat{}.Parse(`inp.txt`)))
+
+	gtest.Eq(start(inp, ``).Target, filepath.Join(out, `inp_000004.txt`))
+
+	// In directory backups, each file is compressed.
+	sub := filepath.Join(dir, `sub`)
+	gg.MkdirAll(sub)
+	gg.WriteFile(filepath.Join(sub, `two.txt`), `two`)
+	path = start(sub, COMPRESS_GZIP).Target
+	gtest.Eq(filepath.Base(path), `sub_000001`)
+	gtest.Eq(readGzip(filepath.Join(path, `two.txt.gz`)), `two`)
+}
+
+func TestBackup_compress_level(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+
+	// Compressible, but not trivially: words in a pseudo-random order.
+	var buf gg.Buf
+	words := []string{`alpha`, `beta`, `gamma`, `delta`, `epsilon`, `zeta`, `eta`, `theta`}
+	for ind := 0; ind < 1<<16; ind++ {
+		buf.AppendString(words[(ind*ind+ind/7)%len(words)])
+		buf.AppendString(` `)
+	}
+	gg.WriteFile(inp, buf)
+
+	size := func(level uint64) int64 {
+		run := RunState{}
+		run.Entry.Input = inp
+		run.Entry.Output = filepath.Join(dir, strconv.FormatUint(level, 10))
+		run.Entry.Compress = COMPRESS_GZIP
+		run.Entry.CompressLevel.Set(level)
+		backup(&run)
+		gtest.Eq(run.Result, RESULT_OK)
+		return gg.Try1(os.Stat(run.Target)).Size()
+	}
+
+	fast, best := size(1), size(9)
+	gtest.True(best < fast, best, fast)
+	gtest.True(fast < int64(len(buf)))
+
+	entry := Entry{Name: `notes`, Input: inp, Output: dir, CommonConfig: CommonConfig{Compress: COMPRESS_GZIP}}
+	gtest.NoErr(validateConfig(Config{Entries: []Entry{entry}}))
+
+	for _, level := range []uint64{0, 10} {
+		entry.CompressLevel.Set(level)
+		gtest.ErrStr(`"compressLevel" must be between 1 and 9`, validateConfig(Config{Entries: []Entry{entry}}))
+	}
+}
+
+func TestBackup_exclude(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+
+	for _, path := range []string{
+		`keep.txt`,
+		`app.log`,
+		`node_modules/one.js`,
+		`src/node_modules/two.js`,
+		`src/main.go`,
+		`src/cache`,
+		`cache/three.txt`,
+		`build/main.o`,
+		`build/main.txt`,
+	} {
+		path = filepath.Join(inp, filepath.FromSlash(path))
+		gg.MkdirAll(filepath.Dir(path))
+		gg.WriteFile(path, `data`)
+	}
+
+	run := RunState{}
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Exclude = []string{`**/node_modules`, `*.log`, `cache/`, `build/*.o`}
+	backup(&run)
+
+	var found []string
+	gg.Try(filepath.WalkDir(run.Target, func(path string, src fs.DirEntry, err error) error {
+		if err == nil && !src.IsDir() {
+			found = append(found, filepath.ToSlash(gg.Try1(filepath.Rel(run.Target, path))))
+		}
+		return err
+	}))
+	gtest.Equal(gg.SortedPrim(found), []string{
+		`build/main.txt`,
+		`keep.txt`,
+		`src/cache`,
+		`src/main.go`,
+	})
+
+	gtest.False(run.Accepts(testEvent(filepath.Join(inp, `app.log`))))
+	gtest.False(run.Accepts(testEvent(filepath.Join(inp, `node_modules`, `one.js`))))
+	gtest.True(run.Accepts(testEvent(filepath.Join(inp, `keep.txt`))))
+
+	// Changes of excluded files don't make the backup outdated.
+	later := time.Now().Add(time.Hour)
+	gg.Try(os.Chtimes(filepath.Join(inp, `app.log`), later, later))
+	gtest.True(isUpToDate(&run, run.Target))
+}
+
+func TestBackup_ignore_hidden(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `.inp`)
+	out := filepath.Join(dir, `out`)
+
+	for _, path := range []string{
+		`keep.txt`,
+		`.DS_Store`,
+		`.gitignore`,
+		`.git/config`,
+		`src/.main.go.swp`,
+		`src/main.go`,
+	} {
+		path = filepath.Join(inp, filepath.FromSlash(path))
+		gg.MkdirAll(filepath.Dir(path))
+		gg.WriteFile(path, `data`)
+	}
+
+	run := RunState{}
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.IgnoreHidden.Set(true)
+	backup(&run)
+
+	// The input itself is hidden, but is still backed up.
+	var found []string
+	gg.Try(filepath.WalkDir(run.Target, func(path string, src fs.DirEntry, err error) error {
+		if err == nil && path != run.Target {
+			found = append(found, filepath.ToSlash(gg.Try1(filepath.Rel(run.Target, path))))
+		}
+		return err
+	}))
+	gtest.Equal(gg.SortedPrim(found), []string{`keep.txt`, `src`, `src/main.go`})
+
+	gtest.False(run.Accepts(testEvent(filepath.Join(inp, `.git`, `config`))))
+	gtest.True(run.Accepts(testEvent(filepath.Join(inp, `keep.txt`))))
+
+	later := time.Now().Add(time.Hour)
+	gg.Try(os.Chtimes(filepath.Join(inp, `.DS_Store`), later, later))
+	gtest.True(isUpToDate(&run, run.Target))
+}
+
+func TestBackup_symlinks(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` {
+		t.Skip(`creating symlinks requires privileges on Windows`)
+	}
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `sub/file.txt`), `one`)
+	gg.Try(os.Symlink(`sub/file.txt`, filepath.Join(inp, `file_link.txt`)))
+	gg.Try(os.Symlink(`..`, filepath.Join(inp, `sub/parent_link`)))
+
+	backupWith := func(mode string) string {
+		out := filepath.Join(dir, `out_`+mode)
+		var run RunState
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		run.Entry.Symlinks = mode
+		backup(&run)
+		gtest.Eq(run.Result, RESULT_OK)
+		return run.Target
+	}
+
+	{
+		tar := backupWith(SYMLINKS_COPY)
+		gtest.Eq(gg.Try1(os.Readlink(filepath.Join(tar, `file_link.txt`))), `sub/file.txt`)
+		gtest.Eq(gg.Try1(os.Readlink(filepath.Join(tar, `sub/parent_link`))), `..`)
+		gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `file_link.txt`)), `one`)
+	}
+
+	{
+		tar := backupWith(SYMLINKS_SKIP)
+		gtest.Equal(gg.SortedPrim(readDir(tar)), []string{`sub`})
+		gtest.Equal(readDir(filepath.Join(tar, `sub`)), []string{`file.txt`})
+	}
+
+	// The symlink to the parent would recurse forever, and is skipped.
+	{
+		tar := backupWith(SYMLINKS_FOLLOW)
+		info := gg.Try1(os.Lstat(filepath.Join(tar, `file_link.txt`)))
+		gtest.False(isSymlink(info))
+		gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `file_link.txt`)), `one`)
+		gtest.Equal(readDir(filepath.Join(tar, `sub`)), []string{`file.txt`})
+	}
+
+	gtest.PanicStr(`unrecognized "symlinks" "never"`, func() { validateSymlinks(`never`) })
+}
+
+func TestBackup_concurrency(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+
+	var exp []string
+	for ind := 0; ind < 64; ind++ {
+		rel := fmt.Sprintf(`dir_%v/file_%v.txt`, ind%4, ind)
+		path := filepath.Join(inp, filepath.FromSlash(rel))
+		gg.MkdirAll(filepath.Dir(path))
+		gg.WriteFile(path, rel)
+		exp = append(exp, rel)
+	}
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Concurrency.Set(4)
+	run.Entry.Manifest.Set(true)
+	backup(&run)
+
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(run.Stats.Files, 64)
+	gtest.Zero(run.Pool)
+
+	var found []string
+	gg.Try(filepath.WalkDir(run.Target, func(path string, src fs.DirEntry, err error) error {
+		if err == nil && !src.IsDir() {
+			rel := filepath.ToSlash(gg.Try1(filepath.Rel(run.Target, path)))
+			gtest.Eq(gg.ReadFile[string](path), rel)
+			found = append(found, rel)
+		}
+		return err
+	}))
+	sort.Strings(exp)
+	gtest.Equal(gg.SortedPrim(found), exp)
+
+	// Directory times are applied after their files are written.
+	gtest.True(isUpToDate(&run, run.Target))
+	gtest.Eq(
+		gg.Try1(os.Stat(filepath.Join(run.Target, `dir_0`))).ModTime(),
+		gg.Try1(os.Stat(filepath.Join(inp, `dir_0`))).ModTime(),
+	)
+
+	if runtime.GOOS == `windows` {
+		return
+	}
+
+	// A file which can't be read fails the whole backup.
+	lis := gg.Try1(net.Listen(`unix`, filepath.Join(inp, `dir_0/socket`)))
+	defer lis.Close()
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_ERROR)
+	gtest.False(gg.DirExists(filepath.Join(out, `inp_000002`)))
+}
+
+func TestBackup_dry_run_copies(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.DryRun, true).Done()
+	defer gg.SnapSwap(&FLAGS.Verbose, true).Done()
+
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `sub`, `one.txt`), `one`)
+
+	run := RunState{}
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	backup(&run)
+
+	gtest.Eq(run.Result, RESULT_DRY_RUN)
+	gtest.False(gg.DirExists(out))
+	gtest.Eq(run.Stats.Files, 1)
+	gtest.True(strings.Contains(buf.String(), gg.Str(
+		DRY_RUN_PREFIX, ` would copy `,
+		fmtPath(filepath.Join(inp, `sub`, `one.txt`)), ` to `,
+		fmtPath(filepath.Join(out, `inp_000001`, `sub`, `one.txt`)),
+	)))
+}
+
+func TestBackup_skip_unchanged(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub/two.txt`), `two`)
+
+	run := RunState{}
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.SkipUnchanged.Set(true)
+
+	backup(&run)
+	gtest.Eq(run.Index, 1)
+	hash := run.LastHash
+	gtest.Eq(len(hash), 64)
+
+	// Rewriting a file with the same content only changes its timestamp.
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	run.Start()
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_UP_TO_DATE)
+	gtest.Len(readDir(out), 1)
+
+	gg.WriteFile(filepath.Join(inp, `sub/two.txt`), `three`)
+	run.Start()
+	backup(&run)
+	gtest.Eq(run.Index, 2)
+	gtest.NotEq(run.LastHash, hash)
+
+	// Renames change the hash, even with the same contents.
+	gg.Try(os.Rename(filepath.Join(inp, `sub/two.txt`), filepath.Join(inp, `sub/four.txt`)))
+	gtest.NotEq(contentHash(inp, nil), run.LastHash)
+}
+
+func TestBackup_verify(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub/two.txt`), `two`)
+
+	for _, compress := range []string{COMPRESS_NONE, COMPRESS_GZIP} {
+		run := RunState{}
+		run.Entry.Input = inp
+		run.Entry.Output = out
+		run.Entry.Verify.Set(true)
+		run.Entry.Compress = compress
+		backup(&run)
+		gtest.Eq(run.Result, RESULT_OK)
+		gtest.Eq(run.Stats.Files, 2)
+	}
+
+	src := filepath.Join(inp, `one.txt`)
+	tar := filepath.Join(dir, `copy.txt`)
+	gg.WriteFile(tar, `one`)
+	verifyCopy(src, tar, false, nil)
+
+	gg.WriteFile(tar, `two`)
+	gtest.PanicStr(`differs from its source`, func() { verifyCopy(src, tar, false, nil) })
+	gtest.False(gg.FileExists(tar))
+}
+
+func TestBackup_outputs(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	one := filepath.Join(dir, `one`)
+	two := filepath.Join(dir, `two`)
+	gg.WriteFile(inp, `one`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = one
+	run.Entry.Outputs = []Output{{Path: two}, {Path: one}}
+	run.Entry.Limit.Set(2)
+
+	targets := run.Targets()
+	gtest.Eq(len(targets), 2)
+	gtest.Eq(targets[0], &run)
+	gtest.Eq(targets[1].Entry.Output, two)
+
+	// The second output missed a backup.
+	backupTargets(targets, `test`)
+	backupTargets(targets[:1], `test`)
+	gtest.Eq(targets[0].Index, 2)
+
+	backupTargets(targets, `test`)
+	gtest.Eq(targets[0].Index, 3)
+	gtest.Eq(targets[1].Index, 3)
+
+	// A failing output doesn't prevent backups to the others.
+	gg.Try(os.RemoveAll(two))
+	gg.WriteFile(two, `not a directory`)
+	backupTargets(targets, `test`)
+	gtest.Eq(targets[0].Result, RESULT_OK)
+	gtest.Eq(targets[1].Result, RESULT_ERROR)
+
+	gtest.Equal(gg.SortedPrim(readDir(one)), []string{`inp_000003.txt`, `inp_000004.txt`})
+}
+
+func TestBackup_outputs_format(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	plain := filepath.Join(dir, `plain`)
+	archives := filepath.Join(dir, `archives`)
+	gg.MkdirAll(inp)
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+
+	var entry Entry
+	gg.JsonDecode(gg.JsonString(map[string]any{
+		`input`: inp,
+		`outputs`: []any{
+			plain,
+			map[string]any{`path`: archives, `archive`: ARCHIVE_TAR_GZ, `compressLevel`: 9},
+		},
+	}), &entry)
+
+	gtest.Equal(entry.Outputs, []Output{
+		{Path: plain},
+		{Path: archives, Archive: ARCHIVE_TAR_GZ, CompressLevel: gg.OptVal(uint64(9))},
+	})
+	gtest.NoErr(validateConfig(Config{Entries: []Entry{entry}}))
+
+	run := RunState{Entry: entry}
+	targets := run.Targets()
+	gtest.Eq(len(targets), 2)
+	gtest.False(targets[0].Archived())
+	gtest.True(targets[1].Archived())
+	gtest.Eq(targets[1].GzipLevel(), 9)
+
+	// The plain output missed a backup, and still continues the shared sequence.
+	backupTargets(targets, `test`)
+	backupTargets(targets[1:], `test`)
+	backupTargets(targets, `test`)
+
+	gtest.Equal(gg.SortedPrim(readDir(plain)), []string{`inp_000001`, `inp_000003`})
+	gtest.Equal(gg.SortedPrim(readDir(archives)), []string{`inp_000001.tar.gz`, `inp_000002.tar.gz`, `inp_000003.tar.gz`})
+	gtest.Eq(gg.ReadFile[string](filepath.Join(plain, `inp_000003`, `one.txt`)), `one`)
+
+	entry.Outputs[1].Archive = `zip`
+	gtest.ErrStr(`field "outputs"`, validateConfig(Config{Entries: []Entry{entry}}))
+
+	entry.Outputs[1] = Output{Compress: COMPRESS_GZIP}
+	gtest.ErrStr(`missing output path`, validateConfig(Config{Entries: []Entry{entry}}))
+}
+
+func TestStorageBackup(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` {
+		t.Skip(`the test SFTP server uses local paths as remote paths`)
+	}
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub/two.txt`), `two`)
+	gg.Try(os.Chmod(filepath.Join(inp, `one.txt`), 0o750))
+
+	// In-process SFTP server serving the local filesystem.
+	reqRead, reqWrite := io.Pipe()
+	resRead, resWrite := io.Pipe()
+	server := gg.Try1(sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{reqRead, resWrite}))
+	go server.Serve()
+
+	// The client waits for the server to close the connection.
+	store := SftpStorage{Client: gg.Try1(sftp.NewClientPipe(resRead, reqWrite))}
+	defer store.Close()
+	defer server.Close()
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = `sftp://user@localhost` + out
+	run.Entry.Limit.Set(2)
+
+	// Left by a failed backup.
+	gg.MkdirAll(filepath.Join(out, `.inp_000001.tmp-123`))
+
+	for range gg.Iter(3) {
+		run.Start()
+		storageBackup(&run, store, out)
+	}
+
+	gtest.Eq(run.Index, 3)
+	gtest.Eq(run.Stats.Files, 2)
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{
+		`inp_000002`,
+		`inp_000003`,
+	})
+	gtest.Eq(gg.ReadFile[string](filepath.Join(run.Target, `sub/two.txt`)), `two`)
+	gtest.Eq(gg.Try1(os.Stat(filepath.Join(run.Target, `one.txt`))).Mode().Perm(), 0o750)
+
+	// The same logic works with local storage.
+	storageBackup(&run, LocalStorage{}, out)
+	gtest.Eq(run.Index, 4)
+	gtest.Eq(len(readDir(out)), 2)
+
+	// On startup, the latest remote backup is up to date.
+	fresh := RunState{Entry: run.Entry}
+	fresh.Start()
+	storageBackup(&fresh, store, out)
+	gtest.Eq(fresh.Result, RESULT_UP_TO_DATE)
+	gtest.Eq(fresh.Counters.UpToDate, 1)
+
+	run.Entry.SkipUnchanged.Set(true)
+	run.Start()
+	storageBackup(&run, store, out)
+	gtest.Eq(run.Index, 5)
+	run.Start()
+	storageBackup(&run, store, out)
+	gtest.Eq(run.Result, RESULT_UP_TO_DATE)
+
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `changed`)
+	run.Start()
+	storageBackup(&run, store, out)
+	gtest.Eq(run.Index, 6)
+
+	remote, ok := parseRemote(`sftp://user@example.com/backups`)
+	gtest.True(ok)
+	gtest.Eq(remote, RemoteOutput{User: `user`, Host: `example.com:22`, Path: `/backups`})
+	gtest.Eq(remote.String(), `sftp://user@example.com:22/backups`)
+
+	_, ok = parseRemote(`/backups`)
+	gtest.False(ok)
+
+	gtest.PanicStr(`missing user`, func() { parseRemote(`sftp://example.com/backups`) })
+}
+
+func TestCmdOnce(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` {
+		t.Skip(`the failing entry uses "false"`)
+	}
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	good := Entry{Name: `good`, Input: inp, Output: out}
+	bad := Entry{Name: `bad`, Input: inp, Output: filepath.Join(dir, `bad`)}
+	bad.CopyCommand = Command{`false`}
+
+	gg.WriteFile(conf, gg.JsonString(Config{Entries: []Entry{good, bad}}))
+	gtest.PanicStr(`1 of 2 backups failed`, func() { cmdOnce(nil) })
+	gtest.Equal(readDir(out), []string{`inp_000001.txt`})
+
+	defer gg.SnapSwap(&FLAGS.Entries, StringsFlag{`good`}).Done()
+	cmdOnce(nil)
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{`inp_000001.txt`, `inp_000002.txt`})
+}
+
+func TestEntry_Match(t *testing.T) {
+	defer gtest.Catch(t)
+
+	entry := Entry{
+		Name:   `notes`,
+		Input:  `/home/user/notes`,
+		Inputs: []string{`/home/user/docs`, `/home/user/photos`},
+	}
+
+	type Case struct {
+		Patterns []string
+		Exp      bool
+	}
+
+	for _, val := range []Case{
+		{nil, true},
+		{[]string{`notes`}, true},
+		{[]string{`note`}, false},
+		{[]string{`no*`}, true},
+		{[]string{`n?tes`}, true},
+		{[]string{`docs`}, false},
+		{[]string{`/home/user/notes`}, true},
+		{[]string{`/home/user/*`}, true},
+		{[]string{`/home/user/photos`}, true},
+		{[]string{`/home/*/docs`}, true},
+		{[]string{`/home/other/*`}, false},
+		{[]string{`music`, `no*`}, true},
+		{[]string{`music`, `video`}, false},
+		{[]string{`[`}, false},
+	} {
+		gtest.Eq(entry.Match(val.Patterns), val.Exp, val.Patterns)
+	}
+
+	// Empty names and inputs never match, even the pattern "*".
+	gtest.False(Entry{}.Match([]string{`*`}))
+	gtest.True(Entry{Name: `notes`}.Match([]string{`*`}))
+}
+
+func TestCmdOnce_entry(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	var entries []Entry
+	for _, name := range []string{`notes`, `docs`, `photos`} {
+		inp := filepath.Join(dir, name+`.txt`)
+		gg.WriteFile(inp, name)
+		entries = append(entries, Entry{Name: name, Input: inp, Output: filepath.Join(dir, `out`, name)})
+	}
+	gg.WriteFile(conf, gg.JsonString(Config{Entries: entries}))
+
+	// The flag may be repeated, matching names or inputs.
+	var patterns StringsFlag
+	gtest.NoErr(patterns.Set(`no*`))
+	gtest.NoErr(patterns.Set(filepath.Join(dir, `photos.txt`)))
+	gtest.Eq(patterns.String(), `no*,`+filepath.Join(dir, `photos.txt`))
+	defer gg.SnapSwap(&FLAGS.Entries, patterns).Done()
+
+	cmdOnce(nil)
+	gtest.Equal(gg.SortedPrim(readDir(filepath.Join(dir, `out`))), []string{`notes`, `photos`})
+}
+
+func TestBackup_copyCommand(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` {
+		t.Skip(`the copy command uses "sh"`)
+	}
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	var cmd Command
+	gg.JsonDecode(`"rsync -a {src}/ {dst}"`, &cmd)
+	gtest.Equal(cmd, Command{`rsync`, `-a`, `{src}/`, `{dst}`})
+	gtest.Equal(cmd.Args(`one`, `two`), []string{`rsync`, `-a`, `one/`, `two`})
+	gtest.Equal(Command{`cp`, `--to={dst}`, `{src}{src}`}.Args(`one`, `two`), []string{`cp`, `--to=two`, `oneone`})
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	args := filepath.Join(dir, `args.txt`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub`, `two.txt`), `two`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Manifest.Set(true)
+	run.Entry.CopyCommand = Command{
+		`sh`, `-c`, `cp -R "$0" "$1" && echo "$0 $1" > "$2"`,
+		`{src}`, `{dst}`, args,
+	}
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+
+	// The command gets the input and the temporary target, which is renamed
+	// into the backup afterwards.
+	tar := filepath.Join(out, `inp_000001`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `one.txt`)), `one`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(tar, `sub`, `two.txt`)), `two`)
+	gtest.Eq(gg.ReadFile[string](args), inp+` `+tempPath(tar)+"\n")
+
+	// Stats and the manifest are computed from the result.
+	gtest.Eq(run.Stats.Files, 2)
+	gtest.Eq(run.Stats.Bytes, 6)
+	manifest := readManifest(tar)
+	gtest.Eq(len(manifest.Files), 2)
+	gtest.Empty(manifest.Verify(tar))
+}
+
+func TestMatchContentType(t *testing.T) {
+	defer gtest.Catch(t)
+
+	type Case struct {
+		Patterns []string
+		Type     string
+		Exp      bool
+	}
+
+	for _, val := range []Case{
+		{[]string{`text/*`}, `text/plain; charset=utf-8`, true},
+		{[]string{`text/plain`}, `text/plain; charset=utf-8`, true},
+		{[]string{`text/html`}, `text/plain; charset=utf-8`, false},
+		{[]string{`image/*`}, `image/png`, true},
+		{[]string{`image/*`}, `application/pdf`, false},
+		{[]string{`image/*`, `application/pdf`}, `application/pdf`, true},
+		{[]string{`*/*`}, `application/octet-stream`, true},
+		{[]string{`*`}, `image/png`, false},
+		{[]string{`*/*`}, ``, false},
+		{nil, `image/png`, false},
+	} {
+		gtest.Eq(matchContentType(val.Patterns, val.Type), val.Exp, val)
+	}
+}
+
+func TestBackup_contentTypes(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	pdf := "%PDF-1.7\n"
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+
+	// Types are detected by content, regardless of extensions.
+	files := map[string]string{
+		`photo.png`:        png,
+		`photo.txt`:        png,
+		`notes.png`:        `plain text`,
+		`sub/doc.pdf`:      pdf,
+		`sub/doc.bin`:      pdf,
+		`sub/notes.txt`:    `plain text`,
+		`sub/unknown.data`: "\x00\x01\x02",
+	}
+	for key, val := range files {
+		gg.WriteFile(filepath.Join(inp, filepath.FromSlash(key)), val)
+	}
+
+	type Case struct {
+		Path string
+		Type string
+	}
+
+	for _, val := range []Case{
+		{`photo.png`, `image/png`},
+		{`photo.txt`, `image/png`},
+		{`notes.png`, `text/plain; charset=utf-8`},
+		{`sub/doc.bin`, `application/pdf`},
+		{`sub/unknown.data`, `application/octet-stream`},
+		{`missing.txt`, ``},
+	} {
+		gtest.Eq(detectContentType(filepath.Join(inp, filepath.FromSlash(val.Path))), val.Type, val.Path)
+	}
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.ContentTypes = []string{`image/*`, `application/pdf`}
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+
+	var copied []string
+	tar := filepath.Join(out, `inp_000001`)
+	gg.Try(filepath.WalkDir(tar, func(path string, src fs.DirEntry, err error) error {
+		if err == nil && !src.IsDir() {
+			copied = append(copied, filepath.ToSlash(gg.Try1(filepath.Rel(tar, path))))
+		}
+		return err
+	}))
+	gtest.Equal(gg.SortedPrim(copied), []string{`photo.png`, `photo.txt`, `sub/doc.bin`, `sub/doc.pdf`})
+}
+
+func TestValidateConfig(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	file := filepath.Join(dir, `file.txt`)
+	gg.WriteFile(inp, `one`)
+	gg.WriteFile(file, `one`)
+
+	good := Entry{Name: `good`, Input: inp, Output: filepath.Join(dir, `out/nested`)}
+	gtest.NoErr(validateConfig(Config{Entries: []Entry{good}}))
+
+	missing := Entry{Name: `missing`}
+	notDir := Entry{Name: `notDir`, Input: filepath.Join(dir, `missing.txt`), Output: filepath.Join(file, `out`)}
+	negative := Entry{Name: `negative`, Input: inp, Output: dir}
+	negative.Debounce.Set(-1)
+	negative.Limit.Set(math.MaxUint64)
+
+	disabled := missing
+	disabled.Disabled = true
+
+	var dur Duration
+	gtest.PanicStr(`invalid duration "10sec"`, func() { gg.JsonDecode(`"10sec"`, &dur) })
+
+	err := validateConfig(Config{Entries: []Entry{good, missing, notDir, negative, disabled}})
+	gtest.Equal(strings.Split(err.Error(), "\n"), []string{
+		`entry "missing": field "input": missing input path`,
+		`entry "missing": field "output": missing output path`,
+		`entry "notDir": field "output": ` + fmtPath(file) + ` is not a directory`,
+		`entry "negative": field "debounce": negative duration -1ns`,
+		`entry "negative": field "limit": 18446744073709551615 is too large, the maximum is 9223372036854775807`,
+	})
+}
+
+func TestRunReloading_invalid(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+	defer gg.SnapSwap(&FLAGS.ConfigRetry, 0).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	entry := Entry{Name: `notes`, Input: inp, Output: out}
+	gg.WriteFile(conf, `{"configDebounce": "0s", "entries": [`+gg.JsonString(entry)+`]}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan notify.EventInfo)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runReloading(ctx, events)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		gtest.True(RUNNING.Wait(time.Second * 5))
+	}()
+
+	// Validation briefly creates a hidden file in the output. See
+	// `validateOutputDir`.
+	backups := func() int { return len(gg.Reject(readDir(out), isHiddenRel)) }
+
+	// With "-force-initial", every start of the entry makes a backup.
+	waitFor(func() bool { return backups() == 1 })
+
+	// Sending on the unbuffered channel waits until the previous event is
+	// handled, so two events ensure that the first reload has finished.
+	gg.WriteFile(conf, `{"entries": [`)
+	events <- nil
+	events <- nil
+	gtest.Equal(RUNNING.List(), []string{`notes`})
+
+	// An output which is a file fails validation.
+	entry.Output = conf
+	gg.WriteFile(conf, `{"configDebounce": "0s", "entries": [`+gg.JsonString(entry)+`]}`)
+	events <- nil
+	events <- nil
+	gtest.Equal(RUNNING.List(), []string{`notes`})
+	gtest.Eq(backups(), 1)
+
+	entry.Output = out
+	gg.WriteFile(conf, `{"configDebounce": "0s", "entries": [`+gg.JsonString(entry)+`]}`)
+	events <- nil
+	waitFor(func() bool { return backups() == 2 })
+}
+
+func TestRunReloading_missing_input(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var buf SyncBuf
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	entry := Entry{Name: `notes`, Input: inp, Output: out}
+	gg.WriteFile(conf, gg.JsonString(Config{Entries: []Entry{entry}}))
+
+	// A missing input passes validation, since the entry waits for it.
+	gtest.NoErr(validateConfig(readConfig()))
+	gtest.Eq(readValidConfig().Entries[0].Input, inp)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runReloading(ctx, make(chan notify.EventInfo))
+	}()
+	defer func() {
+		cancel()
+		<-done
+		gtest.True(RUNNING.Wait(time.Second * 5))
+	}()
+
+	waitFor(func() bool {
+		return strings.Contains(buf.String(), `input `+fmtPath(inp)+` is missing; deferring backups until it reappears`)
+	})
+	gtest.Equal(RUNNING.List(), []string{`notes`})
+	gtest.False(gg.DirExists(out))
+	gtest.False(strings.Contains(buf.String(), `invalid config`))
+}
+
+// Buffer safe for concurrent use, for capturing logs of background goroutines.
+type SyncBuf struct {
+	sync.Mutex
+	Buf bytes.Buffer
+}
+
+func (self *SyncBuf) Write(src []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+	return self.Buf.Write(src)
+}
+
+func (self *SyncBuf) String() string {
+	self.Lock()
+	defer self.Unlock()
+	return self.Buf.String()
+}
+
+func TestRunReloading_keeps_config(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+	defer gg.SnapSwap(&FLAGS.ConfigRetry, time.Second).Done()
+
+	clock := &FakeClock{Time: time.Now()}
+	defer gg.SnapSwap(&CONFIG_CLOCK, Clock(clock)).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	entry := Entry{Name: `notes`, Input: inp, Output: out}
+	write := func() {
+		gg.WriteFile(conf, `{"configDebounce": "0s", "debounce": "10ms", "throttle": "0s", "entries": [`+gg.JsonString(entry)+`]}`)
+	}
+	write()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan notify.EventInfo)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runReloading(ctx, events)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		gtest.True(RUNNING.Wait(time.Second * 5))
+	}()
+
+	// Validation briefly creates a hidden file in the output. See
+	// `validateOutputDir`.
+	backups := func() int { return len(gg.Reject(readDir(out), isHiddenRel)) }
+
+	// With "-force-initial", every start of the entry makes a backup.
+	waitFor(func() bool { return backups() == 1 })
+
+	// A config saved mid-edit fails to decode, and each failed reload
+	// schedules a retry.
+	gg.WriteFile(conf, `{"entries": [`)
+	events <- nil
+	events <- nil
+	clock.WaitTimers(2)
+	gtest.Equal(RUNNING.List(), []string{`notes`})
+
+	// The previous entry keeps watching and backing up its input.
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	waitFor(func() bool { return backups() == 2 })
+	gtest.Equal(RUNNING.List(), []string{`notes`})
+
+	// The retry switches over to the fixed config.
+	entry.Name = `docs`
+	write()
+	clock.Advance(time.Second)
+	waitFor(func() bool { return backups() == 3 })
+	waitFor(func() bool { return gg.Equal(RUNNING.List(), []string{`docs`}) })
+}
+
+func TestRunReloading_debounce(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	entry := Entry{Name: `notes`, Input: inp, Output: out}
+	gg.WriteFile(conf, `{"configDebounce": "100ms", "entries": [`+gg.JsonString(entry)+`]}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan notify.EventInfo)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runReloading(ctx, events)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		gtest.True(RUNNING.Wait(time.Second * 5))
+	}()
+
+	// Validation briefly creates a hidden file in the output. See
+	// `validateOutputDir`.
+	backups := func() int { return len(gg.Reject(readDir(out), isHiddenRel)) }
+
+	// With "-force-initial", every start of the entry makes a backup.
+	waitFor(func() bool { return backups() == 1 })
+
+	// A burst of changes results in one reload.
+	for range [5]struct{}{} {
+		events <- nil
+	}
+	waitFor(func() bool { return backups() == 2 })
+	time.Sleep(time.Millisecond * 300)
+	gtest.Eq(backups(), 2)
+}
+
+func TestRunReloading_restart_guard(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+	defer gg.SnapSwap(&FLAGS.RestartGuard, time.Minute).Done()
+
+	clock := &FakeClock{Time: time.Now()}
+	defer gg.SnapSwap(&CONFIG_CLOCK, Clock(clock)).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	entry := Entry{Name: `notes`, Input: inp, Output: out}
+	gg.WriteFile(conf, `{"configDebounce": "0s", "entries": [`+gg.JsonString(entry)+`]}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan notify.EventInfo)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runReloading(ctx, events)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		gtest.True(RUNNING.Wait(time.Second * 5))
+	}()
+
+	// Validation briefly creates a hidden file in the output. See
+	// `validateOutputDir`.
+	backups := func() int { return len(gg.Reject(readDir(out), isHiddenRel)) }
+
+	// With "-force-initial", every start of the entry makes a backup.
+	waitFor(func() bool { return backups() == 1 })
+
+	// Changes within the guard window queue one reload. Sending on the
+	// unbuffered channel waits until the previous event is handled, so the
+	// last event ensures that the others have been handled.
+	clock.Advance(time.Second * 10)
+	for range [4]struct{}{} {
+		events <- nil
+	}
+	events <- nil
+	gtest.Eq(clock.Count, 1)
+	gtest.Eq(backups(), 1)
+
+	// The queued reload happens when the window ends, and only once.
+	clock.Advance(time.Second * 49)
+	events <- nil
+	gtest.Eq(backups(), 1)
+
+	clock.Advance(time.Second)
+	waitFor(func() bool { return backups() == 2 })
+
+	// The reload starts a new window.
+	events <- nil
+	events <- nil
+	gtest.Eq(clock.Count, 2)
+	time.Sleep(time.Millisecond * 100)
+	gtest.Eq(backups(), 2)
+}
+
+func TestEntry_disabled(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	entry := Entry{Name: `notes`, Input: inp, Output: out, Disabled: true}
+	gg.WriteFile(conf, gg.JsonString(Config{Entries: []Entry{entry}}))
+
+	cmdOnce(nil)
+	gtest.False(gg.DirExists(out))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run(ctx, readConfig())
+	gtest.Empty(RUNNING.List())
+
+	entry.Disabled = false
+	gg.WriteFile(conf, gg.JsonString(Config{Entries: []Entry{entry}}))
+	cmdOnce(nil)
+	gtest.Equal(readDir(out), []string{`inp_000001.txt`})
+}
+
+func TestShutdown(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `two.txt`), `two`)
+	gg.MkdirAll(out)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var run RunState
+	run.Ctx = ctx
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.ContinueOnError = gg.OptVal(true)
+	backup(&run)
+
+	// Not even `continueOnError` keeps copying after a stop, and the
+	// incomplete backup is removed.
+	gtest.Eq(run.Result, RESULT_ERROR)
+	gtest.Empty(readDir(out))
+
+	var running Running
+	running.Add(`one`)
+	running.Add(`one`)
+	gtest.False(running.Wait(time.Millisecond))
+	gtest.Equal(running.List(), []string{`one`})
+
+	running.Done(`one`)
+	running.Done(`one`)
+	gtest.True(running.Wait(time.Millisecond))
+	gtest.Empty(running.List())
+}
+
+func TestRunEvents_trigger(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	clock := &FakeClock{Time: time.Now()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var run RunState
+	run.Ctx = ctx
+	run.Clock = clock
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Debounce.Set(0)
+	run.Entry.Throttle.Set(Duration(time.Hour))
+
+	events := make(chan notify.EventInfo)
+	go runEvents(ctx, &run, run.Targets(), events, func(eve notify.EventInfo) (notify.EventInfo, bool) {
+		return eve, true
+	}, nil, nil)
+
+	backups := func() int { return len(readDir(out)) }
+	waitFor(func() bool { return backups() == 1 })
+
+	// Triggered backups ignore throttle.
+	clock.Advance(time.Minute * 30)
+	TRIGGERS.Fire()
+	waitFor(func() bool { return backups() == 2 })
+
+	// Throttle counts from the triggered backup. Sending the event waits for
+	// the previous backup to finish.
+	clock.Advance(time.Minute * 40)
+	events <- testEvent(inp)
+	events <- testEvent(inp)
+	gtest.Eq(backups(), 2)
+}
+
+func TestBackup_timestamp_naming(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+	gg.MkdirAll(out)
+
+	// Indexed backups are unrelated to timestamped ones, and kept.
+	gg.WriteFile(filepath.Join(out, `inp_000009.txt`), `old`)
+
+	clock := &FakeClock{Time: time.Date(2024, 1, 2, 15, 4, 5, 6, time.UTC)}
+
+	var run RunState
+	run.Clock = clock
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Naming = NAMING_TIMESTAMP
+	run.Entry.Limit.Set(2)
+
+	backup(&run)
+	gtest.Eq(run.Index, Index(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC).UnixNano()))
+
+	// Backups within the precision of the layout get later names.
+	backup(&run)
+	clock.Advance(time.Hour)
+	backup(&run)
+
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{
+		`inp_000009.txt`,
+		`inp_2024-01-02T15-04-06.txt`,
+		`inp_2024-01-02T16-04-05.txt`,
+	})
+
+	run.Entry.TimestampLayout = `2006_01_02`
+	gtest.PanicStr(`invalid "timestampLayout"`, run.GetIndexFormat().Validate)
+}
+
+func TestListBackups(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	backup(&run)
+	gg.WriteFile(filepath.Join(inp, `two.txt`), `two`)
+	backup(&run)
+	gg.WriteFile(pinPath(filepath.Join(out, `inp_000001`)), ``)
+
+	list := listBackups(&run)
+	gtest.Len(list, 2)
+	gtest.Eq(list[0].Name, `inp_000001`)
+	gtest.Eq(list[0].Index, 1)
+	gtest.Eq(list[0].Files, 1)
+	gtest.Eq(list[0].Bytes, 3)
+	gtest.True(list[0].Pinned)
+	gtest.Eq(list[1].Name, `inp_000002`)
+	gtest.Eq(list[1].Files, 2)
+	gtest.Eq(list[1].Bytes, 6)
+	gtest.False(list[1].Pinned)
+
+	run.Entry.Output = filepath.Join(dir, `zip`)
+	run.Entry.Zip.Set(true)
+	backup(&run)
+
+	list = listBackups(&run)
+	gtest.Len(list, 1)
+	gtest.Eq(list[0].Name, `000001`)
+	gtest.Eq(list[0].Path, run.ZipPath())
+	gtest.Eq(list[0].Files, 2)
+	gtest.Eq(list[0].Bytes, 6)
+}
+
+func TestCmdRestore(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+	gg.WriteFile(conf, gg.JsonString(Config{Entries: []Entry{{Name: `notes`, Input: inp, Output: out}}}))
+
+	run := RunState{Entry: Entry{Input: inp, Output: out}}
+	backup(&run)
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `two`)
+	backup(&run)
+	gg.WriteFile(filepath.Join(inp, `added.txt`), `added`)
+
+	// Without "-force", the existing input is kept.
+	gtest.PanicStr(`pass "-force" to replace it`, func() { cmdRestore([]string{`notes`}) })
+	gtest.Eq(gg.ReadFile[string](filepath.Join(inp, `added.txt`)), `added`)
+
+	// Restoring replaces the input rather than merging.
+	cmdRestore([]string{`-force`, `notes`, `1`})
+	gtest.Equal(readDir(inp), []string{`one.txt`})
+	gtest.Eq(gg.ReadFile[string](filepath.Join(inp, `one.txt`)), `one`)
+
+	cmdRestore([]string{`-force`, `notes`})
+	gtest.Eq(gg.ReadFile[string](filepath.Join(inp, `one.txt`)), `two`)
+
+	gg.Try(os.RemoveAll(inp))
+	cmdRestore([]string{`notes`, `1`})
+	gtest.Eq(gg.ReadFile[string](filepath.Join(inp, `one.txt`)), `one`)
+	gtest.Equal(gg.SortedPrim(readDir(dir)), []string{`backup.json`, `inp`, `out`})
+
+	gtest.PanicStr(`found no backup with index "3"`, func() { cmdRestore([]string{`-force`, `notes`, `3`}) })
+}
+
+func TestCmdPrune(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+	gg.MkdirAll(out)
+	for _, ind := range []string{`1`, `2`, `3`, `4`} {
+		gg.WriteFile(filepath.Join(out, `inp_00000`+ind+`.txt`), ind)
+	}
+	gg.WriteFile(pinPath(filepath.Join(out, `inp_000001.txt`)), ``)
+
+	conf := filepath.Join(dir, `backup.json`)
+	defer gg.SnapSwap(&FLAGS.Config, conf).Done()
+
+	entry := Entry{Name: `inp`, Input: inp, Output: out}
+	entry.Limit.Set(2)
+	gg.WriteFile(conf, gg.JsonString(Config{Entries: []Entry{entry}}))
+
+	backups := func() []string {
+		return gg.Reject(gg.SortedPrim(readDir(out)), func(val string) bool { return strings.HasSuffix(val, PIN_EXT) })
+	}
+
+	func() {
+		defer gg.SnapSwap(&FLAGS.DryRun, true).Done()
+		cmdPrune(nil)
+	}()
+	gtest.Len(backups(), 4)
+
+	cmdPrune([]string{`inp`})
+	gtest.Equal(backups(), []string{`inp_000001.txt`, `inp_000003.txt`, `inp_000004.txt`})
+}
+
+func TestBackup_post_hook(t *testing.T) {
+	defer gtest.Catch(t)
+
+	if runtime.GOOS == `windows` {
+		t.Skip(`the test hook uses "sh"`)
+	}
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	hooked := filepath.Join(dir, `hook.log`)
+	gg.WriteFile(inp, `one`)
+
+	var run RunState
+	run.Entry.Name = `notes`
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.SkipUnchanged.Set(true)
+	run.Entry.PostHook = Command{`sh`, `-c`, `echo "$BACKUP_NAME $BACKUP_INPUT $BACKUP_OUTPUT_PATH $BACKUP_INDEX" >> ` + hooked}
+
+	backup(&run)
+	gtest.Eq(
+		gg.ReadFile[string](hooked),
+		`notes `+inp+` `+filepath.Join(out, `inp_000001.txt`)+` 000001`+"\n",
+	)
+
+	// Skipped backups don't run the hook.
+	backup(&run)
+	gtest.Eq(len(strings.Split(gg.ReadFile[string](hooked), "\n")), 2)
+
+	// A failing hook doesn't fail or remove the backup.
+	run.Entry.SkipUnchanged.Clear()
+	run.Entry.PostHook = Command{`sh`, `-c`, `exit 1`}
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.True(gg.FileExists(filepath.Join(out, `inp_000002.txt`)))
+}
+
+func TestHealthFile(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	health := filepath.Join(dir, `health/notes.txt`)
+	gg.WriteFile(inp, `one`)
+
+	clock := &FakeClock{Time: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+
+	var run RunState
+	run.Clock = clock
+	run.Entry.Input = inp
+	run.Entry.Output = filepath.Join(dir, `out`)
+	run.Entry.HealthFile = health
+
+	read := func() string { return gg.ReadFile[string](health) }
+	stamp := func(val time.Time) string { return val.Format(time.RFC3339) + "\n" }
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(read(), stamp(clock.Now()))
+
+	clock.Advance(time.Hour)
+	prev := clock.Now()
+	gg.WriteFile(inp, `two`)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(read(), stamp(prev))
+
+	// A failed backup leaves the time of the latest success, so the file goes
+	// stale.
+	clock.Advance(time.Hour)
+	gg.Try(os.Remove(inp))
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_ERROR)
+	gtest.Eq(read(), stamp(prev))
+
+	// So does a successful backup while the watch is broken.
+	gg.WriteFile(inp, `three`)
+	run.WatchErr = gg.Errf(`watch failed`)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(read(), stamp(prev))
+
+	// Once the watch recovers, the next success updates the file.
+	clock.Advance(time.Hour)
+	run.WatchErr = nil
+	gg.WriteFile(inp, `four`)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(read(), stamp(clock.Now()))
+}
+
+func TestMetrics(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&METRICS, new(Metrics)).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	var run RunState
+	run.Entry.Name = `notes`
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Limit.Set(2)
+
+	for range [3]struct{}{} {
+		backup(&run)
+	}
+
+	gg.Try(os.Remove(inp))
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_ERROR)
+
+	var buf bytes.Buffer
+	gg.Try1(METRICS.WriteTo(&buf))
+	text := buf.String()
+
+	for _, line := range []string{
+		`backup_completed_total{entry="notes"} 3`,
+		`backup_failed_total{entry="notes"} 1`,
+		`backup_duration_seconds_bucket{entry="notes",le="+Inf"} 3`,
+		`backup_duration_seconds_count{entry="notes"} 3`,
+		`backup_retained{entry="notes",output="` + escapeLabel(out) + `"} 2`,
+		`# TYPE backup_duration_seconds histogram`,
+	} {
+		gtest.True(strings.Contains(text, line+"\n"), line)
+	}
+	gtest.True(strings.Contains(text, `backup_last_success_timestamp_seconds{entry="notes"} `))
+	gtest.Eq(escapeLabel(`a"b\c`), `a\"b\\c`)
+}
+
+func TestPause(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&METRICS, new(Metrics)).Done()
+	defer setPaused(false)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	gg.WriteFile(inp, `one`)
+
+	run := &RunState{}
+	run.Entry.Input = inp
+	run.Entry.Output = filepath.Join(dir, `out`)
+	targets := []*RunState{run}
+
+	setPaused(true)
+	gtest.True(PAUSED.Load())
+	gtest.True(run.Paused())
+
+	// Events are drained without pending backups, and pending backups are skipped.
+	gtest.Zero(pendingTargets(targets, testEvent(inp), nil))
+	backupTargets(targets, `test`)
+	gtest.Zero(run.Index)
+	gtest.False(gg.FileExists(run.Entry.Output))
+
+	setPaused(false)
+	gtest.False(run.Paused())
+	gtest.Equal(pendingTargets(targets, testEvent(inp), nil), targets)
+	backupTargets(targets, `test`)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.True(gg.FileExists(filepath.Join(run.Entry.Output, `inp_000001.txt`)))
+}
+
+func TestMetricsHandler_pause(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&METRICS, new(Metrics)).Done()
+	defer setPaused(false)
+
+	han := metricsHandler()
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		han.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	gtest.Eq(serve(http.MethodGet, STATUS_PATH).Body.String(), `{"paused":false}`)
+	gtest.True(strings.Contains(serve(http.MethodGet, METRICS_PATH).Body.String(), "backup_paused 0\n"))
+
+	gtest.Eq(serve(http.MethodGet, PAUSE_PATH).Code, http.StatusMethodNotAllowed)
+	gtest.False(PAUSED.Load())
+
+	rec := serve(http.MethodPost, PAUSE_PATH)
+	gtest.Eq(rec.Code, http.StatusOK)
+	gtest.Eq(rec.Body.String(), `{"paused":true}`)
+	gtest.True(PAUSED.Load())
+	gtest.Eq(serve(http.MethodGet, STATUS_PATH).Body.String(), `{"paused":true}`)
+	gtest.True(strings.Contains(serve(http.MethodGet, METRICS_PATH).Body.String(), "backup_paused 1\n"))
+
+	gtest.Eq(serve(http.MethodPost, RESUME_PATH).Body.String(), `{"paused":false}`)
+	gtest.False(PAUSED.Load())
+}
+
+func TestAllFormats(t *testing.T) {
+	defer gtest.Catch(t)
+
+	has := func(kind, name string) bool {
+		return gg.Some(allFormats(), func(val Format) bool {
+			return val.Kind == kind && val.Name == name
+		})
+	}
+
+	gtest.True(has(`compress`, COMPRESS_GZIP))
+	gtest.True(has(`archive`, ARCHIVE_TAR))
+	gtest.True(has(`archive`, ARCHIVE_TAR_GZ))
+	gtest.True(has(`encrypt`, ENCRYPT_AES_256_GCM))
+	gtest.Eq(has(`link`, `reflink`), runtime.GOOS == `linux` || runtime.GOOS == `darwin`)
+}
+
+func TestRateLimiter(t *testing.T) {
+	defer gtest.Catch(t)
+
+	var rate ByteRate
+	gtest.NoErr(rate.UnmarshalText([]byte(`20MB/s`)))
+	gtest.Eq(rate, 20e6)
+	gtest.NoErr(rate.UnmarshalText([]byte(`512KiB`)))
+	gtest.Eq(rate, 512<<10)
+	gtest.ErrAny(rate.UnmarshalText([]byte(`fast`)))
+
+	clock := &FakeClock{Time: time.Unix(0, 0)}
+	limit := &RateLimiter{Rate: 1000, Clock: clock}
+	ctx := context.Background()
+
+	// The first read passes immediately, and reserves the next second.
+	gtest.NoErr(limit.Wait(ctx, 1000))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gtest.NoErr(limit.Wait(ctx, 500))
+	}()
+
+	clock.WaitTimers(1)
+	clock.Advance(time.Millisecond * 999)
+	select {
+	case <-done:
+		panic(gg.Errf(`expected the read to wait for one second`))
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	<-done
+
+	// Both reads are accounted for: the next one waits half a second more.
+	go limit.Wait(ctx, 1)
+	clock.WaitTimers(2)
+	clock.Lock()
+	gtest.Eq(clock.Timers[0].Time, time.Unix(0, 0).Add(time.Millisecond*1500))
+	clock.Unlock()
+	clock.Advance(time.Second)
+}
+
+func TestBackup_rate_limit(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+
+	// Three files of three read buffers each, copied in parallel: with the
+	// limit shared, all reads but the first wait for their share of time.
+	size := COPY_BUFFER_SIZE * 3
+	for _, name := range []string{`one`, `two`, `three`} {
+		gg.WriteFile(filepath.Join(inp, name), strings.Repeat(`a`, size))
+	}
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Concurrency.Set(3)
+	run.Entry.RateLimit.Set(ByteRate(size * 6))
+
+	start := time.Now()
+	backup(&run)
+	elapsed := time.Since(start)
+
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(run.Stats.Bytes, uint64(size*3))
+	// 8 buffers after the first at 18 buffers per second.
+	gtest.True(elapsed >= time.Millisecond*400, elapsed)
+}
+
+func TestBackup_rate_limit_modes(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	gg.MkdirAll(inp)
+
+	// Two files of three read buffers each, read sequentially: all reads but
+	// the first wait for their share of time.
+	size := COPY_BUFFER_SIZE * 3
+	for _, name := range []string{`one`, `two`} {
+		gg.WriteFile(filepath.Join(inp, name), strings.Repeat(`a`, size))
+	}
+
+	for name, set := range map[string]func(*Entry){
+		`archive`:     func(val *Entry) { val.Archive = ARCHIVE_TAR_GZ },
+		`incremental`: func(val *Entry) { val.Incremental.Set(true) },
+		`zip`:         func(val *Entry) { val.Zip.Set(true) },
+		`store`:       func(val *Entry) { val.Store.Set(true) },
+	} {
+		var run RunState
+		run.Entry.Input = inp
+		run.Entry.Output = filepath.Join(dir, name)
+		run.Entry.RateLimit.Set(ByteRate(COPY_BUFFER_SIZE * 20))
+		set(&run.Entry)
+
+		start := time.Now()
+		backup(&run)
+		elapsed := time.Since(start)
+
+		gtest.Eq(run.Result, RESULT_OK, name)
+		// 5 buffers after the first at 20 buffers per second.
+		gtest.True(elapsed >= time.Millisecond*200, name, elapsed)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.Verbose, true).Done()
+
+	var text bytes.Buffer
+	prevOut, prevFlags := log.Writer(), log.Flags()
+	defer log.SetFlags(prevFlags)
+	defer log.SetOutput(prevOut)
+	log.SetFlags(0)
+	log.SetOutput(&text)
+
+	dir := t.TempDir()
+	small := filepath.Join(dir, `small`)
+	large := filepath.Join(dir, `large`)
+	gg.WriteFile(small, strings.Repeat(`a`, 99))
+	gg.WriteFile(large, strings.Repeat(`a`, 1000))
+
+	clock := &FakeClock{Time: time.Unix(0, 0)}
+	var run RunState
+	run.Clock = clock
+	run.Entry.ProgressThreshold.Set(100)
+	run.Entry.ProgressInterval.Set(Duration(time.Second))
+
+	{
+		progress, stop := startProgress(&run, small)
+		stop()
+		gtest.Zero(progress)
+	}
+
+	progress, stop := startProgress(&run, large)
+	gtest.Eq(progress.Total, 1000)
+
+	src := progress.Reader(strings.NewReader(gg.ReadFile[string](large)))
+	gtest.Eq(gg.Try1(io.ReadFull(src, make([]byte, 250))), 250)
+
+	clock.WaitTimers(1)
+	clock.Advance(time.Second)
+	clock.WaitTimers(1)
+	stop()
+
+	gtest.Eq(text.String(), `copying `+fmtPath(large)+": copied 250 / 1000 bytes, 25%\n")
+}
+
+func TestBackup_check_space(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, strings.Repeat(`a`, 1000))
+
+	// A volume of 1000 bytes, which only has the backups.
+	var run RunState
+	run.DiskFree = func(string) (uint64, error) {
+		var used uint64
+		if gg.DirExists(out) {
+			used = walkSize(out).Bytes
+		}
+		return 1000 - used, nil
+	}
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Limit.Set(1)
+	run.Entry.SpaceMargin.Set(0)
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	first := readDir(out)
+	gtest.Len(first, 1)
+
+	// Short of space, but the previous backup, which retention would delete
+	// after this backup anyway, takes enough, so it's deleted first.
+	gg.WriteFile(inp, strings.Repeat(`a`, 500))
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	second := readDir(out)
+	gtest.Len(second, 1)
+	gtest.NotEq(second[0], first[0])
+
+	// Deleting old backups wouldn't help: fails without copying or deleting.
+	run.Entry.SpaceMargin.Set(1000)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_ERROR)
+	gtest.Equal(readDir(out), second)
+
+	run.Entry.CheckSpace.Set(false)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+}
+
+func TestBackup_archive(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.MkdirAll(filepath.Join(inp, `empty`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub/two.txt`), `two`)
+	gg.Try(os.Chmod(filepath.Join(inp, `one.txt`), 0o600))
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	gg.Try(os.Chtimes(filepath.Join(inp, `sub/two.txt`), modTime, modTime))
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Limit.Set(1)
+	run.Entry.Archive = ARCHIVE_TAR
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Equal(readDir(out), []string{`inp_000001.tar`})
+	gtest.Eq(run.Stats.Files, 2)
+
+	readArchive := func(path string, zipped bool) map[string]*tar.Header {
+		file := gg.Try1(os.Open(path))
+		defer file.Close()
+
+		var src io.Reader = file
+		if zipped {
+			src = gg.Try1(gzip.NewReader(file))
+		}
+
+		out := map[string]*tar.Header{}
+		read := tar.NewReader(src)
+		for {
+			head, err := read.Next()
+			if err == io.EOF {
+				return out
+			}
+			gg.Try(err)
+			out[head.Name] = head
+		}
+	}
+
+	heads := readArchive(filepath.Join(out, `inp_000001.tar`), false)
+	gtest.Equal(gg.SortedPrim(gg.MapKeys(heads)), []string{`empty/`, `one.txt`, `sub/`, `sub/two.txt`})
+	gtest.True(heads[`empty/`].FileInfo().IsDir())
+	gtest.Eq(heads[`sub/two.txt`].ModTime.UTC(), modTime)
+	if runtime.GOOS != `windows` {
+		gtest.Eq(heads[`one.txt`].FileInfo().Mode().Perm(), 0o600)
+	}
+
+	// Gzipped archives belong to the same sequence, so the previous one is
+	// pruned over the limit.
+	run.Entry.Archive = ARCHIVE_TAR_GZ
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Equal(readDir(out), []string{`inp_000002.tar.gz`})
+	gtest.Equal(
+		gg.SortedPrim(gg.MapKeys(readArchive(filepath.Join(out, `inp_000002.tar.gz`), true))),
+		[]string{`empty/`, `one.txt`, `sub/`, `sub/two.txt`},
+	)
+
+	run.Entry.Compress = COMPRESS_GZIP
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_ERROR)
+}
+
+// Gzipped archives count the compressor against the memory budget.
+func TestBackup_archive_memory(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+	defer MEMORY.SetLimit(0)
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	gg.MkdirAll(inp)
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+
+	held := gg.Try1(MEMORY.Acquire(nil, COPY_BUFFER_SIZE))
+	defer held()
+	MEMORY.SetLimit(COPY_BUFFER_SIZE*2 + DEFLATE_MEMORY/2)
+
+	for _, archive := range []string{ARCHIVE_TAR, ARCHIVE_TAR_GZ} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+
+		var run RunState
+		run.Ctx = ctx
+		run.Entry.Input = inp
+		run.Entry.Output = filepath.Join(dir, archive)
+		run.Entry.Archive = archive
+		backup(&run)
+
+		if archive == ARCHIVE_TAR {
+			gtest.Eq(run.Result, RESULT_OK)
+		} else {
+			// Waits for memory until the deadline.
+			gtest.NotEq(run.Result, RESULT_OK)
+		}
+	}
+}
+
+func TestBackup_encrypt(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	key := filepath.Join(dir, `key`)
+	gg.MkdirAll(inp)
+	gg.WriteFile(key, strings.Repeat(`ab`, 32)+"\n")
+
+	// Several chunks, the last one partial.
+	large := strings.Repeat(`secret `, ENC_CHUNK/2)
+	gg.WriteFile(filepath.Join(inp, `one.txt`), large)
+	gg.WriteFile(filepath.Join(inp, `two.txt`), ``)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Verify.Set(true)
+	run.Entry.Encrypt.Set(Encryption{KeyFile: key})
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+
+	path := filepath.Join(out, `inp_000001`)
+	gtest.Equal(gg.SortedPrim(readDir(path)), []string{`one.txt.enc`, `two.txt.enc`})
+
+	body := gg.ReadFile[string](filepath.Join(path, `one.txt.enc`))
+	gtest.True(strings.HasPrefix(body, ENC_MAGIC))
+	gtest.False(strings.Contains(body, `secret`))
+
+	// Restored with the same key.
+	gg.Try(os.RemoveAll(inp))
+	restoreBackup(&run, run.BackupName().IndexFormat.Parse(`inp_000001`), false)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(inp, `one.txt`)), large)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(inp, `two.txt`)), ``)
+
+	// Truncated or decrypted with another key, fails instead of returning
+	// partial or garbage data.
+	aead := run.GetEncrypt().Cipher()
+	decrypt := func(src string, aead cipher.AEAD) (string, error) {
+		return gg.Catch01(func() string {
+			return string(gg.Try1(io.ReadAll(newDecryptReader(strings.NewReader(src), aead))))
+		})
+	}
+	gtest.Eq(gg.Try1(decrypt(body, aead)), large)
+
+	_, err := decrypt(body[:len(body)-1], aead)
+	gtest.ErrAny(err)
+
+	// Ends after a full chunk which isn't marked as the last one.
+	_, err = decrypt(body[:len(ENC_MAGIC)+aead.NonceSize()+ENC_CHUNK+aead.Overhead()], aead)
+	gtest.ErrAny(err)
+
+	other := Encryption{KeyEnv: `BACKUP_TEST_KEY`}
+	t.Setenv(`BACKUP_TEST_KEY`, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	_, err = decrypt(body, other.Cipher())
+	gtest.ErrAny(err)
+
+	// Single-file backups get the suffix after the extension.
+	file := filepath.Join(dir, `notes.txt`)
+	gg.WriteFile(file, `notes`)
+	run.Entry.Input = file
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.True(gg.FileExists(filepath.Join(out, `notes_000001.txt.enc`)))
+
+	gg.Try(os.Remove(file))
+	restoreBackup(&run, run.BackupName().IndexFormat.Parse(`notes_000001.txt.enc`), false)
+	gtest.Eq(gg.ReadFile[string](file), `notes`)
+
+	// Missing and short keys are reported at startup.
+	entry := Entry{Name: `notes`, Input: file, Output: out}
+	entry.Encrypt.Set(Encryption{KeyFile: filepath.Join(dir, `missing`)})
+	gtest.ErrAny(validateConfig(Config{Entries: []Entry{entry}}))
+
+	gg.WriteFile(key, `abab`)
+	entry.Encrypt.Set(Encryption{KeyFile: key})
+	gtest.ErrAny(validateConfig(Config{Entries: []Entry{entry}}))
+
+	entry.Encrypt.Set(Encryption{KeyEnv: `BACKUP_TEST_KEY`})
+	gtest.NoErr(validateConfig(Config{Entries: []Entry{entry}}))
+}
+
+func TestBackup_reflink(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(inp)
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+
+	if runtime.GOOS != `windows` {
+		gtest.True(sameDevice(inp, dir))
+	}
+	gtest.False(sameDevice(inp, filepath.Join(dir, `missing`)))
+
+	// Reflinks are transparent: whether the filesystem supports them or not,
+	// the backup is the same.
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(run.Stats.Bytes, 3)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(out, `inp_000001/one.txt`)), `one`)
+
+	run.Entry.Reflink = REFLINK_NEVER
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(out, `inp_000002/one.txt`)), `one`)
+
+	entry := Entry{Name: `notes`, Input: inp, Output: out}
+	entry.Reflink = `sometimes`
+	gtest.ErrAny(validateConfig(Config{Entries: []Entry{entry}}))
+}
+
+func TestBackup_hardlink(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub`, `two.txt`), `two`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Hardlink.Set(true)
+	run.Entry.Manifest.Set(true)
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(run.Stats.Linked, 0)
+
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `three`)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(run.Stats.Files, 2)
+	gtest.Eq(run.Stats.Linked, 1)
+
+	stat := func(path string) os.FileInfo { return gg.Try1(os.Stat(filepath.Join(out, path))) }
+	gtest.True(os.SameFile(stat(`inp_000001/sub/two.txt`), stat(`inp_000002/sub/two.txt`)))
+	gtest.False(os.SameFile(stat(`inp_000001/one.txt`), stat(`inp_000002/one.txt`)))
+	gtest.Eq(gg.ReadFile[string](filepath.Join(out, `inp_000001/one.txt`)), `one`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(out, `inp_000002/one.txt`)), `three`)
+
+	manifest := readManifest(filepath.Join(out, `inp_000002`))
+	gtest.Eq(len(manifest.Files), 2)
+	gtest.Empty(manifest.Verify(filepath.Join(out, `inp_000002`)))
+
+	entry := Entry{Name: `notes`, Input: inp, Output: out}
+	entry.Hardlink.Set(true)
+	entry.Compress = COMPRESS_GZIP
+	gtest.ErrAny(validateConfig(Config{Entries: []Entry{entry}}))
+}
+
+func TestBackup_fsync(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	gtest.True(run.GetFsync())
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+
+	run.Entry.Fsync.Set(false)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Equal(gg.SortedPrim(readDir(out)), []string{`inp_000001.txt`, `inp_000002.txt`})
+
+	// Sync errors are surfaced.
+	gtest.ErrAny(syncFile(filepath.Join(dir, `missing`)))
+	if runtime.GOOS != `windows` {
+		gtest.NoErr(syncDir(out))
+		gtest.ErrAny(syncDir(filepath.Join(dir, `missing`)))
+	}
+}
+
+func TestBackup_inputs(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := gg.Try1(filepath.EvalSymlinks(t.TempDir()))
+	one := filepath.Join(dir, `one`)
+	two := filepath.Join(dir, `other/two.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(one, `sub`))
+	gg.MkdirAll(filepath.Dir(two))
+	gg.WriteFile(filepath.Join(one, `sub/file.txt`), `one`)
+	gg.WriteFile(two, `two`)
+
+	var run RunState
+	run.Entry.Name = `both`
+	run.Entry.Inputs = []string{one, two}
+	run.Entry.Output = out
+	run.Entry.Limit.Set(1)
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Equal(readDir(out), []string{`both_000001`})
+	gtest.Eq(run.Stats.Files, 2)
+	gtest.Eq(run.Entry.Input, ``)
+
+	path := filepath.Join(out, `both_000001`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(path, inputSubpath(one), `sub/file.txt`)), `one`)
+	gtest.Eq(gg.ReadFile[string](filepath.Join(path, inputSubpath(two))), `two`)
+
+	// One sequence and one retention for all inputs.
+	gg.WriteFile(two, `three`)
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Equal(readDir(out), []string{`both_000002`})
+	gtest.Eq(gg.ReadFile[string](filepath.Join(out, `both_000002`, inputSubpath(two))), `three`)
+
+	// Events are filtered by the watcher of their input.
+	watchers := newInputWatchers(&run)
+	watchers.Watch()
+	defer watchers.Close()
+
+	accepts := func(path string) bool {
+		_, ok := watchers.Filter(testEvent(path))
+		return ok
+	}
+	gtest.True(accepts(filepath.Join(one, `sub/file.txt`)))
+	gtest.True(accepts(two))
+	gtest.False(accepts(filepath.Join(dir, `other/unrelated.txt`)))
+
+	run.Entry.Inputs = []string{one, filepath.Join(one, `sub`)}
+	gtest.PanicStr(`overlap`, func() { run.MultiInput() })
+
+	run.Entry.Inputs = []string{one, two}
+	run.Entry.Input = one
+	gtest.PanicStr(`mutually exclusive`, func() { run.MultiInput() })
+}
+
+func TestBackup_size_bounds(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `empty.lock`), ``)
+	gg.WriteFile(filepath.Join(inp, `sub/small.txt`), `small`)
+	gg.WriteFile(filepath.Join(inp, `sub/core.dump`), strings.Repeat(`x`, 100))
+
+	var conf CommonConfig
+	gg.JsonDecode(`{"minSize": "1B", "maxSize": "0.05KB"}`, &conf)
+	gtest.Eq(conf.MinSize.Val, 1)
+	gtest.Eq(conf.MaxSize.Val, 50)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.CommonConfig = conf
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+	gtest.Eq(run.Stats.Files, 1)
+	gtest.Equal(readDir(filepath.Join(out, `inp_000001`)), []string{`sub`})
+	gtest.Equal(readDir(filepath.Join(out, `inp_000001/sub`)), []string{`small.txt`})
+
+	// A single-file input outside of the bounds skips the backup.
+	run = RunState{}
+	run.Entry.Input = filepath.Join(inp, `sub/core.dump`)
+	run.Entry.Output = out
+	run.Entry.CommonConfig = conf
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_UP_TO_DATE)
+	gtest.Equal(readDir(out), []string{`inp_000001`})
+}
+
+func TestReadConfig_url(t *testing.T) {
+	defer gtest.Catch(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rew http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != `/backup.json` {
+			http.NotFound(rew, req)
+			return
+		}
+		_, _ = io.WriteString(rew, `{"limit": 3, "entries": [{"input": "one", "output": "two"}]}`)
+	}))
+	defer srv.Close()
+
+	gtest.True(isConfigStream(srv.URL + `/backup.json`))
+	gtest.True(isConfigStream(CONFIG_STDIN))
+	gtest.False(isConfigStream(`backup.json`))
+
+	defer gg.SnapSwap(&FLAGS.Config, srv.URL+`/backup.json`).Done()
+	conf := readConfig()
+	gtest.Eq(conf.Limit.Val, 3)
+	gtest.Len(conf.Entries, 1)
+	gtest.Eq(conf.Entries[0].Input, `one`)
+
+	FLAGS.Config = srv.URL + `/missing.json`
+	gtest.PanicStr(`404`, func() { readConfig() })
+}
+
+func TestReadConfig_include(t *testing.T) {
+	defer gtest.Catch(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, `backup.json`)
+	gg.MkdirAll(filepath.Join(dir, `projects`))
+	gg.WriteFile(path, `{
+		"debounce": "3s",
+		"include": ["projects/*.json"],
+		"entries": [{"input": "main", "output": "out"}]
+	}`)
+	gg.WriteFile(filepath.Join(dir, `projects/one.json`), `{
+		"limit": 2,
+		"include": ["../shared.json"],
+		"entries": [{"input": "one", "output": "out"}, {"input": "two", "output": "out", "limit": 1}]
+	}`)
+	gg.WriteFile(filepath.Join(dir, `shared.json`), `{"entries": [{"input": "shared", "output": "out"}]}`)
+	defer gg.SnapSwap(&FLAGS.Config, path).Done()
+
+	conf := readConfig()
+	gtest.Equal(gg.Map(conf.Entries, func(val Entry) string { return val.Input }), []string{`main`, `one`, `two`, `shared`})
+	gtest.Equal(conf.Files, []string{path, filepath.Join(dir, `projects/one.json`), filepath.Join(dir, `shared.json`)})
+
+	limit := func(ind int) uint64 {
+		return RunState{Config: conf, Entry: conf.Entries[ind]}.GetLimit()
+	}
+	gtest.Eq(limit(0), DEFAULT_LIMIT)
+	gtest.Eq(limit(1), 2)
+	gtest.Eq(limit(2), 1)
+	gtest.Eq(limit(3), DEFAULT_LIMIT)
+	gtest.Eq(RunState{Config: conf, Entry: conf.Entries[1]}.GetDebounce(), Duration(time.Second*3))
+
+	// Included by two other files, but read once.
+	gg.WriteFile(filepath.Join(dir, `projects/two.json`), `{"include": ["../shared.json"]}`)
+	conf = readConfig()
+	gtest.Equal(gg.Map(conf.Entries, func(val Entry) string { return val.Input }), []string{`main`, `one`, `two`, `shared`})
+	gtest.Equal(conf.Files, []string{
+		path,
+		filepath.Join(dir, `projects/one.json`),
+		filepath.Join(dir, `shared.json`),
+		filepath.Join(dir, `projects/two.json`),
+	})
+
+	gg.WriteFile(filepath.Join(dir, `shared.json`), `{"include": ["projects/one.json"]}`)
+	gtest.PanicStr(`include cycle`, func() { readConfig() })
+
+	gg.WriteFile(path, `{"include": ["missing.json"]}`)
+	gtest.PanicStr(`missing included config file`, func() { readConfig() })
+}
+
+func TestOtelExporter(t *testing.T) {
+	defer gtest.Catch(t)
+	defer OTEL_PREV_RUN.Store(OTEL_PREV_RUN.Swap(SpanRef{}))
+
+	reqs := make(chan OtelRequest, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(rew http.ResponseWriter, req *http.Request) {
+		gtest.Eq(req.Method, http.MethodPost)
+		gtest.Eq(req.URL.Path, OTEL_TRACES_PATH)
+		gtest.Eq(req.Header.Get(`Content-Type`), `application/json`)
+
+		var body OtelRequest
+		gg.JsonDecode(gg.Try1(io.ReadAll(req.Body)), &body)
+		reqs <- body
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tracer := newTracer(ctx, Config{OtelEndpoint: srv.URL + `/`})
+
+	span := tracer.Start(`backup`)
+	span.Set(`backup.files`, 3)
+	span.Set(`backup.dry`, false)
+	child := span.Child(`copy`)
+	child.End(nil)
+	span.End(gg.Errf(`disk full`))
+
+	cancel()
+	tracer.Wait()
+	close(reqs)
+
+	var spans []OtelSpan
+	for req := range reqs {
+		gtest.Len(req.ResourceSpans, 1)
+		gtest.Len(req.ResourceSpans[0].ScopeSpans, 1)
+		gtest.Eq(req.ResourceSpans[0].ScopeSpans[0].Scope.Name, OTEL_SCOPE)
+		spans = append(spans, req.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}
+	gtest.Equal(gg.Map(spans, func(val OtelSpan) string { return val.Name }), []string{`run`, `copy`, `backup`})
+
+	run, file, back := spans[0], spans[1], spans[2]
+	str := func(val string) OtelValue { return OtelValue{StringValue: &val} }
+	boolean := func(val bool) OtelValue { return OtelValue{BoolValue: &val} }
+
+	gtest.Equal(run.Attributes, []OtelAttr{
+		{`config.path`, str(FLAGS.Config)},
+		{`config.entries`, otelInt(0)},
+	})
+	gtest.Equal(run.Status, OtelStatus{Code: OTEL_STATUS_OK})
+
+	gtest.Equal(back.Attributes, []OtelAttr{
+		{`backup.files`, otelInt(3)},
+		{`backup.dry`, boolean(false)},
+	})
+	gtest.Equal(back.Status, OtelStatus{Code: OTEL_STATUS_ERROR, Message: `disk full`})
+	gtest.Equal(back.Links, []OtelLink{{TraceId: run.TraceId, SpanId: run.SpanId}})
+	gtest.Zero(back.ParentSpanId)
+
+	gtest.Eq(file.TraceId, back.TraceId)
+	gtest.Eq(file.ParentSpanId, back.SpanId)
+	gtest.Equal(file.Status, OtelStatus{Code: OTEL_STATUS_OK})
+}
+
+func TestSpan_End_full_queue(t *testing.T) {
+	defer gtest.Catch(t)
+
+	exp := &OtelExporter{Spans: make(chan *Span, 1)}
+	tracer := &Tracer{Exporter: exp}
+
+	one := tracer.Start(`one`)
+	two := tracer.Start(`two`)
+	one.End(nil)
+	two.End(nil)
+
+	// The exporter isn't running, so the second span is dropped without
+	// blocking.
+	gtest.Eq(len(exp.Spans), 1)
+	gtest.Eq(<-exp.Spans, one)
+}
+
+func TestVerify_corrupted(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp`)
+	out := filepath.Join(dir, `out`)
+	gg.MkdirAll(filepath.Join(inp, `sub`))
+	gg.WriteFile(filepath.Join(inp, `one.txt`), `one`)
+	gg.WriteFile(filepath.Join(inp, `sub`, `two.txt`), `two`)
+	gg.WriteFile(filepath.Join(inp, `three.txt`), `three`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+	run.Entry.Manifest.Set(true)
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+
+	path := filepath.Join(out, `inp_000001`)
+	manifest := readManifest(path)
+	gtest.Eq(len(manifest.Files), 3)
+	gtest.Empty(manifest.Verify(path))
+
+	// Same size, different content; truncated; removed.
+	gg.WriteFile(filepath.Join(path, `one.txt`), `uno`)
+	gg.WriteFile(filepath.Join(path, `sub`, `two.txt`), `tw`)
+	gg.Try(os.Remove(filepath.Join(path, `three.txt`)))
+
+	problems := manifest.Verify(path)
+	gtest.Eq(len(problems), 3)
+	gtest.Eq(problems[0], fmtPath(filepath.Join(path, `one.txt`))+`: checksum mismatch`)
+	gtest.Eq(problems[1], fmtPath(filepath.Join(path, `sub`, `two.txt`))+`: expected size 3, found 2`)
+	gtest.True(strings.HasPrefix(problems[2], fmtPath(filepath.Join(path, `three.txt`))+`: `))
+
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	verifyLatest(&run)
+	text := buf.String()
+	gtest.True(strings.Contains(text, `CORRUPTION DETECTED in backup `+fmtPath(path)))
+	for _, val := range problems {
+		gtest.True(strings.Contains(text, `  `+val), val)
+	}
+
+	run.Manifest = manifest
+	gtest.PanicStr(`verification of new backup`, func() { verifyNew(&run, path) })
+	gtest.PanicStr(`checksum mismatch`, func() { verifyNew(&run, path) })
+}
+
+func TestVerify_missing_manifest(t *testing.T) {
+	defer gtest.Catch(t)
+	defer gg.SnapSwap(&FLAGS.ForceInitial, true).Done()
+	defer gg.SnapSwap(&FLAGS.Verbose, true).Done()
+
+	dir := t.TempDir()
+	inp := filepath.Join(dir, `inp.txt`)
+	out := filepath.Join(dir, `out`)
+	gg.WriteFile(inp, `one`)
+
+	var run RunState
+	run.Entry.Input = inp
+	run.Entry.Output = out
+
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	// Nothing to verify before the first backup.
+	verifyLatest(&run)
+	gtest.Zero(buf.Len())
+
+	backup(&run)
+	gtest.Eq(run.Result, RESULT_OK)
+
+	path := filepath.Join(out, `inp_000001.txt`)
+	gtest.False(gg.FileExists(manifestPath(path)))
+	gtest.Zero(readManifest(path))
+
+	buf.Reset()
+	verifyLatest(&run)
+	gtest.True(strings.HasSuffix(buf.String(), `unable to verify `+fmtPath(path)+": missing manifest\n"))
+
+	// Without a manifest, new backups aren't verified.
+	run.Manifest = nil
+	verifyNew(&run, path)
+
+	// When manifests are enabled, a missing manifest is an error, reported
+	// even in quiet mode.
+	FLAGS.Verbose = false
+	run.Entry.Manifest.Set(true)
+	buf.Reset()
+	log.SetOutput(LogWriter{Text: &buf, Quiet: true})
+	verifyLatest(&run)
+	gtest.True(strings.Contains(buf.String(), `unable to verify `+fmtPath(path)+`: missing manifest`))
+}
+
+func TestAppendHistory_limit(t *testing.T) {
+	defer gtest.Catch(t)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := &FakeClock{Time: start}
+
+	var run RunState
+	run.Clock = clock
+	run.Entry.Input = `inp.txt`
+	run.Entry.Output = t.TempDir()
+	run.Entry.History.Set(true)
+	run.Entry.HistoryLimit.Set(3)
+
+	for ind := 1; ind <= 5; ind++ {
+		run.Result = RESULT_OK
+		run.Index = Index(ind)
+		run.Target = filepath.Join(run.Entry.Output, fmt.Sprintf(`inp_%06d.txt`, ind))
+		run.Stats = CopyStats{Files: 1, Bytes: uint64(ind)}
+
+		var err error
+		if ind == 5 {
+			run.Result = RESULT_ERROR
+			err = gg.Errf(`disk full`)
+		}
+		appendHistory(&run, err)
+		clock.Advance(time.Minute)
+	}
+
+	path := historyPath(&run)
+	gtest.Eq(len(readHistoryLines(path)), 3)
+
+	recs := readHistory(path)
+	gtest.Equal(gg.Map(recs, func(val HistoryRecord) Index { return val.Index }), []Index{3, 4, 5})
+
+	gtest.True(recs[0].Time.Equal(start.Add(time.Minute * 2)))
+	gtest.Eq(recs[0].Result, RESULT_OK)
+	gtest.Eq(recs[0].Path, filepath.Join(run.Entry.Output, `inp_000003.txt`))
+	gtest.Eq(recs[0].Files, 1)
+	gtest.Eq(recs[0].Bytes, 3)
+	gtest.Zero(recs[0].Error)
+
+	gtest.True(recs[2].Time.Equal(start.Add(time.Minute * 4)))
+	gtest.Eq(recs[2].Result, RESULT_ERROR)
+	gtest.Eq(recs[2].Error, `disk full`)
+
+	// Lowering the limit trims the file on the next record.
+	run.Entry.HistoryLimit.Set(1)
+	run.Result = RESULT_UP_TO_DATE
+	appendHistory(&run, nil)
+	recs = readHistory(path)
+	gtest.Eq(len(recs), 1)
+	gtest.Eq(recs[0].Result, RESULT_UP_TO_DATE)
+}
+
+func TestDiffFiles(t *testing.T) {
+	defer gtest.Catch(t)
+
+	type Case struct {
+		Name    string
+		Prev    map[string]string // Nil means no previous backup.
+		Inp     map[string]string
+		Newer   []string // Input files modified after the previous backup.
+		Exclude []string
+		Exp     FileDiff
+	}
+
+	mtime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	write := func(root string, files map[string]string, newer []string) {
+		gg.MkdirAll(root)
+		for key, val := range files {
+			path := filepath.Join(root, filepath.FromSlash(key))
+			gg.MkdirAll(filepath.Dir(path))
+			gg.WriteFile(path, val)
+
+			inst := mtime
+			if gg.Has(newer, key) {
+				inst = inst.Add(time.Hour)
+			}
+			gg.Try(os.Chtimes(path, inst, inst))
+		}
+	}
+
+	for _, val := range []Case{
+		{
+			Name: `no previous backup`,
+			Inp:  map[string]string{`one.txt`: `one`, `sub/two.txt`: `two`},
+			Exp:  FileDiff{Added: []string{`one.txt`, `sub/two.txt`}},
+		},
+		{
+			Name: `unchanged`,
+			Prev: map[string]string{`one.txt`: `one`},
+			Inp:  map[string]string{`one.txt`: `one`},
+		},
+		{
+			Name: `added`,
+			Prev: map[string]string{`one.txt`: `one`},
+			Inp:  map[string]string{`one.txt`: `one`, `sub/two.txt`: `two`},
+			Exp:  FileDiff{Added: []string{`sub/two.txt`}},
+		},
+		{
+			Name: `removed`,
+			Prev: map[string]string{`one.txt`: `one`, `sub/two.txt`: `two`},
+			Inp:  map[string]string{`one.txt`: `one`},
+			Exp:  FileDiff{Removed: []string{`sub/two.txt`}},
+		},
+		{
+			Name: `changed size`,
+			Prev: map[string]string{`one.txt`: `one`},
+			Inp:  map[string]string{`one.txt`: `three`},
+			Exp:  FileDiff{Modified: []string{`one.txt`}},
+		},
+		{
+			Name:  `changed time`,
+			Prev:  map[string]string{`one.txt`: `one`},
+			Inp:   map[string]string{`one.txt`: `uno`},
+			Newer: []string{`one.txt`},
+			Exp:   FileDiff{Modified: []string{`one.txt`}},
+		},
+		{
+			Name:  `all kinds`,
+			Prev:  map[string]string{`one.txt`: `one`, `two.txt`: `two`, `three.txt`: `three`},
+			Inp:   map[string]string{`one.txt`: `one`, `two.txt`: `dos`, `four.txt`: `four`},
+			Newer: []string{`two.txt`},
+			Exp: FileDiff{
+				Added:    []string{`four.txt`},
+				Modified: []string{`two.txt`},
+				Removed:  []string{`three.txt`},
+			},
+		},
+		{
+			Name:    `excluded`,
+			Prev:    map[string]string{`one.txt`: `one`},
+			Inp:     map[string]string{`one.txt`: `one`, `two.log`: `two`},
+			Exclude: []string{`*.log`},
+		},
+	} {
+		dir := t.TempDir()
+		inp := filepath.Join(dir, `inp`)
+		write(inp, val.Inp, val.Newer)
+
+		var prev string
+		if val.Prev != nil {
+			prev = filepath.Join(dir, `inp_000001`)
+			write(prev, val.Prev, nil)
+		}
+
+		run := &RunState{}
+		run.Entry.Input = inp
+		run.Entry.Exclude = val.Exclude
+
+		diff := diffFiles(inp, prev, run.Includes)
+		gtest.Equal(diff, val.Exp, val.Name)
+
+		var buf bytes.Buffer
+		func() {
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(&buf)
+			logDiff(run, prev, filepath.Join(dir, `inp_000002`))
+		}()
+
+		text := buf.String()
+		gtest.Eq(strings.Contains(text, `no previous backup`), prev == ``, val.Name)
+		gtest.Eq(strings.Contains(text, `no changes`), diff.IsEmpty(), val.Name)
+		for _, path := range val.Exp.Added {
+			gtest.True(strings.Contains(text, `added    `+fmtPath(path)), val.Name)
+		}
+		for _, path := range val.Exp.Modified {
+			gtest.True(strings.Contains(text, `modified `+fmtPath(path)), val.Name)
+		}
+		for _, path := range val.Exp.Removed {
+			gtest.True(strings.Contains(text, `removed  `+fmtPath(path)), val.Name)
+		}
+	}
+}
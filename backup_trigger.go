@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Trigger channels of the running entries, for backing up every entry at once
+on `SIGHUP`. See `watchTrigger`.
+*/
+var TRIGGERS Triggers
+
+/*
+Set of trigger channels, one per running entry, each selected in the event loop
+of its entry. See `runEvents`. Each channel has a buffer of one, and triggers
+fired while the previous one is pending are coalesced.
+*/
+type Triggers struct {
+	sync.Mutex
+	Chans []chan struct{}
+}
+
+// Registers and returns a new channel, which must be removed via `.Remove`.
+func (self *Triggers) Add() chan struct{} {
+	self.Lock()
+	defer self.Unlock()
+
+	out := make(chan struct{}, 1)
+	self.Chans = append(self.Chans, out)
+	return out
+}
+
+func (self *Triggers) Remove(val chan struct{}) {
+	self.Lock()
+	defer self.Unlock()
+	self.Chans = gg.Reject(self.Chans, func(elem chan struct{}) bool { return elem == val })
+}
+
+// Signals every registered channel without blocking.
+func (self *Triggers) Fire() {
+	self.Lock()
+	defer self.Unlock()
+
+	if FLAGS.Verbose {
+		log.Printf(`triggering backups of %v entries`, len(self.Chans))
+	}
+
+	for _, val := range self.Chans {
+		select {
+		case val <- struct{}{}:
+		default:
+		}
+	}
+}
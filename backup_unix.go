@@ -2,6 +2,78 @@
 
 package main
 
-import "strconv"
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
 
 func fmtPath(src string) string { return strconv.Quote(src) }
+
+/*
+Flushes the entries of the directory to storage, which makes the creation and
+renaming of files in it durable. See `CommonConfig.Fsync`.
+*/
+func syncDir(path string) error { return syncFile(path) }
+
+// True if both paths are on the same filesystem. See `reflinkFile`.
+func sameDevice(one, two string) bool {
+	oneInfo, err := os.Stat(one)
+	if err != nil {
+		return false
+	}
+	twoInfo, err := os.Stat(two)
+	if err != nil {
+		return false
+	}
+
+	oneStat, ok := oneInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	twoStat, ok := twoInfo.Sys().(*syscall.Stat_t)
+	return ok && oneStat.Dev == twoStat.Dev
+}
+
+// Pauses backups on `SIGUSR1` and resumes them on `SIGUSR2`. See `PAUSED`.
+func watchPause() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range signals {
+			setPaused(sig == syscall.SIGUSR1)
+		}
+	}()
+}
+
+// Backs up every running entry immediately on `SIGHUP`. See `TRIGGERS`.
+func watchTrigger() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			TRIGGERS.Fire()
+		}
+	}()
+}
+
+// Returns the bytes available to unprivileged users on the volume of the path.
+func diskFree(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+func platformFormats() []Format {
+	return []Format{
+		{`signal`, `SIGUSR1, SIGUSR2`, `pause and resume backups`},
+		{`signal`, `SIGHUP`, `back up all entries immediately`},
+		{`link`, `symlink`, `staging mode, see "staging"`},
+	}
+}
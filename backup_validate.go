@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Checks the config for mistakes which would otherwise surface only when backing
+up, or silently misbehave. Returns one error per problem, each naming the entry
+and the field, joined via `errors.Join`, or nil. Only the entries which would
+run are checked: disabled entries and entries not matching `-entry` may be
+incomplete.
+
+Values which fail to decode, such as the duration "10sec", are reported by
+`readConfig` instead.
+*/
+func validateConfig(conf Config) error {
+	var errs []error
+	errs = append(errs, validateCommon(`config`, conf.CommonConfig)...)
+	if conf.ConfigDebounce.Val < 0 {
+		errs = append(errs, gg.Errf(`config: field "configDebounce": negative duration %v`, conf.ConfigDebounce.Val))
+	}
+
+	for _, entry := range conf.Entries {
+		if entry.Disabled || !entry.Match(FLAGS.Entries) {
+			continue
+		}
+		errs = append(errs, validateEntry(RunState{Config: conf, Entry: entry})...)
+	}
+	return errors.Join(errs...)
+}
+
+func validateEntry(run RunState) (out []error) {
+	entry := run.Entry
+	where := `entry ` + fmtPath(entry.GetName())
+
+	fail := func(field, pat string, arg ...any) {
+		out = append(out, gg.Errf(`%v: field %q: `+pat, append([]any{where, field}, arg...)...))
+	}
+
+	out = append(out, validateCommon(where, entry.CommonConfig)...)
+
+	// Missing inputs are allowed: the entry waits for them to appear. See
+	// `runEvents`.
+	if _, err := gg.Catch01(run.MultiInput); err != nil {
+		fail(`inputs`, `%v`, err)
+	} else if len(entry.Inputs) > 0 {
+		for _, path := range entry.Inputs {
+			if _, err := os.Stat(path); err != nil && !isErrFileNotFound(err) {
+				fail(`inputs`, `%v`, err)
+			}
+		}
+	} else if entry.Input == `` {
+		fail(`input`, `missing input path`)
+	} else if _, err := os.Stat(entry.Input); err != nil && !isErrFileNotFound(err) {
+		fail(`input`, `%v`, err)
+	}
+
+	if len(entry.GetOutputs()) <= 0 {
+		fail(`output`, `missing output path`)
+	}
+	if gg.Some(entry.Outputs, func(val Output) bool { return val.Path == `` }) {
+		fail(`outputs`, `missing output path`)
+	}
+	for _, path := range entry.GetOutputs() {
+		if _, ok := parseRemote(path); ok {
+			continue
+		}
+		err := validateOutputDir(path)
+		if err == nil {
+			continue
+		}
+		if path == entry.Output {
+			fail(`output`, `%v`, err)
+		} else {
+			fail(`outputs`, `%v`, err)
+		}
+	}
+
+	if err := gg.Catch10(validateSymlinks, run.GetSymlinks()); err != nil {
+		fail(`symlinks`, `%v`, err)
+	}
+
+	if err := gg.Catch10(validateReflink, run.GetReflink()); err != nil {
+		fail(`reflink`, `%v`, err)
+	}
+
+	if _, err := gg.Catch01(run.Archived); err != nil {
+		fail(`archive`, `%v`, err)
+	}
+
+	if run.GetCompress() == COMPRESS_GZIP || run.GetArchive() == ARCHIVE_TAR_GZ {
+		if _, err := gg.Catch01(run.GzipLevel); err != nil {
+			fail(`compressLevel`, `%v`, err)
+		}
+	}
+
+	// Outputs with their own format. See `Output`.
+	for _, tar := range gg.Ptr(run).Targets() {
+		if tar.Route != nil || !entry.OutputOf(tar.Entry.Output).HasFormat() {
+			continue
+		}
+		where := fmtPath(tar.Entry.Output)
+		if _, err := gg.Catch01(tar.Archived); err != nil {
+			fail(`outputs`, `%v: %v`, where, err)
+		} else if _, err := gg.Catch01(tar.CompressExt); err != nil {
+			fail(`outputs`, `%v: %v`, where, err)
+		} else if _, err := gg.Catch01(tar.GzipLevel); err != nil && (tar.GetCompress() == COMPRESS_GZIP || tar.GetArchive() == ARCHIVE_TAR_GZ) {
+			fail(`outputs`, `%v: %v`, where, err)
+		}
+	}
+
+	if _, err := gg.Catch01(run.Hardlinked); err != nil {
+		fail(`hardlink`, `%v`, err)
+	}
+
+	if _, err := gg.Catch01(run.EncryptExt); err != nil {
+		fail(`encrypt`, `%v`, err)
+	} else if _, err := gg.Catch01(run.GetEncrypt().Cipher); err != nil {
+		fail(`encrypt`, `%v`, err)
+	}
+
+	if max := run.GetMaxSize(); max > 0 && run.GetMinSize() > max {
+		fail(`minSize`, `%v is larger than "maxSize" %v`, run.GetMinSize(), max)
+	}
+
+	if size := uint64(run.GetCopyBufferSize()); size > COPY_BUFFER_MAX {
+		fail(`copyBufferSize`, `%v is too large, the maximum is %v`, size, uint64(COPY_BUFFER_MAX))
+	} else if max := run.Config.MaxCopyMemory; max > 0 && size > max {
+		fail(`copyBufferSize`, `%v is larger than "maxCopyMemory" %v`, size, max)
+	}
+
+	if run.GetLimit() > math.MaxInt {
+		fail(`limit`, `%v is too large, the maximum is %v`, run.GetLimit(), math.MaxInt)
+	}
+	return
+}
+
+/*
+Reports negative durations, which are accepted by the decoder, but make no
+sense as delays or ages. Fields are named by their JSON keys.
+*/
+func validateCommon(where string, conf CommonConfig) (out []error) {
+	val := reflect.ValueOf(conf)
+	typ := val.Type()
+
+	for ind := 0; ind < typ.NumField(); ind++ {
+		var dur Duration
+		switch field := val.Field(ind).Interface().(type) {
+		case Duration:
+			dur = field
+		case gg.Opt[Duration]:
+			dur = field.Val
+		default:
+			continue
+		}
+
+		if dur < 0 {
+			name, _, _ := strings.Cut(typ.Field(ind).Tag.Get(`json`), `,`)
+			out = append(out, gg.Errf(`%v: field %q: negative duration %v`, where, name, dur))
+		}
+	}
+	return
+}
+
+/*
+The output directory is created on the first backup, so it doesn't have to
+exist yet, but its nearest existing ancestor must be a writable directory.
+Writability is checked by creating and removing a temporary file, except in
+dry runs, which must not write.
+*/
+func validateOutputDir(path string) error {
+	dir := filepath.Clean(path)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return gg.Errf(`%v is not a directory`, fmtPath(dir))
+			}
+			break
+		}
+		// ENOTDIR means that an ancestor is a file, reported above.
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+
+	if FLAGS.DryRun {
+		return nil
+	}
+
+	file, err := os.CreateTemp(dir, `.backup-check-*`)
+	if err != nil {
+		return gg.Wrapf(err, `%v is not writable`, fmtPath(dir))
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
+
+/*
+Reads the config and fails if it's invalid. Used when the config is about to
+run, whereas commands such as `backup restore` use `readConfig` directly, since
+they must work when, for example, the input is missing.
+*/
+func readValidConfig() Config {
+	conf := readConfig()
+	err := validateConfig(conf)
+	if err != nil {
+		panic(gg.Wrapf(err, `invalid config file %v`, fmtPath(FLAGS.Config)))
+	}
+	return conf
+}
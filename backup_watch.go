@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitranim/gg"
+	"github.com/rjeczalik/notify"
+)
+
+/*
+Names of watch backends, chosen via `-watch-backend`. The default backend uses
+`rjeczalik/notify`, which watches directory trees natively where the platform
+supports it. The alternative uses `fsnotify/fsnotify`, which watches trees by
+adding every directory, including new ones as they appear. Single files are
+watched via their directories with either backend (see `watchConfig`).
+*/
+const (
+	WATCH_BACKEND_NOTIFY   = `notify`
+	WATCH_BACKEND_FSNOTIFY = `fsnotify`
+)
+
+/*
+Watches paths, sending FS events and errors to the channels given to
+`newWatcher`. Several watchers may share the channels. Closing stops watching,
+but doesn't close the channels, which allows to replace a watcher without
+affecting its consumers. The error channel reports failures after watching has
+started, without blocking, and may be nil. The "notify" backend doesn't report
+errors.
+*/
+type Watcher interface {
+	Add(path string, recursive bool, mask notify.Event) error
+	Events() <-chan notify.EventInfo
+	Errors() <-chan error
+	Close() error
+}
+
+func newWatcher(events chan notify.EventInfo, errs chan error) Watcher {
+	switch FLAGS.WatchBackend {
+	case ``, WATCH_BACKEND_NOTIFY:
+		return NotifyWatcher{events, errs}
+	case WATCH_BACKEND_FSNOTIFY:
+		return newFsnotifyWatcher(events, errs)
+	default:
+		panic(gg.Errf(
+			`unrecognized watch backend %q, expected %q or %q`,
+			FLAGS.WatchBackend, WATCH_BACKEND_NOTIFY, WATCH_BACKEND_FSNOTIFY,
+		))
+	}
+}
+
+type NotifyWatcher struct {
+	Chan chan notify.EventInfo
+	Errs chan error
+}
+
+func (self NotifyWatcher) Add(path string, recursive bool, mask notify.Event) error {
+	if recursive {
+		path = filepath.Join(path, `...`)
+	}
+	return notify.Watch(path, self.Chan, mask)
+}
+
+func (self NotifyWatcher) Events() <-chan notify.EventInfo { return self.Chan }
+
+func (self NotifyWatcher) Errors() <-chan error { return self.Errs }
+
+// Stops all watches of the channel, including those of other watchers.
+func (self NotifyWatcher) Close() error {
+	notify.Stop(self.Chan)
+	return nil
+}
+
+type FsnotifyWatcher struct {
+	sync.Mutex
+	Watcher *fsnotify.Watcher
+	Chan    chan notify.EventInfo
+	Errs    chan error
+	Done    chan struct{}
+	Once    sync.Once
+	Masks   map[string]notify.Event // By absolute path.
+	Trees   []string                // Absolute paths of recursive watches.
+}
+
+func newFsnotifyWatcher(events chan notify.EventInfo, errs chan error) *FsnotifyWatcher {
+	out := &FsnotifyWatcher{
+		Watcher: gg.Try1(fsnotify.NewWatcher()),
+		Chan:    events,
+		Errs:    errs,
+		Done:    make(chan struct{}),
+		Masks:   map[string]notify.Event{},
+	}
+	go out.run()
+	return out
+}
+
+func (self *FsnotifyWatcher) Add(path string, recursive bool, mask notify.Event) (err error) {
+	defer gg.Rec(&err)
+	path = gg.Try1(filepath.Abs(path))
+
+	self.Lock()
+	defer self.Unlock()
+
+	if recursive {
+		self.Trees = append(self.Trees, path)
+		self.addTree(path, mask)
+	} else {
+		gg.Try(self.Watcher.Add(path))
+		self.Masks[path] = mask
+	}
+	return
+}
+
+func (self *FsnotifyWatcher) addTree(root string, mask notify.Event) {
+	gg.Try(filepath.WalkDir(root, func(path string, src fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if src.IsDir() {
+			gg.Try(self.Watcher.Add(path))
+			self.Masks[path] = mask
+		}
+		return nil
+	}))
+}
+
+func (self *FsnotifyWatcher) Events() <-chan notify.EventInfo { return self.Chan }
+
+func (self *FsnotifyWatcher) Errors() <-chan error { return self.Errs }
+
+func (self *FsnotifyWatcher) Close() error {
+	self.Once.Do(func() { close(self.Done) })
+	return self.Watcher.Close()
+}
+
+func (self *FsnotifyWatcher) run() {
+	for {
+		select {
+		case <-self.Done:
+			return
+
+		case eve, ok := <-self.Watcher.Events:
+			if !ok {
+				return
+			}
+			val, ok := self.event(eve)
+			if !ok {
+				continue
+			}
+			select {
+			case self.Chan <- val:
+			case <-self.Done:
+				return
+			}
+
+		case err, ok := <-self.Watcher.Errors:
+			if !ok {
+				return
+			}
+			self.fail(err)
+		}
+	}
+}
+
+func (self *FsnotifyWatcher) fail(err error) {
+	select {
+	case self.Errs <- err:
+	default:
+	}
+}
+
+/*
+Converts the event, returning false when it doesn't match the mask of the watch.
+New directories in watched trees are watched too. Their contents created before
+the watch are not reported.
+*/
+func (self *FsnotifyWatcher) event(src fsnotify.Event) (FsEvent, bool) {
+	self.Lock()
+	defer self.Unlock()
+
+	parent := filepath.Dir(src.Name)
+	mask, ok := self.Masks[src.Name]
+	if !ok {
+		mask, ok = self.Masks[parent]
+	}
+	if !ok {
+		return FsEvent{}, false
+	}
+
+	if src.Has(fsnotify.Create) && gg.DirExists(src.Name) && self.inTree(parent) {
+		err := gg.Catch(func() { self.addTree(src.Name, mask) })
+		if err != nil {
+			self.fail(err)
+		}
+	}
+
+	out := FsEvent{Name: src.Name, Op: fsnotifyOpEvent(src.Op)}
+	return out, out.Op&mask != 0
+}
+
+func (self *FsnotifyWatcher) inTree(path string) bool {
+	return gg.Some(self.Trees, func(root string) bool { return inputRel(root, path) != `` })
+}
+
+// Attribute changes are not reported, like with `notify.All`.
+func fsnotifyOpEvent(src fsnotify.Op) (out notify.Event) {
+	if src.Has(fsnotify.Create) {
+		out |= notify.Create
+	}
+	if src.Has(fsnotify.Write) {
+		out |= notify.Write
+	}
+	if src.Has(fsnotify.Remove) {
+		out |= notify.Remove
+	}
+	if src.Has(fsnotify.Rename) {
+		out |= notify.Rename
+	}
+	return
+}
+
+// Implements `notify.EventInfo` for events of `FsnotifyWatcher`.
+type FsEvent struct {
+	Name string
+	Op   notify.Event
+}
+
+func (self FsEvent) Event() notify.Event { return self.Op }
+func (self FsEvent) Path() string        { return self.Name }
+func (self FsEvent) Sys() any            { return nil }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Schedule restricting when an entry may make backups, such as off-peak hours in
+bandwidth-metered environments. Outside of the window, FS events are still
+noted, but backups are deferred until the window opens, at which point a single
+backup runs for all the changes made in the meantime. Empty `Days` or `Hours`
+allow any day or any time. Example:
+
+	{"days": ["sat", "sun"], "hours": ["22:00-06:00"]}
+
+Time ranges may wrap around midnight. Days are checked for the current local
+time, so the range above permits Sunday from 22:00 until midnight, but Monday
+from midnight until 06:00 only if Monday is also listed.
+*/
+type Window struct {
+	Days  []Weekday   `json:"days"`
+	Hours []TimeRange `json:"hours"`
+}
+
+func (self Window) IsZero() bool { return len(self.Days) <= 0 && len(self.Hours) <= 0 }
+
+func (self Window) Allows(val time.Time) bool {
+	return (len(self.Days) <= 0 || gg.Has(self.Days, Weekday(val.Weekday()))) &&
+		(len(self.Hours) <= 0 || gg.Some(self.Hours, func(src TimeRange) bool { return src.Has(val) }))
+}
+
+// Maximum distance into the future searched by `Window.Next`.
+const WINDOW_SEARCH = time.Hour * 24 * 8
+
+/*
+Returns the earliest time, starting with the given one, when the window allows
+backups, with minute precision. Returns false if the window never opens.
+*/
+func (self Window) Next(val time.Time) (time.Time, bool) {
+	if self.Allows(val) {
+		return val, true
+	}
+
+	next := val.Truncate(time.Minute)
+	for end := val.Add(WINDOW_SEARCH); next.Before(end); {
+		next = next.Add(time.Minute)
+		if self.Allows(next) {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+type Weekday time.Weekday
+
+func (self *Weekday) UnmarshalText(src []byte) error {
+	str := strings.ToLower(gg.ToString(src))
+
+	for ind := time.Sunday; ind <= time.Saturday; ind++ {
+		name := strings.ToLower(ind.String())
+		if str == name || str == name[:3] {
+			*self = Weekday(ind)
+			return nil
+		}
+	}
+	return gg.Errf(`unrecognized day of week %q`, src)
+}
+
+// Time of day range such as "22:00-06:00". The end is exclusive.
+type TimeRange struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func (self *TimeRange) UnmarshalText(src []byte) error {
+	str := gg.ToString(src)
+	start, end, ok := strings.Cut(str, `-`)
+	if !ok {
+		return gg.Errf(`invalid time range %q: expected format "HH:MM-HH:MM"`, str)
+	}
+
+	startVal, err := parseTimeOfDay(start)
+	if err != nil {
+		return gg.Wrapf(err, `invalid time range %q`, str)
+	}
+
+	endVal, err := parseTimeOfDay(end)
+	if err != nil {
+		return gg.Wrapf(err, `invalid time range %q`, str)
+	}
+
+	self.Start = startVal
+	self.End = endVal
+	return nil
+}
+
+func (self TimeRange) Has(val time.Time) bool {
+	hour, min, sec := val.Clock()
+	day := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+
+	if self.Start <= self.End {
+		return day >= self.Start && day < self.End
+	}
+	return day >= self.Start || day < self.End
+}
+
+func parseTimeOfDay(src string) (time.Duration, error) {
+	val, err := time.Parse(`15:04`, strings.TrimSpace(src))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(val.Hour())*time.Hour + time.Duration(val.Minute())*time.Minute, nil
+}
+
+/*
+Gates the backups of an entry by its window (see `Window`). Backups requested
+outside of the window are deferred, and run together when it opens. Backups
+requested while the input is missing are deferred until `runEvents` notices it
+reappearing.
+*/
+type Schedule struct {
+	Run      *RunState
+	Deferred []*RunState
+	Wake     <-chan time.Time
+	Missing  bool
+}
+
+func (self *Schedule) Backup(targets []*RunState, pat string, args ...any) {
+	window := self.Run.Entry.Window
+	clock := self.Run.GetClock()
+	now := clock.Now()
+
+	self.Defer(targets)
+
+	if window.IsZero() || window.Allows(now) {
+		self.Flush(pat, args...)
+		return
+	}
+
+	next, ok := window.Next(now)
+	for _, tar := range targets {
+		if ok {
+			logDecision(tar, `deferring backup until %v: outside of the backup window`, next.Format(time.RFC3339))
+		} else {
+			logDecision(tar, `deferring backup: the backup window never opens`)
+		}
+	}
+
+	if ok {
+		self.Wake = clock.After(next.Sub(now))
+	} else {
+		self.Wake = nil
+	}
+}
+
+/*
+Backs up the given targets immediately, along with any deferred ones, ignoring
+the backup window. Used for backups triggered by `SIGHUP`.
+*/
+func (self *Schedule) Force(targets []*RunState, pat string, args ...any) {
+	self.Defer(targets)
+	self.Flush(pat, args...)
+}
+
+func (self *Schedule) Defer(targets []*RunState) {
+	for _, tar := range targets {
+		if !gg.Has(self.Deferred, tar) {
+			self.Deferred = append(self.Deferred, tar)
+		}
+	}
+}
+
+func (self *Schedule) Flush(pat string, args ...any) {
+	if self.Missing {
+		for _, tar := range self.Deferred {
+			logDecision(tar, `deferring backup: the input is missing`)
+		}
+		return
+	}
+
+	targets := self.Deferred
+	self.Deferred = nil
+	self.Wake = nil
+	backupTargets(targets, pat, args...)
+}
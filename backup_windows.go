@@ -2,4 +2,46 @@
 
 package main
 
+import (
+	"syscall"
+	"unsafe"
+)
+
+var PROC_GET_DISK_FREE_SPACE = syscall.NewLazyDLL(`kernel32.dll`).NewProc(`GetDiskFreeSpaceExW`)
+
 func fmtPath(src string) string { return `"` + src + `"` }
+
+/*
+Windows doesn't support syncing directories, and NTFS journals renames.
+See `CommonConfig.Fsync`.
+*/
+func syncDir(string) error { return nil }
+
+// Reflinks are unsupported on Windows. See `reflinkFile`.
+func sameDevice(string, string) bool { return false }
+
+// Windows doesn't have `SIGUSR1` and `SIGUSR2`, so pausing is unsupported.
+func watchPause() {}
+
+// Windows doesn't deliver `SIGHUP`, so triggering backups is unsupported.
+func watchTrigger() {}
+
+// Returns the bytes available to the current user on the volume of the path.
+func diskFree(path string) (uint64, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var out uint64
+	ret, _, err := PROC_GET_DISK_FREE_SPACE.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&out)), 0, 0)
+	if ret == 0 {
+		return 0, err
+	}
+	return out, nil
+}
+
+// Symlinks are supported, but require special privileges.
+func platformFormats() []Format {
+	return []Format{{`link`, `symlink`, `staging mode, see "staging"; requires privileges`}}
+}
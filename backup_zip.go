@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitranim/gg"
+)
+
+/*
+Versioned zip mode, enabled by the config option `zip`. Instead of separate
+indexed backups, each entry has one zip file in its output directory, named
+like the input plus this suffix. Each backup is added as a new top-level folder
+named after its index, and retention removes the oldest folders. This keeps
+all versions in one file that's easy to hand off.
+
+Zip files can't be safely modified in place, so each backup rewrites the
+archive into a temporary file, copying retained folders without recompression,
+and renames it over the old one. A crash at any point leaves either the old
+archive or the new one, never a partial one.
+*/
+const ZIP_EXT = `.zip`
+
+func (self RunState) ZipPath() string {
+	return filepath.Join(self.Entry.Output, filepath.Base(self.Entry.Input)+ZIP_EXT)
+}
+
+func zipBackup(run *RunState) {
+	if len(run.GetCopyCommand()) > 0 || run.GetStore() {
+		panic(gg.Errf(`"zip" can't be used with "copyCommand" or "store"`))
+	}
+
+	format := run.GetIndexFormat()
+	path := run.ZipPath()
+	prev := zipIndices(path, format)
+
+	if run.CheckUpToDate() && len(prev) > 0 {
+		nextTime := maxModTime(run.Entry.Input, run.Includes)
+		prevTime := maxModTime(path, nil)
+		if prevTime.After(nextTime) {
+			logDecision(run, `skipping backup: %v is already up to date`, fmtPath(path))
+			run.Result = RESULT_UP_TO_DATE
+			run.Counters.UpToDate++
+			finalizeZip(run)
+			return
+		}
+	}
+
+	next := run.NextIndex(gg.Last(prev))
+	kept := prev
+	if limit := gg.NumConv[int](run.GetLimit()); limit > 0 {
+		kept = gg.Drop(prev, len(prev)+1-limit)
+	}
+	name := format.EncodeIndex(next)
+
+	if FLAGS.DryRun {
+		log.Printf(`%v would back up %v to %v in %v`, DRY_RUN_PREFIX, fmtPath(run.Entry.Input), name, fmtPath(path))
+		for _, ind := range gg.Take(prev, len(prev)-len(kept)) {
+			log.Printf(`%v would delete %v from %v`, DRY_RUN_PREFIX, format.EncodeIndex(ind), fmtPath(path))
+		}
+		run.Result = RESULT_DRY_RUN
+		finalizeZip(run)
+		return
+	}
+
+	run.Span.Set(`backup.output`, path)
+	run.Span.Set(`backup.index`, uint64(next))
+	run.Target = path
+	run.Index = next
+
+	writeZip(run, path, format, kept, name)
+	finalizeZip(run)
+
+	if FLAGS.Verbose || FLAGS.Decisions {
+		logRecord(LogRecord{
+			Msg:   fmt.Sprintf(`backed up %v to %v in %v`, fmtPath(run.Entry.Input), name, fmtPath(path)),
+			Entry: run.Entry.GetName(),
+			Path:  path,
+		})
+	}
+}
+
+func finalizeZip(run *RunState) {
+	run.Latest = run.GetClock().Now()
+	touchHealthFile(run)
+	runPostHook(run)
+}
+
+// Returns the sorted indices of the top-level folders of the archive.
+func zipIndices(path string, format IndexFormat) (out []Index) {
+	if !gg.FileExists(path) {
+		return nil
+	}
+
+	defer gg.Detailf(`unable to read %v`, fmtPath(path))
+	file := gg.Try1(zip.OpenReader(path))
+	defer file.Close()
+
+	set := gg.Set[Index]{}
+	for _, val := range file.File {
+		ind, ok := zipIndex(val.Name, format)
+		if ok {
+			set.Add(ind)
+		}
+	}
+	return gg.SortedPrim(gg.MapKeys(set))
+}
+
+func zipIndex(name string, format IndexFormat) (Index, bool) {
+	head, _, _ := strings.Cut(name, `/`)
+	return format.DecodeIndex(head)
+}
+
+/*
+Writes a new version of the archive with the kept folders of the old one, plus
+a new folder with the current input.
+*/
+func writeZip(run *RunState, path string, format IndexFormat, kept []Index, name string) {
+	defer gg.Detailf(`unable to write %v`, fmtPath(path))
+
+	run.MkdirAll(run.Entry.Output)
+
+	tmp := gg.Try1(os.CreateTemp(run.Entry.Output, filepath.Base(path)+`.tmp-*`))
+	defer os.Remove(tmp.Name()) // Nop after the rename.
+	defer tmp.Close()           // Nop after the explicit close.
+
+	out := zip.NewWriter(tmp)
+
+	if gg.FileExists(path) {
+		src := gg.Try1(zip.OpenReader(path))
+		defer src.Close()
+
+		for _, file := range src.File {
+			ind, ok := zipIndex(file.Name, format)
+			if ok && gg.Has(kept, ind) {
+				gg.Try(out.Copy(file))
+			}
+		}
+	}
+
+	zipInput(run, out, name)
+
+	gg.Try(out.Close())
+	gg.Try(tmp.Sync())
+	gg.Try(tmp.Close())
+	gg.Try(os.Rename(tmp.Name(), path))
+}
+
+/*
+Adds the input to the archive under the given folder. A single-file input is
+stored in the folder under its own name.
+*/
+func zipInput(run *RunState, out *zip.Writer, dir string) {
+	root := run.Entry.Input
+	base := filepath.Dir(root)
+	if gg.DirExists(root) {
+		base = root
+	}
+
+	gg.Try(filepath.WalkDir(root, func(path string, src fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !run.Includes(path, src) {
+			return skipEntry(src)
+		}
+
+		name := dir
+		if rel := filepath.ToSlash(gg.Try1(filepath.Rel(base, path))); rel != `.` {
+			name += `/` + rel
+		}
+
+		head := gg.Try1(zip.FileInfoHeader(gg.Try1(src.Info())))
+
+		if src.IsDir() {
+			head.Name = name + `/`
+			gg.Try1(out.CreateHeader(head))
+			return nil
+		}
+
+		head.Name = name
+		head.Method = zip.Deflate
+		tar := gg.Try1(out.CreateHeader(head))
+		file := gg.Try1(os.Open(path))
+		defer file.Close()
+
+		size := gg.Try1(copyBudgeted(run.Ctx, tar, run.RateReader(file), run.GetCopyBufferSize(), DEFLATE_MEMORY))
+		run.Stats.Files++
+		run.Stats.Bytes += uint64(size)
+		return nil
+	}))
+}
@@ -3,8 +3,12 @@ module github.com/mitranim/backup
 go 1.20
 
 require (
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/mitranim/gg v0.1.23
+	github.com/pkg/sftp v1.13.6
 	github.com/rjeczalik/notify v0.9.3
+	golang.org/x/crypto v0.14.0
+	golang.org/x/sys v0.13.0
 )
 
-require golang.org/x/sys v0.0.0-20180926160741-c2ed4eda69e7 // indirect
+require github.com/kr/fs v0.1.0 // indirect